@@ -0,0 +1,210 @@
+package holydb
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/garder500/holydb/internal/server"
+	"github.com/garder500/holydb/pkg/storage"
+)
+
+// execAdmin dispatches the "admin" maintenance subcommands.
+func execAdmin(argv []string) error {
+	if len(argv) == 0 {
+		printAdminUsage()
+		return nil
+	}
+	switch argv[0] {
+	case "recount":
+		return execRecount(argv[1:])
+	case "user":
+		return execUser(argv[1:])
+	case "rotate-key":
+		return execRotateKey(argv[1:])
+	default:
+		return fmt.Errorf("unknown admin command: %s", argv[0])
+	}
+}
+
+// execRecount rebuilds the usage counters of the given buckets (all buckets
+// under --root when none are given).
+func execRecount(argv []string) error {
+	fs := flag.NewFlagSet("admin recount", flag.ExitOnError)
+	root := fs.String("root", ".", "storage root directory")
+	fs.Usage = func() { printRecountUsage(fs) }
+	if err := fs.Parse(argv); err != nil {
+		return err
+	}
+	ls := &storage.LocalStorage{Root: *root}
+	buckets := fs.Args()
+	if len(buckets) == 0 {
+		all, err := ls.ListBuckets(context.Background())
+		if err != nil {
+			return err
+		}
+		for _, b := range all {
+			buckets = append(buckets, b.Name)
+		}
+	}
+	for _, b := range buckets {
+		u, err := ls.Recount(context.Background(), b)
+		if err != nil {
+			return fmt.Errorf("recount %s: %w", b, err)
+		}
+		fmt.Printf("%s: objects=%d bytes=%d parts=%d version_bytes=%d multipart_bytes=%d\n",
+			b, u.Objects, u.Bytes, u.Parts, u.VersionBytes, u.MultipartBytes)
+	}
+	return nil
+}
+
+func printAdminUsage() {
+	exe := filepath.Base(os.Args[0])
+	fmt.Printf("Usage: %s admin <command> [flags]\n\n", exe)
+	fmt.Println("Commands:")
+	fmt.Println("  recount    Rebuild bucket usage counters from the data on disk")
+	fmt.Println("  user       Manage access keys (add, list, remove)")
+	fmt.Println("  rotate-key Rewrap the encryption keys of every object under the current master key")
+}
+
+func printRecountUsage(fs *flag.FlagSet) {
+	exe := filepath.Base(os.Args[0])
+	fmt.Printf("Usage: %s admin recount [flags] [bucket...]\n\n", exe)
+	fmt.Println("Rebuilds the usage counters (.bucket.usage) of the given buckets, or of")
+	fmt.Println("every bucket, e.g. after a crash. Stop the server first.")
+	fmt.Println("Flags:")
+	fs.PrintDefaults()
+}
+
+// execRotateKey rewraps every data key and sealed metadata file under --root
+// with the current master key, after adding a new one with --generate.
+func execRotateKey(argv []string) error {
+	fs := flag.NewFlagSet("admin rotate-key", flag.ExitOnError)
+	root := fs.String("root", ".", "storage root directory")
+	keyFile := fs.String("encryption-key-file", "", "file of master keys, the current one first (default: $HOLYDB_MASTER_KEY)")
+	generate := fs.Bool("generate", false, "add a new random master key at the top of --encryption-key-file first")
+	fs.Usage = func() { printRotateKeyUsage(fs) }
+	if err := fs.Parse(argv); err != nil {
+		return err
+	}
+	ls := &storage.LocalStorage{Root: *root}
+	// fail before adding a key a running server would not know about;
+	// RotateKeys takes the lock again for the rotation itself
+	unlock, err := ls.LockRoot()
+	if err != nil {
+		return err
+	}
+	unlock()
+	if *generate {
+		if *keyFile == "" {
+			return fmt.Errorf("--generate needs --encryption-key-file")
+		}
+		id, err := storage.GenerateMasterKey(*keyFile)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("added master key %s to %s\n", id, *keyFile)
+	}
+	keys, err := storage.LoadKeyring(*keyFile)
+	if err != nil {
+		return fmt.Errorf("encryption keys: %w", err)
+	}
+	if keys == nil {
+		return fmt.Errorf("no master key: give --encryption-key-file or set %s", storage.MasterKeyEnv)
+	}
+	ls.Keys = keys
+	report, err := ls.RotateKeys(context.Background())
+	fmt.Printf("current key %s: %d data keys rewrapped, %d metadata files resealed, %d objects with customer keys left as they are\n",
+		report.KeyID, report.Rewrapped, report.Resealed, report.CustomerKeys)
+	if err != nil {
+		return err
+	}
+	for _, id := range report.Retired {
+		fmt.Printf("key %s is no longer used and can be removed from the key file\n", id)
+	}
+	return nil
+}
+
+func printRotateKeyUsage(fs *flag.FlagSet) {
+	exe := filepath.Base(os.Args[0])
+	fmt.Printf("Usage: %s admin rotate-key [flags]\n\n", exe)
+	fmt.Println("Rewraps the data keys and reseals the metadata of every object, version and")
+	fmt.Println("upload with the first key of the key file; object data is not rewritten.")
+	fmt.Println("The keys reported as no longer used can then be removed. It refuses to")
+	fmt.Println("run while a server uses the root: stop the server first, and restart it")
+	fmt.Println("with the updated key file.")
+	fmt.Println("Flags:")
+	fs.PrintDefaults()
+	fmt.Println("")
+	fmt.Println("Examples:")
+	fmt.Printf("  %s admin rotate-key --root ./data --encryption-key-file ./holydb.keys --generate\n", exe)
+}
+
+// execUser manages the access keys of the credential store under --root.
+func execUser(argv []string) error {
+	if len(argv) == 0 {
+		printUserUsage(nil)
+		return nil
+	}
+	cmd := argv[0]
+	fs := flag.NewFlagSet("admin user "+cmd, flag.ExitOnError)
+	root := fs.String("root", ".", "storage root directory")
+	fs.Usage = func() { printUserUsage(fs) }
+	if err := fs.Parse(argv[1:]); err != nil {
+		return err
+	}
+	store, err := server.OpenCredentialStore(*root)
+	if err != nil {
+		return err
+	}
+	switch cmd {
+	case "add":
+		if fs.NArg() != 1 {
+			return fmt.Errorf("usage: admin user add [flags] <user>")
+		}
+		cred, err := store.Add(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("user:       %s\naccess key: %s\nsecret key: %s\n", cred.User, cred.AccessKey, cred.SecretKey)
+		fmt.Println("The secret key is stored under the storage root; keep this copy safe.")
+	case "list":
+		creds, err := store.List()
+		if err != nil {
+			return err
+		}
+		for _, c := range creds {
+			fmt.Printf("%s\t%s\t%s\n", c.AccessKey, c.User, c.Created.Format(time.RFC3339))
+		}
+	case "remove":
+		if fs.NArg() == 0 {
+			return fmt.Errorf("usage: admin user remove [flags] <access-key>...")
+		}
+		for _, ak := range fs.Args() {
+			if err := store.Remove(ak); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unknown admin user command: %s", cmd)
+	}
+	return nil
+}
+
+func printUserUsage(fs *flag.FlagSet) {
+	exe := filepath.Base(os.Args[0])
+	fmt.Printf("Usage: %s admin user <add|list|remove> [flags] [args]\n\n", exe)
+	fmt.Println("Manages the access keys used to sign requests (AWS Signature V4).")
+	fmt.Println("Changes apply to a running server without a restart.")
+	fmt.Println("Commands:")
+	fmt.Println("  add <user>             Create an access key pair for user")
+	fmt.Println("  list                   List access keys with their user")
+	fmt.Println("  remove <access-key>... Remove access keys")
+	if fs != nil {
+		fmt.Println("Flags:")
+		fs.PrintDefaults()
+	}
+}
@@ -0,0 +1,81 @@
+package holydb
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/garder500/holydb/pkg/storage"
+)
+
+// execFsck checks the objects under --root and exits with an error when
+// problems remain unrepaired.
+func execFsck(argv []string) error {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	root := fs.String("root", ".", "storage root directory")
+	keyFile := fs.String("encryption-key-file", "", "file of master keys (default: $HOLYDB_MASTER_KEY)")
+	checksums := fs.Bool("checksums", true, "read all data and verify it against the recorded checksums")
+	repair := fs.Bool("repair", false, "remove unreferenced parts and quarantine unreadable objects")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	fs.Usage = func() { printFsckUsage(fs) }
+	if err := fs.Parse(argv); err != nil {
+		return err
+	}
+	keys, err := storage.LoadKeyring(*keyFile)
+	if err != nil {
+		return fmt.Errorf("encryption keys: %w", err)
+	}
+	ls := &storage.LocalStorage{Root: *root, Keys: keys}
+	report, err := ls.Fsck(context.Background(), storage.FsckOptions{
+		Buckets:         fs.Args(),
+		VerifyChecksums: *checksums,
+		Repair:          *repair,
+	})
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		for _, is := range report.Issues {
+			fmt.Printf("%-18s %s", is.Kind, is.Path)
+			if is.VersionID != "" {
+				fmt.Printf(" (version %s)", is.VersionID)
+			}
+			if is.Detail != "" {
+				fmt.Printf(": %s", is.Detail)
+			}
+			if is.Repair != "" {
+				fmt.Printf(" [%s]", is.Repair)
+			}
+			fmt.Println()
+		}
+		fmt.Printf("%d buckets, %d objects checked, %d problems (%d unrepaired)\n",
+			report.Buckets, report.Objects, len(report.Issues), report.Unrepaired())
+	}
+	if err != nil {
+		return err
+	}
+	if n := report.Unrepaired(); n > 0 {
+		return fmt.Errorf("%d unrepaired problems", n)
+	}
+	return nil
+}
+
+func printFsckUsage(fs *flag.FlagSet) {
+	exe := filepath.Base(os.Args[0])
+	fmt.Printf("Usage: %s fsck [flags] [bucket...]\n\n", exe)
+	fmt.Println("Checks the manifests, parts, metadata and checksums of every object of the")
+	fmt.Println("given buckets, or of every bucket. With --repair, unreferenced parts are")
+	fmt.Println("removed and unreadable objects are moved to {bucket}/.quarantine.")
+	fmt.Println("The data of encrypted objects is only verified with their master key,")
+	fmt.Println("and never for objects encrypted with a customer-provided key.")
+	fmt.Println("Flags:")
+	fs.PrintDefaults()
+	fmt.Println("")
+	fmt.Println("Examples:")
+	fmt.Printf("  %s fsck --root ./data\n", exe)
+	fmt.Printf("  %s fsck --root ./data --repair --json photos\n", exe)
+}
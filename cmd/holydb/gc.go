@@ -0,0 +1,52 @@
+package holydb
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/garder500/holydb/pkg/storage"
+)
+
+// execGC runs one garbage collection pass over --root and prints what was
+// reclaimed.
+func execGC(argv []string) error {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	root := fs.String("root", ".", "storage root directory")
+	maxAge := fs.Duration("max-age", 24*time.Hour, "minimum age of the uploads and temporary files to remove")
+	dryRun := fs.Bool("dry-run", false, "only report what would be removed")
+	fs.Usage = func() { printGCUsage(fs) }
+	if err := fs.Parse(argv); err != nil {
+		return err
+	}
+	ls := &storage.LocalStorage{Root: *root}
+	report, err := ls.CollectGarbage(context.Background(), storage.GCOptions{MaxAge: *maxAge, DryRun: *dryRun})
+	verb := "removed"
+	if *dryRun {
+		verb = "would remove"
+	}
+	for _, up := range report.AbortedUploads {
+		fmt.Printf("%s upload %s of %s/%s (started %s)\n", verb, up.UploadID, up.Bucket, up.Key, up.Initiated.Format(time.RFC3339))
+	}
+	for _, p := range report.RemovedPaths {
+		fmt.Printf("%s %s\n", verb, p)
+	}
+	fmt.Printf("%d uploads, %d leftover files, %d bytes reclaimed\n", len(report.AbortedUploads), len(report.RemovedPaths), report.ReclaimedBytes)
+	return err
+}
+
+func printGCUsage(fs *flag.FlagSet) {
+	exe := filepath.Base(os.Args[0])
+	fmt.Printf("Usage: %s gc [flags]\n\n", exe)
+	fmt.Println("Aborts incomplete multipart uploads and removes temporary files left by")
+	fmt.Println("interrupted writes once they are older than --max-age.")
+	fmt.Println("Flags:")
+	fs.PrintDefaults()
+	fmt.Println("")
+	fmt.Println("Examples:")
+	fmt.Printf("  %s gc --root ./data --dry-run\n", exe)
+	fmt.Printf("  %s gc --root ./data --max-age 72h\n", exe)
+}
@@ -0,0 +1,94 @@
+package holydb
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/garder500/holydb/internal/server"
+)
+
+// execPresign prints a presigned URL of an object, signed with an access key
+// of the credential store under --root.
+func execPresign(argv []string) error {
+	fs := flag.NewFlagSet("presign", flag.ExitOnError)
+	root := fs.String("root", ".", "storage root directory (holding the credential store)")
+	accessKey := fs.String("access-key", "", "access key to sign with (default: the only key of the store)")
+	endpoint := fs.String("endpoint", "http://localhost:8080", "base URL the server is reached at")
+	method := fs.String("method", "GET", "HTTP method the URL allows")
+	expires := fs.Duration("expires", server.DefaultPresignExpires, "how long the URL stays valid (at most 168h)")
+	contentLength := fs.Int64("content-length", 0, "exact body size the request must send (0: any)")
+	contentType := fs.String("content-type", "", "Content-Type the request must send (empty: any)")
+	fs.Usage = func() { printPresignUsage(fs) }
+	if err := fs.Parse(argv); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return errors.New("presign needs a bucket and a key")
+	}
+	store, err := server.OpenCredentialStore(*root)
+	if err != nil {
+		return err
+	}
+	cred, err := signingCredential(store, *accessKey)
+	if err != nil {
+		return err
+	}
+	object, err := server.ObjectURL(*endpoint, fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	signed, err := server.Presign(cred, object, server.PresignOptions{
+		Method:        *method,
+		Expires:       *expires,
+		ContentLength: *contentLength,
+		ContentType:   *contentType,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println(signed)
+	return nil
+}
+
+// signingCredential returns the credential of accessKey, or the only one of
+// the store when accessKey is empty.
+func signingCredential(store *server.CredentialStore, accessKey string) (server.Credential, error) {
+	if accessKey != "" {
+		cred, ok := store.Lookup(accessKey)
+		if !ok {
+			return server.Credential{}, fmt.Errorf("%w: %s", server.ErrNoSuchAccessKey, accessKey)
+		}
+		return cred, nil
+	}
+	creds, err := store.List()
+	if err != nil {
+		return server.Credential{}, err
+	}
+	switch len(creds) {
+	case 0:
+		return server.Credential{}, errors.New("no access keys; create one with 'admin user add'")
+	case 1:
+		return creds[0], nil
+	default:
+		return server.Credential{}, errors.New("several access keys exist; choose one with --access-key")
+	}
+}
+
+func printPresignUsage(fs *flag.FlagSet) {
+	exe := filepath.Base(os.Args[0])
+	fmt.Printf("Usage: %s presign [flags] <bucket> <key>\n\n", exe)
+	fmt.Println("Prints a time-limited URL of an object that needs no credentials, for")
+	fmt.Println("downloads (GET) or uploads (PUT). The URL is signed with AWS Signature V4;")
+	fmt.Println("the method, the host and the content length and type, when given, cannot")
+	fmt.Println("be changed by whoever uses it.")
+	fmt.Println("Flags:")
+	fs.PrintDefaults()
+	fmt.Println("")
+	fmt.Println("Examples:")
+	fmt.Printf("  %s presign --root ./data photos 2024/cat.jpg\n", exe)
+	fmt.Printf("  %s presign --root ./data --method PUT --expires 1h --content-type image/jpeg photos upload.jpg\n", exe)
+}
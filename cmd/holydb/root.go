@@ -1,14 +1,19 @@
 package holydb
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/garder500/holydb/internal/server"
+	"github.com/garder500/holydb/pkg/storage"
 )
 
 const versionString = "0.1.0"
@@ -53,6 +58,16 @@ func Execute() error {
 		return nil
 	case "serve":
 		return execServe(args[1:])
+	case "admin":
+		return execAdmin(args[1:])
+	case "gc":
+		return execGC(args[1:])
+	case "fsck":
+		return execFsck(args[1:])
+	case "unpack":
+		return execUnpack(args[1:])
+	case "presign":
+		return execPresign(args[1:])
 	default:
 		return fmt.Errorf("unknown command: %s", args[0])
 	}
@@ -63,17 +78,39 @@ func execServe(argv []string) error {
 	fs := flag.NewFlagSet("serve", flag.ExitOnError)
 	addr := fs.String("addr", ":8080", "address to listen on")
 	root := fs.String("root", ".", "storage root directory")
+	exportDir := fs.String("export-dir", "", "directory where POST _reconstruct may write files (empty disables)")
+	keyFile := fs.String("encryption-key-file", "", "file of master keys to encrypt data at rest with (default: $HOLYDB_MASTER_KEY, none: no encryption)")
 	background := fs.Bool("background", false, "run server in background (detached)")
+	lifecycleInterval := fs.Duration("lifecycle-interval", time.Hour, "how often to apply bucket lifecycle rules (0 disables)")
+	lifecycleDryRun := fs.Bool("lifecycle-dry-run", false, "log lifecycle expirations without deleting anything")
+	gcInterval := fs.Duration("gc-interval", time.Hour, "how often to collect stale uploads and temporary files (0 disables)")
+	gcMaxAge := fs.Duration("gc-max-age", 24*time.Hour, "minimum age of the uploads and temporary files to collect")
+	scrubInterval := fs.Duration("scrub-interval", 0, "how often to verify every object and its checksums (0 disables)")
+	scrubRepair := fs.Bool("scrub-repair", false, "let the scrubber repair and quarantine what it finds")
+	s3Addr := fs.String("s3-addr", "", "address of the S3-compatible API (empty disables)")
+	s3Domain := fs.String("s3-domain", "", "domain for virtual-host style S3 bucket addressing (<bucket>.<domain>)")
+	auth := fs.Bool("auth", false, "require requests signed with an access key (see 'admin user add')")
 	fs.Usage = func() { printServeUsage(fs) }
 	if err := fs.Parse(argv); err != nil {
 		return err
 	}
+	if *auth {
+		// checked before detaching, where the error would not be seen
+		if err := requireAccessKeys(*root); err != nil {
+			return err
+		}
+	}
 	if *background && os.Getenv("HOLYDB_BACKGROUND") != "1" {
 		exe, err := os.Executable()
 		if err != nil {
 			return err
 		}
-		args := []string{exe, "serve", "--addr=" + *addr, "--root=" + *root, "--background=false"}
+		args := []string{exe, "serve", "--addr=" + *addr, "--root=" + *root, "--export-dir=" + *exportDir, "--background=false",
+			"--encryption-key-file=" + *keyFile,
+			"--lifecycle-interval=" + lifecycleInterval.String(), "--lifecycle-dry-run=" + strconv.FormatBool(*lifecycleDryRun),
+			"--gc-interval=" + gcInterval.String(), "--gc-max-age=" + gcMaxAge.String(),
+			"--scrub-interval=" + scrubInterval.String(), "--scrub-repair=" + strconv.FormatBool(*scrubRepair),
+			"--s3-addr=" + *s3Addr, "--s3-domain=" + *s3Domain, "--auth=" + strconv.FormatBool(*auth)}
 		devnull, err := os.OpenFile("/dev/null", os.O_RDWR, 0)
 		if err != nil {
 			return err
@@ -93,8 +130,62 @@ func execServe(argv []string) error {
 		fmt.Printf("started background process pid=%d\n", proc.Pid)
 		return nil
 	}
+	keys, err := storage.LoadKeyring(*keyFile)
+	if err != nil {
+		return fmt.Errorf("encryption keys: %w", err)
+	}
+	// held while serving, so that maintenance such as 'admin rotate-key'
+	// refuses to run under a live server
+	unlock, err := (&storage.LocalStorage{Root: *root}).LockRoot()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	fmt.Printf("Starting server on %s, root=%s\n", *addr, *root)
-	return server.Run(server.Config{Addr: *addr, Root: *root})
+	opts := []server.Option{
+		server.WithAddr(*addr),
+		server.WithRoot(*root),
+		server.WithExportDir(*exportDir),
+		server.WithLifecycle(*lifecycleInterval, *lifecycleDryRun),
+		server.WithGC(*gcInterval, *gcMaxAge),
+		server.WithScrub(*scrubInterval, *scrubRepair),
+		server.WithS3(*s3Addr, *s3Domain),
+	}
+	if keys != nil {
+		fmt.Printf("encrypting data at rest with master key %s\n", keys.CurrentID())
+		opts = append(opts, server.WithEncryption(keys))
+	}
+	if *auth {
+		store, err := server.OpenCredentialStore(*root)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, server.WithAuth(server.NewSigV4Authenticator(store)))
+	} else {
+		fmt.Println("warning: authentication is off, every request is served; start with --auth to require signed requests")
+	}
+	srv := server.New(opts...)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return srv.Run(ctx)
+}
+
+// requireAccessKeys fails when the storage root has no access key, as a
+// server started with --auth would then deny every request.
+func requireAccessKeys(root string) error {
+	store, err := server.OpenCredentialStore(root)
+	if err != nil {
+		return err
+	}
+	creds, err := store.List()
+	if err != nil {
+		return err
+	}
+	if len(creds) == 0 {
+		return fmt.Errorf("--auth: no access key in %s; create one with '%s admin user add --root %s <user>' or start without --auth",
+			root, filepath.Base(os.Args[0]), root)
+	}
+	return nil
 }
 
 func runDefault() error { // retained for backwards test compatibility
@@ -112,6 +203,11 @@ func printRootUsage() {
 	fmt.Printf("Usage:\n  %s [command] [flags]\n\n", exe)
 	fmt.Println("Commands:")
 	fmt.Println("  serve      Start HTTP storage server")
+	fmt.Println("  admin      Maintenance commands (recount, user, rotate-key)")
+	fmt.Println("  gc         Remove stale multipart uploads and temporary files")
+	fmt.Println("  fsck       Check (and repair) the consistency of a storage root")
+	fmt.Println("  unpack     Extract or import a reconstructed file")
+	fmt.Println("  presign    Print a time-limited URL of an object")
 	fmt.Println("  version    Show version information")
 	fmt.Println("  help       Show help (also: 'help <command>')")
 	fmt.Println("")
@@ -136,6 +232,9 @@ func printServeUsage(fs *flag.FlagSet) {
 	fmt.Println("Examples:")
 	fmt.Printf("  %s serve --addr :8080 --root ./data\n", exe)
 	fmt.Printf("  %s serve --background --addr 0.0.0.0:8080\n", exe)
+	fmt.Printf("  %s serve --root ./data --s3-addr :9000 --s3-domain s3.localhost\n", exe)
+	fmt.Printf("  %s serve --root ./data --encryption-key-file ./holydb.keys\n", exe)
+	fmt.Printf("  %s serve --root ./data --auth   # needs an access key, see 'admin user add'\n", exe)
 }
 
 func showSubcommandHelp(cmd string) error {
@@ -145,9 +244,60 @@ func showSubcommandHelp(cmd string) error {
 		// duplicate flag definitions for help display only
 		fs.String("addr", ":8080", "address to listen on")
 		fs.String("root", ".", "storage root directory")
+		fs.String("export-dir", "", "directory where POST _reconstruct may write files (empty disables)")
+		fs.String("encryption-key-file", "", "file of master keys to encrypt data at rest with (default: $HOLYDB_MASTER_KEY, none: no encryption)")
 		fs.Bool("background", false, "run server in background (detached)")
+		fs.Duration("lifecycle-interval", time.Hour, "how often to apply bucket lifecycle rules (0 disables)")
+		fs.Bool("lifecycle-dry-run", false, "log lifecycle expirations without deleting anything")
+		fs.Duration("gc-interval", time.Hour, "how often to collect stale uploads and temporary files (0 disables)")
+		fs.Duration("gc-max-age", 24*time.Hour, "minimum age of the uploads and temporary files to collect")
+		fs.Duration("scrub-interval", 0, "how often to verify every object and its checksums (0 disables)")
+		fs.Bool("scrub-repair", false, "let the scrubber repair and quarantine what it finds")
+		fs.String("s3-addr", "", "address of the S3-compatible API (empty disables)")
+		fs.String("s3-domain", "", "domain for virtual-host style S3 bucket addressing (<bucket>.<domain>)")
+		fs.Bool("auth", false, "require requests signed with an access key (see 'admin user add')")
 		printServeUsage(fs)
 		return nil
+	case "admin":
+		printAdminUsage()
+		return nil
+	case "gc":
+		fs := flag.NewFlagSet("gc", flag.ExitOnError)
+		fs.String("root", ".", "storage root directory")
+		fs.Duration("max-age", 24*time.Hour, "minimum age of the uploads and temporary files to remove")
+		fs.Bool("dry-run", false, "only report what would be removed")
+		printGCUsage(fs)
+		return nil
+	case "fsck":
+		fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+		fs.String("root", ".", "storage root directory")
+		fs.String("encryption-key-file", "", "file of master keys (default: $HOLYDB_MASTER_KEY)")
+		fs.Bool("checksums", true, "read all data and verify it against the recorded checksums")
+		fs.Bool("repair", false, "remove unreferenced parts and quarantine unreadable objects")
+		fs.Bool("json", false, "print the report as JSON")
+		printFsckUsage(fs)
+		return nil
+	case "unpack":
+		fs := flag.NewFlagSet("unpack", flag.ExitOnError)
+		fs.String("out", "", "file to write the object data to, - for stdout (default: the recorded file name)")
+		fs.Bool("info", false, "only print the file's header")
+		fs.String("root", ".", "storage root directory (with --bucket)")
+		fs.String("encryption-key-file", "", "file of master keys to encrypt the import with (default: $HOLYDB_MASTER_KEY)")
+		fs.String("bucket", "", "import the object into this bucket instead of writing a file")
+		fs.String("key", "", "key to import the object as (default: the recorded key)")
+		printUnpackUsage(fs)
+		return nil
+	case "presign":
+		fs := flag.NewFlagSet("presign", flag.ExitOnError)
+		fs.String("root", ".", "storage root directory (holding the credential store)")
+		fs.String("access-key", "", "access key to sign with (default: the only key of the store)")
+		fs.String("endpoint", "http://localhost:8080", "base URL the server is reached at")
+		fs.String("method", "GET", "HTTP method the URL allows")
+		fs.Duration("expires", server.DefaultPresignExpires, "how long the URL stays valid (at most 168h)")
+		fs.Int64("content-length", 0, "exact body size the request must send (0: any)")
+		fs.String("content-type", "", "Content-Type the request must send (empty: any)")
+		printPresignUsage(fs)
+		return nil
 	case "version":
 		fmt.Println("Shows version information.")
 		return nil
@@ -1,7 +1,10 @@
 package holydb
 
 import (
+	"strings"
 	"testing"
+
+	"github.com/garder500/holydb/internal/server"
 )
 
 func TestExecute(t *testing.T) {
@@ -24,3 +27,21 @@ func TestShowHelp(t *testing.T) {
 	// Note: This function prints to stdout but shouldn't return an error
 	showHelp()
 }
+
+func TestServeAuthRequiresAccessKey(t *testing.T) {
+	root := t.TempDir()
+	err := execServe([]string{"--root", root, "--auth"})
+	if err == nil || !strings.Contains(err.Error(), "no access key") {
+		t.Fatalf("serve --auth without access keys: %v", err)
+	}
+	store, err := server.OpenCredentialStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Add("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := requireAccessKeys(root); err != nil {
+		t.Fatalf("requireAccessKeys with a key: %v", err)
+	}
+}
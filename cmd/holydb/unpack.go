@@ -0,0 +1,113 @@
+package holydb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/garder500/holydb/pkg/storage"
+)
+
+// execUnpack extracts the object of a reconstructed file, either to a local
+// file or, with --bucket, back into a storage root.
+func execUnpack(argv []string) error {
+	fs := flag.NewFlagSet("unpack", flag.ExitOnError)
+	out := fs.String("out", "", "file to write the object data to, - for stdout (default: the recorded file name)")
+	info := fs.Bool("info", false, "only print the file's header")
+	root := fs.String("root", ".", "storage root directory (with --bucket)")
+	keyFile := fs.String("encryption-key-file", "", "file of master keys to encrypt the import with (default: $HOLYDB_MASTER_KEY)")
+	bucket := fs.String("bucket", "", "import the object into this bucket instead of writing a file")
+	key := fs.String("key", "", "key to import the object as (default: the recorded key)")
+	fs.Usage = func() { printUnpackUsage(fs) }
+	if err := fs.Parse(argv); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("unpack needs exactly one file")
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if *bucket != "" {
+		keys, err := storage.LoadKeyring(*keyFile)
+		if err != nil {
+			return fmt.Errorf("encryption keys: %w", err)
+		}
+		ls := &storage.LocalStorage{Root: *root, Keys: keys}
+		obj, err := ls.Import(context.Background(), *bucket, *key, f)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("imported %s/%s (%d bytes, etag %s)\n", *bucket, obj.Key, obj.Size, obj.ETag)
+		return nil
+	}
+
+	rc, err := storage.OpenReconstructed(f)
+	if err != nil {
+		return err
+	}
+	if *info {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(struct {
+			Version int                     `json:"version"`
+			Size    int64                   `json:"size"`
+			Header  storage.ContainerHeader `json:"header"`
+		}{rc.Version, rc.Size, rc.Header})
+	}
+	dst := *out
+	if dst == "" {
+		dst = filepath.Base(rc.Header.Metadata["filename"])
+		if dst == "." || dst == "/" {
+			dst = filepath.Base(rc.Header.Key)
+		}
+		if dst == "." || dst == "/" {
+			return errors.New("the file records no name, use --out")
+		}
+	}
+	if dst == "-" {
+		_, err := io.Copy(os.Stdout, rc)
+		return err
+	}
+	// write next to the destination and rename once the checksum matched
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".unpack-*")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, rc)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	fmt.Printf("wrote %s\n", dst)
+	return nil
+}
+
+func printUnpackUsage(fs *flag.FlagSet) {
+	exe := filepath.Base(os.Args[0])
+	fmt.Printf("Usage: %s unpack [flags] <file>\n\n", exe)
+	fmt.Println("Verifies a file produced by _reconstruct and extracts the object data, or")
+	fmt.Println("imports it with its recorded metadata into a bucket.")
+	fmt.Println("Flags:")
+	fs.PrintDefaults()
+	fmt.Println("")
+	fmt.Println("Examples:")
+	fmt.Printf("  %s unpack --info report.holy\n", exe)
+	fmt.Printf("  %s unpack --out report.pdf report.holy\n", exe)
+	fmt.Printf("  %s unpack --root ./data --bucket restored report.holy\n", exe)
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/garder500/holydb/pkg/storage"
+)
+
+// Authenticator checks the credentials of every request. It returns the
+// request to serve, possibly carrying the caller's identity in its context,
+// or an error; errors other than the server's own are reported to the
+// client as 403 AccessDenied with their message.
+type Authenticator interface {
+	Authenticate(req *http.Request) (*http.Request, error)
+}
+
+// AuthenticatorFunc adapts a function to Authenticator.
+type AuthenticatorFunc func(req *http.Request) (*http.Request, error)
+
+// Authenticate calls f(req).
+func (f AuthenticatorFunc) Authenticate(req *http.Request) (*http.Request, error) { return f(req) }
+
+// authMiddleware authenticates requests with a, reporting failures with
+// writeErr. Requests without credentials are served as anonymous, leaving
+// it to the policy evaluator to deny them unless a bucket policy allows
+// them. The caller's identity is recorded for the request log.
+func authMiddleware(a Authenticator, writeErr func(http.ResponseWriter, *http.Request, error)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			authed, err := a.Authenticate(req)
+			if errors.Is(err, errMissingCredentials) {
+				next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), anonymousKey{}, true)))
+				return
+			}
+			if err != nil {
+				var ae *apiError
+				if !errors.As(err, &ae) {
+					err = accessDenied(err.Error())
+				}
+				writeErr(w, req, err)
+				return
+			}
+			if id, ok := storage.IdentityFromContext(authed.Context()); ok {
+				if slot, ok := req.Context().Value(identitySlotKey{}).(*storage.Identity); ok {
+					*slot = id
+				}
+			}
+			next.ServeHTTP(w, authed)
+		})
+	}
+}
+
+// identitySlotKey holds the *storage.Identity the logging middleware reports
+// once the request has been served.
+type identitySlotKey struct{}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// credentialsFile is where a CredentialStore keeps its access keys, relative
+// to the storage root. Bucket names cannot start with a dot, so it never
+// collides with a bucket.
+const credentialsFile = ".holydb/credentials.json"
+
+// ErrNoSuchAccessKey is returned when removing an unknown access key.
+var ErrNoSuchAccessKey = errors.New("no such access key")
+
+// Credential is an access key pair. The secret key is needed in clear text to
+// verify request signatures, so the credentials file is only readable by its
+// owner.
+type Credential struct {
+	AccessKey string    `json:"access_key"`
+	SecretKey string    `json:"secret_key"`
+	User      string    `json:"user"`
+	Created   time.Time `json:"created"`
+}
+
+// CredentialSource looks up the credential of an access key.
+type CredentialSource interface {
+	Lookup(accessKey string) (Credential, bool)
+}
+
+// CredentialStore is a CredentialSource persisted under a storage root. It
+// reloads the file when it changes, so keys added or removed with
+// "holydb admin user" apply to a running server.
+type CredentialStore struct {
+	path string
+
+	mu      sync.Mutex
+	creds   map[string]Credential
+	modTime time.Time
+	size    int64
+}
+
+// OpenCredentialStore opens the credential store of the storage root. A
+// missing file is an empty store.
+func OpenCredentialStore(root string) (*CredentialStore, error) {
+	c := &CredentialStore{path: filepath.Join(root, credentialsFile)}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload rereads the file if it changed since it was last read.
+func (c *CredentialStore) reload() error {
+	fi, err := os.Stat(c.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		c.creds, c.modTime, c.size = map[string]Credential{}, time.Time{}, 0
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if c.creds != nil && fi.ModTime().Equal(c.modTime) && fi.Size() == c.size {
+		return nil
+	}
+	b, err := os.ReadFile(c.path)
+	if err != nil {
+		return err
+	}
+	var list []Credential
+	if err := json.Unmarshal(b, &list); err != nil {
+		return fmt.Errorf("credentials file %s: %w", c.path, err)
+	}
+	creds := make(map[string]Credential, len(list))
+	for _, cr := range list {
+		creds[cr.AccessKey] = cr
+	}
+	c.creds, c.modTime, c.size = creds, fi.ModTime(), fi.Size()
+	return nil
+}
+
+// save writes the credentials through a temporary file renamed over the
+// store file.
+func (c *CredentialStore) save() error {
+	list := make([]Credential, 0, len(c.creds))
+	for _, cr := range c.creds {
+		list = append(list, cr)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].AccessKey < list[j].AccessKey })
+	b, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o700); err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if fi, err := os.Stat(c.path); err == nil {
+		c.modTime, c.size = fi.ModTime(), fi.Size()
+	}
+	return nil
+}
+
+// Lookup returns the credential of accessKey. A store that cannot be reread
+// keeps serving the keys it last loaded.
+func (c *CredentialStore) Lookup(accessKey string) (Credential, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reload()
+	cr, ok := c.creds[accessKey]
+	return cr, ok
+}
+
+// Add creates a new random access key pair for user.
+func (c *CredentialStore) Add(user string) (Credential, error) {
+	if user == "" {
+		return Credential{}, errors.New("user name must not be empty")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.reload(); err != nil {
+		return Credential{}, err
+	}
+	cr := Credential{
+		AccessKey: "HDB" + randomString(17, accessKeyAlphabet),
+		SecretKey: randomString(40, secretKeyAlphabet),
+		User:      user,
+		Created:   time.Now().UTC().Truncate(time.Second),
+	}
+	c.creds[cr.AccessKey] = cr
+	if err := c.save(); err != nil {
+		delete(c.creds, cr.AccessKey)
+		return Credential{}, err
+	}
+	return cr, nil
+}
+
+// List returns every credential sorted by access key.
+func (c *CredentialStore) List() ([]Credential, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	list := make([]Credential, 0, len(c.creds))
+	for _, cr := range c.creds {
+		list = append(list, cr)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].AccessKey < list[j].AccessKey })
+	return list, nil
+}
+
+// Remove deletes an access key; it fails with ErrNoSuchAccessKey if the key
+// does not exist.
+func (c *CredentialStore) Remove(accessKey string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.reload(); err != nil {
+		return err
+	}
+	cr, ok := c.creds[accessKey]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNoSuchAccessKey, accessKey)
+	}
+	delete(c.creds, accessKey)
+	if err := c.save(); err != nil {
+		c.creds[accessKey] = cr
+		return err
+	}
+	return nil
+}
+
+const (
+	accessKeyAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	secretKeyAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+)
+
+// randomString returns n characters drawn uniformly from alphabet, which
+// must hold at most 256 characters.
+func randomString(n int, alphabet string) string {
+	out := make([]byte, 0, n)
+	limit := 256 - 256%len(alphabet)
+	var b [1]byte
+	for len(out) < n {
+		rand.Read(b[:])
+		if int(b[0]) < limit {
+			out = append(out, alphabet[int(b[0])%len(alphabet)])
+		}
+	}
+	return string(out)
+}
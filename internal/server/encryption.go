@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+
+	"github.com/garder500/holydb/pkg/storage"
+)
+
+// customerKeyHeaders names the headers carrying a customer-provided
+// encryption key: the key itself (base64), its MD5 (base64, optional) and,
+// on the S3 frontend, the algorithm (which must be AES256).
+type customerKeyHeaders struct{ algorithm, key, md5 string }
+
+var (
+	nativeKeyHeaders = customerKeyHeaders{
+		key: "X-Encryption-Key",
+		md5: "X-Encryption-Key-MD5",
+	}
+	nativeCopySourceKeyHeaders = customerKeyHeaders{
+		key: "X-Copy-Source-Encryption-Key",
+		md5: "X-Copy-Source-Encryption-Key-MD5",
+	}
+	s3KeyHeaders = customerKeyHeaders{
+		algorithm: "X-Amz-Server-Side-Encryption-Customer-Algorithm",
+		key:       "X-Amz-Server-Side-Encryption-Customer-Key",
+		md5:       "X-Amz-Server-Side-Encryption-Customer-Key-MD5",
+	}
+	s3CopySourceKeyHeaders = customerKeyHeaders{
+		algorithm: "X-Amz-Copy-Source-Server-Side-Encryption-Customer-Algorithm",
+		key:       "X-Amz-Copy-Source-Server-Side-Encryption-Customer-Key",
+		md5:       "X-Amz-Copy-Source-Server-Side-Encryption-Customer-Key-MD5",
+	}
+)
+
+// customerKey returns the key carried by the headers hs of req, or nil when
+// there is none.
+func customerKey(req *http.Request, hs customerKeyHeaders) ([]byte, error) {
+	encoded, sum := req.Header.Get(hs.key), req.Header.Get(hs.md5)
+	algorithm := ""
+	if hs.algorithm != "" {
+		algorithm = req.Header.Get(hs.algorithm)
+	}
+	if encoded == "" {
+		if sum != "" || algorithm != "" {
+			return nil, badRequest(hs.key + " is required")
+		}
+		return nil, nil
+	}
+	if hs.algorithm != "" && algorithm != storage.EncryptionAES256 {
+		return nil, badRequest(hs.algorithm + " must be " + storage.EncryptionAES256)
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != storage.KeySize {
+		return nil, badRequest(hs.key + " must be a base64-encoded 256-bit key")
+	}
+	if sum != "" && subtle.ConstantTimeCompare([]byte(sum), []byte(storage.CustomerKeyMD5(key))) != 1 {
+		return nil, badRequest(hs.md5 + " does not match the key")
+	}
+	return key, nil
+}
+
+// customerKeyMiddleware passes the customer-provided encryption keys of a
+// request, in the native or the S3 headers, to the storage through the
+// request context. Malformed keys are rejected with writeErr.
+func customerKeyMiddleware(writeErr func(http.ResponseWriter, *http.Request, error)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if sse := req.Header.Get("X-Amz-Server-Side-Encryption"); sse != "" && sse != storage.EncryptionAES256 {
+				writeErr(w, req, badRequest("X-Amz-Server-Side-Encryption must be "+storage.EncryptionAES256))
+				return
+			}
+			ctx := req.Context()
+			for _, c := range []struct {
+				headers customerKeyHeaders
+				with    func(context.Context, []byte) context.Context
+			}{
+				{nativeKeyHeaders, storage.WithCustomerKey},
+				{s3KeyHeaders, storage.WithCustomerKey},
+				{nativeCopySourceKeyHeaders, storage.WithCopySourceCustomerKey},
+				{s3CopySourceKeyHeaders, storage.WithCopySourceCustomerKey},
+			} {
+				key, err := customerKey(req, c.headers)
+				if err != nil {
+					writeErr(w, req, err)
+					return
+				}
+				if key != nil {
+					ctx = c.with(ctx, key)
+				}
+			}
+			next.ServeHTTP(w, req.WithContext(ctx))
+		})
+	}
+}
+
+// setEncryptionHeaders reports how an object is encrypted at rest:
+// X-Encryption gives the algorithm and X-Encryption-Key-MD5 the customer key
+// it is encrypted with, if any.
+func setEncryptionHeaders(h http.Header, info storage.ObjectInfo) {
+	if info.Encryption == "" {
+		return
+	}
+	h.Set("X-Encryption", info.Encryption)
+	if info.CustomerKeyMD5 != "" {
+		h.Set(nativeKeyHeaders.md5, info.CustomerKeyMD5)
+	}
+}
+
+// setS3EncryptionHeaders is setEncryptionHeaders for the S3 frontend.
+func setS3EncryptionHeaders(h http.Header, info storage.ObjectInfo) {
+	switch {
+	case info.CustomerKeyMD5 != "":
+		h.Set(s3KeyHeaders.algorithm, info.Encryption)
+		h.Set(s3KeyHeaders.md5, info.CustomerKeyMD5)
+	case info.Encryption != "":
+		h.Set("X-Amz-Server-Side-Encryption", info.Encryption)
+	}
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/garder500/holydb/pkg/storage"
+)
+
+func TestCustomerKeys(t *testing.T) {
+	keys, err := storage.NewKeyring(bytes.Repeat([]byte{1}, storage.KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := New(WithRoot(t.TempDir()), WithEncryption(keys), WithS3("", "s3.test"), WithLogger(log.New(io.Discard, "", 0)))
+	do := func(method, target, body string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		return rec
+	}
+	key := bytes.Repeat([]byte{7}, storage.KeySize)
+	encoded, sum := base64.StdEncoding.EncodeToString(key), storage.CustomerKeyMD5(key)
+	wrong := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{8}, storage.KeySize))
+
+	if rec := do(http.MethodPut, "/v1/storage/vault", "", nil); rec.Code != http.StatusCreated {
+		t.Fatalf("create bucket: %d %s", rec.Code, rec.Body)
+	}
+	rec := do(http.MethodPut, "/v1/storage/vault/plain.txt", "hello", nil)
+	if rec.Code != http.StatusCreated || rec.Header().Get("X-Encryption") != "AES256" || rec.Header().Get("X-Encryption-Key-MD5") != "" {
+		t.Fatalf("PUT: %d %v", rec.Code, rec.Header())
+	}
+	for _, h := range []map[string]string{
+		{"X-Encryption-Key": "c2hvcnQ="},
+		{"X-Encryption-Key": encoded, "X-Encryption-Key-MD5": storage.CustomerKeyMD5([]byte("other"))},
+		{"X-Encryption-Key-MD5": sum},
+	} {
+		if rec := do(http.MethodPut, "/v1/storage/vault/secret.txt", "top secret", h); rec.Code != http.StatusBadRequest {
+			t.Fatalf("PUT with %v: %d %s", h, rec.Code, rec.Body)
+		}
+	}
+	rec = do(http.MethodPut, "/v1/storage/vault/secret.txt", "top secret", map[string]string{"X-Encryption-Key": encoded, "X-Encryption-Key-MD5": sum})
+	if rec.Code != http.StatusCreated || rec.Header().Get("X-Encryption-Key-MD5") != sum {
+		t.Fatalf("PUT with a customer key: %d %v %s", rec.Code, rec.Header(), rec.Body)
+	}
+	if rec := do(http.MethodGet, "/v1/storage/vault/secret.txt", "", nil); rec.Code != http.StatusBadRequest {
+		t.Fatalf("GET without the key: %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodGet, "/v1/storage/vault/secret.txt", "", map[string]string{"X-Encryption-Key": wrong}); rec.Code != http.StatusForbidden {
+		t.Fatalf("GET with the wrong key: %d %s", rec.Code, rec.Body)
+	}
+	rec = do(http.MethodGet, "/v1/storage/vault/secret.txt", "", map[string]string{"X-Encryption-Key": encoded, "Range": "bytes=4-9"})
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "secret" {
+		t.Fatalf("ranged GET with the key: %d %s", rec.Code, rec.Body)
+	}
+	rec = do(http.MethodPut, "/v1/storage/vault/copy.txt", "", map[string]string{
+		"X-Copy-Source":                "vault/secret.txt",
+		"X-Copy-Source-Encryption-Key": encoded,
+	})
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Encryption-Key-MD5") != "" {
+		t.Fatalf("copy with the source key: %d %v %s", rec.Code, rec.Header(), rec.Body)
+	}
+	if rec := do(http.MethodGet, "/v1/storage/vault/copy.txt", "", nil); rec.Code != http.StatusOK || rec.Body.String() != "top secret" {
+		t.Fatalf("GET of the copy: %d %s", rec.Code, rec.Body)
+	}
+
+	// the S3 frontend takes the keys in the SSE-C headers
+	sse := map[string]string{
+		"X-Amz-Server-Side-Encryption-Customer-Algorithm": "AES256",
+		"X-Amz-Server-Side-Encryption-Customer-Key":       encoded,
+		"X-Amz-Server-Side-Encryption-Customer-Key-MD5":   sum,
+	}
+	rec, body := s3Do(t, srv, http.MethodPut, "/vault/s3.txt", "from s3", sse)
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Amz-Server-Side-Encryption-Customer-Key-MD5") != sum {
+		t.Fatalf("PutObject with SSE-C: %d %v %s", rec.Code, rec.Header(), body)
+	}
+	if rec, body := s3Do(t, srv, http.MethodGet, "/vault/s3.txt", "", nil); rec.Code != http.StatusBadRequest || !strings.Contains(body, "InvalidRequest") {
+		t.Fatalf("GetObject without the key: %d %s", rec.Code, body)
+	}
+	if rec, body := s3Do(t, srv, http.MethodGet, "/vault/s3.txt", "", sse); rec.Code != http.StatusOK || body != "from s3" {
+		t.Fatalf("GetObject with the key: %d %s", rec.Code, body)
+	}
+	delete(sse, "X-Amz-Server-Side-Encryption-Customer-Algorithm")
+	if rec, body := s3Do(t, srv, http.MethodGet, "/vault/s3.txt", "", sse); rec.Code != http.StatusBadRequest {
+		t.Fatalf("GetObject without the algorithm: %d %s", rec.Code, body)
+	}
+	rec, body = s3Do(t, srv, http.MethodHead, "/vault/plain.txt", "", nil)
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Amz-Server-Side-Encryption") != "AES256" {
+		t.Fatalf("HeadObject: %d %v %s", rec.Code, rec.Header(), body)
+	}
+	if rec, body := s3Do(t, srv, http.MethodPut, "/vault/kms.txt", "x", map[string]string{"X-Amz-Server-Side-Encryption": "aws:kms"}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("PutObject with SSE-KMS: %d %s", rec.Code, body)
+	}
+}
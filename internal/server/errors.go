@@ -0,0 +1,97 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/garder500/holydb/pkg/storage"
+)
+
+// ErrorResponse is the JSON body written for every failed request.
+type ErrorResponse struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Resource  string `json:"resource"`
+	RequestID string `json:"request_id"`
+}
+
+// apiError is an error raised by the HTTP layer itself (bad query
+// parameters, unsupported methods...) rather than by the storage backend.
+type apiError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *apiError) Error() string { return e.message }
+
+func badRequest(message string) error {
+	return &apiError{status: http.StatusBadRequest, code: "InvalidRequest", message: message}
+}
+
+func accessDenied(message string) error {
+	return &apiError{status: http.StatusForbidden, code: "AccessDenied", message: message}
+}
+
+var errMethodNotAllowed = &apiError{status: http.StatusMethodNotAllowed, code: "MethodNotAllowed", message: "method not allowed"}
+
+// storageErrors maps storage sentinel errors to an HTTP status, an error
+// code and the code the S3 frontend reports for them.
+var storageErrors = []struct {
+	err    error
+	status int
+	code   string
+	s3Code string
+}{
+	{storage.ErrInvalidKey, http.StatusBadRequest, "InvalidKey", "InvalidArgument"},
+	{storage.ErrNoSuchBucket, http.StatusNotFound, "NoSuchBucket", "NoSuchBucket"},
+	{storage.ErrNoSuchKey, http.StatusNotFound, "NoSuchKey", "NoSuchKey"},
+	{storage.ErrNoSuchUpload, http.StatusNotFound, "NoSuchUpload", "NoSuchUpload"},
+	{storage.ErrNoSuchVersion, http.StatusNotFound, "NoSuchVersion", "NoSuchVersion"},
+	{storage.ErrBucketExists, http.StatusConflict, "BucketAlreadyExists", "BucketAlreadyOwnedByYou"},
+	{storage.ErrBucketNotEmpty, http.StatusConflict, "BucketNotEmpty", "BucketNotEmpty"},
+	{storage.ErrQuotaExceeded, http.StatusInsufficientStorage, "QuotaExceeded", "QuotaExceeded"},
+	{storage.ErrInvalidPart, http.StatusBadRequest, "InvalidPart", "InvalidPart"},
+	{storage.ErrBadDigest, http.StatusBadRequest, "BadDigest", "BadDigest"},
+	{storage.ErrInvalidRange, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "InvalidRange"},
+	{storage.ErrInvalidConfig, http.StatusBadRequest, "InvalidConfiguration", "MalformedXML"},
+	{storage.ErrInvalidArgument, http.StatusBadRequest, "InvalidArgument", "InvalidArgument"},
+	{storage.ErrCustomerKeyRequired, http.StatusBadRequest, "InvalidRequest", "InvalidRequest"},
+	{storage.ErrWrongCustomerKey, http.StatusForbidden, "AccessDenied", "AccessDenied"},
+}
+
+// writeError writes err as a structured JSON error. Errors that do not map
+// to a known storage or API error are logged and reported as a generic
+// internal error so server paths never leak to clients.
+func writeError(w http.ResponseWriter, req *http.Request, err error) {
+	status, code, message := http.StatusInternalServerError, "InternalError", "internal server error"
+	var ae *apiError
+	if errors.As(err, &ae) {
+		status, code, message = ae.status, ae.code, ae.message
+	} else {
+		matched := false
+		for _, se := range storageErrors {
+			if errors.Is(err, se.err) {
+				status, code, message = se.status, se.code, err.Error()
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			requestLogger(req).Printf("ERR %s %s: %v", req.Method, req.URL.Path, err)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if req.Method == http.MethodHead {
+		return
+	}
+	json.NewEncoder(w).Encode(ErrorResponse{
+		Code:      code,
+		Message:   message,
+		Resource:  req.URL.Path,
+		RequestID: requestID(req.Context()),
+	})
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/garder500/holydb/pkg/storage"
+)
+
+// garbageCollector is implemented by storage backends that leave stale
+// uploads and temporary files behind.
+type garbageCollector interface {
+	CollectGarbage(ctx context.Context, opts storage.GCOptions) (storage.GCReport, error)
+}
+
+// runGC collects stale multipart uploads and temporary files once per
+// interval until ctx is cancelled.
+func runGC(ctx context.Context, logger *log.Logger, ls garbageCollector, interval, maxAge time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		report, err := ls.CollectGarbage(ctx, storage.GCOptions{MaxAge: maxAge})
+		if err != nil {
+			logger.Printf("gc: %v", err)
+		}
+		for _, up := range report.AbortedUploads {
+			logger.Printf("gc: aborted upload %s of %s/%s started %s", up.UploadID, up.Bucket, up.Key, up.Initiated.Format(time.RFC3339))
+		}
+		for _, p := range report.RemovedPaths {
+			logger.Printf("gc: removed %s", p)
+		}
+		if len(report.AbortedUploads)+len(report.RemovedPaths) > 0 {
+			logger.Printf("gc: reclaimed %d bytes", report.ReclaimedBytes)
+		}
+	}
+}
@@ -2,41 +2,152 @@ package server
 
 import (
 	"encoding/json"
+	"io"
 	"net/http"
+	"strconv"
 
 	"github.com/garder500/holydb/pkg/storage"
 	"github.com/gorilla/mux"
 )
 
-// RegisterBucketHandlers registers bucket listing and control endpoints (GET list, POST initiate multipart)
-func RegisterBucketHandlers(r *mux.Router, ls storage.Storage) {
-	r.HandleFunc("/{bucket}", func(w http.ResponseWriter, req *http.Request) {
+// handleListBuckets serves GET / with every bucket, sorted by name.
+func handleListBuckets(ls storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			writeError(w, req, errMethodNotAllowed)
+			return
+		}
+		buckets, err := ls.ListBuckets(req.Context())
+		if err != nil {
+			writeError(w, req, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(buckets)
+	}
+}
+
+// handleBucket serves /{bucket}: PUT creates the bucket (optional BucketMetadata JSON body), HEAD
+// checks it exists, DELETE removes it (?force=true also removes its content), GET lists objects
+// (plain, paged, ?versions or ?uploads).
+func handleBucket(ls storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
 		vars := mux.Vars(req)
 		bucket := vars["bucket"]
 		switch req.Method {
-		case http.MethodPost:
-			if req.URL.Query().Get("uploads") != "" { // start multipart (without key yet)
-				id, err := ls.StartMultipart(req.Context(), bucket, "")
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
+		case http.MethodPut:
+			var bm *storage.BucketMetadata
+			if req.ContentLength != 0 {
+				bm = &storage.BucketMetadata{}
+				if err := json.NewDecoder(req.Body).Decode(bm); err != nil && err != io.EOF {
+					writeError(w, req, badRequest("invalid bucket metadata: "+err.Error()))
+					return
+				}
+			}
+			if err := ls.CreateBucket(req.Context(), bucket); err != nil {
+				writeError(w, req, err)
+				return
+			}
+			if bm != nil {
+				if err := ls.PutBucketMetadata(req.Context(), bucket, *bm); err != nil {
+					writeError(w, req, err)
 					return
 				}
-				w.Write([]byte(id))
+			}
+			w.Header().Set("Location", req.URL.Path)
+			w.WriteHeader(http.StatusCreated)
+		case http.MethodHead:
+			if _, err := ls.HeadBucket(req.Context(), bucket); err != nil {
+				writeError(w, req, err)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		case http.MethodDelete:
+			force, _ := strconv.ParseBool(req.URL.Query().Get("force"))
+			if err := ls.DeleteBucket(req.Context(), bucket, force); err != nil {
+				writeError(w, req, err)
 				return
 			}
-			http.Error(w, "unsupported", http.StatusBadRequest)
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodPost:
+			if req.URL.Query().Has("uploads") {
+				writeError(w, req, badRequest("multipart uploads are started on a key: POST /{bucket}/{key}?uploads"))
+				return
+			}
+			writeError(w, req, badRequest("unsupported bucket operation"))
 		case http.MethodGet:
 			prefix := req.URL.Query().Get("prefix")
+			if req.URL.Query().Has("uploads") {
+				uploads, err := ls.ListMultipartUploads(req.Context(), bucket, prefix)
+				if err != nil {
+					writeError(w, req, err)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(uploads)
+				return
+			}
+			if req.URL.Query().Has("versions") {
+				versions, err := ls.ListVersions(req.Context(), bucket, prefix)
+				if err != nil {
+					writeError(w, req, err)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(versions)
+				return
+			}
+			if isPagedList(req) {
+				listObjects(w, req, ls, bucket)
+				return
+			}
 			list, err := ls.List(req.Context(), bucket, prefix)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				writeError(w, req, err)
 				return
 			}
 			b, _ := json.Marshal(list)
 			w.Header().Set("Content-Type", "application/json")
 			w.Write(b)
 		default:
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			writeError(w, req, errMethodNotAllowed)
+		}
+	}
+}
+
+// isPagedList reports whether a bucket GET asks for a ListObjects page
+// rather than the legacy array of every key.
+func isPagedList(req *http.Request) bool {
+	q := req.URL.Query()
+	for _, p := range []string{"list-type", "delimiter", "start-after", "continuation-token", "max-keys"} {
+		if q.Has(p) {
+			return true
+		}
+	}
+	return false
+}
+
+func listObjects(w http.ResponseWriter, req *http.Request, ls storage.Storage, bucket string) {
+	q := req.URL.Query()
+	opts := storage.ListOptions{
+		Prefix:            q.Get("prefix"),
+		Delimiter:         q.Get("delimiter"),
+		StartAfter:        q.Get("start-after"),
+		ContinuationToken: q.Get("continuation-token"),
+	}
+	if v := q.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, req, badRequest("invalid max-keys"))
+			return
 		}
-	}).Methods(http.MethodPost, http.MethodGet)
+		opts.MaxKeys = n
+	}
+	res, err := ls.ListObjects(req.Context(), bucket, opts)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
 }
@@ -8,32 +8,32 @@ import (
 	"github.com/gorilla/mux"
 )
 
-// RegisterBucketMetaHandlers handles bucket metadata read/write (.bucket.meta)
-func RegisterBucketMetaHandlers(r *mux.Router, ls storage.Storage) {
-	r.HandleFunc("/{bucket}/.bucket.meta", func(w http.ResponseWriter, req *http.Request) {
+// handleBucketMeta handles bucket metadata read/write (.bucket.meta)
+func handleBucketMeta(ls storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
 		vars := mux.Vars(req)
 		bucket := vars["bucket"]
 		switch req.Method {
 		case http.MethodPut:
 			var bm storage.BucketMetadata
 			if err := json.NewDecoder(req.Body).Decode(&bm); err != nil {
-				http.Error(w, err.Error(), http.StatusBadRequest)
+				writeError(w, req, badRequest("invalid bucket metadata: "+err.Error()))
 				return
 			}
 			if err := ls.PutBucketMetadata(req.Context(), bucket, bm); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				writeError(w, req, err)
 				return
 			}
 			w.WriteHeader(http.StatusOK)
 		case http.MethodGet:
 			bm, err := ls.GetBucketMetadata(req.Context(), bucket)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusNotFound)
+				writeError(w, req, err)
 				return
 			}
 			json.NewEncoder(w).Encode(bm)
 		default:
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			writeError(w, req, errMethodNotAllowed)
 		}
-	}).Methods(http.MethodPut, http.MethodGet)
+	}
 }
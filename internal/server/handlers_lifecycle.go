@@ -0,0 +1,65 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/garder500/holydb/pkg/storage"
+	"github.com/gorilla/mux"
+)
+
+// handleLifecycle handles the bucket lifecycle configuration
+// /{bucket}/_lifecycle. GET returns the rules, or with ?dryRun the objects
+// they would expire now; PUT replaces the rules; POST ?run applies them.
+func handleLifecycle(ls storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		bucket := mux.Vars(req)["bucket"]
+		q := req.URL.Query()
+		switch req.Method {
+		case http.MethodGet:
+			if q.Has("dryRun") {
+				report, err := ls.ApplyLifecycle(req.Context(), bucket, true)
+				if err != nil {
+					writeError(w, req, err)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(report)
+				return
+			}
+			cfg, err := ls.GetLifecycle(req.Context(), bucket)
+			if err != nil {
+				writeError(w, req, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(cfg)
+		case http.MethodPut:
+			var cfg storage.LifecycleConfig
+			if err := json.NewDecoder(req.Body).Decode(&cfg); err != nil {
+				writeError(w, req, badRequest("invalid lifecycle configuration: "+err.Error()))
+				return
+			}
+			if err := ls.PutLifecycle(req.Context(), bucket, cfg); err != nil {
+				writeError(w, req, err)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		case http.MethodPost:
+			if !q.Has("run") {
+				writeError(w, req, badRequest("missing run parameter"))
+				return
+			}
+			dryRun := q.Get("dryRun") == "true" || q.Get("dryRun") == "1"
+			report, err := ls.ApplyLifecycle(req.Context(), bucket, dryRun)
+			if err != nil {
+				writeError(w, req, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(report)
+		default:
+			writeError(w, req, errMethodNotAllowed)
+		}
+	}
+}
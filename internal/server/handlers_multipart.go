@@ -2,41 +2,106 @@ package server
 
 import (
 	"encoding/json"
+	"io"
+	"net"
 	"net/http"
 
 	"github.com/garder500/holydb/pkg/storage"
 	"github.com/gorilla/mux"
 )
 
-// RegisterMultipartHandlers adds endpoints to complete or abort a multipart upload once parts have been uploaded.
-// POST /{bucket}/{key}?complete=uploadId with optional X-Meta-JSON header completes the upload.
+// completeRequest is the optional JSON body of a complete call listing, in
+// ascending order, the parts to commit.
+type completeRequest struct {
+	Parts []storage.CompletedPart `json:"parts"`
+}
+
+// The multipart upload endpoints are selected by their query parameter (see routes):
+// POST /{bucket}/{key}?uploads with optional X-Meta-JSON header starts an upload bound to key.
+// GET /{bucket}/{key}?uploadId=... lists the parts uploaded so far.
+// POST /{bucket}/{key}?complete=uploadId with optional X-Meta-JSON header completes the upload;
+// an optional JSON body {"parts":[{"part_number":1,"etag":"..."}]} selects the parts to commit,
+// otherwise every uploaded part is committed in numeric order.
 // DELETE /{bucket}/{key}?abort=uploadId aborts the upload.
-func RegisterMultipartHandlers(r *mux.Router, ls storage.Storage) {
-	r.HandleFunc("/{bucket}/{rest:.*}", func(w http.ResponseWriter, req *http.Request) {
+// Parts are uploaded with PUT /{bucket}/{key}?uploadId=...&partNumber=N (see handleObject).
+
+// handleCreateMultipart serves POST /{bucket}/{key}?uploads.
+func handleCreateMultipart(ls storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+		var meta storage.Metadata
+		if m := req.Header.Get("X-Meta-JSON"); m != "" {
+			_ = json.Unmarshal([]byte(m), &meta)
+		}
+		up, err := ls.CreateMultipartUpload(req.Context(), vars["bucket"], vars["rest"], meta, initiator(req))
+		if err != nil {
+			writeError(w, req, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(up)
+	}
+}
+
+// handleListParts serves GET /{bucket}/{key}?uploadId=....
+func handleListParts(ls storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+		parts, err := ls.ListParts(req.Context(), vars["bucket"], vars["rest"], req.URL.Query().Get("uploadId"))
+		if err != nil {
+			writeError(w, req, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(parts)
+	}
+}
+
+// handleCompleteMultipart serves POST /{bucket}/{key}?complete=uploadId.
+func handleCompleteMultipart(ls storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
 		vars := mux.Vars(req)
-		bucket := vars["bucket"]
-		key := vars["rest"]
-		q := req.URL.Query()
-		if uploadID := q.Get("complete"); uploadID != "" && req.Method == http.MethodPost {
-			var meta storage.Metadata
-			if m := req.Header.Get("X-Meta-JSON"); m != "" {
-				_ = json.Unmarshal([]byte(m), &meta)
-			}
-			if err := ls.CompleteMultipart(req.Context(), bucket, key, uploadID, meta); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			w.WriteHeader(http.StatusOK)
+		var meta storage.Metadata
+		if m := req.Header.Get("X-Meta-JSON"); m != "" {
+			_ = json.Unmarshal([]byte(m), &meta)
+		}
+		var body completeRequest
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil && err != io.EOF {
+			writeError(w, req, badRequest("invalid complete request body: "+err.Error()))
 			return
 		}
-		if uploadID := q.Get("abort"); uploadID != "" && req.Method == http.MethodDelete {
-			if err := ls.AbortMultipart(req.Context(), bucket, key, uploadID); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			w.WriteHeader(http.StatusNoContent)
+		info, err := ls.CompleteMultipart(req.Context(), vars["bucket"], vars["rest"], req.URL.Query().Get("complete"), body.Parts, meta)
+		if err != nil {
+			writeError(w, req, err)
 			return
 		}
-		// Let other handlers process if not multipart control.
-	}).Methods(http.MethodPost, http.MethodDelete)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", quoteETag(info.ETag))
+		json.NewEncoder(w).Encode(info)
+	}
+}
+
+// handleAbortMultipart serves DELETE /{bucket}/{key}?abort=uploadId.
+func handleAbortMultipart(ls storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+		if err := ls.AbortMultipart(req.Context(), vars["bucket"], vars["rest"], req.URL.Query().Get("abort")); err != nil {
+			writeError(w, req, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// initiator identifies who started a multipart upload: the authenticated
+// user, or the client address of anonymous requests.
+func initiator(req *http.Request) string {
+	if id, ok := storage.IdentityFromContext(req.Context()); ok {
+		return id.User
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
 }
@@ -1,18 +1,32 @@
 package server
 
 import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"hash/crc32"
 	"io"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 
 	"github.com/garder500/holydb/pkg/storage"
 	"github.com/gorilla/mux"
 )
 
-// RegisterObjectHandlers registers handlers for object-level operations: PUT/GET/DELETE /{bucket}/{key...}
-func RegisterObjectHandlers(r *mux.Router, ls storage.Storage) {
-	r.HandleFunc("/{bucket}/{rest:.*}", func(w http.ResponseWriter, req *http.Request) {
+// handleObject serves the object-level operations: PUT/GET/HEAD/DELETE /{bucket}/{key...}
+// GET and HEAD honour Range, If-Match, If-None-Match, If-Modified-Since and If-Unmodified-Since.
+// ?versionId= reads (GET) or permanently deletes (DELETE) a specific version.
+// A PUT with an X-Copy-Source header copies an existing object server-side.
+// Multipart calls are routed to their own handlers by query parameter; a POST
+// without ?uploads or ?complete= is rejected.
+func handleObject(ls storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
 		vars := mux.Vars(req)
 		bucket := vars["bucket"]
 		key := vars["rest"]
@@ -23,10 +37,17 @@ func RegisterObjectHandlers(r *mux.Router, ls storage.Storage) {
 			partNum := q.Get("partNumber")
 			if uploadID != "" && partNum != "" { // multipart part upload
 				pn, _ := strconv.Atoi(partNum)
-				if err := ls.UploadPart(req.Context(), bucket, key, uploadID, pn, req.Body); err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
+				body, err := verifiedBody(req)
+				if err != nil {
+					writeError(w, req, err)
 					return
 				}
+				part, err := ls.UploadPart(req.Context(), bucket, key, uploadID, pn, body)
+				if err != nil {
+					writeError(w, req, err)
+					return
+				}
+				w.Header().Set("ETag", quoteETag(part.ETag))
 				w.WriteHeader(http.StatusOK)
 				return
 			}
@@ -34,27 +55,260 @@ func RegisterObjectHandlers(r *mux.Router, ls storage.Storage) {
 			if m := req.Header.Get("X-Meta-JSON"); m != "" {
 				_ = json.Unmarshal([]byte(m), &meta)
 			}
-			if err := ls.PutWithMetadata(req.Context(), bucket, key, req.Body, meta); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+			if ct := req.Header.Get("Content-Type"); ct != "" && meta[storage.MetaContentType] == "" {
+				if meta == nil {
+					meta = storage.Metadata{}
+				}
+				meta[storage.MetaContentType] = ct
+			}
+			if src := req.Header.Get("X-Copy-Source"); src != "" {
+				copyObject(w, req, ls, bucket, key, src, meta)
 				return
 			}
-			w.WriteHeader(http.StatusCreated)
-		case http.MethodGet:
-			rc, err := ls.Get(req.Context(), bucket, key)
+			body, err := verifiedBody(req)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusNotFound)
+				writeError(w, req, err)
 				return
 			}
-			defer rc.Close()
-			io.Copy(w, rc)
+			info, err := ls.PutWithMetadata(req.Context(), bucket, key, body, meta)
+			if err != nil {
+				writeError(w, req, err)
+				return
+			}
+			if info.ETag != "" {
+				w.Header().Set("ETag", quoteETag(info.ETag))
+			}
+			if info.VersionID != "" {
+				w.Header().Set("X-Version-Id", info.VersionID)
+			}
+			setEncryptionHeaders(w.Header(), info)
+			w.WriteHeader(http.StatusCreated)
+		case http.MethodGet, http.MethodHead:
+			if vid := req.URL.Query().Get("versionId"); vid != "" {
+				serveVersion(w, req, ls, bucket, key, vid)
+				return
+			}
+			serveObject(w, req, ls, bucket, key)
 		case http.MethodDelete:
-			if err := ls.Delete(req.Context(), bucket, key); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+			var err error
+			if vid := req.URL.Query().Get("versionId"); vid != "" {
+				err = ls.DeleteVersion(req.Context(), bucket, key, vid)
+			} else {
+				err = ls.Delete(req.Context(), bucket, key)
+			}
+			if err != nil {
+				writeError(w, req, err)
 				return
 			}
 			w.WriteHeader(http.StatusNoContent)
+		case http.MethodPost:
+			writeError(w, req, badRequest("POST on an object requires ?uploads or ?complete=uploadId"))
 		default:
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			writeError(w, req, errMethodNotAllowed)
+		}
+	}
+}
+
+// serveObject writes an object with its ETag, Last-Modified, Content-Type
+// and Content-Length. http.ServeContent takes care of HEAD, byte ranges and
+// conditional requests; the object is read through Storage.GetRange so only
+// the requested bytes are read from disk.
+func serveObject(w http.ResponseWriter, req *http.Request, ls storage.Storage, bucket, key string) {
+	info, err := ls.Stat(req.Context(), bucket, key)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	setObjectHeaders(w, info)
+	content := &objectReader{ctx: req.Context(), ls: ls, bucket: bucket, key: key, size: info.Size}
+	defer content.Close()
+	http.ServeContent(w, req, "", info.LastModified, content)
+}
+
+// serveVersion writes a specific object version like serveObject: ranges
+// and conditional requests are handled by http.ServeContent, and ranges are
+// read through Storage.GetVersionRange.
+func serveVersion(w http.ResponseWriter, req *http.Request, ls storage.Storage, bucket, key, versionID string) {
+	rc, info, err := ls.GetVersion(req.Context(), bucket, key, versionID)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	setObjectHeaders(w, info)
+	content := &objectReader{ctx: req.Context(), ls: ls, bucket: bucket, key: key, versionID: versionID, size: info.Size, rc: rc}
+	defer content.Close()
+	http.ServeContent(w, req, "", info.LastModified, content)
+}
+
+// setObjectHeaders sets the ETag, checksum, version, encryption and content type headers of an object response.
+func setObjectHeaders(w http.ResponseWriter, info storage.ObjectInfo) {
+	h := w.Header()
+	if info.ETag != "" {
+		h.Set("ETag", quoteETag(info.ETag))
+	}
+	if info.Checksums.SHA256 != "" {
+		h.Set("X-Checksum-SHA256", info.Checksums.SHA256)
+	}
+	if info.VersionID != "" {
+		h.Set("X-Version-Id", info.VersionID)
+	}
+	setEncryptionHeaders(h, info)
+	// set explicitly so ServeContent does not read the object to sniff it
+	contentType := info.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	h.Set("Content-Type", contentType)
+}
+
+// objectReader adapts Storage.GetRange (or GetVersionRange when versionID
+// is set) to the io.ReadSeeker expected by http.ServeContent. Seeks only
+// move the offset; the next Read opens a new range reader if the current
+// one, which may be given up front, is not at that offset.
+type objectReader struct {
+	ctx       context.Context
+	ls        storage.Storage
+	bucket    string
+	key       string
+	versionID string
+	size      int64
+	off       int64
+	pos       int64 // offset of rc
+	rc        io.ReadCloser
+}
+
+func (o *objectReader) Read(p []byte) (int, error) {
+	if o.off >= o.size {
+		return 0, io.EOF
+	}
+	if o.rc != nil && o.pos != o.off {
+		o.Close()
+	}
+	if o.rc == nil {
+		var rc io.ReadCloser
+		var err error
+		if o.versionID != "" {
+			rc, err = o.ls.GetVersionRange(o.ctx, o.bucket, o.key, o.versionID, o.off, -1)
+		} else {
+			rc, err = o.ls.GetRange(o.ctx, o.bucket, o.key, o.off, -1)
+		}
+		if err != nil {
+			return 0, err
+		}
+		o.rc, o.pos = rc, o.off
+	}
+	n, err := o.rc.Read(p)
+	o.off += int64(n)
+	o.pos = o.off
+	return n, err
+}
+
+func (o *objectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += o.off
+	case io.SeekEnd:
+		offset += o.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before start of object")
+	}
+	o.off = offset
+	return offset, nil
+}
+
+func (o *objectReader) Close() error {
+	if o.rc == nil {
+		return nil
+	}
+	err := o.rc.Close()
+	o.rc = nil
+	return err
+}
+
+// quoteETag formats an ETag for the ETag response header.
+func quoteETag(etag string) string { return `"` + etag + `"` }
+
+// verifiedBody wraps the request body so that the upload fails with
+// storage.ErrBadDigest when it does not match the Content-MD5,
+// X-Checksum-SHA256 or X-Checksum-CRC32C request headers. Content-MD5 is
+// base64 as in RFC 1864; the X-Checksum headers accept base64 or hex.
+// The Content-Length, when known, is passed on so bucket quotas can reject
+// oversized uploads before the body is read.
+func verifiedBody(req *http.Request) (io.Reader, error) {
+	var want storage.Checksums
+	for _, h := range []struct {
+		header string
+		size   int
+		dst    *string
+		hexOK  bool
+	}{
+		{"Content-MD5", md5.Size, &want.MD5, false},
+		{"X-Checksum-SHA256", sha256.Size, &want.SHA256, true},
+		{"X-Checksum-CRC32C", crc32.Size, &want.CRC32C, true},
+	} {
+		v := req.Header.Get(h.header)
+		if v == "" {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(v)
+		if (err != nil || len(b) != h.size) && h.hexOK {
+			b, err = hex.DecodeString(v)
+		}
+		if err != nil || len(b) != h.size {
+			return nil, badRequest("malformed " + h.header + " header")
+		}
+		*h.dst = hex.EncodeToString(b)
+	}
+	return storage.WithSize(storage.NewVerifyingReader(req.Body, want), req.ContentLength), nil
+}
+
+// copyObject handles a PUT carrying X-Copy-Source: /{bucket}/{key}[?versionId=...]
+// (URL-encoded). X-Metadata-Directive: REPLACE stores the request's metadata
+// instead of the source's.
+func copyObject(w http.ResponseWriter, req *http.Request, ls storage.Storage, bucket, key, source string, meta storage.Metadata) {
+	srcBucket, srcKey, versionID, err := parseCopySource(source)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	opts := storage.CopyOptions{
+		SourceVersionID:   versionID,
+		MetadataDirective: strings.ToUpper(req.Header.Get("X-Metadata-Directive")),
+		Metadata:          meta,
+	}
+	info, err := ls.Copy(req.Context(), srcBucket, srcKey, bucket, key, opts)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", quoteETag(info.ETag))
+	if info.VersionID != "" {
+		w.Header().Set("X-Version-Id", info.VersionID)
+	}
+	setEncryptionHeaders(w.Header(), info)
+	json.NewEncoder(w).Encode(info)
+}
+
+// parseCopySource splits an X-Copy-Source header into bucket, key and
+// optional version ID.
+func parseCopySource(source string) (bucket, key, versionID string, err error) {
+	path, query, _ := strings.Cut(source, "?")
+	if query != "" {
+		q, err := url.ParseQuery(query)
+		if err != nil {
+			return "", "", "", badRequest("invalid X-Copy-Source query")
 		}
-	}).Methods(http.MethodPut, http.MethodGet, http.MethodDelete)
+		versionID = q.Get("versionId")
+	}
+	path, err = url.PathUnescape(strings.TrimPrefix(path, "/"))
+	if err != nil {
+		return "", "", "", badRequest("invalid X-Copy-Source encoding")
+	}
+	bucket, key, ok := strings.Cut(path, "/")
+	if !ok || bucket == "" || key == "" {
+		return "", "", "", badRequest("X-Copy-Source must be /{bucket}/{key}")
+	}
+	return bucket, key, versionID, nil
 }
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/garder500/holydb/pkg/storage"
+	"github.com/gorilla/mux"
+)
+
+// handlePolicy handles the bucket access policy /{bucket}/_policy. GET
+// returns the policy, PUT replaces it and DELETE removes it. Policies are
+// only enforced when the server authenticates requests.
+func handlePolicy(ls storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		bucket := mux.Vars(req)["bucket"]
+		switch req.Method {
+		case http.MethodGet:
+			p, err := ls.GetBucketPolicy(req.Context(), bucket)
+			if err != nil {
+				writeError(w, req, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(p)
+		case http.MethodPut:
+			var p storage.BucketPolicy
+			dec := json.NewDecoder(req.Body)
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&p); err != nil {
+				writeError(w, req, badRequest("invalid bucket policy: "+err.Error()))
+				return
+			}
+			if err := ls.PutBucketPolicy(req.Context(), bucket, p); err != nil {
+				writeError(w, req, err)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		case http.MethodDelete:
+			if err := ls.DeleteBucketPolicy(req.Context(), bucket); err != nil {
+				writeError(w, req, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeError(w, req, errMethodNotAllowed)
+		}
+	}
+}
@@ -1,33 +1,131 @@
 package server
 
 import (
+	"errors"
+	"io/fs"
+	"mime"
 	"net/http"
+	"os"
+	"path"
+	"path/filepath"
 	"strings"
 
 	"github.com/garder500/holydb/pkg/storage"
 	"github.com/gorilla/mux"
 )
 
-// RegisterReconstructHandlers registers /{bucket}/_reconstruct/{key...}
-func RegisterReconstructHandlers(r *mux.Router, ls storage.Storage) {
-	r.HandleFunc("/{bucket}/_reconstruct/{rest:.*}", func(w http.ResponseWriter, req *http.Request) {
-		vars := mux.Vars(req)
-		bucket := vars["bucket"]
-		key := vars["rest"]
-		out := req.URL.Query().Get("out")
-		include := req.URL.Query().Get("include")
-		var includeKeys []string
-		if include != "" {
-			includeKeys = strings.Split(include, ",")
+// handleReconstruct serves /{bucket}/_reconstruct/{key...}.
+// GET streams the reconstructed file (the container described at storage.ContainerVersion, with
+// the metadata keys listed in ?include=a,b) as an attachment.
+// POST ?out=relative/path writes it to a new file under exportDir instead; it is refused when
+// exportDir is empty.
+func handleReconstruct(ls storage.Storage, exportDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+			reconstructDownload(w, req, ls)
+		case http.MethodPost:
+			reconstructExport(w, req, ls, exportDir)
+		default:
+			writeError(w, req, errMethodNotAllowed)
 		}
-		if out == "" {
-			http.Error(w, "missing out param", http.StatusBadRequest)
-			return
-		}
-		if err := ls.Reconstruct(req.Context(), bucket, key, out, includeKeys); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+	}
+}
+
+// reconstructDownload streams the reconstructed file to the client.
+func reconstructDownload(w http.ResponseWriter, req *http.Request, ls storage.Storage) {
+	vars := mux.Vars(req)
+	bucket := vars["bucket"]
+	key := vars["rest"]
+	meta, err := ls.GetMetadata(req.Context(), bucket, key)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	name := meta["filename"]
+	if name == "" {
+		name = path.Base(key)
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	if err := ls.ReconstructTo(req.Context(), bucket, key, w, includeKeys(req)); err != nil {
+		// nothing was written if the object vanished meanwhile; otherwise
+		// the client sees a truncated body
+		w.Header().Del("Content-Disposition")
+		writeError(w, req, err)
+	}
+}
+
+// reconstructExport writes the reconstructed file to a new file under
+// exportDir.
+func reconstructExport(w http.ResponseWriter, req *http.Request, ls storage.Storage, exportDir string) {
+	vars := mux.Vars(req)
+	if exportDir == "" {
+		writeError(w, req, accessDenied("server-side export is disabled; use GET to download the reconstructed file"))
+		return
+	}
+	out := req.URL.Query().Get("out")
+	if out == "" {
+		writeError(w, req, badRequest("missing out param"))
+		return
+	}
+	if !filepath.IsLocal(out) {
+		writeError(w, req, badRequest("out must be a relative path inside the export directory"))
+		return
+	}
+	if err := os.MkdirAll(exportDir, 0o755); err != nil {
+		writeError(w, req, err)
+		return
+	}
+	root, err := os.OpenRoot(exportDir)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	defer root.Close()
+	f, err := createExportFile(root, out)
+	switch {
+	case errors.Is(err, fs.ErrExist):
+		writeError(w, req, &apiError{status: http.StatusConflict, code: "FileExists", message: "out already exists in the export directory"})
+		return
+	case err != nil:
+		// also a path leaving the export directory through a symbolic link
+		writeError(w, req, badRequest("out must name a new file inside the export directory"))
+		return
+	}
+	err = ls.ReconstructTo(req.Context(), vars["bucket"], vars["rest"], f, includeKeys(req))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		root.Remove(out)
+		writeError(w, req, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// createExportFile creates out and its missing parent directories in root.
+// Going through an os.Root, neither ".." nor a symbolic link can lead
+// outside the export directory, and an existing file is never replaced.
+func createExportFile(root *os.Root, out string) (*os.File, error) {
+	if dir := filepath.Dir(out); dir != "." {
+		parent := ""
+		for _, elem := range strings.Split(dir, string(filepath.Separator)) {
+			parent = filepath.Join(parent, elem)
+			if err := root.Mkdir(parent, 0o755); err != nil && !errors.Is(err, fs.ErrExist) {
+				return nil, err
+			}
 		}
-		w.WriteHeader(http.StatusOK)
-	}).Methods(http.MethodPost)
+	}
+	return root.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+}
+
+// includeKeys returns the metadata keys listed in ?include=.
+func includeKeys(req *http.Request) []string {
+	include := req.URL.Query().Get("include")
+	if include == "" {
+		return nil
+	}
+	return strings.Split(include, ",")
 }
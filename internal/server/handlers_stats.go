@@ -8,16 +8,20 @@ import (
 	"github.com/gorilla/mux"
 )
 
-// RegisterStatsHandlers registers bucket stats endpoint /{bucket}/_stats
-func RegisterStatsHandlers(r *mux.Router, ls storage.Storage) {
-	r.HandleFunc("/{bucket}/_stats", func(w http.ResponseWriter, req *http.Request) {
+// handleStats serves the bucket stats endpoint /{bucket}/_stats
+func handleStats(ls storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			writeError(w, req, errMethodNotAllowed)
+			return
+		}
 		vars := mux.Vars(req)
 		bucket := vars["bucket"]
 		st, err := ls.Stats(req.Context(), bucket)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, req, err)
 			return
 		}
 		json.NewEncoder(w).Encode(st)
-	}).Methods(http.MethodGet)
+	}
 }
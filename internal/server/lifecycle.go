@@ -0,0 +1,45 @@
+package server
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/garder500/holydb/pkg/storage"
+)
+
+// lifecycleApplier is implemented by storage backends with lifecycle rules.
+type lifecycleApplier interface {
+	ApplyAllLifecycles(ctx context.Context, dryRun bool) ([]storage.LifecycleReport, error)
+}
+
+// runLifecycle applies the lifecycle rules of every bucket once per
+// interval until ctx is cancelled. In dry-run mode expirations are only logged.
+func runLifecycle(ctx context.Context, logger *log.Logger, ls lifecycleApplier, interval time.Duration, dryRun bool) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		reports, err := ls.ApplyAllLifecycles(ctx, dryRun)
+		if err != nil {
+			logger.Printf("lifecycle: %v", err)
+		}
+		for _, r := range reports {
+			for _, a := range r.Actions {
+				prefix := "lifecycle"
+				if dryRun {
+					prefix = "lifecycle (dry-run)"
+				}
+				if a.Error != "" {
+					logger.Printf("%s: %s %s/%s %s%s rule=%s failed: %s", prefix, a.Action, r.Bucket, a.Key, a.VersionID, a.UploadID, a.Rule, a.Error)
+					continue
+				}
+				logger.Printf("%s: %s %s/%s %s%s rule=%s", prefix, a.Action, r.Bucket, a.Key, a.VersionID, a.UploadID, a.Rule)
+			}
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/garder500/holydb/pkg/storage"
+)
+
+var errPolicyDenied = authError(http.StatusForbidden, "AccessDenied", "access denied by the bucket policy")
+
+// anonymousKey marks the context of a request served without credentials.
+type anonymousKey struct{}
+
+func isAnonymous(ctx context.Context) bool {
+	return ctx.Value(anonymousKey{}) != nil
+}
+
+// policyEvaluator authorizes requests against the policies of their bucket
+// (see storage.BucketPolicy). It runs once the request is authenticated,
+// before any handler.
+type policyEvaluator struct {
+	ls storage.Storage
+}
+
+// authorize checks that the caller of req may perform action on key of
+// bucket; key is the listed prefix for storage.ActionListBucket. Actions
+// outside any bucket, or unknown ("" for methods the handler rejects), only
+// need an authenticated caller. Anonymous callers are denied with
+// errMissingCredentials, so they learn that signing may help.
+func (p *policyEvaluator) authorize(req *http.Request, action, bucket, key string) error {
+	anonymous := isAnonymous(req.Context())
+	denied := errPolicyDenied
+	if anonymous {
+		denied = errMissingCredentials
+	}
+	if bucket == "" || action == "" || action == storage.ActionListBuckets || action == storage.ActionCreateBucket {
+		if anonymous {
+			return denied
+		}
+		return nil
+	}
+	pol, err := p.ls.GetBucketPolicy(req.Context(), bucket)
+	if err != nil {
+		if errors.Is(err, storage.ErrNoSuchBucket) || errors.Is(err, storage.ErrInvalidKey) {
+			// let the handler report it, but not to anonymous callers
+			if anonymous {
+				return denied
+			}
+			return nil
+		}
+		return err
+	}
+
+	id, _ := storage.IdentityFromContext(req.Context())
+	source := sourceAddr(req)
+	allowed := !anonymous && !pol.DefaultDeny
+	if allowed && action == storage.ActionPutBucketPolicy {
+		// the policy guards the bucket: only its owner may replace it
+		// unless a statement lets others
+		if allowed, err = p.ownsBucket(req.Context(), bucket, id, pol); err != nil {
+			return err
+		}
+	}
+	if pol.PublicRead && action == storage.ActionGetObject {
+		allowed = true
+	}
+	for _, st := range pol.Statements {
+		if !statementMatches(st, id, anonymous, source, action, key) {
+			continue
+		}
+		if st.Effect == storage.EffectDeny {
+			return denied
+		}
+		allowed = true
+	}
+	if !allowed {
+		return denied
+	}
+	return nil
+}
+
+// ownsBucket reports whether id owns bucket. Buckets created without
+// authentication have no owner; anyone authenticated may give them their
+// first policy, which then decides who may change it.
+func (p *policyEvaluator) ownsBucket(ctx context.Context, bucket string, id storage.Identity, pol storage.BucketPolicy) (bool, error) {
+	info, err := p.ls.HeadBucket(ctx, bucket)
+	if err != nil {
+		return false, err
+	}
+	if info.Owner == "" {
+		return !pol.PublicRead && !pol.DefaultDeny && len(pol.Statements) == 0, nil
+	}
+	return info.Owner == id.User, nil
+}
+
+// statementMatches reports whether st applies to the caller, action and key.
+// For ListBucket, key is the listed prefix: an allow statement must cover
+// it, while a deny statement also matches shorter prefixes whose listing
+// would include the resources it protects.
+func statementMatches(st storage.PolicyStatement, id storage.Identity, anonymous bool, source netip.Addr, action, key string) bool {
+	principal := false
+	for _, p := range st.Principals {
+		principal = principal || p == "*" || (!anonymous && p != "" && (p == id.User || p == id.AccessKey))
+	}
+	if !principal {
+		return false
+	}
+	matched := false
+	for _, a := range st.Actions {
+		matched = matched || a == action || a == "storage:*"
+	}
+	if !matched {
+		return false
+	}
+	if len(st.Resources) > 0 {
+		if !storage.IsObjectAction(action) && action != storage.ActionListBucket {
+			return false
+		}
+		matched = false
+		listDeny := action == storage.ActionListBucket && st.Effect == storage.EffectDeny
+		for _, r := range st.Resources {
+			prefix := strings.TrimSuffix(r, "*")
+			matched = matched || strings.HasPrefix(key, prefix) || (listDeny && strings.HasPrefix(prefix, key))
+		}
+		if !matched {
+			return false
+		}
+	}
+	if c := st.Condition; c != nil {
+		if len(c.SourceIP) > 0 && !inRanges(source, c.SourceIP) {
+			return false
+		}
+		if inRanges(source, c.NotSourceIP) {
+			return false
+		}
+	}
+	return true
+}
+
+// sourceAddr returns the address of the client that sent req. Forwarding
+// headers are not trusted.
+func sourceAddr(req *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	a, _ := netip.ParseAddr(host)
+	return a.Unmap()
+}
+
+func inRanges(a netip.Addr, ranges []string) bool {
+	if !a.IsValid() {
+		return false
+	}
+	for _, r := range ranges {
+		if p, err := storage.ParseSourceIP(r); err == nil && p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// copySource returns the bucket and key named by a copy source header, for
+// authorizing the read of the source; ok is false when the header is absent
+// or malformed, which the handler reports.
+func copySource(header string) (bucket, key string, ok bool) {
+	if header == "" {
+		return "", "", false
+	}
+	bucket, key, _, err := parseCopySource(header)
+	return bucket, key, err == nil
+}
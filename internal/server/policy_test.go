@@ -0,0 +1,135 @@
+package server
+
+import (
+	"encoding/xml"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBucketPolicy(t *testing.T) {
+	alice := Credential{AccessKey: "AKALICE", SecretKey: "alice-secret", User: "alice"}
+	bob := Credential{AccessKey: "AKBOB", SecretKey: "bob-secret", User: "bob"}
+	srv := New(WithRoot(t.TempDir()), WithLogger(log.New(io.Discard, "", 0)), WithS3("", ""),
+		WithAuth(NewSigV4Authenticator(staticCredentials{"AKALICE": alice, "AKBOB": bob})))
+	// do sends a request from addr, signed for cred unless it is nil
+	do := func(h http.Handler, cred *Credential, method, target, body, addr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if addr != "" {
+			req.RemoteAddr = addr
+		}
+		if cred != nil {
+			signV4(req, *cred, body, time.Now())
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	expect := func(rec *httptest.ResponseRecorder, status int, what string) {
+		t.Helper()
+		if rec.Code != status {
+			t.Fatalf("%s: %d %s, want %d", what, rec.Code, rec.Body, status)
+		}
+	}
+
+	expect(do(srv, &alice, http.MethodPut, "/v1/storage/assets", "", ""), http.StatusCreated, "create bucket")
+	expect(do(srv, &alice, http.MethodPut, "/v1/storage/assets/site/index.html", "<h1>hi</h1>", ""), http.StatusCreated, "upload")
+	// without a policy, anonymous callers get nothing and authenticated ones everything
+	expect(do(srv, nil, http.MethodGet, "/v1/storage/assets/site/index.html", "", ""), http.StatusForbidden, "anonymous read without policy")
+	expect(do(srv, &bob, http.MethodGet, "/v1/storage/assets/site/index.html", "", ""), http.StatusOK, "bob read without policy")
+
+	expect(do(srv, &alice, http.MethodPut, "/v1/storage/assets/_policy", `{"statements":[{"effect":"allow","principals":["*"],"actions":["storage:Fly"]}]}`, ""),
+		http.StatusBadRequest, "invalid policy")
+	policy := `{"public_read":true,"statements":[
+		{"effect":"deny","principals":["bob"],"actions":["storage:DeleteObject","storage:PutBucketPolicy"]},
+		{"effect":"allow","principals":["*"],"actions":["storage:PutObject"],"resources":["inbox/*"],"condition":{"source_ip":["192.0.2.0/24"]}}
+	]}`
+	expect(do(srv, &alice, http.MethodPut, "/v1/storage/assets/_policy", policy, ""), http.StatusOK, "put policy")
+
+	rec := do(srv, nil, http.MethodGet, "/v1/storage/assets/site/index.html", "", "")
+	if rec.Code != http.StatusOK || rec.Body.String() != "<h1>hi</h1>" {
+		t.Fatalf("public read: %d %s", rec.Code, rec.Body)
+	}
+	expect(do(srv, nil, http.MethodGet, "/v1/storage/assets", "", ""), http.StatusForbidden, "anonymous listing")
+	expect(do(srv, nil, http.MethodGet, "/v1/storage/assets/_policy", "", ""), http.StatusForbidden, "anonymous policy read")
+	expect(do(srv, nil, http.MethodPut, "/v1/storage/assets/inbox/drop.txt", "x", "192.0.2.7:4000"), http.StatusCreated, "anonymous drop")
+	expect(do(srv, nil, http.MethodPut, "/v1/storage/assets/inbox/drop.txt", "x", "203.0.113.5:4000"), http.StatusForbidden, "drop from outside")
+	expect(do(srv, nil, http.MethodPut, "/v1/storage/assets/site/index.html", "x", "192.0.2.7:4000"), http.StatusForbidden, "anonymous overwrite")
+	rec = do(srv, &bob, http.MethodDelete, "/v1/storage/assets/site/index.html", "", "")
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "bucket policy") {
+		t.Fatalf("bob delete: %d %s", rec.Code, rec.Body)
+	}
+	expect(do(srv, &bob, http.MethodDelete, "/v1/storage/assets/_policy", "", ""), http.StatusForbidden, "bob policy delete")
+	expect(do(srv, &bob, http.MethodPut, "/v1/storage/assets/site/about.html", "about", ""), http.StatusCreated, "bob upload")
+	// copying needs read access to the source
+	expect(do(srv, &alice, http.MethodPut, "/v1/storage/private", "", ""), http.StatusCreated, "create private bucket")
+	expect(do(srv, &alice, http.MethodPut, "/v1/storage/private/secret", "s", ""), http.StatusCreated, "private upload")
+	expect(do(srv, &alice, http.MethodPut, "/v1/storage/private/_policy", `{"default_deny":true,"statements":[{"effect":"allow","principals":["alice"],"actions":["storage:*"]}]}`, ""),
+		http.StatusOK, "private policy")
+	req := httptest.NewRequest(http.MethodPut, "/v1/storage/assets/site/stolen", nil)
+	req.Header.Set("X-Copy-Source", "/private/secret")
+	signV4(req, bob, "", time.Now())
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+	expect(rec, http.StatusForbidden, "bob copy from private")
+	expect(do(srv, &bob, http.MethodGet, "/v1/storage/private?prefix=s", "", ""), http.StatusForbidden, "bob listing private")
+	expect(do(srv, &alice, http.MethodGet, "/v1/storage/private?prefix=s", "", ""), http.StatusOK, "alice listing private")
+
+	// running the lifecycle rules deletes objects, and exporting writes to
+	// the server's disk: reading is not enough for either
+	expect(do(srv, &alice, http.MethodPut, "/v1/storage/assets/_lifecycle", `{"rules":[{"id":"tmp","prefix":"tmp/","expiration_days":1}]}`, ""),
+		http.StatusOK, "put lifecycle")
+	expect(do(srv, &bob, http.MethodPost, "/v1/storage/assets/_lifecycle?run", "", ""), http.StatusForbidden, "bob lifecycle run")
+	expect(do(srv, &alice, http.MethodPost, "/v1/storage/assets/_lifecycle?run", "", ""), http.StatusOK, "alice lifecycle run")
+	expect(do(srv, nil, http.MethodGet, "/v1/storage/assets/_reconstruct/site/index.html", "", ""), http.StatusOK, "anonymous reconstruct download")
+	expect(do(srv, nil, http.MethodPost, "/v1/storage/assets/_reconstruct/site/index.html?out=x", "", ""), http.StatusForbidden, "anonymous export")
+	expect(do(srv, &alice, http.MethodPut, "/v1/storage/readers", "", ""), http.StatusCreated, "create readers bucket")
+	expect(do(srv, &alice, http.MethodPut, "/v1/storage/readers/doc", "d", ""), http.StatusCreated, "readers upload")
+	expect(do(srv, &alice, http.MethodPut, "/v1/storage/readers/_policy", `{"default_deny":true,"statements":[
+		{"effect":"allow","principals":["alice"],"actions":["storage:*"]},
+		{"effect":"allow","principals":["bob"],"actions":["storage:GetObject"]}]}`, ""), http.StatusOK, "readers policy")
+	expect(do(srv, &bob, http.MethodGet, "/v1/storage/readers/doc", "", ""), http.StatusOK, "bob read")
+	expect(do(srv, &bob, http.MethodPost, "/v1/storage/readers/_reconstruct/doc?out=x", "", ""), http.StatusForbidden, "bob export with GetObject only")
+	rec = do(srv, &alice, http.MethodPost, "/v1/storage/readers/_reconstruct/doc?out=x", "", "")
+	if rec.Code != http.StatusForbidden || strings.Contains(rec.Body.String(), "bucket policy") {
+		t.Fatalf("alice export without an export directory: %d %s", rec.Code, rec.Body)
+	}
+
+	// only the owner of a bucket may replace or remove its policy, unless
+	// the policy lets others
+	expect(do(srv, &bob, http.MethodPut, "/v1/storage/readers/_policy", `{}`, ""), http.StatusForbidden, "bob overwriting alice's policy")
+	expect(do(srv, &alice, http.MethodPut, "/v1/storage/owned", "", ""), http.StatusCreated, "create owned bucket")
+	expect(do(srv, &bob, http.MethodPut, "/v1/storage/owned/_policy", `{"statements":[{"effect":"deny","principals":["alice"],"actions":["storage:*"]}]}`, ""),
+		http.StatusForbidden, "bob putting a policy on alice's bucket")
+	expect(do(srv, &alice, http.MethodPut, "/v1/storage/owned/_policy", `{"statements":[{"effect":"allow","principals":["bob"],"actions":["storage:PutBucketPolicy"]}]}`, ""),
+		http.StatusOK, "alice delegating the policy")
+	expect(do(srv, &bob, http.MethodDelete, "/v1/storage/owned/_policy", "", ""), http.StatusNoContent, "bob removing a delegated policy")
+	expect(do(srv, &bob, http.MethodPut, "/v1/storage/owned/_policy", `{}`, ""), http.StatusForbidden, "bob once the delegation is gone")
+
+	// a listing denied under a prefix is denied for every shorter prefix
+	expect(do(srv, &alice, http.MethodPut, "/v1/storage/vault", "", ""), http.StatusCreated, "create vault")
+	expect(do(srv, &alice, http.MethodPut, "/v1/storage/vault/secret/plans", "p", ""), http.StatusCreated, "vault upload")
+	expect(do(srv, &alice, http.MethodPut, "/v1/storage/vault/_policy", `{"statements":[
+		{"effect":"deny","principals":["bob"],"actions":["storage:ListBucket"],"resources":["secret/*"]}]}`, ""), http.StatusOK, "vault policy")
+	for _, target := range []string{"/vault", "/vault?prefix=", "/vault?prefix=sec", "/vault?prefix=secret/p", "/vault?versions", "/vault?uploads&prefix=s"} {
+		expect(do(srv, &bob, http.MethodGet, "/v1/storage"+target, "", ""), http.StatusForbidden, "bob listing "+target)
+	}
+	expect(do(srv, &bob, http.MethodGet, "/v1/storage/vault?prefix=public/", "", ""), http.StatusOK, "bob listing another prefix")
+	expect(do(srv.S3Handler(), &bob, http.MethodGet, "/vault?list-type=2", "", ""), http.StatusForbidden, "bob listing vault over S3")
+
+	// the S3 frontend enforces the same policies
+	rec = do(srv.S3Handler(), nil, http.MethodGet, "/assets/site/index.html", "", "")
+	if rec.Code != http.StatusOK || rec.Body.String() != "<h1>hi</h1>" {
+		t.Fatalf("S3 public read: %d %s", rec.Code, rec.Body)
+	}
+	expect(do(srv.S3Handler(), nil, http.MethodGet, "/private/secret", "", ""), http.StatusForbidden, "S3 anonymous private read")
+	rec = do(srv.S3Handler(), &bob, http.MethodPost, "/assets?delete", `<Delete><Object><Key>site/index.html</Key></Object></Delete>`, "")
+	var dr s3DeleteResult
+	if err := xml.Unmarshal(rec.Body.Bytes(), &dr); err != nil || len(dr.Errors) != 1 || dr.Errors[0].Code != "AccessDenied" {
+		t.Fatalf("S3 DeleteObjects by bob: %d %s", rec.Code, rec.Body)
+	}
+}
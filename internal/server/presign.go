@@ -0,0 +1,121 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultPresignExpires is how long a presigned URL stays valid when
+// PresignOptions.Expires is zero.
+const DefaultPresignExpires = 15 * time.Minute
+
+// PresignOptions describes the one request a presigned URL allows.
+type PresignOptions struct {
+	// Method is the HTTP method of the request; GET when empty.
+	Method string
+	// Expires is how long the URL stays valid, at most 7 days.
+	Expires time.Duration
+	// ContentLength, when positive, is the exact size of the request body.
+	ContentLength int64
+	// ContentType, when set, is the Content-Type the request must carry.
+	ContentType string
+	// Region of the credential scope; us-east-1 when empty. The server does
+	// not check it, but S3 clients of the URL may.
+	Region string
+	// Time is the signing time; now when zero.
+	Time time.Time
+}
+
+// Presign returns rawURL signed for cred with AWS Signature V4 query
+// parameters, so that whoever holds the URL can make the request described
+// by opts without credentials until it expires. The method, the host and,
+// when set, the content length and type are signed: a request changing any
+// of them fails with SignatureDoesNotMatch. The body itself is not signed.
+func Presign(cred Credential, rawURL string, opts PresignOptions) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return "", fmt.Errorf("presign: %q is not an absolute URL", rawURL)
+	}
+	if cred.AccessKey == "" || cred.SecretKey == "" {
+		return "", errors.New("presign: the credential has no access or secret key")
+	}
+	method := strings.ToUpper(opts.Method)
+	if method == "" {
+		method = http.MethodGet
+	}
+	expires := opts.Expires
+	if expires == 0 {
+		expires = DefaultPresignExpires
+	}
+	if expires < time.Second || expires > sigV4MaxExpires {
+		return "", fmt.Errorf("presign: expiry must be between 1s and %s", sigV4MaxExpires)
+	}
+	region := opts.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	now := opts.Time
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	amzDate := now.UTC().Format(amzDateFormat)
+	sr := &sigV4Request{
+		scope:         amzDate[:8] + "/" + region + "/s3/aws4_request",
+		signedHeaders: []string{"host"},
+		amzDate:       amzDate,
+		payloadHash:   unsignedPayload,
+	}
+	header := http.Header{}
+	if opts.ContentLength > 0 {
+		header.Set("Content-Length", strconv.FormatInt(opts.ContentLength, 10))
+		sr.signedHeaders = append(sr.signedHeaders, "content-length")
+	}
+	if opts.ContentType != "" {
+		header.Set("Content-Type", opts.ContentType)
+		sr.signedHeaders = append(sr.signedHeaders, "content-type")
+	}
+	sort.Strings(sr.signedHeaders)
+
+	q := u.Query()
+	q.Set("X-Amz-Algorithm", sigV4Algorithm)
+	q.Set("X-Amz-Credential", cred.AccessKey+"/"+sr.scope)
+	q.Set("X-Amz-Date", amzDate)
+	q.Set("X-Amz-Expires", strconv.Itoa(int(expires/time.Second)))
+	q.Set("X-Amz-SignedHeaders", strings.Join(sr.signedHeaders, ";"))
+	q.Del("X-Amz-Signature")
+	u.RawQuery = q.Encode()
+
+	req := &http.Request{Method: method, URL: u, Host: u.Host, Header: header}
+	sig := sr.sign(sigV4SigningKey(cred.SecretKey, sr.scope), req)
+	u.RawQuery += "&X-Amz-Signature=" + sig
+	return u.String(), nil
+}
+
+// ObjectURL returns the URL of an object in the native API of the server at
+// endpoint, e.g. http://localhost:8080/v1/storage/photos/2024/cat.jpg.
+func ObjectURL(endpoint, bucket, key string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return "", fmt.Errorf("endpoint %q must be an absolute URL such as http://localhost:8080", endpoint)
+	}
+	if bucket == "" || key == "" {
+		return "", errors.New("bucket and key must not be empty")
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/v1/storage/" + bucket + "/" + key
+	u.RawPath = ""
+	u.RawQuery, u.Fragment = "", ""
+	return u.String(), nil
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPresign(t *testing.T) {
+	cred := Credential{AccessKey: "AK", SecretKey: "secret", User: "alice"}
+	srv := New(WithRoot(t.TempDir()), WithLogger(log.New(io.Discard, "", 0)),
+		WithAuth(NewSigV4Authenticator(staticCredentials{"AK": cred})))
+	do := func(method, target, body, contentType string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		return rec
+	}
+	req := httptest.NewRequest(http.MethodPut, "/v1/storage/photos", nil)
+	signV4(req, cred, "", time.Now())
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create bucket: %d %s", rec.Code, rec.Body)
+	}
+
+	object, err := ObjectURL("http://holydb.test", "photos", "2024/a b.txt")
+	if err != nil || object != "http://holydb.test/v1/storage/photos/2024/a%20b.txt" {
+		t.Fatalf("ObjectURL = %q, %v", object, err)
+	}
+	put, err := Presign(cred, object, PresignOptions{Method: http.MethodPut, ContentLength: 5, ContentType: "text/plain"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct{ body, contentType string }{{"hello!", "text/plain"}, {"hello", "text/html"}, {"hello", ""}} {
+		if rec := do(http.MethodPut, put, c.body, c.contentType); rec.Code != http.StatusForbidden ||
+			!strings.Contains(rec.Body.String(), "SignatureDoesNotMatch") {
+			t.Fatalf("upload of %q as %q: %d %s", c.body, c.contentType, rec.Code, rec.Body)
+		}
+	}
+	if rec := do(http.MethodPut, put, "hello", "text/plain"); rec.Code != http.StatusCreated {
+		t.Fatalf("presigned upload: %d %s", rec.Code, rec.Body)
+	}
+
+	get, err := Presign(cred, object, PresignOptions{Expires: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := do(http.MethodGet, get, "", ""); rec.Code != http.StatusOK || rec.Body.String() != "hello" {
+		t.Fatalf("presigned download: %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodDelete, get, "", ""); rec.Code != http.StatusForbidden {
+		t.Fatalf("DELETE with a GET URL: %d %s", rec.Code, rec.Body)
+	}
+	expired, err := Presign(cred, object, PresignOptions{Expires: time.Minute, Time: time.Now().Add(-2 * time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := do(http.MethodGet, expired, "", ""); rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "expired") {
+		t.Fatalf("expired URL: %d %s", rec.Code, rec.Body)
+	}
+
+	if _, err := Presign(cred, object, PresignOptions{Expires: 8 * 24 * time.Hour}); err == nil {
+		t.Fatal("Presign accepted an expiry over 7 days")
+	}
+}
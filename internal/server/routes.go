@@ -0,0 +1,109 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/garder500/holydb/pkg/storage"
+	"github.com/gorilla/mux"
+)
+
+// route is one entry of the routing table. Routes are matched in table
+// order, so reserved sub-resources and query-selected operations must come
+// before the object catch-all that would otherwise capture them.
+type route struct {
+	name    string
+	methods []string // nil matches every method; the handler rejects the others
+	path    string
+	queries []string // pairs for mux.Route.Queries
+	handler func(s *Server) http.HandlerFunc
+	// actions maps methods to the bucket policy action they perform; other
+	// methods only need an authenticated caller.
+	actions map[string]string
+}
+
+// routes is the routing table of /v1/storage, mirroring contrib/openapi.yaml.
+// The sub-resource path segments (_lifecycle, _stats, _reconstruct,
+// .bucket.meta) are reserved by storage.ParseObjectKey, so no object key can
+// collide with them.
+var routes = []route{
+	{name: "ListBuckets", path: "", handler: func(s *Server) http.HandlerFunc { return handleListBuckets(s.storage) }, actions: listBucketsActions},
+	{name: "ListBucketsSlash", path: "/", handler: func(s *Server) http.HandlerFunc { return handleListBuckets(s.storage) }, actions: listBucketsActions},
+
+	// bucket sub-resources
+	{name: "BucketMetadata", path: "/{bucket}/.bucket.meta", handler: func(s *Server) http.HandlerFunc { return handleBucketMeta(s.storage) },
+		actions: map[string]string{http.MethodGet: storage.ActionGetBucketMetadata, http.MethodPut: storage.ActionPutBucketMetadata}},
+	{name: "Lifecycle", path: "/{bucket}/_lifecycle", handler: func(s *Server) http.HandlerFunc { return handleLifecycle(s.storage) },
+		actions: map[string]string{http.MethodGet: storage.ActionGetBucketMetadata, http.MethodPut: storage.ActionPutBucketMetadata, http.MethodPost: runLifecycleAction}},
+	{name: "Policy", path: "/{bucket}/_policy", handler: func(s *Server) http.HandlerFunc { return handlePolicy(s.storage) },
+		actions: map[string]string{http.MethodGet: storage.ActionGetBucketPolicy, http.MethodPut: storage.ActionPutBucketPolicy, http.MethodDelete: storage.ActionPutBucketPolicy}},
+	{name: "Stats", path: "/{bucket}/_stats", handler: func(s *Server) http.HandlerFunc { return handleStats(s.storage) },
+		actions: map[string]string{http.MethodGet: storage.ActionListBucket}},
+	{name: "Reconstruct", path: "/{bucket}/_reconstruct/{rest:.*}", handler: func(s *Server) http.HandlerFunc { return handleReconstruct(s.storage, s.exportDir) },
+		actions: map[string]string{http.MethodGet: storage.ActionGetObject, http.MethodPost: storage.ActionExportObject}},
+
+	// multipart operations, selected by query parameter on an object
+	{name: "CreateMultipartUpload", methods: []string{http.MethodPost}, path: "/{bucket}/{rest:.*}", queries: []string{"uploads", ""}, handler: func(s *Server) http.HandlerFunc { return handleCreateMultipart(s.storage) }, actions: multipartActions},
+	{name: "CompleteMultipartUpload", methods: []string{http.MethodPost}, path: "/{bucket}/{rest:.*}", queries: []string{"complete", ""}, handler: func(s *Server) http.HandlerFunc { return handleCompleteMultipart(s.storage) }, actions: multipartActions},
+	{name: "ListParts", methods: []string{http.MethodGet}, path: "/{bucket}/{rest:.*}", queries: []string{"uploadId", ""}, handler: func(s *Server) http.HandlerFunc { return handleListParts(s.storage) }, actions: multipartActions},
+	{name: "AbortMultipartUpload", methods: []string{http.MethodDelete}, path: "/{bucket}/{rest:.*}", queries: []string{"abort", ""}, handler: func(s *Server) http.HandlerFunc { return handleAbortMultipart(s.storage) }, actions: multipartActions},
+
+	{name: "Object", path: "/{bucket}/{rest:.*}", handler: func(s *Server) http.HandlerFunc { return handleObject(s.storage) },
+		actions: map[string]string{http.MethodGet: storage.ActionGetObject, http.MethodHead: storage.ActionGetObject, http.MethodPut: storage.ActionPutObject, http.MethodDelete: storage.ActionDeleteObject}},
+	{name: "Bucket", path: "/{bucket}", handler: func(s *Server) http.HandlerFunc { return handleBucket(s.storage) },
+		actions: map[string]string{http.MethodGet: storage.ActionListBucket, http.MethodHead: storage.ActionListBucket, http.MethodPut: storage.ActionCreateBucket, http.MethodDelete: storage.ActionDeleteBucket}},
+}
+
+var (
+	listBucketsActions = map[string]string{http.MethodGet: storage.ActionListBuckets}
+	// running the lifecycle rules deletes objects anywhere in the bucket
+	runLifecycleAction = storage.ActionDeleteObject
+	// the parts of an upload belong to the object being written
+	multipartActions = map[string]string{http.MethodGet: storage.ActionPutObject, http.MethodPost: storage.ActionPutObject, http.MethodDelete: storage.ActionPutObject}
+)
+
+// register adds every entry of the routing table to r.
+func (s *Server) register(r *mux.Router) {
+	for _, rt := range routes {
+		h := rt.handler(s)
+		if s.policies != nil {
+			h = s.authorizeRoute(rt.actions, h)
+		}
+		mr := r.Handle(rt.path, h).Name(rt.name)
+		if rt.methods != nil {
+			mr.Methods(rt.methods...)
+		}
+		if rt.queries != nil {
+			mr.Queries(rt.queries...)
+		}
+	}
+}
+
+// authorizeRoute consults the bucket policies before h: the action of the
+// request method on the routed bucket and key, the read of the source of a
+// copy, and the read of an exported object.
+func (s *Server) authorizeRoute(actions map[string]string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+		action, key := actions[req.Method], vars["rest"]
+		if action == storage.ActionListBucket {
+			key = req.URL.Query().Get("prefix")
+		}
+		if err := s.policies.authorize(req, action, vars["bucket"], key); err != nil {
+			writeError(w, req, err)
+			return
+		}
+		if action == storage.ActionExportObject {
+			if err := s.policies.authorize(req, storage.ActionGetObject, vars["bucket"], key); err != nil {
+				writeError(w, req, err)
+				return
+			}
+		}
+		if srcBucket, srcKey, ok := copySource(req.Header.Get("X-Copy-Source")); ok && action == storage.ActionPutObject {
+			if err := s.policies.authorize(req, storage.ActionGetObject, srcBucket, srcKey); err != nil {
+				writeError(w, req, err)
+				return
+			}
+		}
+		h(w, req)
+	}
+}
@@ -0,0 +1,315 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garder500/holydb/pkg/storage"
+	"github.com/gorilla/mux"
+)
+
+// TestRoutes checks that every operation of contrib/openapi.yaml reaches its
+// intended handler.
+func TestRoutes(t *testing.T) {
+	r := mux.NewRouter()
+	New(WithRoot(t.TempDir())).register(r)
+
+	cases := []struct {
+		method, target, route string
+	}{
+		{http.MethodGet, "", "ListBuckets"},
+		{http.MethodGet, "/", "ListBucketsSlash"},
+
+		{http.MethodPut, "/photos/dir/key.txt", "Object"},
+		{http.MethodPut, "/photos/key.txt?uploadId=u&partNumber=1", "Object"},
+		{http.MethodGet, "/photos/dir/key.txt", "Object"},
+		{http.MethodGet, "/photos/key.txt?versionId=v", "Object"},
+		{http.MethodHead, "/photos/key.txt", "Object"},
+		{http.MethodDelete, "/photos/key.txt", "Object"},
+		{http.MethodDelete, "/photos/key.txt?versionId=v", "Object"},
+		{http.MethodPost, "/photos/key.txt", "Object"},
+
+		{http.MethodPost, "/photos/dir/key.txt?uploads", "CreateMultipartUpload"},
+		{http.MethodPost, "/photos/key.txt?complete=u", "CompleteMultipartUpload"},
+		{http.MethodGet, "/photos/key.txt?uploadId=u", "ListParts"},
+		{http.MethodDelete, "/photos/key.txt?abort=u", "AbortMultipartUpload"},
+
+		{http.MethodPut, "/photos", "Bucket"},
+		{http.MethodHead, "/photos", "Bucket"},
+		{http.MethodDelete, "/photos?force=true", "Bucket"},
+		{http.MethodPost, "/photos?uploads", "Bucket"},
+		{http.MethodGet, "/photos?list-type=2&delimiter=/", "Bucket"},
+		{http.MethodGet, "/photos?versions", "Bucket"},
+		{http.MethodGet, "/photos?uploads", "Bucket"},
+
+		{http.MethodGet, "/photos/.bucket.meta", "BucketMetadata"},
+		{http.MethodPut, "/photos/.bucket.meta", "BucketMetadata"},
+		{http.MethodGet, "/photos/_lifecycle", "Lifecycle"},
+		{http.MethodGet, "/photos/_lifecycle?dryRun", "Lifecycle"},
+		{http.MethodPut, "/photos/_lifecycle", "Lifecycle"},
+		{http.MethodPost, "/photos/_lifecycle?run", "Lifecycle"},
+		{http.MethodGet, "/photos/_policy", "Policy"},
+		{http.MethodPut, "/photos/_policy", "Policy"},
+		{http.MethodDelete, "/photos/_policy", "Policy"},
+		{http.MethodGet, "/photos/_stats", "Stats"},
+		{http.MethodDelete, "/photos/_stats", "Stats"},
+		{http.MethodGet, "/photos/_reconstruct/dir/key.txt?include=a,b", "Reconstruct"},
+		{http.MethodPost, "/photos/_reconstruct/key.txt?out=x", "Reconstruct"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, "/"+strings.TrimPrefix(c.target, "/"), nil)
+		if c.target == "" {
+			req.URL.Path = ""
+		}
+		var m mux.RouteMatch
+		if !r.Match(req, &m) {
+			t.Errorf("%s %q: no route matched (%v)", c.method, c.target, m.MatchErr)
+			continue
+		}
+		if got := m.Route.GetName(); got != c.route {
+			t.Errorf("%s %q: routed to %s, want %s", c.method, c.target, got, c.route)
+		}
+	}
+}
+
+func TestRoutesServeSubResources(t *testing.T) {
+	srv := New(WithRoot(t.TempDir()), WithLogger(log.New(io.Discard, "", 0)))
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest(method, "/v1/storage"+target, strings.NewReader(body)))
+		return rec
+	}
+
+	if rec := do(http.MethodPut, "/photos", ""); rec.Code != http.StatusCreated {
+		t.Fatalf("create bucket: %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodPut, "/photos/.bucket.meta", `{"capacity_bytes":100}`); rec.Code != http.StatusOK {
+		t.Fatalf("put bucket meta: %d %s", rec.Code, rec.Body)
+	}
+	rec := do(http.MethodGet, "/photos/.bucket.meta", "")
+	var bm storage.BucketMetadata
+	if err := json.Unmarshal(rec.Body.Bytes(), &bm); err != nil || bm.CapacityBytes != 100 {
+		t.Fatalf("get bucket meta: %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodPut, "/photos/obj", "hello"); rec.Code != http.StatusCreated {
+		t.Fatalf("put object: %d %s", rec.Code, rec.Body)
+	}
+	rec = do(http.MethodGet, "/photos/_stats", "")
+	var st storage.Stats
+	if err := json.Unmarshal(rec.Body.Bytes(), &st); err != nil || st.ObjectCount != 1 {
+		t.Fatalf("stats: %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodPut, "/photos/_lifecycle", `{"rules":[{"id":"retention","expiration_days":1}]}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("put lifecycle with the reserved retention id: %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodPut, "/photos/_lifecycle", `{"rules":[{"id":"tmp","prefix":"tmp/","expiration_days":1}]}`); rec.Code != http.StatusOK {
+		t.Fatalf("put lifecycle: %d %s", rec.Code, rec.Body)
+	}
+	for _, target := range []string{"/photos/_lifecycle", "/photos/_lifecycle?dryRun"} {
+		if rec := do(http.MethodGet, target, ""); rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("GET %s: %d %q %s", target, rec.Code, rec.Header().Get("Content-Type"), rec.Body)
+		}
+	}
+	if rec := do(http.MethodPost, "/photos/_lifecycle?run", ""); rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("run lifecycle: %d %q %s", rec.Code, rec.Header().Get("Content-Type"), rec.Body)
+	}
+	// reserved paths never fall through to the object handler
+	if rec := do(http.MethodPut, "/photos/_stats", "x"); rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("PUT _stats: %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodDelete, "/photos/.bucket.meta", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("DELETE .bucket.meta: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestRoutesMultipart(t *testing.T) {
+	srv := New(WithRoot(t.TempDir()), WithLogger(log.New(io.Discard, "", 0)))
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest(method, "/v1/storage"+target, strings.NewReader(body)))
+		return rec
+	}
+
+	if rec := do(http.MethodPut, "/photos", ""); rec.Code != http.StatusCreated {
+		t.Fatalf("create bucket: %d %s", rec.Code, rec.Body)
+	}
+	// a POST selecting no multipart operation must not succeed silently
+	rec := do(http.MethodPost, "/photos/big", "")
+	var er ErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &er); err != nil || rec.Code != http.StatusBadRequest || er.Code != "InvalidRequest" {
+		t.Fatalf("bare POST: %d %s", rec.Code, rec.Body)
+	}
+
+	rec = do(http.MethodPost, "/photos/big?uploads", "")
+	var up storage.MultipartUpload
+	if err := json.Unmarshal(rec.Body.Bytes(), &up); err != nil || up.UploadID == "" {
+		t.Fatalf("create upload: %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodPut, "/photos/big?uploadId="+up.UploadID+"&partNumber=1", "part one"); rec.Code != http.StatusOK {
+		t.Fatalf("upload part: %d %s", rec.Code, rec.Body)
+	}
+	rec = do(http.MethodGet, "/photos/big?uploadId="+up.UploadID, "")
+	var parts []storage.PartInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &parts); err != nil || len(parts) != 1 {
+		t.Fatalf("list parts: %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodPost, "/photos/big?complete="+up.UploadID, ""); rec.Code != http.StatusOK {
+		t.Fatalf("complete: %d %s", rec.Code, rec.Body)
+	}
+	rec = do(http.MethodGet, "/photos/big", "")
+	if !bytes.Equal(rec.Body.Bytes(), []byte("part one")) {
+		t.Fatalf("get completed object: %d %s", rec.Code, rec.Body)
+	}
+
+	rec = do(http.MethodPost, "/photos/other?uploads", "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &up); err != nil {
+		t.Fatalf("create upload: %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodDelete, "/photos/other?abort="+up.UploadID, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("abort: %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodGet, "/photos/other?uploadId="+up.UploadID, ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("list parts after abort: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestRoutesServeVersion(t *testing.T) {
+	srv := New(WithRoot(t.TempDir()), WithS3("", ""), WithLogger(log.New(io.Discard, "", 0)))
+	do := func(method, target, body string, header map[string]string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, "/v1/storage"+target, strings.NewReader(body))
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		return rec
+	}
+
+	do(http.MethodPut, "/docs", "", nil)
+	if rec := do(http.MethodPut, "/docs/.bucket.meta", `{"versioning":true}`, nil); rec.Code != http.StatusOK {
+		t.Fatalf("enable versioning: %d %s", rec.Code, rec.Body)
+	}
+	rec := do(http.MethodPut, "/docs/a.txt", "first version", map[string]string{"Content-Type": "text/plain", "X-Meta-JSON": `{"owner":"alice"}`})
+	vid, etag := rec.Header().Get("X-Version-Id"), rec.Header().Get("ETag")
+	if rec.Code != http.StatusCreated || vid == "" {
+		t.Fatalf("put: %d %v", rec.Code, rec.Header())
+	}
+	do(http.MethodPut, "/docs/a.txt", "second version", nil)
+
+	target := "/docs/a.txt?versionId=" + vid
+	rec = do(http.MethodGet, target, "", map[string]string{"Range": "bytes=6-12", "If-Match": etag})
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "version" || rec.Header().Get("Content-Range") != "bytes 6-12/13" {
+		t.Fatalf("ranged GET with If-Match: %d %v %s", rec.Code, rec.Header(), rec.Body)
+	}
+	if rec := do(http.MethodGet, target, "", map[string]string{"If-Match": `"other"`}); rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("GET with a stale If-Match: %d %s", rec.Code, rec.Body)
+	}
+	for _, inm := range []string{etag, "*", `"other", ` + etag} {
+		if rec := do(http.MethodGet, target, "", map[string]string{"If-None-Match": inm}); rec.Code != http.StatusNotModified {
+			t.Fatalf("GET with If-None-Match %s: %d %s", inm, rec.Code, rec.Body)
+		}
+	}
+	// only whole ETags match
+	if rec := do(http.MethodGet, target, "", map[string]string{"If-None-Match": etag[:len(etag)-2] + `"`}); rec.Code != http.StatusOK || rec.Body.String() != "first version" {
+		t.Fatalf("GET with an ETag prefix: %d %s", rec.Code, rec.Body)
+	}
+	rec = do(http.MethodGet, target, "", map[string]string{"If-Modified-Since": time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)})
+	if rec.Code != http.StatusNotModified {
+		t.Fatalf("GET with If-Modified-Since: %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodHead, target, "", nil); rec.Code != http.StatusOK || rec.Header().Get("Content-Length") != "13" || rec.Body.Len() != 0 {
+		t.Fatalf("HEAD: %d %v", rec.Code, rec.Header())
+	}
+
+	rec2, body := s3Do(t, srv, http.MethodGet, "/docs/a.txt?versionId="+vid, "", map[string]string{"Range": "bytes=-7", "If-Match": etag})
+	if rec2.Code != http.StatusPartialContent || body != "version" {
+		t.Fatalf("S3 ranged GetObject of a version: %d %s", rec2.Code, body)
+	}
+	// the version keeps its own metadata
+	rec2, body = s3Do(t, srv, http.MethodGet, "/docs/a.txt?versionId="+vid, "", nil)
+	if rec2.Code != http.StatusOK || rec2.Header().Get("Content-Type") != "text/plain" || rec2.Header().Get("X-Amz-Meta-Owner") != "alice" {
+		t.Fatalf("S3 GetObject of a version: %d %v %s", rec2.Code, rec2.Header(), body)
+	}
+}
+
+func TestRoutesReconstructExport(t *testing.T) {
+	exportDir, outside := t.TempDir(), t.TempDir()
+	srv := New(WithRoot(t.TempDir()), WithExportDir(exportDir), WithLogger(log.New(io.Discard, "", 0)))
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest(method, "/v1/storage"+target, strings.NewReader(body)))
+		return rec
+	}
+	do(http.MethodPut, "/docs", "")
+	if rec := do(http.MethodPut, "/docs/report.txt", "quarterly report"); rec.Code != http.StatusCreated {
+		t.Fatalf("put: %d %s", rec.Code, rec.Body)
+	}
+
+	if rec := do(http.MethodPost, "/docs/_reconstruct/report.txt?out=2024/q1/report.holy", ""); rec.Code != http.StatusOK {
+		t.Fatalf("export: %d %s", rec.Code, rec.Body)
+	}
+	f, err := os.Open(filepath.Join(exportDir, "2024", "q1", "report.holy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := storage.OpenReconstructed(f)
+	if err != nil || rc.Header.Key != "report.txt" {
+		t.Fatalf("OpenReconstructed: %+v %v", rc, err)
+	}
+	if got, err := io.ReadAll(rc); err != nil || string(got) != "quarterly report" {
+		t.Fatalf("exported payload %q: %v", got, err)
+	}
+	f.Close()
+
+	// existing files, and files behind symbolic links, are left alone
+	kept := filepath.Join(outside, "kept.txt")
+	if err := os.WriteFile(kept, []byte("kept"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for name, target := range map[string]string{"escape": outside, "kept-link": kept} {
+		if err := os.Symlink(target, filepath.Join(exportDir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for out, code := range map[string]int{
+		"2024/q1/report.holy": http.StatusConflict,
+		"kept-link":           http.StatusConflict,
+		"escape/kept.txt":     http.StatusBadRequest,
+		"escape/new.holy":     http.StatusBadRequest,
+		"escape/sub/new.holy": http.StatusBadRequest,
+		"../new.holy":         http.StatusBadRequest,
+	} {
+		if rec := do(http.MethodPost, "/docs/_reconstruct/report.txt?out="+out, ""); rec.Code != code {
+			t.Fatalf("export to %s: %d %s, want %d", out, rec.Code, rec.Body, code)
+		}
+	}
+	if data, err := os.ReadFile(kept); err != nil || string(data) != "kept" {
+		t.Fatalf("file outside the export directory changed: %q %v", data, err)
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) != 1 {
+		t.Fatalf("files created outside the export directory: %v", entries)
+	}
+
+	// a failed export leaves nothing behind
+	if rec := do(http.MethodPost, "/docs/_reconstruct/missing.txt?out=missing.holy", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("export of a missing object: %d %s", rec.Code, rec.Body)
+	}
+	if _, err := os.Stat(filepath.Join(exportDir, "missing.holy")); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("export of a missing object left a file: %v", err)
+	}
+}
@@ -0,0 +1,630 @@
+package server
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/garder500/holydb/pkg/storage"
+)
+
+// s3API serves an S3-compatible API on top of a storage.Storage, so S3
+// tools (aws-cli, rclone, the AWS SDKs) can use HolyDB. Buckets are
+// addressed path-style (/{bucket}/{key}) or, when domain is set,
+// virtual-host style ({bucket}.{domain}/{key}). Responses are S3 XML
+// documents and x-amz-meta-* headers map to object metadata. Bucket
+// policies apply as in the native API.
+type s3API struct {
+	ls       storage.Storage
+	domain   string
+	policies *policyEvaluator // nil when requests are not authenticated
+}
+
+// s3Unsupported are the S3 sub-resources the frontend does not implement;
+// requests for them fail with NotImplemented instead of being mistaken for
+// plain object or bucket operations (ListObjectVersions for ?versions, which
+// would otherwise list only current objects).
+var s3Unsupported = []string{
+	"accelerate", "acl", "analytics", "attributes", "cors", "encryption", "intelligent-tiering",
+	"inventory", "legal-hold", "lifecycle", "logging", "metrics", "notification", "object-lock",
+	"ownershipControls", "policy", "publicAccessBlock", "replication", "requestPayment", "restore",
+	"retention", "select", "tagging", "torrent", "versions", "website",
+}
+
+func (a *s3API) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	bucket, key := a.resolve(req)
+	q := req.URL.Query()
+	for _, sub := range s3Unsupported {
+		if q.Has(sub) {
+			writeS3Error(w, req, bucket, s3NotImplemented("the "+sub+" sub-resource is not supported"))
+			return
+		}
+	}
+	if a.policies != nil {
+		if err := a.authorize(req, bucket, key); err != nil {
+			writeS3Error(w, req, bucket, err)
+			return
+		}
+	}
+	switch {
+	case bucket == "":
+		if req.Method != http.MethodGet {
+			writeS3Error(w, req, "", errMethodNotAllowed)
+			return
+		}
+		a.listBuckets(w, req)
+	case key == "":
+		a.serveBucket(w, req, bucket)
+	default:
+		a.serveObject(w, req, bucket, key)
+	}
+}
+
+// authorize consults the bucket policies for the operation req performs.
+// DeleteObjects is authorized key by key by deleteObjects.
+func (a *s3API) authorize(req *http.Request, bucket, key string) error {
+	q := req.URL.Query()
+	var action string
+	switch {
+	case bucket == "":
+		action = storage.ActionListBuckets
+	case key == "":
+		switch req.Method {
+		case http.MethodPut:
+			action = storage.ActionCreateBucket
+			if q.Has("versioning") {
+				action = storage.ActionPutBucketMetadata
+			}
+		case http.MethodDelete:
+			action = storage.ActionDeleteBucket
+		case http.MethodGet, http.MethodHead:
+			action, key = storage.ActionListBucket, q.Get("prefix")
+			if q.Has("location") || q.Has("versioning") {
+				action = storage.ActionGetBucketMetadata
+			}
+		case http.MethodPost:
+			if q.Has("delete") {
+				return nil
+			}
+		}
+	default:
+		switch req.Method {
+		case http.MethodGet, http.MethodHead:
+			action = storage.ActionGetObject
+			if q.Has("uploadId") {
+				action = storage.ActionPutObject
+			}
+		case http.MethodPut, http.MethodPost:
+			action = storage.ActionPutObject
+		case http.MethodDelete:
+			action = storage.ActionDeleteObject
+			if q.Has("uploadId") {
+				action = storage.ActionPutObject
+			}
+		}
+	}
+	if err := a.policies.authorize(req, action, bucket, key); err != nil {
+		return err
+	}
+	if srcBucket, srcKey, ok := copySource(req.Header.Get("X-Amz-Copy-Source")); ok && action == storage.ActionPutObject {
+		return a.policies.authorize(req, storage.ActionGetObject, srcBucket, srcKey)
+	}
+	return nil
+}
+
+// resolve returns the bucket and key a request addresses.
+func (a *s3API) resolve(req *http.Request) (bucket, key string) {
+	path := strings.TrimPrefix(req.URL.Path, "/")
+	if a.domain != "" {
+		host, _, err := net.SplitHostPort(req.Host)
+		if err != nil {
+			host = req.Host
+		}
+		if b, ok := strings.CutSuffix(strings.ToLower(host), "."+a.domain); ok && b != "" {
+			return b, path
+		}
+	}
+	bucket, key, _ = strings.Cut(path, "/")
+	return bucket, key
+}
+
+func (a *s3API) listBuckets(w http.ResponseWriter, req *http.Request) {
+	buckets, err := a.ls.ListBuckets(req.Context())
+	if err != nil {
+		writeS3Error(w, req, "", err)
+		return
+	}
+	res := s3ListAllMyBucketsResult{Xmlns: s3Namespace, Owner: s3DefaultOwner, Buckets: []s3Bucket{}}
+	for _, b := range buckets {
+		res.Buckets = append(res.Buckets, s3Bucket{Name: b.Name, CreationDate: s3Time(b.CreationDate)})
+	}
+	writeXML(w, res)
+}
+
+func (a *s3API) serveBucket(w http.ResponseWriter, req *http.Request, bucket string) {
+	q := req.URL.Query()
+	switch req.Method {
+	case http.MethodPut:
+		if q.Has("versioning") {
+			a.putVersioning(w, req, bucket)
+			return
+		}
+		if err := a.ls.CreateBucket(req.Context(), bucket); err != nil {
+			writeS3Error(w, req, bucket, err)
+			return
+		}
+		w.Header().Set("Location", "/"+bucket)
+		w.WriteHeader(http.StatusOK)
+	case http.MethodHead:
+		if _, err := a.ls.HeadBucket(req.Context(), bucket); err != nil {
+			writeS3Error(w, req, bucket, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		if err := a.ls.DeleteBucket(req.Context(), bucket, false); err != nil {
+			writeS3Error(w, req, bucket, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet:
+		switch {
+		case q.Has("location"):
+			if _, err := a.ls.HeadBucket(req.Context(), bucket); err != nil {
+				writeS3Error(w, req, bucket, err)
+				return
+			}
+			writeXML(w, s3LocationConstraint{Xmlns: s3Namespace})
+		case q.Has("versioning"):
+			bm, err := a.ls.GetBucketMetadata(req.Context(), bucket)
+			if err != nil {
+				writeS3Error(w, req, bucket, err)
+				return
+			}
+			res := s3VersioningConfiguration{Xmlns: s3Namespace}
+			if bm.Versioning {
+				res.Status = "Enabled"
+			}
+			writeXML(w, res)
+		case q.Has("uploads"):
+			a.listUploads(w, req, bucket)
+		default:
+			a.listObjects(w, req, bucket, q.Get("list-type") == "2")
+		}
+	case http.MethodPost:
+		if q.Has("delete") {
+			a.deleteObjects(w, req, bucket)
+			return
+		}
+		writeS3Error(w, req, bucket, s3NotImplemented("unsupported bucket operation"))
+	default:
+		writeS3Error(w, req, bucket, errMethodNotAllowed)
+	}
+}
+
+func (a *s3API) putVersioning(w http.ResponseWriter, req *http.Request, bucket string) {
+	var cfg s3VersioningConfiguration
+	if err := xml.NewDecoder(req.Body).Decode(&cfg); err != nil {
+		writeS3Error(w, req, bucket, s3MalformedXML("invalid VersioningConfiguration: "+err.Error()))
+		return
+	}
+	bm, err := a.ls.GetBucketMetadata(req.Context(), bucket)
+	if err != nil {
+		writeS3Error(w, req, bucket, err)
+		return
+	}
+	bm.Versioning = cfg.Status == "Enabled"
+	if err := a.ls.PutBucketMetadata(req.Context(), bucket, bm); err != nil {
+		writeS3Error(w, req, bucket, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// listObjects serves ListObjectsV2 (v2) and the original ListObjects.
+func (a *s3API) listObjects(w http.ResponseWriter, req *http.Request, bucket string, v2 bool) {
+	q := req.URL.Query()
+	enc := q.Get("encoding-type")
+	opts := storage.ListOptions{
+		Prefix:    q.Get("prefix"),
+		Delimiter: q.Get("delimiter"),
+		MaxKeys:   1000,
+	}
+	if v := q.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeS3Error(w, req, bucket, storage.ErrInvalidArgument)
+			return
+		}
+		opts.MaxKeys = n
+	}
+	res := s3ListBucketResult{
+		Xmlns:        s3Namespace,
+		Name:         bucket,
+		Prefix:       s3Encode(opts.Prefix, enc),
+		MaxKeys:      opts.MaxKeys,
+		Delimiter:    s3Encode(opts.Delimiter, enc),
+		EncodingType: enc,
+	}
+	if v2 {
+		opts.StartAfter = q.Get("start-after")
+		opts.ContinuationToken = q.Get("continuation-token")
+		res.StartAfter = s3Encode(opts.StartAfter, enc)
+		res.ContinuationToken = opts.ContinuationToken
+	} else {
+		marker := q.Get("marker")
+		opts.StartAfter = marker
+		if opts.Delimiter != "" && strings.HasSuffix(marker, opts.Delimiter) && len(marker) > len(opts.Prefix) {
+			// the marker is a common prefix: skip every key it groups
+			opts.StartAfter = marker + string(utf8.MaxRune)
+		}
+		m := s3Encode(marker, enc)
+		res.Marker = &m
+	}
+	if opts.MaxKeys == 0 {
+		// ListObjects treats zero as the default page size
+		if v2 {
+			res.KeyCount = new(int)
+		}
+		writeXML(w, res)
+		return
+	}
+	page, err := a.ls.ListObjects(req.Context(), bucket, opts)
+	if err != nil {
+		writeS3Error(w, req, bucket, err)
+		return
+	}
+	var last string
+	for _, o := range page.Objects {
+		res.Contents = append(res.Contents, s3Object{
+			Key:          s3Encode(o.Key, enc),
+			LastModified: s3Time(o.LastModified),
+			ETag:         quoteETag(o.ETag),
+			Size:         o.Size,
+			StorageClass: "STANDARD",
+		})
+		last = max(last, o.Key)
+	}
+	for _, p := range page.CommonPrefixes {
+		res.CommonPrefixes = append(res.CommonPrefixes, s3CommonPrefix{Prefix: s3Encode(p, enc)})
+		last = max(last, p)
+	}
+	res.IsTruncated = page.IsTruncated
+	if v2 {
+		n := len(res.Contents) + len(res.CommonPrefixes)
+		res.KeyCount = &n
+		res.NextContinuationToken = page.NextContinuationToken
+	} else if page.IsTruncated {
+		res.NextMarker = s3Encode(last, enc)
+	}
+	writeXML(w, res)
+}
+
+func (a *s3API) listUploads(w http.ResponseWriter, req *http.Request, bucket string) {
+	prefix := req.URL.Query().Get("prefix")
+	uploads, err := a.ls.ListMultipartUploads(req.Context(), bucket, prefix)
+	if err != nil {
+		writeS3Error(w, req, bucket, err)
+		return
+	}
+	res := s3ListMultipartUploadsResult{Xmlns: s3Namespace, Bucket: bucket, Prefix: prefix}
+	for _, up := range uploads {
+		res.Uploads = append(res.Uploads, s3Upload{
+			Key:       up.Key,
+			UploadID:  up.UploadID,
+			Initiator: s3Owner{ID: up.Initiator, DisplayName: up.Initiator},
+			Owner:     s3DefaultOwner,
+			Initiated: s3Time(up.Initiated),
+		})
+	}
+	writeXML(w, res)
+}
+
+// deleteObjects serves DeleteObjects (POST /{bucket}?delete). As with
+// DeleteObject, keys that do not exist are reported as deleted.
+func (a *s3API) deleteObjects(w http.ResponseWriter, req *http.Request, bucket string) {
+	var body s3Delete
+	if err := xml.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeS3Error(w, req, bucket, s3MalformedXML("invalid Delete request: "+err.Error()))
+		return
+	}
+	res := s3DeleteResult{Xmlns: s3Namespace}
+	for _, o := range body.Objects {
+		var err error
+		if a.policies != nil {
+			err = a.policies.authorize(req, storage.ActionDeleteObject, bucket, o.Key)
+		}
+		switch {
+		case err != nil:
+		case o.VersionID != "":
+			err = a.ls.DeleteVersion(req.Context(), bucket, o.Key, o.VersionID)
+		default:
+			err = a.ls.Delete(req.Context(), bucket, o.Key)
+		}
+		if err != nil && !errors.Is(err, storage.ErrNoSuchKey) {
+			_, code, message, ok := s3ErrorFor(err, bucket)
+			if !ok {
+				requestLogger(req).Printf("ERR %s %s: delete %s: %v", req.Method, req.URL.Path, o.Key, err)
+			}
+			res.Errors = append(res.Errors, s3DeleteError{Key: o.Key, Code: code, Message: message})
+			continue
+		}
+		if !body.Quiet {
+			res.Deleted = append(res.Deleted, s3Deleted{Key: o.Key, VersionID: o.VersionID})
+		}
+	}
+	writeXML(w, res)
+}
+
+func (a *s3API) serveObject(w http.ResponseWriter, req *http.Request, bucket, key string) {
+	q := req.URL.Query()
+	switch req.Method {
+	case http.MethodPut:
+		switch {
+		case q.Has("uploadId") && q.Has("partNumber"):
+			a.uploadPart(w, req, bucket, key)
+		case req.Header.Get("X-Amz-Copy-Source") != "":
+			a.copyObject(w, req, bucket, key)
+		default:
+			a.putObject(w, req, bucket, key)
+		}
+	case http.MethodGet, http.MethodHead:
+		switch {
+		case q.Has("uploadId") && req.Method == http.MethodGet:
+			a.listParts(w, req, bucket, key)
+		case q.Get("versionId") != "":
+			a.getVersion(w, req, bucket, key, q.Get("versionId"))
+		default:
+			a.getObject(w, req, bucket, key)
+		}
+	case http.MethodDelete:
+		var err error
+		switch {
+		case q.Has("uploadId"):
+			err = a.ls.AbortMultipart(req.Context(), bucket, key, q.Get("uploadId"))
+		case q.Get("versionId") != "":
+			err = a.ls.DeleteVersion(req.Context(), bucket, key, q.Get("versionId"))
+		default:
+			err = a.ls.Delete(req.Context(), bucket, key)
+			if errors.Is(err, storage.ErrNoSuchKey) {
+				err = nil // DeleteObject is idempotent in S3
+			}
+		}
+		if err != nil {
+			writeS3Error(w, req, bucket, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPost:
+		switch {
+		case q.Has("uploads"):
+			a.createUpload(w, req, bucket, key)
+		case q.Has("uploadId"):
+			a.completeUpload(w, req, bucket, key)
+		default:
+			writeS3Error(w, req, bucket, s3NotImplemented("unsupported object operation"))
+		}
+	default:
+		writeS3Error(w, req, bucket, errMethodNotAllowed)
+	}
+}
+
+func (a *s3API) putObject(w http.ResponseWriter, req *http.Request, bucket, key string) {
+	body, err := s3Body(req)
+	if err != nil {
+		writeS3Error(w, req, bucket, err)
+		return
+	}
+	info, err := a.ls.PutWithMetadata(req.Context(), bucket, key, body, s3Metadata(req))
+	if err != nil {
+		writeS3Error(w, req, bucket, err)
+		return
+	}
+	w.Header().Set("ETag", quoteETag(info.ETag))
+	if info.VersionID != "" {
+		w.Header().Set("X-Amz-Version-Id", info.VersionID)
+	}
+	setS3EncryptionHeaders(w.Header(), info)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (a *s3API) copyObject(w http.ResponseWriter, req *http.Request, bucket, key string) {
+	srcBucket, srcKey, versionID, err := parseCopySource(req.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		writeS3Error(w, req, bucket, err)
+		return
+	}
+	opts := storage.CopyOptions{
+		SourceVersionID:   versionID,
+		MetadataDirective: strings.ToUpper(req.Header.Get("X-Amz-Metadata-Directive")),
+		Metadata:          s3Metadata(req),
+	}
+	info, err := a.ls.Copy(req.Context(), srcBucket, srcKey, bucket, key, opts)
+	if err != nil {
+		writeS3Error(w, req, bucket, err)
+		return
+	}
+	if info.VersionID != "" {
+		w.Header().Set("X-Amz-Version-Id", info.VersionID)
+	}
+	setS3EncryptionHeaders(w.Header(), info)
+	writeXML(w, s3CopyObjectResult{Xmlns: s3Namespace, LastModified: s3Time(info.LastModified), ETag: quoteETag(info.ETag)})
+}
+
+func (a *s3API) getObject(w http.ResponseWriter, req *http.Request, bucket, key string) {
+	info, err := a.ls.Stat(req.Context(), bucket, key)
+	if err != nil {
+		writeS3Error(w, req, bucket, err)
+		return
+	}
+	meta, err := a.ls.GetMetadata(req.Context(), bucket, key)
+	if err != nil {
+		writeS3Error(w, req, bucket, err)
+		return
+	}
+	setS3ObjectHeaders(w, info, meta)
+	content := &objectReader{ctx: req.Context(), ls: a.ls, bucket: bucket, key: key, size: info.Size}
+	defer content.Close()
+	http.ServeContent(w, req, "", info.LastModified, content)
+}
+
+// getVersion writes a specific object version with its own metadata; as in
+// getObject, ranges and conditional requests are handled by http.ServeContent.
+func (a *s3API) getVersion(w http.ResponseWriter, req *http.Request, bucket, key, versionID string) {
+	rc, info, err := a.ls.GetVersion(req.Context(), bucket, key, versionID)
+	if err != nil {
+		writeS3Error(w, req, bucket, err)
+		return
+	}
+	meta, err := a.ls.GetVersionMetadata(req.Context(), bucket, key, versionID)
+	if err != nil {
+		rc.Close()
+		writeS3Error(w, req, bucket, err)
+		return
+	}
+	setS3ObjectHeaders(w, info, meta)
+	content := &objectReader{ctx: req.Context(), ls: a.ls, bucket: bucket, key: key, versionID: versionID, size: info.Size, rc: rc}
+	defer content.Close()
+	http.ServeContent(w, req, "", info.LastModified, content)
+}
+
+func (a *s3API) createUpload(w http.ResponseWriter, req *http.Request, bucket, key string) {
+	up, err := a.ls.CreateMultipartUpload(req.Context(), bucket, key, s3Metadata(req), initiator(req))
+	if err != nil {
+		writeS3Error(w, req, bucket, err)
+		return
+	}
+	writeXML(w, s3InitiateMultipartUploadResult{Xmlns: s3Namespace, Bucket: bucket, Key: key, UploadID: up.UploadID})
+}
+
+func (a *s3API) uploadPart(w http.ResponseWriter, req *http.Request, bucket, key string) {
+	if req.Header.Get("X-Amz-Copy-Source") != "" {
+		writeS3Error(w, req, bucket, s3NotImplemented("UploadPartCopy is not supported"))
+		return
+	}
+	q := req.URL.Query()
+	pn, err := strconv.Atoi(q.Get("partNumber"))
+	if err != nil {
+		writeS3Error(w, req, bucket, storage.ErrInvalidPart)
+		return
+	}
+	body, err := s3Body(req)
+	if err != nil {
+		writeS3Error(w, req, bucket, err)
+		return
+	}
+	part, err := a.ls.UploadPart(req.Context(), bucket, key, q.Get("uploadId"), pn, body)
+	if err != nil {
+		writeS3Error(w, req, bucket, err)
+		return
+	}
+	w.Header().Set("ETag", quoteETag(part.ETag))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (a *s3API) completeUpload(w http.ResponseWriter, req *http.Request, bucket, key string) {
+	var body s3CompleteMultipartUpload
+	if err := xml.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeS3Error(w, req, bucket, s3MalformedXML("invalid CompleteMultipartUpload: "+err.Error()))
+		return
+	}
+	parts := make([]storage.CompletedPart, 0, len(body.Parts))
+	for _, p := range body.Parts {
+		parts = append(parts, storage.CompletedPart{PartNumber: p.PartNumber, ETag: p.ETag})
+	}
+	info, err := a.ls.CompleteMultipart(req.Context(), bucket, key, req.URL.Query().Get("uploadId"), parts, nil)
+	if err != nil {
+		writeS3Error(w, req, bucket, err)
+		return
+	}
+	if info.VersionID != "" {
+		w.Header().Set("X-Amz-Version-Id", info.VersionID)
+	}
+	setS3EncryptionHeaders(w.Header(), info)
+	writeXML(w, s3CompleteMultipartUploadResult{
+		Xmlns:    s3Namespace,
+		Location: "/" + bucket + "/" + key,
+		Bucket:   bucket,
+		Key:      key,
+		ETag:     quoteETag(info.ETag),
+	})
+}
+
+func (a *s3API) listParts(w http.ResponseWriter, req *http.Request, bucket, key string) {
+	uploadID := req.URL.Query().Get("uploadId")
+	parts, err := a.ls.ListParts(req.Context(), bucket, key, uploadID)
+	if err != nil {
+		writeS3Error(w, req, bucket, err)
+		return
+	}
+	res := s3ListPartsResult{Xmlns: s3Namespace, Bucket: bucket, Key: key, UploadID: uploadID, Initiator: s3DefaultOwner, Owner: s3DefaultOwner}
+	for _, p := range parts {
+		res.Parts = append(res.Parts, s3Part{PartNumber: p.Number, LastModified: s3Time(p.LastModified), ETag: quoteETag(p.ETag), Size: p.Size})
+	}
+	writeXML(w, res)
+}
+
+// s3MetaPrefix is the header prefix of user-defined object metadata.
+const s3MetaPrefix = "X-Amz-Meta-"
+
+// s3Metadata returns the object metadata of a request: x-amz-meta-<name>
+// headers are stored under <name> (lower-cased) and Content-Type under
+// storage.MetaContentType.
+func s3Metadata(req *http.Request) storage.Metadata {
+	var meta storage.Metadata
+	for name, values := range req.Header {
+		if n, ok := strings.CutPrefix(name, s3MetaPrefix); ok && n != "" {
+			if meta == nil {
+				meta = storage.Metadata{}
+			}
+			meta[strings.ToLower(n)] = strings.Join(values, ",")
+		}
+	}
+	if ct := req.Header.Get("Content-Type"); ct != "" {
+		if meta == nil {
+			meta = storage.Metadata{}
+		}
+		meta[storage.MetaContentType] = ct
+	}
+	return meta
+}
+
+// setS3ObjectHeaders sets the object response headers, with the object's
+// metadata as x-amz-meta-* headers.
+func setS3ObjectHeaders(w http.ResponseWriter, info storage.ObjectInfo, meta storage.Metadata) {
+	setObjectHeaders(w, info)
+	h := w.Header()
+	if info.VersionID != "" {
+		h.Set("X-Amz-Version-Id", info.VersionID)
+	}
+	setS3EncryptionHeaders(h, info)
+	for k, v := range meta {
+		if k != storage.MetaContentType {
+			h.Set(s3MetaPrefix+k, v)
+		}
+	}
+}
+
+// s3Body returns the verified data of a PutObject or UploadPart request.
+// aws-chunked bodies not already decoded by SigV4Authenticator are decoded,
+// and the x-amz-content-sha256 and
+// x-amz-checksum-* headers are verified like their native counterparts.
+func s3Body(req *http.Request) (io.Reader, error) {
+	if isAWSChunked(req) {
+		decodeAWSChunked(req, nil)
+	} else if sum := req.Header.Get("X-Amz-Content-Sha256"); len(sum) == 64 {
+		req.Header.Set("X-Checksum-SHA256", sum)
+	}
+	if v := req.Header.Get("X-Amz-Checksum-Sha256"); v != "" {
+		req.Header.Set("X-Checksum-SHA256", v)
+	}
+	if v := req.Header.Get("X-Amz-Checksum-Crc32c"); v != "" {
+		req.Header.Set("X-Checksum-CRC32C", v)
+	}
+	return verifiedBody(req)
+}
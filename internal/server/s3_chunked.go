@@ -0,0 +1,171 @@
+package server
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// isAWSChunked reports whether the request body uses the aws-chunked
+// encoding that SDKs use for streaming uploads (x-amz-content-sha256:
+// STREAMING-..., optionally with trailing checksums).
+func isAWSChunked(req *http.Request) bool {
+	return strings.HasPrefix(req.Header.Get("X-Amz-Content-Sha256"), "STREAMING-")
+}
+
+// decodeAWSChunked replaces an aws-chunked request body with its decoded
+// data, verifying chunk signatures with signer when it is not nil.
+func decodeAWSChunked(req *http.Request, signer *chunkSigner) {
+	req.Body = io.NopCloser(&awsChunkedReader{r: bufio.NewReader(req.Body), signer: signer})
+	req.ContentLength = -1
+	if n, err := strconv.ParseInt(req.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64); err == nil {
+		req.ContentLength = n
+	}
+	// the body is no longer aws-chunked
+	req.Header.Del("X-Amz-Content-Sha256")
+}
+
+// awsChunkedReader decodes an aws-chunked body:
+//
+//	hex-size[;chunk-signature=...]\r\n data \r\n ... 0[;...]\r\n [trailer\r\n]... \r\n
+//
+// With a signer, every chunk signature is verified as the chunk ends; a
+// mismatch fails the read with errSignatureMismatch. Trailing checksums and
+// trailer signatures are skipped, not verified.
+type awsChunkedReader struct {
+	r      *bufio.Reader
+	left   int64 // bytes left in the current chunk
+	done   bool
+	err    error
+	signer *chunkSigner
+	sig    string    // signature of the current chunk
+	hash   hash.Hash // of the current chunk data
+}
+
+// chunkSigner verifies the chain of chunk signatures of a streaming SigV4
+// upload, starting from the signature of the request itself.
+type chunkSigner struct {
+	key     []byte
+	amzDate string
+	scope   string
+	prev    string
+}
+
+// verify checks the signature of the next chunk, given the SHA-256 of its data.
+func (s *chunkSigner) verify(sig string, dataHash []byte) error {
+	stringToSign := sigV4Algorithm + "-PAYLOAD\n" + s.amzDate + "\n" + s.scope + "\n" + s.prev + "\n" +
+		emptySHA256 + "\n" + hex.EncodeToString(dataHash)
+	if !hmac.Equal([]byte(hex.EncodeToString(hmacSHA256(s.key, stringToSign))), []byte(sig)) {
+		return errSignatureMismatch
+	}
+	s.prev = sig
+	return nil
+}
+
+var errMalformedChunk = errors.New("malformed aws-chunked body")
+
+func (c *awsChunkedReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.done {
+		return 0, io.EOF
+	}
+	if c.left == 0 {
+		if err := c.nextChunk(); err != nil {
+			c.err = err
+			return 0, err
+		}
+		if c.done {
+			return 0, io.EOF
+		}
+	}
+	if int64(len(p)) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.r.Read(p)
+	c.left -= int64(n)
+	if c.hash != nil {
+		c.hash.Write(p[:n])
+	}
+	if c.left == 0 && err == nil {
+		err = c.expectCRLF()
+		if err == nil && c.signer != nil {
+			err = c.signer.verify(c.sig, c.hash.Sum(nil))
+		}
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		c.err = err
+	}
+	return n, err
+}
+
+// nextChunk reads a chunk header; after the final zero-length chunk it
+// consumes the trailers and sets done.
+func (c *awsChunkedReader) nextChunk() error {
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	size, ext, _ := strings.Cut(line, ";")
+	n, err := strconv.ParseInt(strings.TrimSpace(size), 16, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("%w: bad chunk size %q", errMalformedChunk, size)
+	}
+	if c.signer != nil {
+		c.sig, _ = strings.CutPrefix(ext, "chunk-signature=")
+		c.hash = sha256.New()
+	}
+	if n > 0 {
+		c.left = n
+		return nil
+	}
+	c.done = true
+	if c.signer != nil {
+		if err := c.signer.verify(c.sig, c.hash.Sum(nil)); err != nil {
+			return err
+		}
+	}
+	for { // trailers, up to an empty line or the end of the body
+		line, err := c.readLine()
+		if err == io.ErrUnexpectedEOF || (err == nil && line == "") {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (c *awsChunkedReader) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err == io.EOF {
+		return "", io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (c *awsChunkedReader) expectCRLF() error {
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	if line != "" {
+		return errMalformedChunk
+	}
+	return nil
+}
@@ -0,0 +1,326 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// s3Do sends an S3 request to srv's S3 API and returns the response with
+// its body read.
+func s3Do(t *testing.T, srv *Server, method, target, body string, header map[string]string) (*httptest.ResponseRecorder, string) {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	srv.S3Handler().ServeHTTP(rec, req)
+	return rec, rec.Body.String()
+}
+
+func newS3TestServer(t *testing.T) *Server {
+	return New(WithRoot(t.TempDir()), WithS3("", "s3.test"), WithLogger(log.New(io.Discard, "", 0)))
+}
+
+func TestS3ObjectRoundTrip(t *testing.T) {
+	srv := newS3TestServer(t)
+	if rec, body := s3Do(t, srv, http.MethodPut, "/photos", "", nil); rec.Code != http.StatusOK {
+		t.Fatalf("CreateBucket: %d %s", rec.Code, body)
+	}
+	rec, body := s3Do(t, srv, http.MethodPut, "/photos/2024/cat.txt", "meow", map[string]string{
+		"Content-Type":     "text/plain",
+		"X-Amz-Meta-Owner": "alice",
+	})
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") != `"4a4be40c96ac6314e91d93f38043a634"` {
+		t.Fatalf("PutObject: %d %v %s", rec.Code, rec.Header(), body)
+	}
+
+	// virtual-host addressing reaches the same object
+	req := httptest.NewRequest(http.MethodGet, "/2024/cat.txt", nil)
+	req.Host = "photos.s3.test:9000"
+	rec = httptest.NewRecorder()
+	srv.S3Handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "meow" {
+		t.Fatalf("GetObject: %d %s", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get("X-Amz-Meta-Owner"); got != "alice" {
+		t.Fatalf("x-amz-meta-owner = %q", got)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "text/plain" {
+		t.Fatalf("Content-Type = %q", got)
+	}
+
+	rec, body = s3Do(t, srv, http.MethodGet, "/photos/2024/cat.txt", "", map[string]string{"Range": "bytes=1-2"})
+	if rec.Code != http.StatusPartialContent || body != "eo" {
+		t.Fatalf("ranged GetObject: %d %s", rec.Code, body)
+	}
+
+	rec, body = s3Do(t, srv, http.MethodPut, "/photos/copy.txt", "", map[string]string{"X-Amz-Copy-Source": "photos/2024/cat.txt"})
+	var cr s3CopyObjectResult
+	if err := xml.Unmarshal([]byte(body), &cr); err != nil || rec.Code != http.StatusOK || cr.ETag != `"4a4be40c96ac6314e91d93f38043a634"` {
+		t.Fatalf("CopyObject: %d %s", rec.Code, body)
+	}
+
+	rec, body = s3Do(t, srv, http.MethodGet, "/photos?list-type=2&delimiter=/", "", nil)
+	var lr s3ListBucketResult
+	if err := xml.Unmarshal([]byte(body), &lr); err != nil {
+		t.Fatalf("ListObjectsV2: %d %s", rec.Code, body)
+	}
+	if lr.KeyCount == nil || *lr.KeyCount != 2 || len(lr.Contents) != 1 || lr.Contents[0].Key != "copy.txt" ||
+		len(lr.CommonPrefixes) != 1 || lr.CommonPrefixes[0].Prefix != "2024/" {
+		t.Fatalf("ListObjectsV2: %s", body)
+	}
+
+	rec, body = s3Do(t, srv, http.MethodPost, "/photos?delete",
+		`<Delete><Object><Key>copy.txt</Key></Object><Object><Key>missing</Key></Object></Delete>`, nil)
+	var dr s3DeleteResult
+	if err := xml.Unmarshal([]byte(body), &dr); err != nil || len(dr.Deleted) != 2 || len(dr.Errors) != 0 {
+		t.Fatalf("DeleteObjects: %d %s", rec.Code, body)
+	}
+	if rec, body := s3Do(t, srv, http.MethodDelete, "/photos/copy.txt", "", nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("DeleteObject of a missing key: %d %s", rec.Code, body)
+	}
+}
+
+func TestS3Errors(t *testing.T) {
+	srv := newS3TestServer(t)
+	for _, c := range []struct {
+		method, target string
+		status         int
+		code           string
+	}{
+		{http.MethodGet, "/nobucket/key", http.StatusNotFound, "NoSuchBucket"},
+		{http.MethodPut, "/Bad_Bucket", http.StatusBadRequest, "InvalidBucketName"},
+		{http.MethodGet, "/photos?acl", http.StatusNotImplemented, "NotImplemented"},
+		{http.MethodGet, "/photos?versions", http.StatusNotImplemented, "NotImplemented"},
+	} {
+		rec, body := s3Do(t, srv, c.method, c.target, "", nil)
+		var e s3Error
+		if err := xml.Unmarshal([]byte(body), &e); err != nil || rec.Code != c.status || e.Code != c.code {
+			t.Errorf("%s %s: %d %s, want %d %s", c.method, c.target, rec.Code, body, c.status, c.code)
+		}
+	}
+	s3Do(t, srv, http.MethodPut, "/photos", "", nil)
+	rec, body := s3Do(t, srv, http.MethodGet, "/photos/missing", "", nil)
+	var e s3Error
+	if err := xml.Unmarshal([]byte(body), &e); err != nil || rec.Code != http.StatusNotFound || e.Code != "NoSuchKey" {
+		t.Fatalf("GetObject of a missing key: %d %s", rec.Code, body)
+	}
+	rec, body = s3Do(t, srv, http.MethodPut, "/photos", "", nil)
+	if err := xml.Unmarshal([]byte(body), &e); err != nil || rec.Code != http.StatusConflict || e.Code != "BucketAlreadyOwnedByYou" {
+		t.Fatalf("CreateBucket twice: %d %s", rec.Code, body)
+	}
+}
+
+func TestS3Multipart(t *testing.T) {
+	srv := newS3TestServer(t)
+	s3Do(t, srv, http.MethodPut, "/videos", "", nil)
+	rec, body := s3Do(t, srv, http.MethodPost, "/videos/big.bin?uploads", "", map[string]string{"X-Amz-Meta-Camera": "x100"})
+	var init s3InitiateMultipartUploadResult
+	if err := xml.Unmarshal([]byte(body), &init); err != nil || init.UploadID == "" {
+		t.Fatalf("CreateMultipartUpload: %d %s", rec.Code, body)
+	}
+	// part 1 is sent aws-chunked, as SDKs do for streaming uploads
+	chunked := "5;chunk-signature=abc\r\nhello\r\n0;chunk-signature=def\r\nx-amz-checksum-crc32:AAAAAA==\r\n\r\n"
+	rec, body = s3Do(t, srv, http.MethodPut, "/videos/big.bin?partNumber=1&uploadId="+init.UploadID, chunked, map[string]string{
+		"X-Amz-Content-Sha256":         "STREAMING-AWS4-HMAC-SHA256-PAYLOAD",
+		"X-Amz-Decoded-Content-Length": "5",
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("UploadPart 1: %d %s", rec.Code, body)
+	}
+	etag1 := rec.Header().Get("ETag")
+	rec, body = s3Do(t, srv, http.MethodPut, "/videos/big.bin?partNumber=2&uploadId="+init.UploadID, " world", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("UploadPart 2: %d %s", rec.Code, body)
+	}
+	etag2 := rec.Header().Get("ETag")
+
+	rec, body = s3Do(t, srv, http.MethodGet, "/videos/big.bin?uploadId="+init.UploadID, "", nil)
+	var lp s3ListPartsResult
+	if err := xml.Unmarshal([]byte(body), &lp); err != nil || len(lp.Parts) != 2 || lp.Parts[0].ETag != etag1 {
+		t.Fatalf("ListParts: %d %s", rec.Code, body)
+	}
+	rec, body = s3Do(t, srv, http.MethodGet, "/videos?uploads", "", nil)
+	var lu s3ListMultipartUploadsResult
+	if err := xml.Unmarshal([]byte(body), &lu); err != nil || len(lu.Uploads) != 1 || lu.Uploads[0].Key != "big.bin" {
+		t.Fatalf("ListMultipartUploads: %d %s", rec.Code, body)
+	}
+
+	complete := "<CompleteMultipartUpload><Part><PartNumber>1</PartNumber><ETag>" + etag1 +
+		"</ETag></Part><Part><PartNumber>2</PartNumber><ETag>" + etag2 + "</ETag></Part></CompleteMultipartUpload>"
+	rec, body = s3Do(t, srv, http.MethodPost, "/videos/big.bin?uploadId="+init.UploadID, complete, nil)
+	var cr s3CompleteMultipartUploadResult
+	if err := xml.Unmarshal([]byte(body), &cr); err != nil || !strings.HasSuffix(cr.ETag, `-2"`) {
+		t.Fatalf("CompleteMultipartUpload: %d %s", rec.Code, body)
+	}
+	rec, body = s3Do(t, srv, http.MethodGet, "/videos/big.bin", "", nil)
+	if body != "hello world" || rec.Header().Get("X-Amz-Meta-Camera") != "x100" {
+		t.Fatalf("GetObject: %d %v %s", rec.Code, rec.Header(), body)
+	}
+}
+
+func TestS3ListObjectsV1Marker(t *testing.T) {
+	srv := newS3TestServer(t)
+	s3Do(t, srv, http.MethodPut, "/docs", "", nil)
+	for _, k := range []string{"a/1", "a/2", "b", "c/1"} {
+		s3Do(t, srv, http.MethodPut, "/docs/"+k, "x", nil)
+	}
+	var seen []string
+	marker := ""
+	for i := 0; i < 5; i++ {
+		rec, body := s3Do(t, srv, http.MethodGet, "/docs?delimiter=/&max-keys=1&marker="+marker, "", nil)
+		var lr s3ListBucketResult
+		if err := xml.Unmarshal([]byte(body), &lr); err != nil {
+			t.Fatalf("ListObjects: %d %s", rec.Code, body)
+		}
+		for _, o := range lr.Contents {
+			seen = append(seen, o.Key)
+		}
+		for _, p := range lr.CommonPrefixes {
+			seen = append(seen, p.Prefix)
+		}
+		if !lr.IsTruncated {
+			break
+		}
+		marker = lr.NextMarker
+	}
+	if got := strings.Join(seen, ","); got != "a/,b,c/" {
+		t.Fatalf("listed %s", got)
+	}
+}
+
+// sdkRequest builds a request the way aws-sdk-go-v2 sends it to a plain HTTP
+// endpoint: the payload hash and a CRC32 checksum in headers, the SDK's
+// invocation headers, and every header but User-Agent and Accept-Encoding
+// signed. The SDK itself is not a dependency of the module (gorilla/mux is
+// its only one), so TestS3OverHTTP replays its requests over a real socket.
+func sdkRequest(t *testing.T, cred Credential, method, target, body string, header map[string]string) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(method, target, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	amzDate := time.Now().UTC().Format(amzDateFormat)
+	scope := amzDate[:8] + "/us-east-1/s3/aws4_request"
+	payload := sha256.Sum256([]byte(body))
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE([]byte(body)))
+	req.Header.Set("User-Agent", "aws-sdk-go-v2/1.36.0 os/linux lang/go#1.24 api/s3#1.75.0")
+	req.Header.Set("Accept-Encoding", "identity")
+	req.Header.Set("Amz-Sdk-Invocation-Id", fmt.Sprintf("%x", payload[:16]))
+	req.Header.Set("Amz-Sdk-Request", "attempt=1; max=3")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payload[:]))
+	if method == http.MethodPut {
+		req.Header.Set("X-Amz-Checksum-Crc32", base64.StdEncoding.EncodeToString(crc))
+		req.Header.Set("X-Amz-Sdk-Checksum-Algorithm", "CRC32")
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	signed := []string{"host"}
+	if req.ContentLength > 0 {
+		signed = append(signed, "content-length")
+	}
+	for k := range req.Header {
+		if k = strings.ToLower(k); k != "user-agent" && k != "accept-encoding" {
+			signed = append(signed, k)
+		}
+	}
+	sort.Strings(signed)
+	req.Host = req.URL.Host
+	sr := &sigV4Request{scope: scope, signedHeaders: signed, amzDate: amzDate, payloadHash: hex.EncodeToString(payload[:])}
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, cred.AccessKey, scope, strings.Join(signed, ";"), sr.sign(sigV4SigningKey(cred.SecretKey, scope), req)))
+	return req
+}
+
+func TestS3OverHTTP(t *testing.T) {
+	cred := Credential{AccessKey: "AKIDEXAMPLE", SecretKey: "secret", User: "alice"}
+	srv := New(WithRoot(t.TempDir()), WithS3("", ""), WithLogger(log.New(io.Discard, "", 0)),
+		WithAuth(NewSigV4Authenticator(staticCredentials{cred.AccessKey: cred})))
+	ts := httptest.NewServer(srv.S3Handler())
+	defer ts.Close()
+	do := func(method, target, body string, header map[string]string) (*http.Response, string) {
+		t.Helper()
+		resp, err := ts.Client().Do(sdkRequest(t, cred, method, ts.URL+target, body, header))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, string(b)
+	}
+
+	if resp, body := do(http.MethodPut, "/photos", "", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("CreateBucket: %d %s", resp.StatusCode, body)
+	}
+	resp, body := do(http.MethodPut, "/photos/2024/a%20cat.txt", "meow", map[string]string{"Content-Type": "text/plain", "X-Amz-Meta-Owner": "alice"})
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") != `"4a4be40c96ac6314e91d93f38043a634"` {
+		t.Fatalf("PutObject: %d %v %s", resp.StatusCode, resp.Header, body)
+	}
+	resp, body = do(http.MethodGet, "/photos/2024/a%20cat.txt", "", nil)
+	if resp.StatusCode != http.StatusOK || body != "meow" || resp.Header.Get("X-Amz-Meta-Owner") != "alice" {
+		t.Fatalf("GetObject: %d %v %s", resp.StatusCode, resp.Header, body)
+	}
+	resp, body = do(http.MethodGet, "/photos/2024/a%20cat.txt", "", map[string]string{"Range": "bytes=1-2"})
+	if resp.StatusCode != http.StatusPartialContent || body != "eo" {
+		t.Fatalf("ranged GetObject: %d %s", resp.StatusCode, body)
+	}
+
+	resp, body = do(http.MethodGet, "/photos?list-type=2&prefix=2024%2F&encoding-type=url", "", nil)
+	var lr s3ListBucketResult
+	if err := xml.Unmarshal([]byte(body), &lr); err != nil || resp.StatusCode != http.StatusOK || len(lr.Contents) != 1 {
+		t.Fatalf("ListObjectsV2: %d %s", resp.StatusCode, body)
+	}
+
+	resp, body = do(http.MethodPost, "/photos/big.bin?uploads", "", map[string]string{"X-Amz-Checksum-Algorithm": "CRC32"})
+	var init s3InitiateMultipartUploadResult
+	if err := xml.Unmarshal([]byte(body), &init); err != nil || init.UploadID == "" {
+		t.Fatalf("CreateMultipartUpload: %d %s", resp.StatusCode, body)
+	}
+	var complete strings.Builder
+	complete.WriteString(`<CompleteMultipartUpload xmlns="http://s3.amazonaws.com/doc/2006-03-01/">`)
+	for i, part := range []string{"hello", " world"} {
+		resp, body = do(http.MethodPut, fmt.Sprintf("/photos/big.bin?partNumber=%d&uploadId=%s", i+1, init.UploadID), part, nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("UploadPart %d: %d %s", i+1, resp.StatusCode, body)
+		}
+		fmt.Fprintf(&complete, "<Part><ChecksumCRC32>%s</ChecksumCRC32><ETag>%s</ETag><PartNumber>%d</PartNumber></Part>",
+			resp.Request.Header.Get("X-Amz-Checksum-Crc32"), resp.Header.Get("ETag"), i+1)
+	}
+	complete.WriteString("</CompleteMultipartUpload>")
+	resp, body = do(http.MethodPost, "/photos/big.bin?uploadId="+init.UploadID, complete.String(), map[string]string{"Content-Type": "application/xml"})
+	var cr s3CompleteMultipartUploadResult
+	if err := xml.Unmarshal([]byte(body), &cr); err != nil || !strings.HasSuffix(cr.ETag, `-2"`) {
+		t.Fatalf("CompleteMultipartUpload: %d %s", resp.StatusCode, body)
+	}
+	if resp, body := do(http.MethodGet, "/photos/big.bin", "", nil); resp.StatusCode != http.StatusOK || body != "hello world" {
+		t.Fatalf("GetObject of the upload: %d %s", resp.StatusCode, body)
+	}
+
+	// a request signed with another secret is refused
+	req := sdkRequest(t, Credential{AccessKey: cred.AccessKey, SecretKey: "wrong"}, http.MethodGet, ts.URL+"/photos/big.bin", "", nil)
+	if resp, err := ts.Client().Do(req); err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("wrongly signed request: %v %v", resp, err)
+	} else {
+		resp.Body.Close()
+	}
+}
@@ -0,0 +1,271 @@
+package server
+
+import (
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/garder500/holydb/pkg/storage"
+)
+
+// s3Namespace is the XML namespace of every S3 response document.
+const s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// s3TimeFormat is the timestamp format of S3 XML documents.
+const s3TimeFormat = "2006-01-02T15:04:05.000Z"
+
+func s3Time(t time.Time) string { return t.UTC().Format(s3TimeFormat) }
+
+// s3Error is the XML body written for every failed S3 request.
+type s3Error struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Resource  string   `xml:"Resource"`
+	RequestID string   `xml:"RequestId"`
+}
+
+// s3APIError is an S3 error raised by the frontend itself, for codes that
+// have no equivalent in the native API.
+type s3APIError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *s3APIError) Error() string { return e.message }
+
+func s3NotImplemented(message string) error {
+	return &s3APIError{status: http.StatusNotImplemented, code: "NotImplemented", message: message}
+}
+
+func s3MalformedXML(message string) error {
+	return &s3APIError{status: http.StatusBadRequest, code: "MalformedXML", message: message}
+}
+
+// writeS3Error writes err as an S3 XML error.
+func writeS3Error(w http.ResponseWriter, req *http.Request, bucket string, err error) {
+	status, code, message, ok := s3ErrorFor(err, bucket)
+	if !ok {
+		requestLogger(req).Printf("ERR %s %s: %v", req.Method, req.URL.Path, err)
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if req.Method == http.MethodHead {
+		return
+	}
+	writeXMLBody(w, s3Error{
+		Code:      code,
+		Message:   message,
+		Resource:  req.URL.Path,
+		RequestID: requestID(req.Context()),
+	})
+}
+
+// s3ErrorFor maps err to an S3 status, code and message. Storage errors are
+// mapped as in writeError, using their S3 code, and an invalid bucket name
+// is reported as InvalidBucketName. Unknown errors are reported as a generic
+// InternalError and ok is false.
+func s3ErrorFor(err error, bucket string) (status int, code, message string, ok bool) {
+	var ae *apiError
+	var se *s3APIError
+	var ke *storage.InvalidKeyError
+	switch {
+	case errors.As(err, &se):
+		return se.status, se.code, se.message, true
+	case errors.As(err, &ae):
+		return ae.status, ae.code, ae.message, true
+	case errors.As(err, &ke) && ke.Value == bucket:
+		return http.StatusBadRequest, "InvalidBucketName", err.Error(), true
+	}
+	for _, e := range storageErrors {
+		if errors.Is(err, e.err) {
+			return e.status, e.s3Code, err.Error(), true
+		}
+	}
+	return http.StatusInternalServerError, "InternalError", "internal server error", false
+}
+
+// writeXML writes v as a 200 S3 response document.
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	writeXMLBody(w, v)
+}
+
+func writeXMLBody(w http.ResponseWriter, v any) {
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(v)
+}
+
+// s3Encode applies encoding-type=url to a key or prefix: clients asking for
+// it URL-decode every key of the listing.
+func s3Encode(s string, encodingType string) string {
+	if encodingType != "url" {
+		return s
+	}
+	return strings.ReplaceAll(url.QueryEscape(s), "%2F", "/")
+}
+
+type s3Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+// s3DefaultOwner is reported as the owner of every bucket and object.
+var s3DefaultOwner = s3Owner{ID: "holydb", DisplayName: "holydb"}
+
+type s3Bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type s3ListAllMyBucketsResult struct {
+	XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Owner   s3Owner    `xml:"Owner"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// s3ListBucketResult is the result of ListObjects (V1 fields Marker and
+// NextMarker) and ListObjectsV2 (the other optional fields).
+type s3ListBucketResult struct {
+	XMLName               xml.Name         `xml:"ListBucketResult"`
+	Xmlns                 string           `xml:"xmlns,attr"`
+	Name                  string           `xml:"Name"`
+	Prefix                string           `xml:"Prefix"`
+	Marker                *string          `xml:"Marker"`
+	NextMarker            string           `xml:"NextMarker,omitempty"`
+	StartAfter            string           `xml:"StartAfter,omitempty"`
+	ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+	KeyCount              *int             `xml:"KeyCount"`
+	MaxKeys               int              `xml:"MaxKeys"`
+	Delimiter             string           `xml:"Delimiter,omitempty"`
+	EncodingType          string           `xml:"EncodingType,omitempty"`
+	IsTruncated           bool             `xml:"IsTruncated"`
+	Contents              []s3Object       `xml:"Contents"`
+	CommonPrefixes        []s3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+type s3InitiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type s3CompleteMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+type s3Part struct {
+	PartNumber   int    `xml:"PartNumber"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+}
+
+type s3ListPartsResult struct {
+	XMLName     xml.Name `xml:"ListPartsResult"`
+	Xmlns       string   `xml:"xmlns,attr"`
+	Bucket      string   `xml:"Bucket"`
+	Key         string   `xml:"Key"`
+	UploadID    string   `xml:"UploadId"`
+	Initiator   s3Owner  `xml:"Initiator"`
+	Owner       s3Owner  `xml:"Owner"`
+	IsTruncated bool     `xml:"IsTruncated"`
+	Parts       []s3Part `xml:"Part"`
+}
+
+type s3Upload struct {
+	Key       string  `xml:"Key"`
+	UploadID  string  `xml:"UploadId"`
+	Initiator s3Owner `xml:"Initiator"`
+	Owner     s3Owner `xml:"Owner"`
+	Initiated string  `xml:"Initiated"`
+}
+
+type s3ListMultipartUploadsResult struct {
+	XMLName     xml.Name   `xml:"ListMultipartUploadsResult"`
+	Xmlns       string     `xml:"xmlns,attr"`
+	Bucket      string     `xml:"Bucket"`
+	Prefix      string     `xml:"Prefix"`
+	IsTruncated bool       `xml:"IsTruncated"`
+	Uploads     []s3Upload `xml:"Upload"`
+}
+
+type s3CopyObjectResult struct {
+	XMLName      xml.Name `xml:"CopyObjectResult"`
+	Xmlns        string   `xml:"xmlns,attr"`
+	LastModified string   `xml:"LastModified"`
+	ETag         string   `xml:"ETag"`
+}
+
+type s3LocationConstraint struct {
+	XMLName xml.Name `xml:"LocationConstraint"`
+	Xmlns   string   `xml:"xmlns,attr"`
+}
+
+type s3VersioningConfiguration struct {
+	XMLName xml.Name `xml:"VersioningConfiguration"`
+	Xmlns   string   `xml:"xmlns,attr,omitempty"`
+	Status  string   `xml:"Status,omitempty"`
+}
+
+type s3Delete struct {
+	XMLName xml.Name `xml:"Delete"`
+	Quiet   bool     `xml:"Quiet"`
+	Objects []struct {
+		Key       string `xml:"Key"`
+		VersionID string `xml:"VersionId"`
+	} `xml:"Object"`
+}
+
+type s3Deleted struct {
+	Key       string `xml:"Key"`
+	VersionID string `xml:"VersionId,omitempty"`
+}
+
+type s3DeleteError struct {
+	Key     string `xml:"Key"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+type s3DeleteResult struct {
+	XMLName xml.Name        `xml:"DeleteResult"`
+	Xmlns   string          `xml:"xmlns,attr"`
+	Deleted []s3Deleted     `xml:"Deleted"`
+	Errors  []s3DeleteError `xml:"Error"`
+}
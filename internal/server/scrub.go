@@ -0,0 +1,41 @@
+package server
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/garder500/holydb/pkg/storage"
+)
+
+// checker is implemented by storage backends that can check their consistency.
+type checker interface {
+	Fsck(ctx context.Context, opts storage.FsckOptions) (storage.FsckReport, error)
+}
+
+// runScrub checks every object, including its checksums, once per interval
+// until ctx is cancelled, logging the problems found and, with repair, fixed.
+func runScrub(ctx context.Context, logger *log.Logger, ls checker, interval time.Duration, repair bool) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		report, err := ls.Fsck(ctx, storage.FsckOptions{VerifyChecksums: true, Repair: repair})
+		if err != nil {
+			logger.Printf("scrub: %v", err)
+		}
+		for _, is := range report.Issues {
+			action := "found"
+			if is.Repair != "" {
+				action = is.Repair
+			}
+			logger.Printf("scrub: %s %s/%s %s: %s %s", is.Kind, is.Bucket, is.Key, is.VersionID, action, is.Detail)
+		}
+		logger.Printf("scrub: checked %d objects in %d buckets, %d problems (%d unrepaired)",
+			report.Objects, report.Buckets, len(report.Issues), report.Unrepaired())
+	}
+}
@@ -1,44 +1,238 @@
 package server
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"log"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/garder500/holydb/pkg/storage"
 	"github.com/gorilla/mux"
 )
 
-// Config holds server configuration.
-type Config struct {
-	Addr string
-	Root string
+// Server is the HolyDB HTTP server. It is used both by the holydb command
+// and by programs embedding HolyDB; build it with New and Options.
+type Server struct {
+	addr       string
+	storage    storage.Storage
+	middleware []func(http.Handler) http.Handler
+	auth       Authenticator
+	policies   *policyEvaluator
+	logger     *log.Logger
+	exportDir  string
+	keys       *storage.Keyring
+
+	lifecycleInterval time.Duration
+	lifecycleDryRun   bool
+	gcInterval        time.Duration
+	gcMaxAge          time.Duration
+	scrubInterval     time.Duration
+	scrubRepair       bool
+
+	s3Addr   string
+	s3Domain string
+
+	handler   http.Handler
+	s3Handler http.Handler
+}
+
+// Option configures a Server.
+type Option func(*Server)
+
+// WithAddr sets the address ListenAndServe and Run listen on (default ":8080").
+func WithAddr(addr string) Option { return func(s *Server) { s.addr = addr } }
+
+// WithStorage sets the storage backend (default: a LocalStorage rooted at ".").
+func WithStorage(st storage.Storage) Option { return func(s *Server) { s.storage = st } }
+
+// WithRoot uses a LocalStorage rooted at root as the storage backend.
+func WithRoot(root string) Option {
+	return func(s *Server) { s.storage = &storage.LocalStorage{Root: root} }
+}
+
+// WithEncryption encrypts the objects the LocalStorage backend writes with
+// the master keys of keys (see storage.LoadKeyring).
+func WithEncryption(keys *storage.Keyring) Option { return func(s *Server) { s.keys = keys } }
+
+// WithMiddleware appends middleware wrapping every route. Middleware runs
+// in the order given, after request IDs and logging and before authentication.
+func WithMiddleware(mw ...func(http.Handler) http.Handler) Option {
+	return func(s *Server) { s.middleware = append(s.middleware, mw...) }
 }
 
-// New creates a configured *http.Server with all routes registered.
-func New(cfg Config) *http.Server {
-	ls := &storage.LocalStorage{Root: cfg.Root}
+// WithAuth authenticates every request with a before it reaches a route,
+// and enforces bucket policies (see storage.BucketPolicy). Requests without
+// credentials are served only where a bucket policy lets anonymous callers
+// in.
+func WithAuth(a Authenticator) Option { return func(s *Server) { s.auth = a } }
+
+// WithLogger sets the logger for requests, internal errors and background
+// workers (default: the standard logger).
+func WithLogger(l *log.Logger) Option { return func(s *Server) { s.logger = l } }
+
+// WithExportDir sets the only directory POST .../_reconstruct may write to;
+// server-side export is disabled without it.
+func WithExportDir(dir string) Option { return func(s *Server) { s.exportDir = dir } }
+
+// WithLifecycle makes Run apply bucket lifecycle rules every interval. In
+// dry-run mode expirations are only logged.
+func WithLifecycle(interval time.Duration, dryRun bool) Option {
+	return func(s *Server) { s.lifecycleInterval, s.lifecycleDryRun = interval, dryRun }
+}
+
+// WithGC makes Run abort multipart uploads and remove temporary files older
+// than maxAge every interval.
+func WithGC(interval, maxAge time.Duration) Option {
+	return func(s *Server) { s.gcInterval, s.gcMaxAge = interval, maxAge }
+}
+
+// WithScrub makes Run check every object and its checksums every interval;
+// with repair it also repairs what it finds.
+func WithScrub(interval time.Duration, repair bool) Option {
+	return func(s *Server) { s.scrubInterval, s.scrubRepair = interval, repair }
+}
+
+// WithS3 makes Run also serve the S3-compatible API on addr. Buckets are
+// addressed path-style, or virtual-host style as <bucket>.<domain> when
+// domain is set.
+func WithS3(addr, domain string) Option {
+	return func(s *Server) { s.s3Addr, s.s3Domain = addr, strings.ToLower(domain) }
+}
+
+// New creates a Server with all routes registered.
+func New(opts ...Option) *Server {
+	s := &Server{addr: ":8080", logger: log.Default()}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.storage == nil {
+		s.storage = &storage.LocalStorage{Root: "."}
+	}
+	if ls, ok := s.storage.(*storage.LocalStorage); ok && s.keys != nil {
+		ls.Keys = s.keys
+	}
+	if s.auth != nil {
+		s.policies = &policyEvaluator{ls: s.storage}
+	}
+	s.handler = s.chain(s.routes(), writeError)
+	s.s3Handler = s.chain(&s3API{ls: s.storage, domain: s.s3Domain, policies: s.policies}, func(w http.ResponseWriter, req *http.Request, err error) {
+		writeS3Error(w, req, "", err)
+	})
+	return s
+}
+
+func (s *Server) routes() http.Handler {
 	r := mux.NewRouter()
-	r.Use(loggingMiddleware)
 	// versioned API root
 	v1 := r.PathPrefix("/v1").Subrouter()
-	// storage subrouter
-	storageRouter := v1.PathPrefix("/storage").Subrouter()
+	s.register(v1.PathPrefix("/storage").Subrouter())
+	return r
+}
+
+// chain wraps h with request IDs, logging, the configured middleware,
+// authentication and customer-provided encryption keys, in that order.
+// Authentication failures and malformed keys are written with writeErr.
+func (s *Server) chain(h http.Handler, writeErr func(http.ResponseWriter, *http.Request, error)) http.Handler {
+	h = customerKeyMiddleware(writeErr)(h)
+	if s.auth != nil {
+		h = authMiddleware(s.auth, writeErr)(h)
+	}
+	for i := len(s.middleware) - 1; i >= 0; i-- {
+		h = s.middleware[i](h)
+	}
+	return requestIDMiddleware(loggingMiddleware(s.logger)(h))
+}
+
+// ServeHTTP serves the HolyDB API, so a Server can be mounted in another mux.
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.handler.ServeHTTP(w, req)
+}
+
+// S3Handler returns the S3-compatible API, with the same middleware and
+// authentication as the native one. Run serves it when WithS3 is given.
+func (s *Server) S3Handler() http.Handler { return s.s3Handler }
 
-	RegisterObjectHandlers(storageRouter, ls)
-	RegisterBucketHandlers(storageRouter, ls)
-	RegisterBucketMetaHandlers(storageRouter, ls)
-	RegisterStatsHandlers(storageRouter, ls)
-	RegisterReconstructHandlers(storageRouter, ls)
-	RegisterMultipartHandlers(storageRouter, ls)
+// Storage returns the storage backend.
+func (s *Server) Storage() storage.Storage { return s.storage }
 
-	return &http.Server{Addr: cfg.Addr, Handler: r}
+// Run starts the background workers and serves HTTP (and the S3 API when
+// configured) until ctx is cancelled or a listener fails, then shuts down
+// gracefully.
+func (s *Server) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s.startWorkers(ctx)
+	servers := []*http.Server{{Addr: s.addr, Handler: s, ErrorLog: s.logger}}
+	if s.s3Addr != "" {
+		servers = append(servers, &http.Server{Addr: s.s3Addr, Handler: s.s3Handler, ErrorLog: s.logger})
+	}
+	errc := make(chan error, len(servers))
+	for i, srv := range servers {
+		go func() {
+			if i == 0 {
+				s.logger.Printf("starting server on %s", srv.Addr)
+			} else {
+				s.logger.Printf("starting S3 API on %s", srv.Addr)
+			}
+			errc <- srv.ListenAndServe()
+		}()
+	}
+	var err error
+	select {
+	case err = <-errc:
+	case <-ctx.Done():
+	}
+	shutdownCtx, stop := context.WithTimeout(context.Background(), 10*time.Second)
+	defer stop()
+	for _, srv := range servers {
+		if serr := srv.Shutdown(shutdownCtx); serr != nil && err == nil {
+			err = serr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	for range servers {
+		if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+	}
+	return nil
 }
 
-// Run starts the HTTP server and blocks.
-func Run(cfg Config) error {
-	srv := New(cfg)
-	log.Printf("starting server on %s", cfg.Addr)
-	return srv.ListenAndServe()
+// ListenAndServe runs the server until it fails.
+func (s *Server) ListenAndServe() error {
+	return s.Run(context.Background())
+}
+
+// startWorkers starts the background workers that were configured and that
+// the storage backend supports.
+func (s *Server) startWorkers(ctx context.Context) {
+	if s.lifecycleInterval > 0 {
+		if lc, ok := s.storage.(lifecycleApplier); ok {
+			go runLifecycle(ctx, s.logger, lc, s.lifecycleInterval, s.lifecycleDryRun)
+		} else {
+			s.logger.Printf("lifecycle: storage backend %T does not support lifecycle rules", s.storage)
+		}
+	}
+	if s.gcInterval > 0 {
+		if gc, ok := s.storage.(garbageCollector); ok {
+			go runGC(ctx, s.logger, gc, s.gcInterval, s.gcMaxAge)
+		} else {
+			s.logger.Printf("gc: storage backend %T does not support garbage collection", s.storage)
+		}
+	}
+	if s.scrubInterval > 0 {
+		if fc, ok := s.storage.(checker); ok {
+			go runScrub(ctx, s.logger, fc, s.scrubInterval, s.scrubRepair)
+		} else {
+			s.logger.Printf("scrub: storage backend %T does not support consistency checks", s.storage)
+		}
+	}
 }
 
 // logging middleware to trace requests and response status
@@ -52,11 +246,49 @@ func (l *loggingResponseWriter) WriteHeader(code int) {
 	l.ResponseWriter.WriteHeader(code)
 }
 
-func loggingMiddleware(next http.Handler) http.Handler {
+func loggingMiddleware(logger *log.Logger) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lrw := &loggingResponseWriter{ResponseWriter: w, status: 200}
+			logger.Printf("REQ %s %s from %s id=%s", r.Method, r.URL.String(), r.RemoteAddr, requestID(r.Context()))
+			id := new(storage.Identity)
+			ctx := context.WithValue(context.WithValue(r.Context(), loggerKey{}, logger), identitySlotKey{}, id)
+			next.ServeHTTP(lrw, r.WithContext(ctx))
+			user := id.User
+			if user == "" {
+				user = "-"
+			}
+			logger.Printf("RES %d %s %s user=%s", lrw.status, r.Method, r.URL.Path, user)
+		})
+	}
+}
+
+type loggerKey struct{}
+
+// requestLogger returns the server's logger for req.
+func requestLogger(req *http.Request) *log.Logger {
+	if l, ok := req.Context().Value(loggerKey{}).(*log.Logger); ok {
+		return l
+	}
+	return log.Default()
+}
+
+type requestIDKey struct{}
+
+// requestIDMiddleware assigns every request a random ID, exposed in the
+// X-Request-Id response header and in error bodies.
+func requestIDMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		lrw := &loggingResponseWriter{ResponseWriter: w, status: 200}
-		log.Printf("REQ %s %s from %s", r.Method, r.URL.String(), r.RemoteAddr)
-		next.ServeHTTP(lrw, r)
-		log.Printf("RES %d %s %s", lrw.status, r.Method, r.URL.Path)
+		var b [8]byte
+		rand.Read(b[:])
+		id := hex.EncodeToString(b[:])
+		w.Header().Set("X-Request-Id", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
 	})
 }
+
+// requestID returns the ID assigned by requestIDMiddleware, if any.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
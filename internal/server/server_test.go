@@ -0,0 +1,136 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garder500/holydb/pkg/storage"
+)
+
+func TestNewOptions(t *testing.T) {
+	quiet := WithLogger(log.New(io.Discard, "", 0))
+	if ls, ok := New(quiet).Storage().(*storage.LocalStorage); !ok || ls.Root != "." {
+		t.Fatalf("default storage: %#v", New(quiet).Storage())
+	}
+	st := &storage.LocalStorage{Root: t.TempDir()}
+	if got := New(WithStorage(st), quiet).Storage(); got != st {
+		t.Fatalf("WithStorage: got %#v", got)
+	}
+	root := t.TempDir()
+	keys, err := storage.NewKeyring(bytes.Repeat([]byte{1}, storage.KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls, ok := New(WithRoot(root), WithEncryption(keys), quiet).Storage().(*storage.LocalStorage)
+	if !ok || ls.Root != root || ls.Keys != keys {
+		t.Fatalf("WithRoot and WithEncryption: %#v", ls)
+	}
+
+	// middleware runs in order on both APIs, before authentication
+	var order []string
+	mark := func(name string) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, req)
+			})
+		}
+	}
+	cred := Credential{AccessKey: "AK", SecretKey: "secret", User: "alice"}
+	srv := New(WithRoot(t.TempDir()), WithS3("", "S3.Test"), WithMiddleware(mark("a")), WithMiddleware(mark("b")),
+		WithAuth(NewSigV4Authenticator(staticCredentials{"AK": cred})), quiet)
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/v1/storage/photos", nil))
+	if rec.Code != http.StatusForbidden || strings.Join(order, ",") != "a,b" {
+		t.Fatalf("unsigned request: %d %s, middleware ran %v", rec.Code, rec.Body, order)
+	}
+	req := httptest.NewRequest(http.MethodPut, "/v1/storage/photos", nil)
+	signV4(req, cred, "", time.Now())
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("signed request: %d %s", rec.Code, rec.Body)
+	}
+	order = nil
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = "photos.s3.test"
+	signV4(req, cred, "", time.Now())
+	rec = httptest.NewRecorder()
+	srv.S3Handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "<Name>photos</Name>") || strings.Join(order, ",") != "a,b" {
+		t.Fatalf("S3 ListObjects on the virtual host: %d %s, middleware ran %v", rec.Code, rec.Body, order)
+	}
+}
+
+// freeAddr returns a loopback address nothing listens on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestRun(t *testing.T) {
+	addr, s3Addr := freeAddr(t), freeAddr(t)
+	srv := New(WithRoot(t.TempDir()), WithAddr(addr), WithS3(s3Addr, ""), WithLogger(log.New(io.Discard, "", 0)),
+		WithLifecycle(10*time.Millisecond, true), WithGC(10*time.Millisecond, time.Hour), WithScrub(10*time.Millisecond, true))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- srv.Run(ctx) }()
+
+	get := func(url string) (int, error) {
+		resp, err := http.Get(url)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+	for _, url := range []string{"http://" + addr + "/v1/storage/", "http://" + s3Addr + "/"} {
+		var code int
+		var err error
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if code, err = get(url); err == nil {
+				break
+			}
+		}
+		if err != nil || code != http.StatusOK {
+			t.Fatalf("GET %s: %d %v", url, code, err)
+		}
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Run after cancel: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after the context was cancelled")
+	}
+	if _, err := get("http://" + addr + "/v1/storage/"); err == nil {
+		t.Fatal("server still listening after Run returned")
+	}
+
+	// a listener that cannot start ends Run with its error
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	err = New(WithRoot(t.TempDir()), WithAddr(l.Addr().String()), WithLogger(log.New(io.Discard, "", 0))).Run(context.Background())
+	if err == nil {
+		t.Fatal("Run on a busy address returned no error")
+	}
+}
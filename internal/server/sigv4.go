@@ -0,0 +1,354 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garder500/holydb/pkg/storage"
+)
+
+const (
+	sigV4Algorithm = "AWS4-HMAC-SHA256"
+	amzDateFormat  = "20060102T150405Z"
+	// sigV4MaxSkew is how far the signing time of a request may be from the
+	// server clock.
+	sigV4MaxSkew = 15 * time.Minute
+	// sigV4MaxExpires caps X-Amz-Expires of presigned requests, as in S3.
+	sigV4MaxExpires = 7 * 24 * time.Hour
+
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	emptySHA256     = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	// streamingSignedPayload marks an aws-chunked body whose chunks are
+	// signed, optionally followed by signed trailers.
+	streamingSignedPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+)
+
+func authError(status int, code, message string) error {
+	return &apiError{status: status, code: code, message: message}
+}
+
+var (
+	errMissingCredentials = authError(http.StatusForbidden, "AccessDenied", "request is not signed")
+	errSignatureMismatch  = authError(http.StatusForbidden, "SignatureDoesNotMatch", "the request signature does not match")
+	errInvalidAccessKey   = authError(http.StatusForbidden, "InvalidAccessKeyId", "the access key does not exist")
+	errTimeSkewed         = authError(http.StatusForbidden, "RequestTimeTooSkewed", "the request time is too far from the server time")
+	errRequestExpired     = authError(http.StatusForbidden, "AccessDenied", "request has expired")
+)
+
+func malformedAuth(message string) error {
+	return authError(http.StatusBadRequest, "AuthorizationHeaderMalformed", message)
+}
+
+func malformedQueryAuth(message string) error {
+	return authError(http.StatusBadRequest, "AuthorizationQueryParametersError", message)
+}
+
+// SigV4Authenticator authenticates requests signed with AWS Signature
+// Version 4, either in the Authorization header or in the query string
+// (presigned URLs). Signed payload hashes are enforced on the body, and
+// aws-chunked bodies are decoded with each chunk signature verified. The
+// region and service of the credential scope are not checked. Authenticated
+// requests carry a storage.Identity in their context.
+type SigV4Authenticator struct {
+	creds CredentialSource
+	now   func() time.Time
+}
+
+// NewSigV4Authenticator returns a SigV4Authenticator looking up secret keys
+// in creds.
+func NewSigV4Authenticator(creds CredentialSource) *SigV4Authenticator {
+	return &SigV4Authenticator{creds: creds, now: time.Now}
+}
+
+// sigV4Request is the authentication data of a signed request.
+type sigV4Request struct {
+	accessKey     string
+	date          string // YYYYMMDD of the credential scope
+	scope         string // date/region/service/aws4_request
+	signedHeaders []string
+	signature     string
+	amzDate       string
+	payloadHash   string
+	presigned     bool
+}
+
+// Authenticate verifies the request signature.
+func (a *SigV4Authenticator) Authenticate(req *http.Request) (*http.Request, error) {
+	var sr *sigV4Request
+	var err error
+	switch {
+	case strings.HasPrefix(req.Header.Get("Authorization"), sigV4Algorithm+" "):
+		sr, err = parseSigV4Header(req)
+	case req.URL.Query().Get("X-Amz-Algorithm") != "":
+		sr, err = a.parseSigV4Query(req)
+	case req.Header.Get("Authorization") != "":
+		return nil, malformedAuth("unsupported authorization scheme; use " + sigV4Algorithm)
+	default:
+		return nil, errMissingCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := a.checkTime(sr); err != nil {
+		return nil, err
+	}
+	cred, ok := a.creds.Lookup(sr.accessKey)
+	if !ok {
+		return nil, errInvalidAccessKey
+	}
+	key := sigV4SigningKey(cred.SecretKey, sr.scope)
+	if !hmac.Equal([]byte(sr.sign(key, req)), []byte(sr.signature)) {
+		return nil, errSignatureMismatch
+	}
+
+	switch {
+	case strings.HasPrefix(sr.payloadHash, streamingSignedPayload):
+		signer := &chunkSigner{key: key, amzDate: sr.amzDate, scope: sr.scope, prev: sr.signature}
+		decodeAWSChunked(req, signer)
+	case strings.HasPrefix(sr.payloadHash, "STREAMING-"):
+		decodeAWSChunked(req, nil)
+	case isHexSHA256(sr.payloadHash):
+		req.Body = io.NopCloser(storage.NewVerifyingReader(req.Body, storage.Checksums{SHA256: sr.payloadHash}))
+	}
+	id := storage.Identity{User: cred.User, AccessKey: cred.AccessKey}
+	return req.WithContext(storage.WithIdentity(req.Context(), id)), nil
+}
+
+// parseSigV4Header parses an Authorization header of the form
+// AWS4-HMAC-SHA256 Credential=AK/date/region/service/aws4_request, SignedHeaders=a;b, Signature=hex
+func parseSigV4Header(req *http.Request) (*sigV4Request, error) {
+	fields := map[string]string{}
+	for _, f := range strings.Split(strings.TrimPrefix(req.Header.Get("Authorization"), sigV4Algorithm+" "), ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(f), "=")
+		if !ok {
+			return nil, malformedAuth("malformed authorization field " + f)
+		}
+		fields[k] = v
+	}
+	sr := &sigV4Request{signature: fields["Signature"], amzDate: req.Header.Get("X-Amz-Date")}
+	if err := sr.setCredential(fields["Credential"]); err != nil {
+		return nil, malformedAuth(err.Error())
+	}
+	if fields["SignedHeaders"] == "" || sr.signature == "" {
+		return nil, malformedAuth("SignedHeaders and Signature are required")
+	}
+	sr.signedHeaders = strings.Split(fields["SignedHeaders"], ";")
+	if sr.amzDate == "" {
+		// SigV4 also accepts the Date header, in its HTTP format
+		t, err := http.ParseTime(req.Header.Get("Date"))
+		if err != nil {
+			return nil, malformedAuth("missing X-Amz-Date header")
+		}
+		sr.amzDate = t.UTC().Format(amzDateFormat)
+	}
+	sr.payloadHash = req.Header.Get("X-Amz-Content-Sha256")
+	if sr.payloadHash == "" {
+		if req.ContentLength != 0 || len(req.TransferEncoding) > 0 {
+			return nil, badRequest("signed requests with a body must carry an X-Amz-Content-Sha256 header")
+		}
+		sr.payloadHash = emptySHA256
+	}
+	return sr, sr.checkHeaders()
+}
+
+// parseSigV4Query parses the X-Amz-* parameters of a presigned URL.
+func (a *SigV4Authenticator) parseSigV4Query(req *http.Request) (*sigV4Request, error) {
+	q := req.URL.Query()
+	if q.Get("X-Amz-Algorithm") != sigV4Algorithm {
+		return nil, malformedQueryAuth("X-Amz-Algorithm must be " + sigV4Algorithm)
+	}
+	sr := &sigV4Request{
+		signature: q.Get("X-Amz-Signature"),
+		amzDate:   q.Get("X-Amz-Date"),
+		presigned: true,
+	}
+	if err := sr.setCredential(q.Get("X-Amz-Credential")); err != nil {
+		return nil, malformedQueryAuth(err.Error())
+	}
+	if q.Get("X-Amz-SignedHeaders") == "" || sr.signature == "" || sr.amzDate == "" {
+		return nil, malformedQueryAuth("X-Amz-Date, X-Amz-SignedHeaders and X-Amz-Signature are required")
+	}
+	sr.signedHeaders = strings.Split(q.Get("X-Amz-SignedHeaders"), ";")
+	expires, err := strconv.Atoi(q.Get("X-Amz-Expires"))
+	if err != nil || expires < 0 || time.Duration(expires)*time.Second > sigV4MaxExpires {
+		return nil, malformedQueryAuth("X-Amz-Expires must be between 0 and 604800 seconds")
+	}
+	if t, err := time.Parse(amzDateFormat, sr.amzDate); err == nil && a.now().After(t.Add(time.Duration(expires)*time.Second)) {
+		return nil, errRequestExpired
+	}
+	sr.payloadHash = req.Header.Get("X-Amz-Content-Sha256")
+	if sr.payloadHash == "" {
+		sr.payloadHash = unsignedPayload
+	}
+	return sr, sr.checkHeaders()
+}
+
+// sign returns the hex signature of req with the signing key.
+func (sr *sigV4Request) sign(key []byte, req *http.Request) string {
+	stringToSign := sigV4Algorithm + "\n" + sr.amzDate + "\n" + sr.scope + "\n" + hexSHA256([]byte(canonicalRequest(req, sr)))
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// setCredential parses a credential AK/date/region/service/aws4_request.
+func (sr *sigV4Request) setCredential(credential string) error {
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[0] == "" || parts[4] != "aws4_request" {
+		return errors.New("credential must be <access-key>/<date>/<region>/<service>/aws4_request")
+	}
+	sr.accessKey, sr.date = parts[0], parts[1]
+	sr.scope = strings.Join(parts[1:], "/")
+	return nil
+}
+
+// checkHeaders validates the signing time and signed headers.
+func (sr *sigV4Request) checkHeaders() error {
+	if !strings.HasPrefix(sr.amzDate, sr.date) {
+		return malformedAuth("the credential date does not match the request date")
+	}
+	hasHost := false
+	for _, h := range sr.signedHeaders {
+		hasHost = hasHost || h == "host"
+	}
+	if !hasHost {
+		return malformedAuth("the host header must be signed")
+	}
+	return nil
+}
+
+// checkTime rejects requests signed too far from now. Presigned URLs may be
+// used until they expire, so only their clock skew into the future matters.
+func (a *SigV4Authenticator) checkTime(sr *sigV4Request) error {
+	t, err := time.Parse(amzDateFormat, sr.amzDate)
+	if err != nil {
+		return malformedAuth("malformed request date " + sr.amzDate)
+	}
+	now := a.now()
+	if t.After(now.Add(sigV4MaxSkew)) || (!sr.presigned && t.Before(now.Add(-sigV4MaxSkew))) {
+		return errTimeSkewed
+	}
+	return nil
+}
+
+// canonicalRequest builds the SigV4 canonical request of req.
+func canonicalRequest(req *http.Request, sr *sigV4Request) string {
+	var b strings.Builder
+	b.WriteString(req.Method)
+	b.WriteByte('\n')
+	path := req.URL.Path
+	if path == "" {
+		path = "/"
+	}
+	b.WriteString(awsEscape(path, false))
+	b.WriteByte('\n')
+	b.WriteString(canonicalQuery(req.URL.RawQuery))
+	b.WriteByte('\n')
+	for _, h := range sr.signedHeaders {
+		b.WriteString(h)
+		b.WriteByte(':')
+		b.WriteString(canonicalHeaderValue(req, h))
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+	b.WriteString(strings.Join(sr.signedHeaders, ";"))
+	b.WriteByte('\n')
+	b.WriteString(sr.payloadHash)
+	return b.String()
+}
+
+// canonicalQuery sorts and re-encodes the query parameters, leaving out the
+// signature of a presigned URL.
+func canonicalQuery(rawQuery string) string {
+	q, _ := url.ParseQuery(rawQuery)
+	var pairs []string
+	for k, vs := range q {
+		if k == "X-Amz-Signature" {
+			continue
+		}
+		for _, v := range vs {
+			pairs = append(pairs, awsEscape(k, true)+"="+awsEscape(v, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// canonicalHeaderValue returns the trimmed value of a signed header, with
+// runs of spaces collapsed. Go keeps some headers outside req.Header.
+func canonicalHeaderValue(req *http.Request, name string) string {
+	var values []string
+	switch name {
+	case "host":
+		values = []string{req.Host}
+	case "content-length":
+		values = req.Header.Values("Content-Length")
+		if len(values) == 0 && req.ContentLength >= 0 {
+			values = []string{strconv.FormatInt(req.ContentLength, 10)}
+		}
+	case "transfer-encoding":
+		values = req.TransferEncoding
+	default:
+		values = req.Header.Values(name)
+	}
+	for i, v := range values {
+		values[i] = strings.Join(strings.Fields(v), " ")
+	}
+	return strings.Join(values, ",")
+}
+
+// awsEscape percent-encodes s as SigV4 requires: every byte but unreserved
+// characters, and '/' in paths.
+func awsEscape(s string, encodeSlash bool) string {
+	const hexDigits = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&15])
+		}
+	}
+	return b.String()
+}
+
+// sigV4SigningKey derives the signing key of a credential scope.
+func sigV4SigningKey(secret, scope string) []byte {
+	key := []byte("AWS4" + secret)
+	for _, part := range strings.Split(scope, "/") {
+		key = hmacSHA256(key, part)
+	}
+	return key
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func isHexSHA256(s string) bool {
+	if len(s) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// stagingDirName is the per-bucket directory where object data is written
+// before being published into its object directory with a rename. It lives
+// in the bucket so the rename never crosses a filesystem boundary.
+const stagingDirName = ".staging"
+
+// stageFile copies r into a new temporary file under dir, fsyncs it and
+// returns its path, size and checksums. On error the temporary file is removed.
+func stageFile(dir, pattern string, r io.Reader) (string, int64, Checksums, error) {
+	return stagePart(dir, pattern, r, nil, 0)
+}
+
+// stagePart is stageFile for the data of part number part, encrypted with c
+// unless it is nil. The size and checksums are those of the plaintext.
+func stagePart(dir, pattern string, r io.Reader, c *objectCipher, part int) (string, int64, Checksums, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", 0, Checksums{}, err
+	}
+	f, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return "", 0, Checksums{}, err
+	}
+	var w io.Writer = f
+	var fw *frameWriter
+	if c != nil {
+		if fw, err = c.newWriter(f, part); err == nil {
+			w = fw
+		}
+	}
+	sums := newChecksumWriter()
+	var n int64
+	if err == nil {
+		n, err = io.Copy(io.MultiWriter(w, sums), r)
+	}
+	if err == nil && fw != nil {
+		err = fw.Close()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", 0, Checksums{}, err
+	}
+	return f.Name(), n, sums.Sum(), nil
+}
+
+// writeFileAtomic writes data to path through a sibling tmp file that is
+// fsynced and renamed over path, then fsyncs the parent directory.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir fsyncs a directory so that renames and unlinks inside it are durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// removeStaleParts deletes part.N files in objDir that are not listed in keep.
+// It is used after publishing a new version of an object so that parts left
+// over from a previous (e.g. multipart) version are not served with it.
+func removeStaleParts(objDir string, keep map[string]struct{}) error {
+	entries, err := os.ReadDir(objDir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasPrefix(e.Name(), "part.") {
+			continue
+		}
+		if _, ok := keep[e.Name()]; ok {
+			continue
+		}
+		if err := os.Remove(filepath.Join(objDir, e.Name())); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
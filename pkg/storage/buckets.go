@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// bucketInfoFileName records when a bucket was created.
+const bucketInfoFileName = ".bucket.info"
+
+// BucketInfo describes a bucket.
+type BucketInfo struct {
+	Name         string    `json:"name"`
+	CreationDate time.Time `json:"creation_date"`
+	// Owner is the user who created the bucket, empty when it was created
+	// without authentication.
+	Owner string `json:"owner,omitempty"`
+}
+
+// CreateBucket creates an empty bucket, owned by the identity in ctx if any.
+// Objects can only be written to buckets that exist.
+func (s *LocalStorage) CreateBucket(ctx context.Context, bucket string) error {
+	dir, err := s.bucketPath(bucket)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.Root, 0o755); err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			return fmt.Errorf("%w: %s", ErrBucketExists, bucket)
+		}
+		return err
+	}
+	id, _ := IdentityFromContext(ctx)
+	b, err := json.Marshal(BucketInfo{Name: bucket, CreationDate: time.Now().UTC(), Owner: id.User})
+	if err == nil {
+		err = writeFileAtomic(filepath.Join(dir, bucketInfoFileName), b)
+	}
+	if err == nil {
+		err = syncDir(s.Root)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	return nil
+}
+
+// HeadBucket returns the description of an existing bucket.
+func (s *LocalStorage) HeadBucket(ctx context.Context, bucket string) (BucketInfo, error) {
+	dir, err := s.existingBucketDir(bucket)
+	if err != nil {
+		return BucketInfo{Name: bucket}, err
+	}
+	return readBucketInfo(dir, bucket)
+}
+
+// readBucketInfo reads the bucket's creation record, falling back to the
+// directory time for buckets created implicitly by older versions.
+func readBucketInfo(dir, bucket string) (BucketInfo, error) {
+	info := BucketInfo{Name: bucket}
+	data, err := os.ReadFile(filepath.Join(dir, bucketInfoFileName))
+	if err == nil {
+		if err := json.Unmarshal(data, &info); err != nil {
+			return info, fmt.Errorf("corrupt bucket info: %w", err)
+		}
+		info.Name = bucket
+		return info, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return info, err
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return info, err
+	}
+	info.CreationDate = fi.ModTime().UTC()
+	return info, nil
+}
+
+// ListBuckets lists every bucket, sorted by name.
+func (s *LocalStorage) ListBuckets(ctx context.Context) ([]BucketInfo, error) {
+	entries, err := os.ReadDir(s.Root)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	buckets := []BucketInfo{}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if _, err := ParseBucketName(e.Name()); err != nil {
+			continue
+		}
+		info, err := readBucketInfo(filepath.Join(s.Root, e.Name()), e.Name())
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) { // deleted meanwhile
+				continue
+			}
+			return nil, err
+		}
+		buckets = append(buckets, info)
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Name < buckets[j].Name })
+	return buckets, nil
+}
+
+// DeleteBucket removes an empty bucket. A bucket holding objects, archived
+// versions or in-progress multipart uploads is only removed, with all its
+// content, when force is set; otherwise ErrBucketNotEmpty is returned.
+func (s *LocalStorage) DeleteBucket(ctx context.Context, bucket string, force bool) error {
+	dir, err := s.existingBucketDir(bucket)
+	if err != nil {
+		return err
+	}
+	if !force {
+		empty, err := s.bucketEmpty(ctx, bucket, dir)
+		if err != nil {
+			return err
+		}
+		if !empty {
+			return fmt.Errorf("%w: %s", ErrBucketNotEmpty, bucket)
+		}
+	}
+	// move the bucket out of the way first so the name is free again (and
+	// no longer listed) even while a large bucket is being removed
+	trash, err := os.MkdirTemp(s.Root, deletedDirPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(trash)
+	if err := os.Rename(dir, filepath.Join(trash, bucket)); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("%w: %s", ErrNoSuchBucket, bucket)
+		}
+		return err
+	}
+	return syncDir(s.Root)
+}
+
+// bucketEmpty reports whether the bucket holds no object, archived version
+// or multipart upload.
+func (s *LocalStorage) bucketEmpty(ctx context.Context, bucket, dir string) (bool, error) {
+	res, err := s.ListObjects(ctx, bucket, ListOptions{MaxKeys: 1})
+	if err != nil || len(res.Objects) > 0 {
+		return false, err
+	}
+	for _, sub := range []string{versionsDirName, ".multipart"} {
+		entries, err := os.ReadDir(filepath.Join(dir, sub))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return false, err
+		}
+		if len(entries) > 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strings"
+)
+
+// Checksums holds hex-encoded digests of object or part data. Empty fields
+// are unknown (for example objects written before checksums were recorded).
+type Checksums struct {
+	MD5    string `json:"md5,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	CRC32C string `json:"crc32c,omitempty"`
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// checksumWriter computes every supported digest of the bytes written to it.
+type checksumWriter struct {
+	md5    hash.Hash
+	sha256 hash.Hash
+	crc32c hash.Hash32
+}
+
+func newChecksumWriter() *checksumWriter {
+	return &checksumWriter{md5: md5.New(), sha256: sha256.New(), crc32c: crc32.New(crc32cTable)}
+}
+
+func (c *checksumWriter) Write(p []byte) (int, error) {
+	c.md5.Write(p)
+	c.sha256.Write(p)
+	c.crc32c.Write(p)
+	return len(p), nil
+}
+
+func (c *checksumWriter) Sum() Checksums {
+	return Checksums{
+		MD5:    hex.EncodeToString(c.md5.Sum(nil)),
+		SHA256: hex.EncodeToString(c.sha256.Sum(nil)),
+		CRC32C: hex.EncodeToString(c.crc32c.Sum(nil)),
+	}
+}
+
+// verify compares got against the non-empty fields of want.
+func (want Checksums) verify(got Checksums) error {
+	for _, c := range []struct{ name, want, got string }{
+		{"MD5", want.MD5, got.MD5},
+		{"SHA-256", want.SHA256, got.SHA256},
+		{"CRC32C", want.CRC32C, got.CRC32C},
+	} {
+		if c.want != "" && !strings.EqualFold(c.want, c.got) {
+			return fmt.Errorf("%w: %s mismatch", ErrBadDigest, c.name)
+		}
+	}
+	return nil
+}
+
+// NewVerifyingReader returns a reader that yields r unchanged but, once r is
+// exhausted, fails with ErrBadDigest instead of io.EOF when the data does not
+// match the non-empty digests in want. Storage implementations stage data
+// before publishing it, so a mismatch leaves the stored object untouched.
+func NewVerifyingReader(r io.Reader, want Checksums) io.Reader {
+	if want == (Checksums{}) {
+		return r
+	}
+	return &verifyingReader{r: r, want: want, sums: newChecksumWriter()}
+}
+
+type verifyingReader struct {
+	r    io.Reader
+	want Checksums
+	sums *checksumWriter
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.sums.Write(p[:n])
+	if err == io.EOF {
+		if verr := v.want.verify(v.sums.Sum()); verr != nil {
+			return n, verr
+		}
+	}
+	return n, err
+}
+
+// multipartETag computes an S3-style ETag for a multipart object: the MD5 of
+// the concatenated binary part MD5s, suffixed with the number of parts.
+func multipartETag(parts []PartInfo) (string, error) {
+	h := md5.New()
+	for _, p := range parts {
+		b, err := hex.DecodeString(p.ETag)
+		if err != nil || len(b) != md5.Size {
+			return "", fmt.Errorf("part %d has no valid etag", p.Number)
+		}
+		h.Write(b)
+	}
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(h.Sum(nil)), len(parts)), nil
+}
@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+)
+
+// Reconstructed files use a self-describing container:
+//
+//	offset  size  field
+//	0       8     magic "HOLYRCv\x00"
+//	8       2     format version, big-endian (ContainerVersion)
+//	10      2     flags, reserved (0)
+//	12      4     header length H, big-endian
+//	16      8     payload length P, big-endian
+//	24      H     header, JSON (ContainerHeader)
+//	24+H    P     payload: the object data
+//	24+H+P  32    SHA-256 of every preceding byte
+//
+// Files written before the container existed start with an 8-byte
+// big-endian header length followed by a flat JSON object of metadata and
+// the payload up to EOF, with no checksum. OpenReconstructed reads them as
+// version 0.
+const ContainerVersion = 1
+
+var containerMagic = [8]byte{'H', 'O', 'L', 'Y', 'R', 'C', 'v', 0}
+
+const (
+	containerPrefixSize = 24
+	// maxContainerHeader bounds the header a reader accepts.
+	maxContainerHeader = 1 << 20
+)
+
+// ContainerHeader describes the object stored in a reconstructed file.
+type ContainerHeader struct {
+	Key          string    `json:"key,omitempty"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified time.Time `json:"last_modified"`
+	// Metadata holds the metadata keys selected when the file was written.
+	Metadata Metadata `json:"metadata,omitempty"`
+}
+
+// writeContainer writes a container holding size bytes read from payload.
+func writeContainer(w io.Writer, h ContainerHeader, size int64, payload io.Reader) error {
+	hb, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	sum := sha256.New()
+	out := io.MultiWriter(w, sum)
+	var prefix [containerPrefixSize]byte
+	copy(prefix[:8], containerMagic[:])
+	binary.BigEndian.PutUint16(prefix[8:], ContainerVersion)
+	binary.BigEndian.PutUint32(prefix[12:], uint32(len(hb)))
+	binary.BigEndian.PutUint64(prefix[16:], uint64(size))
+	if _, err := out.Write(prefix[:]); err != nil {
+		return err
+	}
+	if _, err := out.Write(hb); err != nil {
+		return err
+	}
+	n, err := io.Copy(out, payload)
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("payload is %d bytes, expected %d", n, size)
+	}
+	_, err = w.Write(sum.Sum(nil))
+	return err
+}
+
+// Reconstructed reads the payload of a reconstructed file. Once the payload
+// is exhausted it verifies the trailing checksum, failing with ErrBadDigest
+// instead of io.EOF on mismatch.
+type Reconstructed struct {
+	Version int
+	Header  ContainerHeader
+	// Size is the payload length, or -1 when unknown (version 0).
+	Size int64
+
+	src       io.Reader
+	remaining int64
+	sum       hash.Hash
+	err       error // sticky once the payload has been read
+}
+
+// OpenReconstructed reads the header of a reconstructed file from r and
+// returns a reader positioned at the start of its payload.
+func OpenReconstructed(r io.Reader) (*Reconstructed, error) {
+	var prefix [containerPrefixSize]byte
+	if _, err := io.ReadFull(r, prefix[:8]); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidContainer, err)
+	}
+	if !bytes.Equal(prefix[:8], containerMagic[:]) {
+		return openLegacy(r, binary.BigEndian.Uint64(prefix[:8]))
+	}
+	if _, err := io.ReadFull(r, prefix[8:]); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidContainer, err)
+	}
+	rc := &Reconstructed{Version: int(binary.BigEndian.Uint16(prefix[8:])), src: r, sum: sha256.New()}
+	if rc.Version != ContainerVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidContainer, rc.Version)
+	}
+	hlen := binary.BigEndian.Uint32(prefix[12:])
+	size := binary.BigEndian.Uint64(prefix[16:])
+	if hlen > maxContainerHeader || size > 1<<62 {
+		return nil, fmt.Errorf("%w: implausible header or payload length", ErrInvalidContainer)
+	}
+	hb := make([]byte, hlen)
+	if _, err := io.ReadFull(r, hb); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidContainer, err)
+	}
+	if err := json.Unmarshal(hb, &rc.Header); err != nil {
+		return nil, fmt.Errorf("%w: header: %v", ErrInvalidContainer, err)
+	}
+	rc.sum.Write(prefix[:])
+	rc.sum.Write(hb)
+	rc.Size, rc.remaining = int64(size), int64(size)
+	return rc, nil
+}
+
+// openLegacy reads the metadata header of a version 0 file.
+func openLegacy(r io.Reader, hlen uint64) (*Reconstructed, error) {
+	if hlen > maxContainerHeader {
+		return nil, fmt.Errorf("%w: bad magic", ErrInvalidContainer)
+	}
+	hb := make([]byte, hlen)
+	if _, err := io.ReadFull(r, hb); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidContainer, err)
+	}
+	rc := &Reconstructed{Size: -1, src: r}
+	if err := json.Unmarshal(hb, &rc.Header.Metadata); err != nil {
+		return nil, fmt.Errorf("%w: bad magic", ErrInvalidContainer)
+	}
+	return rc, nil
+}
+
+func (rc *Reconstructed) Read(p []byte) (int, error) {
+	switch {
+	case rc.Version == 0:
+		return rc.src.Read(p)
+	case rc.err != nil:
+		return 0, rc.err
+	case rc.remaining == 0:
+		rc.err = rc.verify()
+		return 0, rc.err
+	}
+	if int64(len(p)) > rc.remaining {
+		p = p[:rc.remaining]
+	}
+	n, err := rc.src.Read(p)
+	rc.sum.Write(p[:n])
+	rc.remaining -= int64(n)
+	if err == io.EOF {
+		if rc.remaining > 0 {
+			rc.err = fmt.Errorf("%w: payload truncated", ErrInvalidContainer)
+			return n, rc.err
+		}
+		err = nil
+	}
+	return n, err
+}
+
+// verify checks the trailing checksum once the payload has been read and
+// returns io.EOF when it matches.
+func (rc *Reconstructed) verify() error {
+	var trailer [sha256.Size]byte
+	if _, err := io.ReadFull(rc.src, trailer[:]); err != nil {
+		return fmt.Errorf("%w: missing checksum", ErrInvalidContainer)
+	}
+	if !bytes.Equal(trailer[:], rc.sum.Sum(nil)) {
+		return fmt.Errorf("%w: reconstructed file checksum", ErrBadDigest)
+	}
+	return io.EOF
+}
+
+// Import stores the payload of the reconstructed file read from r as key,
+// with the metadata recorded in its header. An empty key uses the key
+// recorded in the header. Nothing is published unless the payload matches
+// the file's checksum.
+func (s *LocalStorage) Import(ctx context.Context, bucket, key string, r io.Reader) (ObjectInfo, error) {
+	rc, err := OpenReconstructed(r)
+	if err != nil {
+		return ObjectInfo{Key: key}, err
+	}
+	if key == "" {
+		key = rc.Header.Key
+	}
+	if key == "" {
+		return ObjectInfo{}, fmt.Errorf("%w: the file records no key, one must be given", ErrInvalidArgument)
+	}
+	return s.PutWithMetadata(ctx, bucket, key, rc, rc.Header.Metadata)
+}
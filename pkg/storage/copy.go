@@ -0,0 +1,220 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Metadata directives for CopyOptions.MetadataDirective.
+const (
+	MetadataCopy    = "COPY"
+	MetadataReplace = "REPLACE"
+)
+
+// CopyOptions controls Copy.
+type CopyOptions struct {
+	// SourceVersionID copies a specific version instead of the current one.
+	SourceVersionID string
+	// MetadataDirective is MetadataCopy (the default) to keep the source
+	// metadata or MetadataReplace to use Metadata instead.
+	MetadataDirective string
+	Metadata          Metadata
+}
+
+// Copy copies an object without streaming it through the caller. Part files
+// are immutable once published, so LocalStorage hard-links them into the
+// destination and only falls back to copying the data when the buckets are
+// on different filesystems. The copy keeps the encryption of the source,
+// except that a source encrypted with a customer-provided key (which the
+// context must carry, see WithCopySourceCustomerKey) or a destination
+// customer-provided key other than the source's makes Copy re-encrypt the
+// data as a single part, as a Put would.
+func (s *LocalStorage) Copy(ctx context.Context, srcBucket, srcKey, dstBucket, dstKey string, opts CopyOptions) (ObjectInfo, error) {
+	info := ObjectInfo{Key: dstKey}
+	switch opts.MetadataDirective {
+	case "", MetadataCopy, MetadataReplace:
+	default:
+		return info, fmt.Errorf("%w: unknown metadata directive %q", ErrInvalidArgument, opts.MetadataDirective)
+	}
+	srcDir, m, err := s.copySource(ctx, srcBucket, srcKey, opts.SourceVersionID)
+	if err != nil {
+		return info, err
+	}
+	srcCipher, err := s.openCipher(m.Encryption, copySourceKey(ctx))
+	if err != nil {
+		return info, err
+	}
+	// data under a customer-provided key is rewritten unless the destination
+	// uses the same key, which keeps the wrapped data key valid
+	srcCustomer := m.Encryption != nil && m.Encryption.CustomerKeyMD5 != ""
+	rewrite := srcCustomer || customerKey(ctx) != nil
+	if ck := customerKey(ctx); srcCustomer && ck != nil && CustomerKeyMD5(ck) == m.Encryption.CustomerKeyMD5 {
+		rewrite = false
+	}
+	dstDir, err := s.objectPath(dstBucket, dstKey)
+	if err != nil {
+		return info, err
+	}
+	if strings.HasSuffix(dstKey, "/") {
+		return info, invalid(dstKey, "cannot copy onto a directory key")
+	}
+	meta := opts.Metadata
+	if opts.MetadataDirective != MetadataReplace {
+		if meta, err = s.readMeta(srcDir); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return info, err
+		}
+	}
+	bucketDir, err := s.existingBucketDir(dstBucket)
+	if err != nil {
+		return info, err
+	}
+	if err := s.checkQuota(ctx, dstBucket, nil, m.Size, s.overwrittenSize(ctx, dstBucket, dstDir)); err != nil {
+		return info, err
+	}
+
+	// link the parts into the destination bucket's staging area first, so
+	// the copy survives the source being overwritten or deleted meanwhile
+	stagingDir := filepath.Join(bucketDir, stagingDirName)
+	if err := os.MkdirAll(stagingDir, 0o755); err != nil {
+		return info, err
+	}
+	staged, err := os.MkdirTemp(stagingDir, "copy-")
+	if err != nil {
+		return info, err
+	}
+	defer os.RemoveAll(staged)
+	if rewrite {
+		if m, err = s.reencrypt(ctx, srcDir, staged, m, srcCipher); err != nil {
+			return info, err
+		}
+	} else {
+		for _, p := range m.Parts {
+			if err := linkOrCopy(filepath.Join(srcDir, p.FileName()), filepath.Join(staged, p.FileName())); err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return info, s.keyNotFound(srcBucket, srcKey)
+				}
+				return info, err
+			}
+		}
+	}
+
+	m.LastModified = time.Now().UTC()
+	m.DeleteMarker = false
+	checkQuota := func(u Usage) error {
+		return s.checkQuota(ctx, dstBucket, &u, m.Size, s.overwrittenSize(ctx, dstBucket, dstDir))
+	}
+	err = s.trackWrite(bucketDir, usageScope{ObjDir: dstDir, Key: dstKey}, checkQuota, func() error {
+		if err := os.MkdirAll(dstDir, 0o755); err != nil {
+			return err
+		}
+		if m.VersionID, err = s.prepareVersion(ctx, dstBucket, bucketDir, dstDir, dstKey); err != nil {
+			return err
+		}
+		for _, p := range m.Parts {
+			if err := os.Rename(filepath.Join(staged, p.FileName()), filepath.Join(dstDir, p.FileName())); err != nil {
+				return err
+			}
+		}
+		return s.publish(dstDir, m, meta)
+	})
+	if err != nil {
+		return info, err
+	}
+	info = m.info(dstKey)
+	info.ContentType = meta[MetaContentType]
+	return info, nil
+}
+
+// reencrypt writes the object of srcDir described by m, decrypted with c, to
+// dir as part.1 encrypted for a new object, and returns its manifest.
+func (s *LocalStorage) reencrypt(ctx context.Context, srcDir, dir string, m Manifest, c *objectCipher) (Manifest, error) {
+	enc, dst, err := s.newEncryption(ctx)
+	if err != nil {
+		return m, err
+	}
+	rc, err := openRange(srcDir, m, 0, -1, c)
+	if err != nil {
+		return m, err
+	}
+	defer rc.Close()
+	tmp, size, sums, err := stagePart(dir, ".part-*", rc, dst, 1)
+	if err != nil {
+		return m, err
+	}
+	out := Manifest{
+		Parts:      []PartInfo{{Number: 1, Size: size, ETag: sums.MD5, SHA256: sums.SHA256, LastModified: time.Now().UTC()}},
+		Size:       size,
+		ETag:       sums.MD5,
+		SHA256:     sums.SHA256,
+		CRC32C:     sums.CRC32C,
+		Encryption: enc,
+	}
+	return out, os.Rename(tmp, filepath.Join(dir, out.Parts[0].FileName()))
+}
+
+// copySource returns the directory and manifest of the object (or version)
+// to copy.
+func (s *LocalStorage) copySource(ctx context.Context, bucket, key, versionID string) (string, Manifest, error) {
+	objDir, err := s.objectPath(bucket, key)
+	if err != nil {
+		return "", Manifest{}, err
+	}
+	if strings.HasSuffix(key, "/") {
+		return "", Manifest{}, invalid(key, "cannot copy a directory key")
+	}
+	bucketDir, err := s.existingBucketDir(bucket)
+	if err != nil {
+		return "", Manifest{}, err
+	}
+	m, err := readManifest(objDir)
+	if versionID == "" || (err == nil && versionIDOf(m) == versionID) {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return "", m, s.keyNotFound(bucket, key)
+			}
+			return "", m, err
+		}
+		return objDir, m, nil
+	}
+	dir, err := versionPath(bucketDir, key, versionID)
+	if err != nil {
+		return "", Manifest{}, err
+	}
+	if m, err = readManifest(dir); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", m, fmt.Errorf("%w: %s/%s version %s", ErrNoSuchVersion, bucket, key, versionID)
+		}
+		return "", m, err
+	}
+	if m.DeleteMarker {
+		return "", m, fmt.Errorf("%w: %s/%s version %s is a delete marker", ErrNoSuchKey, bucket, key, versionID)
+	}
+	return dir, m, nil
+}
+
+// Rename moves an object to another key of the same bucket: it copies the
+// object (hard links, no data is rewritten) and then deletes the source. In
+// a versioned bucket the source keeps its history behind a delete marker.
+func (s *LocalStorage) Rename(ctx context.Context, bucket, srcKey, dstKey string) (ObjectInfo, error) {
+	if srcKey == dstKey {
+		return ObjectInfo{Key: dstKey}, invalid(dstKey, "source and destination keys are identical")
+	}
+	// the object keeps its customer-provided key, if any
+	if ck := customerKey(ctx); ck != nil && copySourceKey(ctx) == nil {
+		ctx = WithCopySourceCustomerKey(ctx, ck)
+	}
+	info, err := s.Copy(ctx, bucket, srcKey, bucket, dstKey, CopyOptions{})
+	if err != nil {
+		return info, err
+	}
+	if err := s.Delete(ctx, bucket, srcKey); err != nil {
+		return info, err
+	}
+	return info, nil
+}
@@ -0,0 +1,390 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LocalStorage encrypts objects at rest when it is given a Keyring. Every
+// object (or multipart upload) gets a random data key that encrypts its part
+// files (see frames.go); the data key is stored in the manifest wrapped,
+// i.e. sealed with AES-256-GCM, under the current master key of the keyring
+// or under the customer-provided key the object was written with. data.meta
+// is sealed under the current master key. Manifests, upload records and
+// the bucket configuration files stay in clear, and objects written before
+// a keyring was configured stay readable, unencrypted.
+
+// MasterKeyEnv is the environment variable LoadKeyring reads master keys
+// from when no key file is given.
+const MasterKeyEnv = "HOLYDB_MASTER_KEY"
+
+// EncryptionAES256 is the only encryption algorithm, AES-256-GCM.
+const EncryptionAES256 = "AES256"
+
+// KeySize is the size of master, data and customer-provided keys.
+const KeySize = 32
+
+// Encryption describes how the part files of an object are encrypted. It is
+// recorded in the manifest, and in the upload directory of multipart uploads.
+type Encryption struct {
+	Algorithm string `json:"algorithm"`
+	// KeyID names the master key DataKey is wrapped with; it is empty when
+	// the object uses a customer-provided key.
+	KeyID string `json:"key_id,omitempty"`
+	// CustomerKeyMD5 is the base64 MD5 of the customer-provided key DataKey
+	// is wrapped with.
+	CustomerKeyMD5 string `json:"customer_key_md5,omitempty"`
+	// DataKey is the wrapped data key: a GCM nonce followed by the sealed key.
+	DataKey []byte `json:"data_key"`
+}
+
+// Additional data binding wrapped keys and sealed metadata to their use.
+var (
+	dataKeyAAD  = []byte("holydb data key")
+	metadataAAD = []byte("holydb metadata")
+)
+
+// Keyring holds the master keys that wrap data keys. The first key is the
+// current one: new objects use it and RotateKeys rewraps everything under
+// it. The others are only used to read objects not rotated yet.
+type Keyring struct {
+	ids  []string
+	keys map[string][]byte
+}
+
+// NewKeyring returns a keyring of 32-byte keys, the first being current.
+func NewKeyring(keys ...[]byte) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w: no master key", ErrInvalidConfig)
+	}
+	k := &Keyring{keys: map[string][]byte{}}
+	for i, key := range keys {
+		if len(key) != KeySize {
+			return nil, fmt.Errorf("%w: master key #%d has %d bytes, want %d", ErrInvalidConfig, i+1, len(key), KeySize)
+		}
+		id := KeyID(key)
+		if _, ok := k.keys[id]; ok {
+			continue
+		}
+		k.ids = append(k.ids, id)
+		k.keys[id] = bytes.Clone(key)
+	}
+	return k, nil
+}
+
+// ParseKeyring parses base64 master keys separated by newlines or commas.
+// Blank lines and lines starting with # are ignored.
+func ParseKeyring(text string) (*Keyring, error) {
+	var keys [][]byte
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, field := range strings.Split(line, ",") {
+			if field = strings.TrimSpace(field); field == "" {
+				continue
+			}
+			key, err := base64.StdEncoding.DecodeString(field)
+			if err != nil {
+				return nil, fmt.Errorf("%w: master key #%d is not valid base64", ErrInvalidConfig, len(keys)+1)
+			}
+			keys = append(keys, key)
+		}
+	}
+	return NewKeyring(keys...)
+}
+
+// LoadKeyring reads the master keys from the key file at path or, when path
+// is empty, from the MasterKeyEnv environment variable. It returns nil when
+// neither is set, in which case objects are stored in clear.
+func LoadKeyring(path string) (*Keyring, error) {
+	text := os.Getenv(MasterKeyEnv)
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		text = string(b)
+	}
+	if strings.TrimSpace(text) == "" {
+		return nil, nil
+	}
+	return ParseKeyring(text)
+}
+
+// GenerateMasterKey adds a new random key at the top of the key file at
+// path, creating it when needed, so it becomes the current key. It returns
+// the new key's ID.
+func GenerateMasterKey(path string) (string, error) {
+	old, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	data := append([]byte(base64.StdEncoding.EncodeToString(key)+"\n"), old...)
+	if _, err := ParseKeyring(string(data)); err != nil {
+		return "", fmt.Errorf("%s: %w", path, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return "", err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return KeyID(key), nil
+}
+
+// KeyID returns the identifier of a master key recorded with the data keys
+// it wraps: the first 8 bytes of its SHA-256, in hex.
+func KeyID(key []byte) string {
+	h := sha256.Sum256(key)
+	return hex.EncodeToString(h[:8])
+}
+
+// CurrentID returns the ID of the key new objects are encrypted with.
+func (k *Keyring) CurrentID() string { return k.ids[0] }
+
+// IDs returns the IDs of every key, the current one first.
+func (k *Keyring) IDs() []string { return append([]string(nil), k.ids...) }
+
+func (k *Keyring) key(id string) ([]byte, error) {
+	if k != nil {
+		if key, ok := k.keys[id]; ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: master key %s", ErrKeyUnavailable, id)
+}
+
+type customerKeyKey struct{}
+
+type copySourceKeyKey struct{}
+
+// WithCustomerKey returns a copy of ctx carrying a customer-provided key:
+// objects written with it are encrypted with it instead of a master key,
+// and they can only be read with it.
+func WithCustomerKey(ctx context.Context, key []byte) context.Context {
+	return context.WithValue(ctx, customerKeyKey{}, key)
+}
+
+// WithCopySourceCustomerKey returns a copy of ctx carrying the
+// customer-provided key of the source of a Copy.
+func WithCopySourceCustomerKey(ctx context.Context, key []byte) context.Context {
+	return context.WithValue(ctx, copySourceKeyKey{}, key)
+}
+
+func customerKey(ctx context.Context) []byte {
+	key, _ := ctx.Value(customerKeyKey{}).([]byte)
+	return key
+}
+
+func copySourceKey(ctx context.Context) []byte {
+	key, _ := ctx.Value(copySourceKeyKey{}).([]byte)
+	return key
+}
+
+// CustomerKeyMD5 returns the base64 MD5 identifying a customer-provided key.
+func CustomerKeyMD5(key []byte) string {
+	sum := md5.Sum(key)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(b)
+}
+
+// seal encrypts data under key with a random nonce, which it prepends.
+func seal(key, data, aad []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, data, aad), nil
+}
+
+// open decrypts what seal returned.
+func open(key, sealed, aad []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed data too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], aad)
+}
+
+// newEncryption returns the encryption of an object about to be written:
+// with the customer-provided key of ctx if any, otherwise with the current
+// master key. Both are nil when the storage has no keyring.
+func (s *LocalStorage) newEncryption(ctx context.Context) (*Encryption, *objectCipher, error) {
+	ck := customerKey(ctx)
+	if ck == nil && s.Keys == nil {
+		return nil, nil, nil
+	}
+	dataKey := make([]byte, KeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, nil, err
+	}
+	enc := &Encryption{Algorithm: EncryptionAES256}
+	wrapKey := ck
+	if ck != nil {
+		if len(ck) != KeySize {
+			return nil, nil, fmt.Errorf("%w: customer key must be %d bytes", ErrInvalidArgument, KeySize)
+		}
+		enc.CustomerKeyMD5 = CustomerKeyMD5(ck)
+	} else {
+		enc.KeyID = s.Keys.CurrentID()
+		wrapKey, _ = s.Keys.key(enc.KeyID)
+	}
+	var err error
+	if enc.DataKey, err = seal(wrapKey, dataKey, dataKeyAAD); err != nil {
+		return nil, nil, err
+	}
+	c, err := newObjectCipher(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return enc, c, nil
+}
+
+// objectCipher returns the cipher of an object encrypted as enc, using the
+// customer-provided key of ctx for customer-key objects. It returns nil for
+// unencrypted objects.
+func (s *LocalStorage) objectCipher(ctx context.Context, enc *Encryption) (*objectCipher, error) {
+	return s.openCipher(enc, customerKey(ctx))
+}
+
+// openCipher unwraps the data key of enc with a master key or with ck.
+func (s *LocalStorage) openCipher(enc *Encryption, ck []byte) (*objectCipher, error) {
+	if enc == nil {
+		return nil, nil
+	}
+	if enc.Algorithm != EncryptionAES256 {
+		return nil, fmt.Errorf("unsupported encryption algorithm %q", enc.Algorithm)
+	}
+	var dataKey []byte
+	if enc.CustomerKeyMD5 != "" {
+		if ck == nil {
+			return nil, ErrCustomerKeyRequired
+		}
+		if subtle.ConstantTimeCompare([]byte(CustomerKeyMD5(ck)), []byte(enc.CustomerKeyMD5)) != 1 {
+			return nil, ErrWrongCustomerKey
+		}
+		var err error
+		if dataKey, err = open(ck, enc.DataKey, dataKeyAAD); err != nil {
+			return nil, ErrWrongCustomerKey
+		}
+	} else {
+		mk, err := s.Keys.key(enc.KeyID)
+		if err != nil {
+			return nil, err
+		}
+		if dataKey, err = open(mk, enc.DataKey, dataKeyAAD); err != nil {
+			return nil, fmt.Errorf("cannot unwrap data key with master key %s: %w", enc.KeyID, err)
+		}
+	}
+	return newObjectCipher(dataKey)
+}
+
+// rewrap wraps the data key of enc under the current master key.
+func (s *LocalStorage) rewrap(enc *Encryption) error {
+	old, err := s.Keys.key(enc.KeyID)
+	if err != nil {
+		return err
+	}
+	dataKey, err := open(old, enc.DataKey, dataKeyAAD)
+	if err != nil {
+		return fmt.Errorf("cannot unwrap data key with master key %s: %w", enc.KeyID, err)
+	}
+	id := s.Keys.CurrentID()
+	current, _ := s.Keys.key(id)
+	if enc.DataKey, err = seal(current, dataKey, dataKeyAAD); err != nil {
+		return err
+	}
+	enc.KeyID = id
+	return nil
+}
+
+// sealedMetaMagic starts a data.meta sealed under a master key; plain
+// metadata is a JSON object.
+const sealedMetaMagic = "HDBM\x01"
+
+// sealedMeta is the JSON following sealedMetaMagic.
+type sealedMeta struct {
+	KeyID  string `json:"key_id"`
+	Sealed []byte `json:"sealed"`
+}
+
+// encodeMeta returns the content of data.meta for meta, sealed under the
+// current master key when the storage has a keyring.
+func (s *LocalStorage) encodeMeta(meta Metadata) ([]byte, error) {
+	b, err := json.Marshal(meta)
+	if err != nil || s.Keys == nil {
+		return b, err
+	}
+	sm := sealedMeta{KeyID: s.Keys.CurrentID()}
+	key, _ := s.Keys.key(sm.KeyID)
+	if sm.Sealed, err = seal(key, b, metadataAAD); err != nil {
+		return nil, err
+	}
+	b, err = json.Marshal(sm)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(sealedMetaMagic), b...), nil
+}
+
+// decodeMeta parses the content of data.meta, plain or sealed. It also
+// returns the ID of the master key sealed metadata uses.
+func (s *LocalStorage) decodeMeta(data []byte) (Metadata, string, error) {
+	var sm sealedMeta
+	if rest, ok := bytes.CutPrefix(data, []byte(sealedMetaMagic)); ok {
+		if err := json.Unmarshal(rest, &sm); err != nil {
+			return nil, "", err
+		}
+		key, err := s.Keys.key(sm.KeyID)
+		if err != nil {
+			return nil, sm.KeyID, err
+		}
+		if data, err = open(key, sm.Sealed, metadataAAD); err != nil {
+			return nil, sm.KeyID, fmt.Errorf("cannot decrypt metadata: %w", err)
+		}
+	}
+	var m Metadata
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, sm.KeyID, err
+	}
+	return m, sm.KeyID, nil
+}
@@ -0,0 +1,56 @@
+package storage
+
+import "errors"
+
+// Sentinel errors returned by Storage implementations. Callers should test
+// for them with errors.Is; implementations wrap them with the bucket, key or
+// upload ID involved but never with filesystem paths.
+var (
+	// ErrInvalidKey is returned when a bucket name, object key or upload ID
+	// fails validation. It is always returned before anything touches the
+	// underlying storage.
+	ErrInvalidKey = errors.New("invalid bucket name or object key")
+	// ErrNoSuchBucket is returned when the bucket does not exist.
+	ErrNoSuchBucket = errors.New("no such bucket")
+	// ErrNoSuchKey is returned when the object does not exist.
+	ErrNoSuchKey = errors.New("no such key")
+	// ErrNoSuchVersion is returned when an object version does not exist.
+	ErrNoSuchVersion = errors.New("no such version")
+	// ErrNoSuchUpload is returned when a multipart upload ID is unknown.
+	ErrNoSuchUpload = errors.New("no such upload")
+	// ErrBucketExists is returned when creating a bucket that already exists.
+	ErrBucketExists = errors.New("bucket already exists")
+	// ErrBucketNotEmpty is returned when deleting a bucket that still holds objects.
+	ErrBucketNotEmpty = errors.New("bucket not empty")
+	// ErrQuotaExceeded is returned when a write would exceed the bucket capacity.
+	ErrQuotaExceeded = errors.New("bucket quota exceeded")
+	// ErrInvalidPart is returned for out-of-range, missing or mismatched multipart parts.
+	ErrInvalidPart = errors.New("invalid part")
+	// ErrBadDigest is returned when uploaded data does not match the checksum
+	// supplied by the client.
+	ErrBadDigest = errors.New("checksum mismatch")
+	// ErrInvalidRange is returned when a requested byte range lies outside the object.
+	ErrInvalidRange = errors.New("invalid range")
+	// ErrInvalidConfig is returned when a bucket configuration (such as a
+	// lifecycle rule set) is malformed.
+	ErrInvalidConfig = errors.New("invalid configuration")
+	// ErrInvalidArgument is returned for malformed request parameters such as
+	// a listing continuation token.
+	ErrInvalidArgument = errors.New("invalid argument")
+	// ErrInvalidContainer is returned when a reconstructed file is truncated
+	// or not in a known container format. A payload that does not match the
+	// file's checksum fails with ErrBadDigest instead.
+	ErrInvalidContainer = errors.New("invalid reconstruct container")
+	// ErrCustomerKeyRequired is returned when reading or writing an object
+	// encrypted with a customer-provided key without supplying that key.
+	ErrCustomerKeyRequired = errors.New("object is encrypted with a customer-provided key")
+	// ErrWrongCustomerKey is returned when the customer-provided key does
+	// not decrypt the object.
+	ErrWrongCustomerKey = errors.New("customer-provided key does not match the object")
+	// ErrKeyUnavailable is returned when an object is encrypted with a master
+	// key the storage was not given (see Keyring).
+	ErrKeyUnavailable = errors.New("encryption key unavailable")
+	// ErrRootLocked is returned when another process, such as a running
+	// server, holds the lock of the storage root (see LocalStorage.LockRoot).
+	ErrRootLocked = errors.New("storage root in use by another process")
+)
@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Encrypted part files hold a header followed by the part data sealed with
+// AES-256-GCM in frames of frameSize bytes:
+//
+//	"HDBE" | version | nonce prefix (8 bytes) | frame 0 | frame 1 | ...
+//
+// Each frame is up to frameSize bytes of data followed by a 16-byte tag. The
+// nonce of frame i is the prefix followed by i, and its additional data is
+// the part number and whether it is the last frame, so frames cannot be
+// reordered, moved to another part or cut off without failing to decrypt.
+// An empty part still has one, empty, frame. Reading a byte range only
+// decrypts the frames covering it.
+const (
+	frameSize       = 64 << 10
+	frameMagic      = "HDBE"
+	frameVersion    = 1
+	framePrefixSize = 8
+	frameHeaderSize = len(frameMagic) + 1 + framePrefixSize
+	frameTagSize    = 16
+)
+
+// objectCipher encrypts and decrypts the part files of one object with its
+// data key. A nil *objectCipher stands for an unencrypted object.
+type objectCipher struct {
+	aead cipher.AEAD
+}
+
+func newObjectCipher(dataKey []byte) (*objectCipher, error) {
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &objectCipher{aead: aead}, nil
+}
+
+// frameCount returns the number of frames holding size bytes.
+func frameCount(size int64) int64 {
+	if size == 0 {
+		return 1
+	}
+	return (size + frameSize - 1) / frameSize
+}
+
+// encryptedSize returns the size of the encrypted file of a part of size bytes.
+func encryptedSize(size int64) int64 {
+	return int64(frameHeaderSize) + size + frameCount(size)*frameTagSize
+}
+
+// plainSize returns the size of the data in an encrypted file of n bytes,
+// the inverse of encryptedSize.
+func plainSize(n int64) (int64, bool) {
+	body := n - int64(frameHeaderSize)
+	if body < frameTagSize {
+		return 0, false
+	}
+	full, rest := body/(frameSize+frameTagSize), body%(frameSize+frameTagSize)
+	switch {
+	case rest == 0:
+		return full * frameSize, true
+	case rest < frameTagSize:
+		return 0, false
+	}
+	return full*frameSize + rest - frameTagSize, true
+}
+
+func frameNonce(prefix []byte, i int64) []byte {
+	return binary.BigEndian.AppendUint32(append(make([]byte, 0, 12), prefix...), uint32(i))
+}
+
+func frameAAD(part int, last bool) []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(part))
+	if last {
+		return append(b, 1)
+	}
+	return append(b, 0)
+}
+
+// frameWriter encrypts the data written to it as part number part. A frame
+// is only sealed once it is known whether more data follows; Close seals the
+// last one.
+type frameWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	part   int
+	prefix []byte
+	index  int64
+	buf    []byte
+	out    []byte
+}
+
+// newWriter writes the file header to w and returns a writer encrypting part.
+func (c *objectCipher) newWriter(w io.Writer, part int) (*frameWriter, error) {
+	prefix := make([]byte, framePrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	header := append(append([]byte(frameMagic), frameVersion), prefix...)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &frameWriter{w: w, aead: c.aead, part: part, prefix: prefix, buf: make([]byte, 0, frameSize)}, nil
+}
+
+func (fw *frameWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if len(fw.buf) == frameSize {
+			if err := fw.flush(false); err != nil {
+				return n - len(p), err
+			}
+		}
+		k := min(frameSize-len(fw.buf), len(p))
+		fw.buf = append(fw.buf, p[:k]...)
+		p = p[k:]
+	}
+	return n, nil
+}
+
+func (fw *frameWriter) flush(last bool) error {
+	fw.out = fw.aead.Seal(fw.out[:0], frameNonce(fw.prefix, fw.index), fw.buf, frameAAD(fw.part, last))
+	fw.index++
+	fw.buf = fw.buf[:0]
+	_, err := fw.w.Write(fw.out)
+	return err
+}
+
+// Close seals the last frame; it does not close the underlying writer.
+func (fw *frameWriter) Close() error { return fw.flush(true) }
+
+// openPartFile opens the part file of p in dir for reading from offset,
+// decrypting it when c is not nil.
+func openPartFile(dir string, p PartInfo, c *objectCipher, offset int64) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(dir, p.FileName()))
+	if err != nil {
+		return nil, err
+	}
+	var rc io.ReadCloser = f
+	if c != nil {
+		rc, err = c.newReader(f, p.Number, p.Size, offset)
+	} else if offset > 0 {
+		_, err = f.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return rc, nil
+}
+
+// frameReader decrypts an encrypted part file.
+type frameReader struct {
+	f      *os.File
+	aead   cipher.AEAD
+	part   int
+	prefix []byte
+	size   int64 // plaintext size of the part
+	index  int64 // next frame to decrypt
+	skip   int   // bytes to drop from the start of the next frame
+	buf    []byte
+	plain  []byte // decrypted bytes not returned yet
+}
+
+// newReader returns a reader over the plaintext of part number part, of
+// size bytes, stored in f, starting at offset.
+func (c *objectCipher) newReader(f *os.File, part int, size, offset int64) (*frameReader, error) {
+	header := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return nil, fmt.Errorf("part %d: encrypted file header: %w", part, err)
+	}
+	if string(header[:len(frameMagic)]) != frameMagic || header[len(frameMagic)] != frameVersion {
+		return nil, fmt.Errorf("part %d is not in a known encrypted format", part)
+	}
+	r := &frameReader{
+		f:      f,
+		aead:   c.aead,
+		part:   part,
+		prefix: header[len(frameMagic)+1:],
+		size:   size,
+		index:  offset / frameSize,
+		skip:   int(offset % frameSize),
+	}
+	if r.index > 0 {
+		if _, err := f.Seek(int64(frameHeaderSize)+r.index*(frameSize+frameTagSize), io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (r *frameReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.index >= frameCount(r.size) {
+			return 0, io.EOF
+		}
+		n := min(frameSize, r.size-r.index*frameSize)
+		if cap(r.buf) < int(n)+frameTagSize {
+			r.buf = make([]byte, 0, frameSize+frameTagSize)
+		}
+		r.buf = r.buf[:n+frameTagSize]
+		if _, err := io.ReadFull(r.f, r.buf); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, fmt.Errorf("part %d: frame %d: %w", r.part, r.index, err)
+		}
+		last := r.index == frameCount(r.size)-1
+		plain, err := r.aead.Open(r.buf[:0], frameNonce(r.prefix, r.index), r.buf, frameAAD(r.part, last))
+		if err != nil {
+			return 0, fmt.Errorf("part %d: frame %d fails authentication", r.part, r.index)
+		}
+		r.index++
+		r.plain = plain[r.skip:]
+		r.skip = 0
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+func (r *frameReader) Close() error { return r.f.Close() }
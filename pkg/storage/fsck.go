@@ -0,0 +1,453 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// quarantineDirName is the per-bucket directory where Fsck moves the files
+// of objects it cannot repair, one {time}-{sha256(key)} directory per object
+// holding the object's files, its key and the problems found.
+const quarantineDirName = ".quarantine"
+
+// Problems reported in FsckIssue.Kind.
+const (
+	IssueCorruptManifest  = "corrupt-manifest"
+	IssueCorruptMeta      = "corrupt-meta"
+	IssueNoParts          = "no-parts"
+	IssueMissingPart      = "missing-part"
+	IssueZeroLengthPart   = "zero-length-part"
+	IssuePartSizeMismatch = "part-size-mismatch"
+	IssueExtraPart        = "extra-part"
+	IssueChecksumMismatch = "checksum-mismatch"
+)
+
+// Repairs reported in FsckIssue.Repair.
+const (
+	RepairRemoved     = "removed"
+	RepairQuarantined = "quarantined"
+)
+
+// FsckOptions controls Fsck.
+type FsckOptions struct {
+	// Buckets restricts the check to these buckets (all buckets when empty).
+	Buckets []string
+	// VerifyChecksums reads every part and compares it with the digests
+	// recorded when it was written.
+	VerifyChecksums bool
+	// Repair removes part files no manifest references, and moves objects
+	// that cannot be read (and unparsable metadata) to the bucket's
+	// quarantine directory.
+	Repair bool
+}
+
+// FsckIssue is one problem found by Fsck. Path is relative to Root.
+type FsckIssue struct {
+	Bucket    string `json:"bucket"`
+	Key       string `json:"key"`
+	VersionID string `json:"version_id,omitempty"`
+	Kind      string `json:"kind"`
+	Detail    string `json:"detail,omitempty"`
+	Path      string `json:"path"`
+	// Repair is the action taken, empty when the problem was only reported.
+	Repair string `json:"repair,omitempty"`
+	// QuarantinePath is where the object's files were moved, relative to Root.
+	QuarantinePath string `json:"quarantine_path,omitempty"`
+}
+
+// FsckReport summarises one consistency check.
+type FsckReport struct {
+	RanAt   time.Time   `json:"ran_at"`
+	Buckets int         `json:"buckets"`
+	Objects int         `json:"objects"`
+	Issues  []FsckIssue `json:"issues"`
+}
+
+// Unrepaired returns the number of issues that were only reported.
+func (r FsckReport) Unrepaired() int {
+	n := 0
+	for _, is := range r.Issues {
+		if is.Repair == "" {
+			n++
+		}
+	}
+	return n
+}
+
+// Fsck checks the objects and archived versions of every bucket: manifests
+// must parse and match their part files, metadata must parse and, with
+// VerifyChecksums, part data must match its recorded digests. Encrypted data
+// and metadata are only verified when their key is available: objects with a
+// customer-provided key, or a master key missing from Keys, are checked
+// against their file sizes alone. Multipart uploads in progress are left to
+// CollectGarbage.
+func (s *LocalStorage) Fsck(ctx context.Context, opts FsckOptions) (FsckReport, error) {
+	report := FsckReport{RanAt: time.Now().UTC(), Issues: []FsckIssue{}}
+	buckets := opts.Buckets
+	if len(buckets) == 0 {
+		all, err := s.ListBuckets(ctx)
+		if err != nil {
+			return report, err
+		}
+		for _, b := range all {
+			buckets = append(buckets, b.Name)
+		}
+	}
+	var errs []error
+	for _, bucket := range buckets {
+		bucketDir, err := s.existingBucketDir(bucket)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		report.Buckets++
+		c := &fsckBucket{s: s, ctx: ctx, opts: opts, bucket: bucket, bucketDir: bucketDir, report: &report}
+		if err := c.run(); err != nil {
+			errs = append(errs, fmt.Errorf("bucket %s: %w", bucket, err))
+		}
+		if c.repaired {
+			// quarantined objects no longer count towards the bucket's usage
+			if _, err := s.Recount(ctx, bucket); err != nil {
+				errs = append(errs, fmt.Errorf("bucket %s: recount: %w", bucket, err))
+			}
+		}
+	}
+	return report, errors.Join(errs...)
+}
+
+// fsckBucket checks one bucket.
+type fsckBucket struct {
+	s         *LocalStorage
+	ctx       context.Context
+	opts      FsckOptions
+	bucket    string
+	bucketDir string
+	report    *FsckReport
+	repaired  bool
+}
+
+func (c *fsckBucket) run() error {
+	// current versions: every directory below the bucket that holds object files
+	err := filepath.WalkDir(c.bucketDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() || path == c.bucketDir {
+			return nil
+		}
+		if filepath.Dir(path) == c.bucketDir && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if err := c.ctx.Err(); err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(c.bucketDir, path)
+		return c.checkObject(path, filepath.ToSlash(rel), "")
+	})
+	if err != nil {
+		return err
+	}
+
+	// archived versions
+	entries, err := os.ReadDir(filepath.Join(c.bucketDir, versionsDirName))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		key, err := os.ReadFile(filepath.Join(c.bucketDir, versionsDirName, e.Name(), "key"))
+		if err != nil {
+			continue
+		}
+		ids, err := archivedVersions(c.bucketDir, string(key))
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if err := c.ctx.Err(); err != nil {
+				return err
+			}
+			dir, err := versionPath(c.bucketDir, string(key), id)
+			if err != nil {
+				continue
+			}
+			if err := c.checkObject(dir, string(key), id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkObject checks the object files directly inside dir, if any. Objects
+// with problems are checked again before being repaired, under the lock
+// writes publish under, so that parts renamed into place by a write that has
+// not yet published its manifest are not mistaken for damage.
+func (c *fsckBucket) checkObject(dir, key, versionID string) error {
+	found, issues, err := c.inspect(dir, key, versionID)
+	if err != nil || !found {
+		return err
+	}
+	c.report.Objects++
+	if c.opts.Repair && len(issues) > 0 {
+		c.s.usageMu.Lock()
+		defer c.s.usageMu.Unlock()
+		found, issues, err = c.inspect(dir, key, versionID)
+		if err != nil || !found {
+			return err
+		}
+		if len(issues) > 0 {
+			if err := c.repair(dir, key, versionID, issues); err != nil {
+				return err
+			}
+		}
+	}
+	c.report.Issues = append(c.report.Issues, issues...)
+	return nil
+}
+
+// inspect returns the problems of the object files directly inside dir;
+// found is false when there are none.
+func (c *fsckBucket) inspect(dir, key, versionID string) (found bool, issues []FsckIssue, err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil, nil
+		}
+		return false, nil, err
+	}
+	files := map[string]int64{} // object files and their sizes
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		name := e.Name()
+		if _, ok := parsePartFileName(name); !ok && name != manifestFileName && name != "data.meta" {
+			continue
+		}
+		fi, err := e.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			continue // removed meanwhile
+		} else if err != nil {
+			return false, nil, err
+		}
+		files[name] = fi.Size()
+	}
+	if len(files) == 0 {
+		return false, nil, nil // intermediate directory of longer keys, or a directory marker
+	}
+
+	add := func(kind, file, detail string) {
+		rel, _ := filepath.Rel(c.s.Root, filepath.Join(dir, file))
+		issues = append(issues, FsckIssue{Bucket: c.bucket, Key: key, VersionID: versionID, Kind: kind, Detail: detail, Path: rel})
+	}
+	if _, ok := files["data.meta"]; ok {
+		if _, err := c.s.readMeta(dir); err != nil && !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, ErrKeyUnavailable) {
+			add(IssueCorruptMeta, "data.meta", err.Error())
+		}
+	}
+	m, err := readManifest(dir)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		// data.meta alone is an object PutMetadata created before any data
+		if _, ok := files["data.meta"]; !ok {
+			add(IssueNoParts, "", "object directory holds no part and no manifest")
+		}
+	case err != nil:
+		add(IssueCorruptManifest, manifestFileName, err.Error())
+	case m.DeleteMarker:
+	default:
+		c.checkParts(dir, m, files, add)
+	}
+	return true, issues, nil
+}
+
+// checkParts compares the manifest with the part files in dir and,
+// optionally, with the part data.
+func (c *fsckBucket) checkParts(dir string, m Manifest, files map[string]int64, add func(kind, file, detail string)) {
+	// fileSize is the size the file of a part must have
+	fileSize := func(p PartInfo) int64 {
+		if m.Encryption != nil {
+			return encryptedSize(p.Size)
+		}
+		return p.Size
+	}
+	var total int64
+	for i, p := range m.Parts {
+		total += p.Size
+		if i > 0 && p.Number <= m.Parts[i-1].Number {
+			add(IssueCorruptManifest, manifestFileName, fmt.Sprintf("part %d is listed out of order", p.Number))
+		}
+		size, ok := files[p.FileName()]
+		switch {
+		case !ok:
+			add(IssueMissingPart, p.FileName(), "")
+		case size == 0 && (fileSize(p) > 0 || len(m.Parts) > 1):
+			add(IssueZeroLengthPart, p.FileName(), "")
+		case size != fileSize(p):
+			add(IssuePartSizeMismatch, p.FileName(), fmt.Sprintf("manifest says %d bytes, file has %d", fileSize(p), size))
+		}
+	}
+	if total != m.Size {
+		add(IssueCorruptManifest, manifestFileName, fmt.Sprintf("object size %d does not match its parts (%d bytes)", m.Size, total))
+	}
+	referenced := m.partNames()
+	for name := range files {
+		if _, ok := referenced[name]; !ok && name != manifestFileName && name != "data.meta" {
+			add(IssueExtraPart, name, "not referenced by the manifest")
+		}
+	}
+	if !c.opts.VerifyChecksums {
+		return
+	}
+	oc, err := c.s.objectCipher(c.ctx, m.Encryption)
+	if errors.Is(err, ErrKeyUnavailable) || errors.Is(err, ErrCustomerKeyRequired) {
+		return
+	} else if err != nil {
+		add(IssueChecksumMismatch, manifestFileName, err.Error())
+		return
+	}
+	// whole-object digests are only recorded for single-part writes
+	whole := newChecksumWriter()
+	for _, p := range m.Parts {
+		if size, ok := files[p.FileName()]; !ok || size != fileSize(p) {
+			return // already reported
+		}
+		sums, err := partChecksums(dir, p, oc, whole)
+		if err != nil {
+			add(IssueChecksumMismatch, p.FileName(), err.Error())
+			return
+		}
+		if err := (Checksums{MD5: p.ETag, SHA256: p.SHA256}).verify(sums); err != nil {
+			add(IssueChecksumMismatch, p.FileName(), err.Error())
+		}
+	}
+	if err := (Checksums{SHA256: m.SHA256, CRC32C: m.CRC32C}).verify(whole.Sum()); err != nil {
+		add(IssueChecksumMismatch, manifestFileName, "object "+err.Error())
+	}
+}
+
+// partChecksums returns the digests of the data of part p in dir,
+// decrypted with c, also writing the data to w.
+func partChecksums(dir string, p PartInfo, c *objectCipher, w io.Writer) (Checksums, error) {
+	f, err := openPartFile(dir, p, c, 0)
+	if err != nil {
+		return Checksums{}, err
+	}
+	defer f.Close()
+	sums := newChecksumWriter()
+	if _, err := io.Copy(io.MultiWriter(sums, w), f); err != nil {
+		return Checksums{}, err
+	}
+	return sums.Sum(), nil
+}
+
+// repair fixes the problems found in dir. Unreferenced parts are removed;
+// an object that cannot be read has all its files moved to quarantine, and
+// otherwise only unparsable metadata is, replaced with empty metadata.
+func (c *fsckBucket) repair(dir, key, versionID string, issues []FsckIssue) error {
+	var unreadable, metaCorrupt bool
+	for _, is := range issues {
+		switch is.Kind {
+		case IssueCorruptMeta:
+			metaCorrupt = true
+		case IssueExtraPart:
+		default:
+			unreadable = true
+		}
+	}
+	var move []string
+	switch {
+	case unreadable:
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if _, ok := parsePartFileName(e.Name()); ok || e.Name() == manifestFileName || e.Name() == "data.meta" {
+				move = append(move, e.Name())
+			}
+		}
+	case metaCorrupt:
+		move = []string{"data.meta"}
+	}
+	var qdir string
+	if len(move) > 0 {
+		var err error
+		if qdir, err = c.quarantine(dir, key, versionID, move, issues); err != nil {
+			return err
+		}
+	}
+	if metaCorrupt && !unreadable {
+		// the object stays readable, with empty metadata
+		if err := c.s.writeMeta(dir, Metadata{}); err != nil {
+			return err
+		}
+	}
+	qrel, _ := filepath.Rel(c.s.Root, qdir)
+	for i := range issues {
+		switch {
+		case unreadable || issues[i].Kind == IssueCorruptMeta:
+			issues[i].Repair, issues[i].QuarantinePath = RepairQuarantined, qrel
+		case issues[i].Kind == IssueExtraPart:
+			if err := os.Remove(filepath.Join(c.s.Root, issues[i].Path)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			issues[i].Repair = RepairRemoved
+		}
+	}
+	c.repaired = true
+	if unreadable {
+		// drop the directory when nothing is left in it, e.g. an archived
+		// version that would otherwise still be listed
+		if err := os.Remove(dir); err == nil {
+			return syncDir(filepath.Dir(dir))
+		}
+	}
+	return syncDir(dir)
+}
+
+// quarantine moves the named files of dir into a new quarantine directory
+// along with the object's key and the issues found, and returns its path.
+func (c *fsckBucket) quarantine(dir, key, versionID string, names []string, issues []FsckIssue) (string, error) {
+	h := sha256.Sum256([]byte(key))
+	qdir := filepath.Join(c.bucketDir, quarantineDirName,
+		fmt.Sprintf("%s-%s", time.Now().UTC().Format("20060102T150405.000000000"), hex.EncodeToString(h[:8])))
+	if versionID != "" {
+		qdir += "-" + versionID
+	}
+	if err := os.MkdirAll(qdir, 0o755); err != nil {
+		return "", err
+	}
+	b, err := json.MarshalIndent(issues, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := writeFileAtomic(filepath.Join(qdir, "issues.json"), b); err != nil {
+		return "", err
+	}
+	if err := writeFileAtomic(filepath.Join(qdir, "key"), []byte(key)); err != nil {
+		return "", err
+	}
+	for _, name := range names {
+		if err := os.Rename(filepath.Join(dir, name), filepath.Join(qdir, name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+	}
+	return qdir, syncDir(qdir)
+}
@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// deletedDirPrefix names the directories under Root that DeleteBucket moves
+// buckets into before removing them.
+const deletedDirPrefix = ".deleted-"
+
+// GCOptions controls CollectGarbage.
+type GCOptions struct {
+	// MaxAge is how old an incomplete multipart upload or a leftover
+	// temporary file must be before it is removed. It must exceed the time
+	// an upload or a write can legitimately take.
+	MaxAge time.Duration
+	// DryRun only reports what would be removed.
+	DryRun bool
+}
+
+// GCReport summarises one garbage collection pass.
+type GCReport struct {
+	RanAt          time.Time         `json:"ran_at"`
+	DryRun         bool              `json:"dry_run"`
+	AbortedUploads []MultipartUpload `json:"aborted_uploads"`
+	// RemovedPaths lists the leftover files and directories removed,
+	// relative to Root.
+	RemovedPaths   []string `json:"removed_paths"`
+	ReclaimedBytes int64    `json:"reclaimed_bytes"`
+}
+
+// CollectGarbage aborts multipart uploads older than opts.MaxAge, including
+// those started before uploads had records, and removes
+// what interrupted operations leave behind: *.tmp files of atomic writes,
+// partially written parts and version copies, the staging area and buckets
+// whose deletion did not finish.
+func (s *LocalStorage) CollectGarbage(ctx context.Context, opts GCOptions) (GCReport, error) {
+	return s.collectGarbage(ctx, time.Now(), opts)
+}
+
+func (s *LocalStorage) collectGarbage(ctx context.Context, now time.Time, opts GCOptions) (GCReport, error) {
+	report := GCReport{RanAt: now.UTC(), DryRun: opts.DryRun, AbortedUploads: []MultipartUpload{}, RemovedPaths: []string{}}
+	stale := func(t time.Time) bool { return now.Sub(t) >= opts.MaxAge }
+	var errs []error
+	remove := func(path string) {
+		size := diskUsage(path)
+		if !opts.DryRun {
+			if err := os.RemoveAll(path); err != nil {
+				errs = append(errs, err)
+				return
+			}
+		}
+		rel, _ := filepath.Rel(s.Root, path)
+		report.RemovedPaths = append(report.RemovedPaths, rel)
+		report.ReclaimedBytes += size
+	}
+
+	// buckets left behind by an interrupted DeleteBucket
+	entries, err := os.ReadDir(s.Root)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return report, err
+	}
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), deletedDirPrefix) {
+			continue
+		}
+		if fi, err := e.Info(); err == nil && stale(fi.ModTime()) {
+			remove(filepath.Join(s.Root, e.Name()))
+		}
+	}
+
+	buckets, err := s.ListBuckets(ctx)
+	if err != nil {
+		return report, err
+	}
+	for _, b := range buckets {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		bucketDir := filepath.Join(s.Root, b.Name)
+
+		uploads, err := s.ListMultipartUploads(ctx, b.Name, "")
+		if err != nil {
+			errs = append(errs, fmt.Errorf("bucket %s: %w", b.Name, err))
+			continue
+		}
+		aborted := map[string]bool{}
+		for _, up := range uploads {
+			if !stale(up.Initiated) {
+				continue
+			}
+			partDir := filepath.Join(bucketDir, ".multipart", up.UploadID)
+			size := diskUsage(partDir)
+			if !opts.DryRun {
+				var err error
+				if up.Key == "" { // started before uploads had records, no key reaches it
+					err = s.trackUsage(bucketDir, usageScope{PartDir: partDir}, func() error { return os.RemoveAll(partDir) })
+				} else {
+					err = s.AbortMultipart(ctx, b.Name, up.Key, up.UploadID)
+				}
+				if err != nil {
+					if !errors.Is(err, ErrNoSuchUpload) { // completed meanwhile
+						errs = append(errs, fmt.Errorf("bucket %s: abort %s: %w", b.Name, up.UploadID, err))
+					}
+					continue
+				}
+			}
+			aborted[up.UploadID] = true
+			report.AbortedUploads = append(report.AbortedUploads, up)
+			report.ReclaimedBytes += size
+		}
+
+		// staged writes and copies that were never published
+		staging, err := os.ReadDir(filepath.Join(bucketDir, stagingDirName))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+		}
+		for _, e := range staging {
+			if fi, err := e.Info(); err == nil && stale(fi.ModTime()) {
+				remove(filepath.Join(bucketDir, stagingDirName, e.Name()))
+			}
+		}
+
+		// temporary files of interrupted writes anywhere else in the bucket
+		err = filepath.WalkDir(bucketDir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			if d.IsDir() {
+				if path != bucketDir && (d.Name() == stagingDirName || aborted[d.Name()]) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !isLeftoverTemp(d.Name()) {
+				return nil
+			}
+			if fi, err := d.Info(); err == nil && stale(fi.ModTime()) {
+				remove(path)
+			}
+			return nil
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("bucket %s: %w", b.Name, err))
+		}
+	}
+	return report, errors.Join(errs...)
+}
+
+// isLeftoverTemp reports whether name is a temporary file written by
+// writeFileAtomic or stageFile, which only survive an interrupted write.
+func isLeftoverTemp(name string) bool {
+	return strings.HasSuffix(name, ".tmp") || strings.HasPrefix(name, ".part-") || strings.HasPrefix(name, ".copy-")
+}
+
+// diskUsage returns the total size of the regular files under path.
+func diskUsage(path string) int64 {
+	var n int64
+	filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			if fi, err := d.Info(); err == nil {
+				n += fi.Size()
+			}
+		}
+		return nil
+	})
+	return n
+}
@@ -0,0 +1,27 @@
+package storage
+
+import "context"
+
+// Identity is the authenticated caller of a request. The HTTP server places
+// it in the request context so Storage implementations and audit logging
+// can tell who did what.
+type Identity struct {
+	// User is the name the access key was created for.
+	User string `json:"user"`
+	// AccessKey is the access key the request was signed with.
+	AccessKey string `json:"access_key"`
+}
+
+type identityKey struct{}
+
+// WithIdentity returns a copy of ctx carrying id.
+func WithIdentity(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// IdentityFromContext returns the identity stored in ctx by WithIdentity.
+// ok is false for anonymous requests.
+func IdentityFromContext(ctx context.Context) (id Identity, ok bool) {
+	id, ok = ctx.Value(identityKey{}).(Identity)
+	return id, ok
+}
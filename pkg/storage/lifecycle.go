@@ -0,0 +1,269 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// lifecycleFileName stores a bucket's lifecycle configuration next to .bucket.meta.
+const lifecycleFileName = ".bucket.lifecycle"
+
+// LifecycleRule expires objects, versions and incomplete multipart uploads
+// whose key starts with Prefix. Zero day counts disable the matching action.
+type LifecycleRule struct {
+	ID                              string `json:"id"`
+	Prefix                          string `json:"prefix,omitempty"`
+	Disabled                        bool   `json:"disabled,omitempty"`
+	ExpirationDays                  int    `json:"expiration_days,omitempty"`
+	NoncurrentVersionExpirationDays int    `json:"noncurrent_version_expiration_days,omitempty"`
+	AbortIncompleteMultipartDays    int    `json:"abort_incomplete_multipart_days,omitempty"`
+}
+
+// LifecycleConfig is the set of lifecycle rules of a bucket.
+type LifecycleConfig struct {
+	Rules []LifecycleRule `json:"rules"`
+}
+
+// retentionRuleID is the ID of the implicit rule enforcing
+// BucketMetadata.RetentionDays, reserved so reports stay unambiguous.
+const retentionRuleID = "retention"
+
+// Validate checks that every rule has an ID, other than the reserved
+// "retention", and at least one action.
+func (c LifecycleConfig) Validate() error {
+	seen := map[string]bool{}
+	for _, r := range c.Rules {
+		if r.ID == "" {
+			return fmt.Errorf("%w: lifecycle rule without id", ErrInvalidConfig)
+		}
+		if r.ID == retentionRuleID {
+			return fmt.Errorf("%w: lifecycle rule id %q is reserved for the bucket retention", ErrInvalidConfig, r.ID)
+		}
+		if seen[r.ID] {
+			return fmt.Errorf("%w: duplicate lifecycle rule id %q", ErrInvalidConfig, r.ID)
+		}
+		seen[r.ID] = true
+		if r.ExpirationDays < 0 || r.NoncurrentVersionExpirationDays < 0 || r.AbortIncompleteMultipartDays < 0 {
+			return fmt.Errorf("%w: rule %q has negative days", ErrInvalidConfig, r.ID)
+		}
+		if r.ExpirationDays == 0 && r.NoncurrentVersionExpirationDays == 0 && r.AbortIncompleteMultipartDays == 0 {
+			return fmt.Errorf("%w: rule %q has no action", ErrInvalidConfig, r.ID)
+		}
+	}
+	return nil
+}
+
+// Lifecycle actions reported in LifecycleAction.Action.
+const (
+	ActionExpireObject  = "expire-object"
+	ActionExpireVersion = "expire-noncurrent-version"
+	ActionAbortUpload   = "abort-multipart-upload"
+)
+
+// LifecycleAction is one expiration performed (or planned in dry-run mode).
+type LifecycleAction struct {
+	Rule      string `json:"rule"`
+	Action    string `json:"action"`
+	Key       string `json:"key,omitempty"`
+	VersionID string `json:"version_id,omitempty"`
+	UploadID  string `json:"upload_id,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// LifecycleReport summarises one lifecycle pass over a bucket.
+type LifecycleReport struct {
+	Bucket  string            `json:"bucket"`
+	DryRun  bool              `json:"dry_run"`
+	RanAt   time.Time         `json:"ran_at"`
+	Actions []LifecycleAction `json:"actions"`
+}
+
+// PutLifecycle stores the lifecycle configuration of a bucket.
+func (s *LocalStorage) PutLifecycle(ctx context.Context, bucket string, cfg LifecycleConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	dir, err := s.existingBucketDir(bucket)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, lifecycleFileName), b)
+}
+
+// GetLifecycle returns the lifecycle configuration of a bucket (empty when
+// none was set).
+func (s *LocalStorage) GetLifecycle(ctx context.Context, bucket string) (LifecycleConfig, error) {
+	var cfg LifecycleConfig
+	dir, err := s.existingBucketDir(bucket)
+	if err != nil {
+		return cfg, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, lifecycleFileName))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return cfg, nil
+		}
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// effectiveRules returns the configured rules plus an implicit rule for
+// BucketMetadata.RetentionDays.
+func (s *LocalStorage) effectiveRules(ctx context.Context, bucket string) ([]LifecycleRule, error) {
+	cfg, err := s.GetLifecycle(ctx, bucket)
+	if err != nil {
+		return nil, err
+	}
+	bm, err := s.GetBucketMetadata(ctx, bucket)
+	if err != nil {
+		return nil, err
+	}
+	var rules []LifecycleRule
+	if bm.RetentionDays > 0 {
+		rules = append(rules, LifecycleRule{ID: retentionRuleID, ExpirationDays: bm.RetentionDays})
+	}
+	for _, r := range cfg.Rules {
+		if !r.Disabled {
+			rules = append(rules, r)
+		}
+	}
+	return rules, nil
+}
+
+// ApplyLifecycle runs the bucket's lifecycle rules once. In dry-run mode it
+// only reports what would be expired.
+func (s *LocalStorage) ApplyLifecycle(ctx context.Context, bucket string, dryRun bool) (LifecycleReport, error) {
+	return s.applyLifecycle(ctx, bucket, time.Now(), dryRun)
+}
+
+func (s *LocalStorage) applyLifecycle(ctx context.Context, bucket string, now time.Time, dryRun bool) (LifecycleReport, error) {
+	report := LifecycleReport{Bucket: bucket, DryRun: dryRun, RanAt: now.UTC()}
+	rules, err := s.effectiveRules(ctx, bucket)
+	if err != nil || len(rules) == 0 {
+		return report, err
+	}
+	expired := func(t time.Time, days int) bool {
+		return days > 0 && !t.IsZero() && now.Sub(t) >= time.Duration(days)*24*time.Hour
+	}
+	record := func(a LifecycleAction, apply func() error) {
+		if !dryRun {
+			if err := apply(); err != nil {
+				a.Error = err.Error()
+			}
+		}
+		report.Actions = append(report.Actions, a)
+	}
+
+	// current versions
+	keys, err := s.List(ctx, bucket, "")
+	if err != nil {
+		return report, err
+	}
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		// the manifest is read directly: Stat would need the key of objects
+		// encrypted with a customer-provided key
+		_, m, err := s.manifest(bucket, key)
+		if err != nil {
+			continue
+		}
+		for _, r := range rules {
+			if strings.HasPrefix(key, r.Prefix) && expired(m.LastModified, r.ExpirationDays) {
+				record(LifecycleAction{Rule: r.ID, Action: ActionExpireObject, Key: key}, func() error {
+					return s.Delete(ctx, bucket, key)
+				})
+				break
+			}
+		}
+	}
+
+	// noncurrent versions: a version becomes noncurrent when the next newer
+	// version of the same key is written
+	if hasRule(rules, func(r LifecycleRule) bool { return r.NoncurrentVersionExpirationDays > 0 }) {
+		versions, err := s.ListVersions(ctx, bucket, "")
+		if err != nil {
+			return report, err
+		}
+		for i, v := range versions {
+			if v.IsLatest || i == 0 || versions[i-1].Key != v.Key {
+				continue
+			}
+			noncurrentSince := versions[i-1].LastModified
+			for _, r := range rules {
+				if strings.HasPrefix(v.Key, r.Prefix) && expired(noncurrentSince, r.NoncurrentVersionExpirationDays) {
+					record(LifecycleAction{Rule: r.ID, Action: ActionExpireVersion, Key: v.Key, VersionID: v.VersionID}, func() error {
+						return s.DeleteVersion(ctx, bucket, v.Key, v.VersionID)
+					})
+					break
+				}
+			}
+		}
+	}
+
+	// incomplete multipart uploads
+	if hasRule(rules, func(r LifecycleRule) bool { return r.AbortIncompleteMultipartDays > 0 }) {
+		uploads, err := s.ListMultipartUploads(ctx, bucket, "")
+		if err != nil {
+			return report, err
+		}
+		for _, up := range uploads {
+			for _, r := range rules {
+				if strings.HasPrefix(up.Key, r.Prefix) && expired(up.Initiated, r.AbortIncompleteMultipartDays) {
+					record(LifecycleAction{Rule: r.ID, Action: ActionAbortUpload, Key: up.Key, UploadID: up.UploadID}, func() error {
+						return s.AbortMultipart(ctx, bucket, up.Key, up.UploadID)
+					})
+					break
+				}
+			}
+		}
+	}
+	return report, nil
+}
+
+func hasRule(rules []LifecycleRule, pred func(LifecycleRule) bool) bool {
+	for _, r := range rules {
+		if pred(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// ApplyAllLifecycles runs ApplyLifecycle on every bucket and returns the
+// reports of buckets where something was (or would be) expired.
+func (s *LocalStorage) ApplyAllLifecycles(ctx context.Context, dryRun bool) ([]LifecycleReport, error) {
+	buckets, err := s.ListBuckets(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var reports []LifecycleReport
+	var errs []error
+	for _, b := range buckets {
+		r, err := s.ApplyLifecycle(ctx, b.Name, dryRun)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("bucket %s: %w", b.Name, err))
+			continue
+		}
+		if len(r.Actions) > 0 {
+			reports = append(reports, r)
+		}
+	}
+	return reports, errors.Join(errs...)
+}
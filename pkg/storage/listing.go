@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// maxListKeys caps ListOptions.MaxKeys, as in S3.
+const maxListKeys = 1000
+
+// ListOptions selects a page of ListObjects results.
+type ListOptions struct {
+	// Prefix restricts the listing to keys that start with it.
+	Prefix string
+	// Delimiter groups keys that contain it after Prefix into a single
+	// common prefix (e.g. "/" to browse folders).
+	Delimiter string
+	// StartAfter lists keys that sort strictly after it.
+	StartAfter string
+	// ContinuationToken resumes a truncated listing (see
+	// ListResult.NextContinuationToken).
+	ContinuationToken string
+	// MaxKeys bounds the number of objects plus common prefixes returned;
+	// zero means (and larger values are capped to) 1000.
+	MaxKeys int
+}
+
+// ListResult is one page of ListObjects results, in lexicographic key order.
+type ListResult struct {
+	Objects               []ObjectInfo `json:"objects"`
+	CommonPrefixes        []string     `json:"common_prefixes,omitempty"`
+	IsTruncated           bool         `json:"is_truncated"`
+	NextContinuationToken string       `json:"next_continuation_token,omitempty"`
+}
+
+// errStopListing ends a listing walk early.
+var errStopListing = errors.New("stop listing")
+
+// ListObjects returns a page of the bucket's objects in lexicographic key
+// order. It walks the bucket lazily and stops as soon as the page is full,
+// so its cost depends on the page size rather than on the bucket size.
+func (s *LocalStorage) ListObjects(ctx context.Context, bucket string, opts ListOptions) (ListResult, error) {
+	res := ListResult{Objects: []ObjectInfo{}}
+	bucketDir, err := s.existingBucketDir(bucket)
+	if err != nil {
+		return res, err
+	}
+	if opts.MaxKeys <= 0 || opts.MaxKeys > maxListKeys {
+		opts.MaxKeys = maxListKeys
+	}
+	after := opts.StartAfter
+	skipPrefix := "" // subtree already reported as a common prefix
+	if opts.ContinuationToken != "" {
+		b, err := base64.RawURLEncoding.DecodeString(opts.ContinuationToken)
+		if err != nil || len(b) == 0 {
+			return res, fmt.Errorf("%w: malformed continuation token", ErrInvalidArgument)
+		}
+		if tok := string(b); tok > after {
+			after = tok
+			if opts.Delimiter != "" && strings.HasSuffix(tok, opts.Delimiter) && len(tok) > len(opts.Prefix) {
+				skipPrefix = tok
+			}
+		}
+	}
+
+	var last string
+	emit := func(key string, info *ObjectInfo) error {
+		if len(res.Objects)+len(res.CommonPrefixes) == opts.MaxKeys {
+			res.IsTruncated = true
+			res.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+			return errStopListing
+		}
+		last = key
+		if info == nil {
+			res.CommonPrefixes = append(res.CommonPrefixes, key)
+		} else {
+			res.Objects = append(res.Objects, *info)
+		}
+		return nil
+	}
+	visit := func(key string, info ObjectInfo) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !strings.HasPrefix(key, opts.Prefix) || key <= after || (skipPrefix != "" && strings.HasPrefix(key, skipPrefix)) {
+			return nil
+		}
+		if opts.Delimiter != "" {
+			if i := strings.Index(key[len(opts.Prefix):], opts.Delimiter); i >= 0 {
+				cp := key[:len(opts.Prefix)+i+len(opts.Delimiter)]
+				skipPrefix = cp
+				return emit(cp, nil)
+			}
+		}
+		return emit(key, &info)
+	}
+	// a subtree holds keys that all start with sub; skip it when none of
+	// them can be listed
+	prune := func(sub string) bool {
+		if !strings.HasPrefix(sub, opts.Prefix) && !strings.HasPrefix(opts.Prefix, sub) {
+			return true
+		}
+		if skipPrefix != "" && strings.HasPrefix(sub, skipPrefix) {
+			return true
+		}
+		return after >= sub && !strings.HasPrefix(after, sub)
+	}
+	err = walkKeys(bucketDir, "", prune, visit)
+	if err != nil && !errors.Is(err, errStopListing) {
+		return res, err
+	}
+	return res, nil
+}
+
+// walkKeys calls visit for every object below dir in lexicographic key
+// order. rel is the key prefix dir stands for ("" for the bucket root).
+//
+// The keys below a child directory c are "c" itself (when c holds an
+// object) and keys starting with "c/". Sorting the object "c" and the
+// subtree "c/" as separate items keeps the order lexicographic even when a
+// sibling such as "c-d" sorts between them.
+func walkKeys(dir, rel string, prune func(sub string) bool, visit func(key string, info ObjectInfo) error) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	type item struct {
+		sortKey string
+		path    string
+		subtree bool
+	}
+	var items []item
+	for _, e := range entries {
+		name := e.Name()
+		if !e.IsDir() || (rel == "" && strings.HasPrefix(name, ".")) {
+			continue
+		}
+		key := rel + name
+		p := filepath.Join(dir, name)
+		items = append(items, item{key, p, false}, item{key + "/", p, true})
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].sortKey < items[j].sortKey })
+	for _, it := range items {
+		if !it.subtree {
+			m, err := readManifest(it.path)
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					continue
+				}
+				return err
+			}
+			if err := visit(it.sortKey, m.info(it.sortKey)); err != nil {
+				return err
+			}
+			continue
+		}
+		if prune(it.sortKey) {
+			continue
+		}
+		// a directory marker ("c/") sorts before every key below it
+		if fi, err := os.Stat(filepath.Join(it.path, ".dir")); err == nil {
+			if err := visit(it.sortKey, ObjectInfo{Key: it.sortKey, LastModified: fi.ModTime().UTC()}); err != nil {
+				return err
+			}
+		}
+		if err := walkKeys(it.path, it.sortKey, prune, visit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// rootLockFile is the file locked by the process that owns the storage
+// root, relative to it. Bucket names cannot start with a dot, so it never
+// collides with a bucket.
+const rootLockFile = ".holydb/lock"
+
+// LockRoot takes the exclusive lock of the storage root, which a running
+// server holds and which maintenance rewriting files in place (RotateKeys)
+// needs. It fails with ErrRootLocked while another holder has it. The lock
+// is released by calling unlock, or when the process exits.
+func (s *LocalStorage) LockRoot() (unlock func() error, err error) {
+	path := filepath.Join(s.Root, rootLockFile)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("%w: %s", ErrRootLocked, s.Root)
+		}
+		return nil, err
+	}
+	return f.Close, nil
+}
@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// manifestFileName is the file inside an object directory listing, in order,
+// the parts that make up the object. Every reader assembles objects from the
+// manifest rather than from a directory listing.
+const manifestFileName = "data.manifest"
+
+// Manifest describes how an object is assembled from its part files, along
+// with the object's ETag and checksums. SHA256 and CRC32C cover the whole
+// object and are only known for single-part writes; multipart objects carry
+// per-part checksums instead.
+type Manifest struct {
+	Parts  []PartInfo `json:"parts"`
+	Size   int64      `json:"size"`
+	ETag   string     `json:"etag,omitempty"`
+	SHA256 string     `json:"sha256,omitempty"`
+	CRC32C string     `json:"crc32c,omitempty"`
+	// LastModified is when this version of the object was published.
+	LastModified time.Time `json:"last_modified"`
+	// VersionID is set for objects written to a versioned bucket.
+	VersionID string `json:"version_id,omitempty"`
+	// DeleteMarker marks an archived version recording a delete.
+	DeleteMarker bool `json:"delete_marker,omitempty"`
+	// Encryption is set when the part files are encrypted; part sizes and
+	// checksums always describe the plaintext.
+	Encryption *Encryption `json:"encryption,omitempty"`
+}
+
+// PartInfo is one part of an object or multipart upload, stored as
+// part.<Number>. ETag is the hex MD5 of the part data.
+type PartInfo struct {
+	Number int    `json:"number"`
+	Size   int64  `json:"size"`
+	ETag   string `json:"etag,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	// LastModified is when the part was uploaded.
+	LastModified time.Time `json:"last_modified"`
+}
+
+// FileName returns the name of the part file inside the object directory.
+func (p PartInfo) FileName() string { return partFileName(p.Number) }
+
+func partFileName(n int) string { return "part." + strconv.Itoa(n) }
+
+// parsePartFileName returns the part number of a part.N file name.
+func parsePartFileName(name string) (int, bool) {
+	s, ok := strings.CutPrefix(name, "part.")
+	if !ok || !isDigits(s) {
+		return 0, false
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return 0, false
+	}
+	return n, true
+}
+
+// scanParts lists the part.N files of dir sorted by numeric part number.
+func scanParts(dir string) ([]PartInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var parts []PartInfo
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		n, ok := parsePartFileName(e.Name())
+		if !ok {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, PartInfo{Number: n, Size: info.Size(), LastModified: info.ModTime().UTC()})
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Number < parts[j].Number })
+	return parts, nil
+}
+
+// readManifest loads the manifest of an object directory. Objects written
+// before manifests existed are described by their part.N files in numeric
+// order. It returns fs.ErrNotExist when the directory holds no object.
+func readManifest(objDir string) (Manifest, error) {
+	var m Manifest
+	data, err := os.ReadFile(filepath.Join(objDir, manifestFileName))
+	if err == nil {
+		if err := json.Unmarshal(data, &m); err != nil {
+			return m, fmt.Errorf("corrupt manifest: %w", err)
+		}
+		return m, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return m, err
+	}
+	parts, err := scanParts(objDir)
+	if err != nil {
+		return m, err
+	}
+	if len(parts) == 0 {
+		return m, fs.ErrNotExist
+	}
+	m.Parts = parts
+	for _, p := range parts {
+		m.Size += p.Size
+		if p.LastModified.After(m.LastModified) {
+			m.LastModified = p.LastModified
+		}
+	}
+	return m, nil
+}
+
+// writeManifest atomically replaces the manifest of an object directory.
+func writeManifest(objDir string, m Manifest) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(objDir, manifestFileName), b)
+}
+
+// info returns the public description of the object described by m.
+func (m Manifest) info(key string) ObjectInfo {
+	info := ObjectInfo{
+		Key:          key,
+		Size:         m.Size,
+		ETag:         m.ETag,
+		LastModified: m.LastModified,
+		VersionID:    m.VersionID,
+		Checksums:    Checksums{MD5: singlePartMD5(m), SHA256: m.SHA256, CRC32C: m.CRC32C},
+	}
+	if m.Encryption != nil {
+		info.Encryption, info.CustomerKeyMD5 = m.Encryption.Algorithm, m.Encryption.CustomerKeyMD5
+	}
+	return info
+}
+
+// singlePartMD5 returns the object MD5 when it equals the ETag (single-part objects).
+func singlePartMD5(m Manifest) string {
+	if len(m.Parts) == 1 {
+		return m.Parts[0].ETag
+	}
+	return ""
+}
+
+// partNames returns the set of part file names referenced by m.
+func (m Manifest) partNames() map[string]struct{} {
+	names := make(map[string]struct{}, len(m.Parts))
+	for _, p := range m.Parts {
+		names[p.FileName()] = struct{}{}
+	}
+	return names
+}
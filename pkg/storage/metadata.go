@@ -2,23 +2,56 @@ package storage
 
 import (
 	"encoding/json"
+	"time"
 )
 
 // Metadata represents arbitrary key/value metadata stored alongside an object.
 // Stored as JSON for now but the file is written as binary (not human-focused).
 type Metadata map[string]string
 
+// MetaContentType is the metadata key holding an object's media type.
+const MetaContentType = "content-type"
+
 // BucketMetadata stores per-bucket settings.
 type BucketMetadata struct {
 	CapacityBytes int64 `json:"capacity_bytes"` // max capacity for bucket (0 = unlimited)
 	RetentionDays int   `json:"retention_days"` // retention in days (0 = unlimited)
+	Versioning    bool  `json:"versioning"`     // keep every overwritten or deleted object as a version
+}
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified time.Time `json:"last_modified"`
+	ContentType  string    `json:"content_type,omitempty"`
+	VersionID    string    `json:"version_id,omitempty"`
+	Checksums    Checksums `json:"checksums"`
+	// Encryption is EncryptionAES256 for objects encrypted at rest, and
+	// CustomerKeyMD5 identifies the customer-provided key when one is used.
+	Encryption     string `json:"encryption,omitempty"`
+	CustomerKeyMD5 string `json:"customer_key_md5,omitempty"`
+}
+
+// CompletedPart identifies a part the client intends to commit when
+// completing a multipart upload. ETag is optional; when set it must match the
+// uploaded part.
+type CompletedPart struct {
+	PartNumber int    `json:"part_number"`
+	ETag       string `json:"etag,omitempty"`
 }
 
 // Stats returns quick analytics for a bucket
 type Stats struct {
-	ObjectCount   int64 `json:"object_count"`
-	UsedBytes     int64 `json:"used_bytes"`
-	CapacityBytes int64 `json:"capacity_bytes"` // copied from bucket metadata
+	ObjectCount int64 `json:"object_count"`
+	PartCount   int64 `json:"part_count"`
+	// UsedBytes counts current objects, archived versions and in-progress
+	// multipart uploads; the last two are also reported on their own.
+	UsedBytes      int64 `json:"used_bytes"`
+	VersionBytes   int64 `json:"version_bytes"`
+	MultipartBytes int64 `json:"multipart_bytes"`
+	CapacityBytes  int64 `json:"capacity_bytes"` // copied from bucket metadata
 }
 
 // MarshalJSON ensures deterministic JSON for metadata.
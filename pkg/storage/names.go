@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// maxKeyLength mirrors the S3 limit on object key length (in bytes).
+const maxKeyLength = 1024
+
+// reservedNames are path components used internally by LocalStorage and the
+// HTTP API. They can be neither bucket names nor key segments.
+var reservedNames = map[string]struct{}{
+	".multipart":        {},
+	".bucket.meta":      {},
+	".staging":          {},
+	".versions":         {},
+	".quarantine":       {},
+	".bucket.lifecycle": {},
+	".bucket.usage":     {},
+	".bucket.info":      {},
+	".bucket.policy":    {},
+	"_lifecycle":        {},
+	"_policy":           {},
+	"_stats":            {},
+	"_reconstruct":      {},
+}
+
+// BucketName is a bucket name that passed validation.
+type BucketName string
+
+// ObjectKey is an object key that passed validation.
+type ObjectKey string
+
+// InvalidKeyError describes why a bucket name or key was rejected.
+// It matches ErrInvalidKey with errors.Is.
+type InvalidKeyError struct {
+	Value  string
+	Reason string
+}
+
+func (e *InvalidKeyError) Error() string {
+	return fmt.Sprintf("invalid name %q: %s", e.Value, e.Reason)
+}
+
+func (e *InvalidKeyError) Is(target error) bool { return target == ErrInvalidKey }
+
+func invalid(value, reason string) error {
+	return &InvalidKeyError{Value: value, Reason: reason}
+}
+
+// ParseBucketName validates name against S3-style bucket naming rules:
+// 3-63 characters, lowercase letters, digits, dots and hyphens, starting and
+// ending with a letter or digit, no consecutive dots and not an IP address.
+func ParseBucketName(name string) (BucketName, error) {
+	if len(name) < 3 || len(name) > 63 {
+		return "", invalid(name, "bucket name must be between 3 and 63 characters")
+	}
+	if _, ok := reservedNames[name]; ok {
+		return "", invalid(name, "bucket name is reserved")
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		case c == '.' || c == '-':
+			if i == 0 || i == len(name)-1 {
+				return "", invalid(name, "bucket name must start and end with a letter or digit")
+			}
+		default:
+			return "", invalid(name, "bucket name may only contain lowercase letters, digits, '.' and '-'")
+		}
+	}
+	if strings.Contains(name, "..") {
+		return "", invalid(name, "bucket name must not contain consecutive dots")
+	}
+	if net.ParseIP(name) != nil {
+		return "", invalid(name, "bucket name must not be formatted as an IP address")
+	}
+	return BucketName(name), nil
+}
+
+// ParseObjectKey validates an object key. Keys are slash-separated paths;
+// a trailing slash denotes a directory marker. Empty segments, "." and "..",
+// NUL bytes, backslashes and reserved or internal file names are rejected so a
+// key can never resolve outside its bucket directory, and so is a leading
+// ".", which would hide the object among the bucket's internal files.
+func ParseObjectKey(key string) (ObjectKey, error) {
+	if key == "" {
+		return "", invalid(key, "key must not be empty")
+	}
+	if len(key) > maxKeyLength {
+		return "", invalid(key, fmt.Sprintf("key must not exceed %d bytes", maxKeyLength))
+	}
+	if strings.ContainsAny(key, "\x00\\") {
+		return "", invalid(key, "key must not contain NUL bytes or backslashes")
+	}
+	if strings.HasPrefix(key, "/") {
+		return "", invalid(key, "key must not start with '/'")
+	}
+	if strings.HasPrefix(key, ".") {
+		// dot-prefixed entries of a bucket directory are its internal files,
+		// which listings, usage and fsck skip
+		return "", invalid(key, "key must not start with '.'")
+	}
+	for _, seg := range strings.Split(strings.TrimSuffix(key, "/"), "/") {
+		if err := checkKeySegment(key, seg); err != nil {
+			return "", err
+		}
+	}
+	return ObjectKey(key), nil
+}
+
+// checkKeySegment validates one path component of key. Every segment maps to
+// a directory under the bucket, so it must not collide with the files
+// LocalStorage keeps inside object directories.
+func checkKeySegment(key, seg string) error {
+	switch {
+	case seg == "":
+		return invalid(key, "key must not contain empty path segments")
+	case seg == "." || seg == "..":
+		return invalid(key, "key must not contain '.' or '..' segments")
+	case isInternalName(seg):
+		return invalid(key, fmt.Sprintf("key segment %q is reserved", seg))
+	}
+	return nil
+}
+
+// isInternalName reports whether name is reserved or used for files stored
+// inside an object directory.
+func isInternalName(name string) bool {
+	if _, ok := reservedNames[name]; ok {
+		return true
+	}
+	switch name {
+	case "data.meta", "data.meta.tmp", "data.manifest", "data.manifest.tmp", ".dir":
+		return true
+	}
+	if n, ok := strings.CutPrefix(name, "part."); ok && isDigits(n) {
+		return true
+	}
+	return false
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
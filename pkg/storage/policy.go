@@ -0,0 +1,188 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// policyFileName stores a bucket's access policy next to .bucket.meta.
+const policyFileName = ".bucket.policy"
+
+// Actions of bucket policy statements. ActionListBuckets and
+// ActionCreateBucket are not bound to an existing bucket, so bucket policies
+// never apply to them. ActionExportObject writes an object to a file on the
+// server (POST _reconstruct), which also needs ActionGetObject.
+const (
+	ActionListBuckets       = "storage:ListBuckets"
+	ActionCreateBucket      = "storage:CreateBucket"
+	ActionDeleteBucket      = "storage:DeleteBucket"
+	ActionListBucket        = "storage:ListBucket"
+	ActionGetObject         = "storage:GetObject"
+	ActionPutObject         = "storage:PutObject"
+	ActionDeleteObject      = "storage:DeleteObject"
+	ActionExportObject      = "storage:ExportObject"
+	ActionGetBucketMetadata = "storage:GetBucketMetadata"
+	ActionPutBucketMetadata = "storage:PutBucketMetadata"
+	ActionGetBucketPolicy   = "storage:GetBucketPolicy"
+	ActionPutBucketPolicy   = "storage:PutBucketPolicy"
+)
+
+var policyActions = map[string]bool{
+	ActionDeleteBucket: true, ActionListBucket: true, ActionGetObject: true, ActionPutObject: true,
+	ActionDeleteObject: true, ActionExportObject: true, ActionGetBucketMetadata: true, ActionPutBucketMetadata: true,
+	ActionGetBucketPolicy: true, ActionPutBucketPolicy: true,
+}
+
+// IsObjectAction reports whether action applies to individual keys, so that
+// statement resources restrict it.
+func IsObjectAction(action string) bool {
+	return action == ActionGetObject || action == ActionPutObject || action == ActionDeleteObject || action == ActionExportObject
+}
+
+// Effects of a policy statement.
+const (
+	EffectAllow = "allow"
+	EffectDeny  = "deny"
+)
+
+// PolicyStatement allows or denies actions to principals.
+type PolicyStatement struct {
+	ID     string `json:"id,omitempty"`
+	Effect string `json:"effect"`
+	// Principals are user names or access keys; "*" is anyone, including
+	// anonymous clients.
+	Principals []string `json:"principals"`
+	// Actions such as storage:GetObject; "storage:*" is every action.
+	Actions []string `json:"actions"`
+	// Resources are key prefixes (a trailing "*" is ignored) restricting
+	// object actions and, through its prefix parameter, ListBucket; denying
+	// ListBucket also denies the shorter prefixes whose listing would show
+	// the resources. A statement with resources does not apply to the other
+	// bucket actions. No resources means the whole bucket.
+	Resources []string         `json:"resources,omitempty"`
+	Condition *PolicyCondition `json:"condition,omitempty"`
+}
+
+// PolicyCondition restricts a statement to some requests.
+type PolicyCondition struct {
+	// SourceIP lists the addresses or CIDR ranges the request must come from.
+	SourceIP []string `json:"source_ip,omitempty"`
+	// NotSourceIP lists the addresses or CIDR ranges it must not come from.
+	NotSourceIP []string `json:"not_source_ip,omitempty"`
+}
+
+// BucketPolicy is the access policy of a bucket. Deny statements always
+// win. Otherwise an action is allowed when a statement allows it or, for
+// authenticated callers, unless DefaultDeny is set; anonymous callers only
+// get what the policy allows them. ActionPutBucketPolicy is the exception:
+// only the bucket owner (see BucketInfo) gets it without a statement.
+type BucketPolicy struct {
+	// PublicRead lets anyone, including anonymous clients, get objects.
+	PublicRead bool `json:"public_read,omitempty"`
+	// DefaultDeny denies authenticated callers the actions no statement
+	// allows them.
+	DefaultDeny bool              `json:"default_deny,omitempty"`
+	Statements  []PolicyStatement `json:"statements,omitempty"`
+}
+
+// ParseSourceIP parses an address or CIDR range of a PolicyCondition; an
+// address is a range of one.
+func ParseSourceIP(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		return p.Masked(), err
+	}
+	a, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(a, a.BitLen()), nil
+}
+
+// Validate checks effects, principals, actions and source IP conditions.
+func (p BucketPolicy) Validate() error {
+	for i, st := range p.Statements {
+		name := st.ID
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		if st.Effect != EffectAllow && st.Effect != EffectDeny {
+			return fmt.Errorf("%w: statement %s: effect must be %q or %q", ErrInvalidConfig, name, EffectAllow, EffectDeny)
+		}
+		if len(st.Principals) == 0 {
+			return fmt.Errorf("%w: statement %s has no principal", ErrInvalidConfig, name)
+		}
+		if len(st.Actions) == 0 {
+			return fmt.Errorf("%w: statement %s has no action", ErrInvalidConfig, name)
+		}
+		for _, a := range st.Actions {
+			if a != "storage:*" && !policyActions[a] {
+				return fmt.Errorf("%w: statement %s: unknown action %q", ErrInvalidConfig, name, a)
+			}
+		}
+		if st.Condition != nil {
+			for _, s := range append(append([]string{}, st.Condition.SourceIP...), st.Condition.NotSourceIP...) {
+				if _, err := ParseSourceIP(s); err != nil {
+					return fmt.Errorf("%w: statement %s: invalid source IP %q", ErrInvalidConfig, name, s)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// PutBucketPolicy stores the access policy of a bucket.
+func (s *LocalStorage) PutBucketPolicy(ctx context.Context, bucket string, p BucketPolicy) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	dir, err := s.existingBucketDir(bucket)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, policyFileName), b)
+}
+
+// GetBucketPolicy returns the access policy of a bucket (empty when none was
+// set).
+func (s *LocalStorage) GetBucketPolicy(ctx context.Context, bucket string) (BucketPolicy, error) {
+	var p BucketPolicy
+	dir, err := s.existingBucketDir(bucket)
+	if err != nil {
+		return p, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, policyFileName))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return p, nil
+		}
+		return p, err
+	}
+	if err := json.Unmarshal(data, &p); err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
+// DeleteBucketPolicy removes the access policy of a bucket, if any.
+func (s *LocalStorage) DeleteBucketPolicy(ctx context.Context, bucket string) error {
+	dir, err := s.existingBucketDir(bucket)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(dir, policyFileName)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
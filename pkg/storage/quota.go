@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// WithSize annotates r with the number of bytes it will yield (for example
+// an HTTP Content-Length) so implementations can reject a write that cannot
+// fit in the bucket before reading any data. A negative size is ignored.
+func WithSize(r io.Reader, size int64) io.Reader {
+	if size < 0 {
+		return r
+	}
+	return &sizedReader{Reader: r, size: size}
+}
+
+type sizedReader struct {
+	io.Reader
+	size int64
+}
+
+// readerSize returns the number of bytes r is known to yield.
+func readerSize(r io.Reader) (int64, bool) {
+	switch v := r.(type) {
+	case *sizedReader:
+		return v.size, true
+	case interface{ Len() int }: // bytes.Reader, strings.Reader, bytes.Buffer
+		return int64(v.Len()), true
+	}
+	return 0, false
+}
+
+// quotaReader fails with ErrQuotaExceeded as soon as more than limit bytes
+// have been read, for bodies whose size is not known up front.
+type quotaReader struct {
+	r     io.Reader
+	limit int64
+	n     int64
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	n, err := q.r.Read(p)
+	q.n += int64(n)
+	if q.n > q.limit {
+		return n, fmt.Errorf("%w: write exceeds remaining capacity of %d bytes", ErrQuotaExceeded, q.limit)
+	}
+	return n, err
+}
+
+// limitWrite enforces the bucket capacity on a write of r. freed is the
+// number of bytes the write releases (e.g. the object it overwrites). It
+// returns r wrapped so that reading past the remaining capacity fails, or
+// ErrQuotaExceeded right away when the declared size cannot fit. Writes are
+// checked again with checkQuota when they are published, as concurrent
+// writes may have used the capacity meanwhile.
+func (s *LocalStorage) limitWrite(ctx context.Context, bucket string, r io.Reader, freed int64) (io.Reader, error) {
+	remaining, limited, err := s.remainingCapacity(ctx, bucket, nil)
+	if err != nil || !limited {
+		return r, err
+	}
+	remaining += freed
+	if size, ok := readerSize(r); ok && size > remaining {
+		return nil, fmt.Errorf("%w: %d bytes requested, %d available", ErrQuotaExceeded, size, max(remaining, 0))
+	}
+	return &quotaReader{r: r, limit: max(remaining, 0)}, nil
+}
+
+// checkQuota fails with ErrQuotaExceeded when a write of size bytes that
+// releases freed bytes does not fit in the bucket, whose usage is u or, when
+// u is nil, read from its counters.
+func (s *LocalStorage) checkQuota(ctx context.Context, bucket string, u *Usage, size, freed int64) error {
+	remaining, limited, err := s.remainingCapacity(ctx, bucket, u)
+	if err != nil || !limited {
+		return err
+	}
+	if remaining += freed; size > remaining {
+		return fmt.Errorf("%w: %d bytes requested, %d available", ErrQuotaExceeded, size, max(remaining, 0))
+	}
+	return nil
+}
+
+// overwrittenSize returns the number of bytes released when a write replaces
+// the object in objDir: its size, unless the bucket keeps old versions.
+func (s *LocalStorage) overwrittenSize(ctx context.Context, bucket, objDir string) int64 {
+	if versioned, err := s.versioningEnabled(ctx, bucket); err != nil || versioned {
+		return 0
+	}
+	m, err := readManifest(objDir)
+	if err != nil {
+		return 0
+	}
+	return m.Size
+}
+
+// checkCompleteQuota verifies that committing m from partDir over objDir
+// leaves the bucket, whose usage is u (see checkQuota), within its capacity.
+// Parts already count towards usage while the upload is in progress;
+// uncommitted parts and the replaced object are released by the completion.
+func (s *LocalStorage) checkCompleteQuota(ctx context.Context, bucket string, u *Usage, partDir, objDir string, m Manifest) error {
+	remaining, limited, err := s.remainingCapacity(ctx, bucket, u)
+	if err != nil || !limited {
+		return err
+	}
+	uploaded, err := scanParts(partDir)
+	if err != nil {
+		return err
+	}
+	for _, p := range uploaded {
+		remaining += p.Size
+	}
+	remaining += s.overwrittenSize(ctx, bucket, objDir) - m.Size
+	if remaining < 0 {
+		return fmt.Errorf("%w: completed object exceeds bucket capacity by %d bytes", ErrQuotaExceeded, -remaining)
+	}
+	return nil
+}
+
+// remainingCapacity returns how many bytes the bucket can still accept, and
+// false when the bucket has no capacity limit. Its usage is u or, when u is
+// nil, read from its counters.
+func (s *LocalStorage) remainingCapacity(ctx context.Context, bucket string, u *Usage) (int64, bool, error) {
+	bm, err := s.GetBucketMetadata(ctx, bucket)
+	if err != nil || bm.CapacityBytes <= 0 {
+		return 0, false, err
+	}
+	if u == nil {
+		current, err := s.Usage(ctx, bucket)
+		if err != nil {
+			return 0, false, err
+		}
+		u = &current
+	}
+	return bm.CapacityBytes - u.used(), true, nil
+}
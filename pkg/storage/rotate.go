@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// RotateReport summarises a RotateKeys pass.
+type RotateReport struct {
+	RanAt time.Time `json:"ran_at"`
+	// KeyID is the current master key everything was rewrapped under.
+	KeyID string `json:"key_id"`
+	// Rewrapped counts the data keys of objects, versions and uploads, and
+	// Resealed the metadata files, moved to the current key.
+	Rewrapped int `json:"rewrapped"`
+	Resealed  int `json:"resealed"`
+	// CustomerKeys counts the objects and uploads encrypted with a
+	// customer-provided key, which are left as they are.
+	CustomerKeys int `json:"customer_keys"`
+	// Retired lists the older keys of the keyring that nothing uses any more.
+	Retired []string `json:"retired"`
+}
+
+// RotateKeys rewraps, under the current master key of Keys, every data key
+// and every sealed data.meta still using another key, in every bucket
+// (current objects, archived versions, uploads in progress and quarantined
+// objects). Metadata stored in clear is sealed too, but part data is never
+// rewritten, so objects written without encryption stay in clear. Once it
+// succeeds the keys reported as retired can be removed from the keyring. It
+// rewrites manifests in place, so it holds the lock of the root meanwhile and
+// fails with ErrRootLocked while a server is running on it.
+func (s *LocalStorage) RotateKeys(ctx context.Context) (RotateReport, error) {
+	report := RotateReport{RanAt: time.Now().UTC(), Retired: []string{}}
+	if s.Keys == nil {
+		return report, fmt.Errorf("%w: no master key to rotate to", ErrInvalidConfig)
+	}
+	unlock, err := s.LockRoot()
+	if err != nil {
+		return report, err
+	}
+	defer unlock()
+	report.KeyID = s.Keys.CurrentID()
+	buckets, err := s.ListBuckets(ctx)
+	if err != nil {
+		return report, err
+	}
+	used := map[string]bool{}
+	var errs []error
+	for _, b := range buckets {
+		bucketDir, err := s.existingBucketDir(b.Name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		err = filepath.WalkDir(bucketDir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			if d.IsDir() {
+				if d.Name() == stagingDirName {
+					return filepath.SkipDir
+				}
+				return ctx.Err()
+			}
+			var ferr error
+			switch d.Name() {
+			case manifestFileName, uploadKeyName:
+				ferr = s.rotateKeyFile(path, &report, used)
+			case "data.meta":
+				ferr = s.rotateMeta(path, &report, used)
+			}
+			if ferr != nil {
+				rel, _ := filepath.Rel(s.Root, path)
+				errs = append(errs, fmt.Errorf("%s: %w", rel, ferr))
+			}
+			return nil
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("bucket %s: %w", b.Name, err))
+		}
+	}
+	for _, id := range s.Keys.IDs() {
+		if !used[id] && id != report.KeyID {
+			report.Retired = append(report.Retired, id)
+		}
+	}
+	sort.Strings(report.Retired)
+	return report, errors.Join(errs...)
+}
+
+// rotateKeyFile rewraps the data key of a manifest, or of the upload key of
+// a multipart upload, at path.
+func (s *LocalStorage) rotateKeyFile(path string, report *RotateReport, used map[string]bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var (
+		m   Manifest
+		enc *Encryption
+	)
+	if filepath.Base(path) == manifestFileName {
+		if err := json.Unmarshal(data, &m); err != nil {
+			return fmt.Errorf("corrupt manifest: %w", err)
+		}
+		enc = m.Encryption
+	} else {
+		enc = new(Encryption)
+		if err := json.Unmarshal(data, enc); err != nil {
+			return fmt.Errorf("corrupt upload key: %w", err)
+		}
+	}
+	switch {
+	case enc == nil:
+		return nil
+	case enc.CustomerKeyMD5 != "":
+		report.CustomerKeys++
+		return nil
+	case enc.KeyID == report.KeyID:
+		used[enc.KeyID] = true
+		return nil
+	}
+	if err := s.rewrap(enc); err != nil {
+		used[enc.KeyID] = true // still needed
+		return err
+	}
+	used[report.KeyID] = true
+	if filepath.Base(path) == manifestFileName {
+		data, err = json.Marshal(m)
+	} else {
+		data, err = json.Marshal(enc)
+	}
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return err
+	}
+	report.Rewrapped++
+	return nil
+}
+
+// rotateMeta reseals the data.meta at path under the current key.
+func (s *LocalStorage) rotateMeta(path string, report *RotateReport, used map[string]bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	meta, id, err := s.decodeMeta(data)
+	if err != nil {
+		if id != "" {
+			used[id] = true // still needed
+		}
+		return err
+	}
+	if id == report.KeyID {
+		used[id] = true
+		return nil
+	}
+	// plain metadata is sealed too, as it would be when next written
+	if data, err = s.encodeMeta(meta); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return err
+	}
+	used[report.KeyID] = true
+	report.Resealed++
+	return nil
+}
@@ -10,28 +10,80 @@ import (
 type Storage interface {
 	// Put stores object data (legacy: single part) without metadata.
 	Put(ctx context.Context, bucket, key string, r io.Reader) error
-	// PutWithMetadata stores object data and writes the metadata file.
-	PutWithMetadata(ctx context.Context, bucket, key string, r io.Reader, meta Metadata) error
+	// PutWithMetadata stores object data and writes the metadata file. It
+	// returns the stored object's ETag and checksums.
+	PutWithMetadata(ctx context.Context, bucket, key string, r io.Reader, meta Metadata) (ObjectInfo, error)
 	// Get returns a ReadCloser that yields the concatenated parts of the object.
 	Get(ctx context.Context, bucket, key string) (io.ReadCloser, error)
+	// GetRange returns length bytes of the object starting at offset (a
+	// negative length reads to the end) without reading earlier parts.
+	GetRange(ctx context.Context, bucket, key string, offset, length int64) (io.ReadCloser, error)
+	// Stat returns the object's size, ETag, checksums and modification time.
+	Stat(ctx context.Context, bucket, key string) (ObjectInfo, error)
 	// PutMetadata writes or updates only the metadata for an existing or new object.
 	PutMetadata(ctx context.Context, bucket, key string, meta Metadata) error
 	// GetMetadata reads the object's metadata (from data.meta).
 	GetMetadata(ctx context.Context, bucket, key string) (Metadata, error)
-	// Delete removes the object (directory and all parts/meta).
+	// Delete removes the object (all parts/meta). In a versioned bucket the
+	// current version is kept and a delete marker is added instead.
 	Delete(ctx context.Context, bucket, key string) error
+	// Versioning (see BucketMetadata.Versioning)
+	GetVersion(ctx context.Context, bucket, key, versionID string) (io.ReadCloser, ObjectInfo, error)
+	// GetVersionRange and GetVersionMetadata read part of a specific version,
+	// like GetRange, and its metadata.
+	GetVersionRange(ctx context.Context, bucket, key, versionID string, offset, length int64) (io.ReadCloser, error)
+	GetVersionMetadata(ctx context.Context, bucket, key, versionID string) (Metadata, error)
+	ListVersions(ctx context.Context, bucket, prefix string) ([]VersionInfo, error)
+	// DeleteVersion permanently removes one version or delete marker.
+	DeleteVersion(ctx context.Context, bucket, key, versionID string) error
+	// Copy copies an object (or one of its versions) server-side; Rename
+	// moves an object to another key of the same bucket.
+	Copy(ctx context.Context, srcBucket, srcKey, dstBucket, dstKey string, opts CopyOptions) (ObjectInfo, error)
+	Rename(ctx context.Context, bucket, srcKey, dstKey string) (ObjectInfo, error)
 	// List returns object keys (directories) under the bucket that match prefix.
 	List(ctx context.Context, bucket, prefix string) ([]string, error)
+	// ListObjects returns one page of objects, in key order, with their size,
+	// ETag and modification time; see ListOptions.
+	ListObjects(ctx context.Context, bucket string, opts ListOptions) (ListResult, error)
 	// Multipart upload support
+	// Uploads are bound to the key they were started for; parts, completion
+	// and abort on another key fail with ErrNoSuchUpload.
 	StartMultipart(ctx context.Context, bucket, key string) (uploadID string, err error)
-	UploadPart(ctx context.Context, bucket, key, uploadID string, partNumber int, r io.Reader) error
-	CompleteMultipart(ctx context.Context, bucket, key, uploadID string, meta Metadata) error
+	CreateMultipartUpload(ctx context.Context, bucket, key string, meta Metadata, initiator string) (MultipartUpload, error)
+	ListMultipartUploads(ctx context.Context, bucket, prefix string) ([]MultipartUpload, error)
+	ListParts(ctx context.Context, bucket, key, uploadID string) ([]PartInfo, error)
+	UploadPart(ctx context.Context, bucket, key, uploadID string, partNumber int, r io.Reader) (PartInfo, error)
+	// CompleteMultipart commits parts, in the given ascending order, as the
+	// object's content. A nil parts list commits every uploaded part; nil
+	// meta keeps the metadata given when the upload was created.
+	// The resulting object gets an S3-style multipart ETag ("<md5>-<parts>").
+	CompleteMultipart(ctx context.Context, bucket, key, uploadID string, parts []CompletedPart, meta Metadata) (ObjectInfo, error)
 	AbortMultipart(ctx context.Context, bucket, key, uploadID string) error
+	// Buckets must be created before objects are written to them; writes to
+	// a missing bucket fail with ErrNoSuchBucket.
+	CreateBucket(ctx context.Context, bucket string) error
+	// DeleteBucket fails with ErrBucketNotEmpty unless force is set.
+	DeleteBucket(ctx context.Context, bucket string, force bool) error
+	ListBuckets(ctx context.Context) ([]BucketInfo, error)
+	HeadBucket(ctx context.Context, bucket string) (BucketInfo, error)
 	// Bucket metadata (per-bucket settings)
 	PutBucketMetadata(ctx context.Context, bucket string, meta BucketMetadata) error
 	GetBucketMetadata(ctx context.Context, bucket string) (BucketMetadata, error)
+	// Lifecycle rules, applied by ApplyLifecycle (see LifecycleConfig)
+	PutLifecycle(ctx context.Context, bucket string, cfg LifecycleConfig) error
+	GetLifecycle(ctx context.Context, bucket string) (LifecycleConfig, error)
+	ApplyLifecycle(ctx context.Context, bucket string, dryRun bool) (LifecycleReport, error)
+	// Access policy, enforced by the HTTP server (see BucketPolicy)
+	PutBucketPolicy(ctx context.Context, bucket string, p BucketPolicy) error
+	GetBucketPolicy(ctx context.Context, bucket string) (BucketPolicy, error)
+	DeleteBucketPolicy(ctx context.Context, bucket string) error
 	// Analytics / stats
 	Stats(ctx context.Context, bucket string) (Stats, error)
-	// Reconstruct object: writes a single file at outPath and embeds selected metadata keys
+	// Reconstruct object: writes a self-describing file at outPath embedding selected metadata keys;
+	// an existing file at outPath is never replaced
 	Reconstruct(ctx context.Context, bucket, key, outPath string, includeKeys []string) error
+	// ReconstructTo streams the same output to w
+	ReconstructTo(ctx context.Context, bucket, key string, w io.Writer, includeKeys []string) error
+	// Import stores the object of a reconstructed file (see OpenReconstructed)
+	Import(ctx context.Context, bucket, key string, r io.Reader) (ObjectInfo, error)
 }
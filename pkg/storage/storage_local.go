@@ -3,77 +3,234 @@ package storage
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"maps"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
 // LocalStorage is a simple filesystem-backed Storage implementation.
 type LocalStorage struct {
 	Root string // root directory where buckets are stored
+	// Keys encrypts new objects at rest (see encryption.go); without it
+	// they are stored in clear, unless written with a customer-provided key.
+	Keys *Keyring
+
+	usageMu sync.Mutex // serialises mutations tracked in bucket usage counters
+}
+
+// bucketPath validates bucket and returns its directory under Root.
+func (s *LocalStorage) bucketPath(bucket string) (string, error) {
+	b, err := ParseBucketName(bucket)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.Root, string(b)), nil
+}
+
+// objectPath validates bucket and key and returns the object directory.
+func (s *LocalStorage) objectPath(bucket, key string) (string, error) {
+	dir, err := s.bucketPath(bucket)
+	if err != nil {
+		return "", err
+	}
+	k, err := ParseObjectKey(key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, string(k)), nil
+}
+
+// uploadPath validates bucket and uploadID and returns the multipart staging directory.
+func (s *LocalStorage) uploadPath(bucket, uploadID string) (string, error) {
+	dir, err := s.bucketPath(bucket)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(uploadID, "upload-") || strings.ContainsAny(uploadID, "/\\\x00") || uploadID != filepath.Base(uploadID) {
+		return "", invalid(uploadID, "malformed upload id")
+	}
+	return filepath.Join(dir, ".multipart", uploadID), nil
+}
+
+// existingBucketDir validates bucket and returns its directory, or
+// ErrNoSuchBucket when the bucket has not been created.
+func (s *LocalStorage) existingBucketDir(bucket string) (string, error) {
+	dir, err := s.bucketPath(bucket)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(dir); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", fmt.Errorf("%w: %s", ErrNoSuchBucket, bucket)
+		}
+		return "", err
+	}
+	return dir, nil
+}
+
+// keyNotFound builds the error for a missing object, distinguishing a missing
+// bucket from a missing key.
+func (s *LocalStorage) keyNotFound(bucket, key string) error {
+	if _, err := s.existingBucketDir(bucket); err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: %s/%s", ErrNoSuchKey, bucket, key)
 }
 
-// ensureBucketDir ensures the bucket directory exists and returns its path.
-func (s *LocalStorage) ensureBucketDir(bucket string) (string, error) {
-	dir := filepath.Join(s.Root, bucket)
-	if err := os.MkdirAll(dir, 0o755); err != nil {
+// existingUploadDir returns the staging directory of an in-progress multipart
+// upload, or ErrNoSuchUpload when it does not exist.
+func (s *LocalStorage) existingUploadDir(bucket, uploadID string) (string, error) {
+	dir, err := s.uploadPath(bucket, uploadID)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(dir); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			if _, err := s.existingBucketDir(bucket); err != nil {
+				return "", err
+			}
+			return "", fmt.Errorf("%w: %s", ErrNoSuchUpload, uploadID)
+		}
 		return "", err
 	}
 	return dir, nil
 }
 
+// maxPartNumber is the highest part number accepted by UploadPart.
+const maxPartNumber = 10000
+
 func (s *LocalStorage) Put(ctx context.Context, bucket, key string, r io.Reader) error {
 	// default to single part -> store as part.1 inside object dir
 	meta := Metadata{"created_by": "LocalStorage"}
-	return s.PutWithMetadata(ctx, bucket, key, r, meta)
+	_, err := s.PutWithMetadata(ctx, bucket, key, r, meta)
+	return err
 }
 
 func (s *LocalStorage) Get(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
-	objDir := filepath.Join(s.Root, bucket, key)
-	// list parts named part.N
-	files, err := os.ReadDir(objDir)
+	return s.GetRange(ctx, bucket, key, 0, -1)
+}
+
+// GetRange returns length bytes of the object starting at offset; a negative
+// length reads to the end. Only the part files covering the range are opened.
+func (s *LocalStorage) GetRange(ctx context.Context, bucket, key string, offset, length int64) (io.ReadCloser, error) {
+	objDir, m, err := s.manifest(bucket, key)
 	if err != nil {
 		return nil, err
 	}
-	var parts []string
-	for _, f := range files {
-		if f.IsDir() {
-			continue
+	c, err := s.objectCipher(ctx, m.Encryption)
+	if err != nil {
+		return nil, err
+	}
+	return openRange(objDir, m, offset, length, c)
+}
+
+// Stat returns the size, ETag, checksums and modification time of an object.
+// Objects encrypted with a customer-provided key need that key.
+func (s *LocalStorage) Stat(ctx context.Context, bucket, key string) (ObjectInfo, error) {
+	objDir, m, err := s.manifest(bucket, key)
+	if err != nil {
+		return ObjectInfo{Key: key}, err
+	}
+	if m.Encryption != nil && m.Encryption.CustomerKeyMD5 != "" {
+		if _, err := s.objectCipher(ctx, m.Encryption); err != nil {
+			return ObjectInfo{Key: key}, err
 		}
-		if strings.HasPrefix(f.Name(), "part.") {
-			parts = append(parts, filepath.Join(objDir, f.Name()))
+	}
+	info := m.info(key)
+	if meta, err := s.readMeta(objDir); err == nil {
+		info.ContentType = meta[MetaContentType]
+	}
+	return info, nil
+}
+
+// manifest validates bucket and key and loads the object's manifest.
+func (s *LocalStorage) manifest(bucket, key string) (string, Manifest, error) {
+	objDir, err := s.objectPath(bucket, key)
+	if err != nil {
+		return "", Manifest{}, err
+	}
+	m, err := readManifest(objDir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", m, s.keyNotFound(bucket, key)
 		}
+		return "", m, err
 	}
-	sort.Strings(parts)
-	if len(parts) == 0 {
-		return nil, fmt.Errorf("no parts found for object %s/%s", bucket, key)
-	}
-	// create a reader that concatenates all parts
-	readers := make([]io.ReadCloser, 0, len(parts))
-	for _, p := range parts {
-		rc, err := os.Open(p)
-		if err != nil { // close all opened
-			for _, r := range readers {
-				r.Close()
-			}
+	return objDir, m, nil
+}
+
+// openRange returns a reader over length bytes of the object described by m,
+// starting at offset, decrypted with c. A negative length, or one running
+// past the end, reads to the end of the object.
+func openRange(objDir string, m Manifest, offset, length int64, c *objectCipher) (io.ReadCloser, error) {
+	if offset < 0 || offset > m.Size {
+		return nil, fmt.Errorf("%w: offset %d outside object of %d bytes", ErrInvalidRange, offset, m.Size)
+	}
+	if length < 0 || length > m.Size-offset {
+		length = m.Size - offset
+	}
+	parts := m.Parts
+	for len(parts) > 0 && offset >= parts[0].Size {
+		offset -= parts[0].Size
+		parts = parts[1:]
+	}
+	r := &partsReader{dir: objDir, parts: parts, cipher: c, skip: offset, remaining: length}
+	if length > 0 {
+		// open the first part now so a missing part file is reported by the
+		// caller rather than by the first Read
+		if err := r.next(); err != nil {
 			return nil, err
 		}
-		readers = append(readers, rc)
 	}
-	return &multiReadCloser{readers: readers}, nil
+	return r, nil
 }
 
-type multiReadCloser struct{ readers []io.ReadCloser }
+// partsReader streams a byte range spanning consecutive part files, opening
+// each part only when the read reaches it.
+type partsReader struct {
+	dir       string
+	parts     []PartInfo // parts not yet opened
+	cipher    *objectCipher
+	skip      int64 // bytes to skip at the start of parts[0]
+	remaining int64 // bytes left to return
+	cur       io.ReadCloser
+}
 
-func (m *multiReadCloser) Read(p []byte) (int, error) {
-	for len(m.readers) > 0 {
-		n, err := m.readers[0].Read(p)
+func (r *partsReader) next() error {
+	if len(r.parts) == 0 {
+		return io.ErrUnexpectedEOF
+	}
+	f, err := openPartFile(r.dir, r.parts[0], r.cipher, r.skip)
+	if err != nil {
+		return err
+	}
+	r.cur, r.parts, r.skip = f, r.parts[1:], 0
+	return nil
+}
+
+func (r *partsReader) Read(p []byte) (int, error) {
+	for r.remaining > 0 {
+		if r.cur == nil {
+			if err := r.next(); err != nil {
+				return 0, err
+			}
+		}
+		if int64(len(p)) > r.remaining {
+			p = p[:r.remaining]
+		}
+		n, err := r.cur.Read(p)
+		r.remaining -= int64(n)
 		if err == io.EOF {
-			m.readers[0].Close()
-			m.readers = m.readers[1:]
+			r.cur.Close()
+			r.cur = nil
 			if n > 0 {
 				return n, nil
 			}
@@ -83,66 +240,101 @@ func (m *multiReadCloser) Read(p []byte) (int, error) {
 	}
 	return 0, io.EOF
 }
-func (m *multiReadCloser) Close() error {
-	var firstErr error
-	for _, r := range m.readers {
-		if err := r.Close(); err != nil && firstErr == nil {
-			firstErr = err
-		}
+
+func (r *partsReader) Close() error {
+	r.parts = nil
+	if r.cur == nil {
+		return nil
 	}
-	m.readers = nil
-	return firstErr
+	err := r.cur.Close()
+	r.cur = nil
+	return err
 }
 
-func (s *LocalStorage) PutWithMetadata(ctx context.Context, bucket, key string, r io.Reader, meta Metadata) error {
-	dir, err := s.ensureBucketDir(bucket)
+func (s *LocalStorage) PutWithMetadata(ctx context.Context, bucket, key string, r io.Reader, meta Metadata) (ObjectInfo, error) {
+	info := ObjectInfo{Key: key}
+	objDir, err := s.objectPath(bucket, key)
 	if err != nil {
-		return err
+		return info, err
+	}
+	bucketDir, err := s.existingBucketDir(bucket)
+	if err != nil {
+		return info, err
 	}
-	objDir := filepath.Join(dir, key)
 	// If key denotes a directory (ends with '/'), create a directory marker
 	// and do NOT create part.1 or data.meta
 	if strings.HasSuffix(key, "/") {
 		if err := os.MkdirAll(objDir, 0o755); err != nil {
-			return err
+			return info, err
 		}
 		marker := filepath.Join(objDir, ".dir")
 		// create or truncate marker
 		if err := os.WriteFile(marker, []byte{}, 0o644); err != nil {
-			return err
+			return info, err
 		}
-		return nil
+		return info, nil
 	}
 
-	if err := os.MkdirAll(objDir, 0o755); err != nil {
-		return err
+	r, err = s.limitWrite(ctx, bucket, r, s.overwrittenSize(ctx, bucket, objDir))
+	if err != nil {
+		return info, err
 	}
-	// write single part as part.1
-	partPath := filepath.Join(objDir, "part.1")
-	f, err := os.Create(partPath)
+	enc, c, err := s.newEncryption(ctx)
 	if err != nil {
-		return err
+		return info, err
 	}
-	if _, err := io.Copy(f, r); err != nil {
-		f.Close()
-		return err
+	// Stage the data first so that a failed or interrupted upload never
+	// replaces (or truncates) the object currently being served.
+	staged, size, sums, err := stagePart(filepath.Join(bucketDir, stagingDirName), "put-*", r, c, 1)
+	if err != nil {
+		return info, err
 	}
-	if err := f.Close(); err != nil {
-		return err
+	defer os.Remove(staged) // no-op once published
+	if err := os.MkdirAll(objDir, 0o755); err != nil {
+		return info, err
 	}
-	// write metadata
-	if err := s.writeMeta(objDir, meta); err != nil {
-		return err
+	var m Manifest
+	checkQuota := func(u Usage) error {
+		return s.checkQuota(ctx, bucket, &u, size, s.overwrittenSize(ctx, bucket, objDir))
 	}
-	return nil
+	err = s.trackWrite(bucketDir, usageScope{ObjDir: objDir, Key: key}, checkQuota, func() error {
+		vid, err := s.prepareVersion(ctx, bucket, bucketDir, objDir, key)
+		if err != nil {
+			return err
+		}
+		// publish as part.1, then the manifest and metadata, then drop parts
+		// of a previous multipart version
+		now := time.Now().UTC()
+		m = Manifest{
+			VersionID:    vid,
+			Parts:        []PartInfo{{Number: 1, Size: size, ETag: sums.MD5, SHA256: sums.SHA256, LastModified: now}},
+			Size:         size,
+			ETag:         sums.MD5,
+			LastModified: now,
+			SHA256:       sums.SHA256,
+			CRC32C:       sums.CRC32C,
+			Encryption:   enc,
+		}
+		if err := os.Rename(staged, filepath.Join(objDir, m.Parts[0].FileName())); err != nil {
+			return err
+		}
+		return s.publish(objDir, m, meta)
+	})
+	if err != nil {
+		return info, err
+	}
+	return m.info(key), nil
 }
 
 func (s *LocalStorage) PutMetadata(ctx context.Context, bucket, key string, meta Metadata) error {
-	dir, err := s.ensureBucketDir(bucket)
+	objDir, err := s.objectPath(bucket, key)
+	if err != nil {
+		return err
+	}
+	bucketDir, err := s.existingBucketDir(bucket)
 	if err != nil {
 		return err
 	}
-	objDir := filepath.Join(dir, key)
 	// For directory keys, do not write data.meta; create a directory marker instead.
 	if strings.HasSuffix(key, "/") {
 		if err := os.MkdirAll(objDir, 0o755); err != nil {
@@ -154,133 +346,306 @@ func (s *LocalStorage) PutMetadata(ctx context.Context, bucket, key string, meta
 		}
 		return nil
 	}
-	if err := os.MkdirAll(objDir, 0o755); err != nil {
-		return err
-	}
-	return s.writeMeta(objDir, meta)
+	// written under the lock of the other mutations, so that it is not lost
+	// to a concurrent delete or fsck repair of the object
+	return s.trackUsage(bucketDir, usageScope{ObjDir: objDir, Key: key}, func() error {
+		if err := os.MkdirAll(objDir, 0o755); err != nil {
+			return err
+		}
+		return s.writeMeta(objDir, meta)
+	})
 }
 
 func (s *LocalStorage) GetMetadata(ctx context.Context, bucket, key string) (Metadata, error) {
-	objDir := filepath.Join(s.Root, bucket, key)
-	data, err := os.ReadFile(filepath.Join(objDir, "data.meta"))
+	objDir, err := s.objectPath(bucket, key)
 	if err != nil {
 		return nil, err
 	}
-	var m Metadata
-	if err := json.Unmarshal(data, &m); err != nil {
+	m, err := s.readMeta(objDir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, s.keyNotFound(bucket, key)
+		}
 		return nil, err
 	}
 	return m, nil
 }
 
-func (s *LocalStorage) writeMeta(objDir string, meta Metadata) error {
-	b, err := json.Marshal(meta)
+// readMeta reads the data.meta file of an object directory, decrypting it
+// when it is sealed.
+func (s *LocalStorage) readMeta(objDir string) (Metadata, error) {
+	data, err := os.ReadFile(filepath.Join(objDir, "data.meta"))
 	if err != nil {
+		return nil, err
+	}
+	m, _, err := s.decodeMeta(data)
+	return m, err
+}
+
+// publish commits a new object version whose part files are already in
+// objDir: it writes the manifest and metadata, removes part files that belong
+// to a previous version and makes the directory durable.
+func (s *LocalStorage) publish(objDir string, m Manifest, meta Metadata) error {
+	if err := writeManifest(objDir, m); err != nil {
+		return err
+	}
+	if err := s.writeMeta(objDir, meta); err != nil {
 		return err
 	}
-	tmp := filepath.Join(objDir, "data.meta.tmp")
-	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+	if err := removeStaleParts(objDir, m.partNames()); err != nil {
 		return err
 	}
-	return os.Rename(tmp, filepath.Join(objDir, "data.meta"))
+	return syncDir(objDir)
 }
 
-// Multipart uploads stored under bucket/.multipart/<uploadID>/part.N
-func (s *LocalStorage) StartMultipart(ctx context.Context, bucket, key string) (string, error) {
-	dir, err := s.ensureBucketDir(bucket)
-	if err != nil {
+// prepareVersion is called before a new version of key is published. In a
+// versioned bucket it archives the current version and returns the ID of the
+// new one; otherwise it returns an empty ID and the write replaces the object.
+func (s *LocalStorage) prepareVersion(ctx context.Context, bucket, bucketDir, objDir, key string) (string, error) {
+	versioned, err := s.versioningEnabled(ctx, bucket)
+	if err != nil || !versioned {
 		return "", err
 	}
-	multipartDir := filepath.Join(dir, ".multipart")
-	if err := os.MkdirAll(multipartDir, 0o755); err != nil {
+	if err := archiveCurrent(bucketDir, objDir, key, false); err != nil {
 		return "", err
 	}
-	// simple upload id: unixnano + random-ish using temp file
-	d, err := os.MkdirTemp(multipartDir, "upload-")
+	return newVersionID(), nil
+}
+
+func (s *LocalStorage) writeMeta(objDir string, meta Metadata) error {
+	b, err := s.encodeMeta(meta)
 	if err != nil {
-		return "", err
+		return err
 	}
-	id := filepath.Base(d)
-	return id, nil
+	return writeFileAtomic(filepath.Join(objDir, "data.meta"), b)
 }
 
-func (s *LocalStorage) UploadPart(ctx context.Context, bucket, key, uploadID string, partNumber int, r io.Reader) error {
-	dir, err := s.ensureBucketDir(bucket)
+// Multipart uploads are stored under bucket/.multipart/<uploadID>/part.N
+// next to the upload record (see uploads.go).
+func (s *LocalStorage) UploadPart(ctx context.Context, bucket, key, uploadID string, partNumber int, r io.Reader) (PartInfo, error) {
+	part := PartInfo{Number: partNumber}
+	if partNumber < 1 || partNumber > maxPartNumber {
+		return part, fmt.Errorf("%w: part number %d out of range 1-%d", ErrInvalidPart, partNumber, maxPartNumber)
+	}
+	partDir, _, err := s.openUpload(bucket, key, uploadID)
 	if err != nil {
-		return err
+		return part, err
 	}
-	partDir := filepath.Join(dir, ".multipart", uploadID)
-	if err := os.MkdirAll(partDir, 0o755); err != nil {
-		return err
+	enc, err := readUploadEncryption(partDir)
+	if err != nil {
+		return part, err
 	}
-	partPath := filepath.Join(partDir, fmt.Sprintf("part.%d", partNumber))
-	f, err := os.Create(partPath)
+	c, err := s.objectCipher(ctx, enc)
 	if err != nil {
-		return err
+		return part, err
 	}
-	if _, err := io.Copy(f, r); err != nil {
-		f.Close()
-		return err
+	// a re-sent part releases the previous attempt
+	var freed int64
+	if fi, err := os.Stat(filepath.Join(partDir, part.FileName())); err == nil {
+		freed = fi.Size()
 	}
-	return f.Close()
+	if r, err = s.limitWrite(ctx, bucket, r, freed); err != nil {
+		return part, err
+	}
+	// stage inside the upload dir so a re-sent part atomically replaces the
+	// previous attempt and an interrupted one leaves no truncated part.N
+	staged, size, sums, err := stagePart(partDir, ".part-*", r, c, partNumber)
+	if err != nil {
+		return part, err
+	}
+	part.Size, part.ETag, part.SHA256 = size, sums.MD5, sums.SHA256
+	part.LastModified = time.Now().UTC()
+	bucketDir, err := s.bucketPath(bucket)
+	if err != nil {
+		return part, err
+	}
+	// parts count towards usage with the size of their files
+	checkQuota := func(u Usage) error {
+		fi, err := os.Stat(staged)
+		if err != nil {
+			return err
+		}
+		var freed int64
+		if fi, err := os.Stat(filepath.Join(partDir, part.FileName())); err == nil {
+			freed = fi.Size()
+		}
+		return s.checkQuota(ctx, bucket, &u, fi.Size(), freed)
+	}
+	err = s.trackWrite(bucketDir, usageScope{PartDir: partDir}, checkQuota, func() error {
+		return os.Rename(staged, filepath.Join(partDir, part.FileName()))
+	})
+	if err != nil {
+		os.Remove(staged)
+		return part, err
+	}
+	// record the part checksums next to it; CompleteMultipart recomputes
+	// them if this sidecar is missing
+	b, err := json.Marshal(part)
+	if err != nil {
+		return part, err
+	}
+	if err := writeFileAtomic(filepath.Join(partDir, part.FileName()+".json"), b); err != nil {
+		return part, err
+	}
+	return part, nil
 }
 
-func (s *LocalStorage) CompleteMultipart(ctx context.Context, bucket, key, uploadID string, meta Metadata) error {
-	dir, err := s.ensureBucketDir(bucket)
+func (s *LocalStorage) CompleteMultipart(ctx context.Context, bucket, key, uploadID string, parts []CompletedPart, meta Metadata) (ObjectInfo, error) {
+	info := ObjectInfo{Key: key}
+	objDir, err := s.objectPath(bucket, key)
 	if err != nil {
-		return err
+		return info, err
 	}
 	// Completing a multipart upload for a directory key is invalid
 	if strings.HasSuffix(key, "/") {
-		return fmt.Errorf("cannot complete multipart upload for directory key %s", key)
+		return info, invalid(key, "cannot complete multipart upload for directory key")
 	}
-	partDir := filepath.Join(dir, ".multipart", uploadID)
-	files, err := os.ReadDir(partDir)
+	partDir, up, err := s.openUpload(bucket, key, uploadID)
 	if err != nil {
-		return err
+		return info, err
+	}
+	if meta == nil {
+		meta = up.Metadata
+	}
+	enc, err := readUploadEncryption(partDir)
+	if err != nil {
+		return info, err
+	}
+	// the customer-provided key is only needed to recompute missing checksums
+	c, err := s.objectCipher(ctx, enc)
+	if err != nil && !errors.Is(err, ErrCustomerKeyRequired) {
+		return info, err
 	}
-	// move parts into object dir maintaining order
-	objDir := filepath.Join(dir, key)
+	m, err := selectParts(partDir, parts, enc, c)
+	if err != nil {
+		return info, err
+	}
+	m.Encryption = enc
+	if m.ETag, err = multipartETag(m.Parts); err != nil {
+		return info, err
+	}
+	if err := s.checkCompleteQuota(ctx, bucket, nil, partDir, objDir, m); err != nil {
+		return info, err
+	}
+	m.LastModified = time.Now().UTC()
 	if err := os.MkdirAll(objDir, 0o755); err != nil {
-		return err
+		return info, err
 	}
-	// collect and sort parts by numeric suffix
-	var parts []string
-	for _, f := range files {
-		if f.IsDir() {
-			continue
+	bucketDir, err := s.bucketPath(bucket)
+	if err != nil {
+		return info, err
+	}
+	checkQuota := func(u Usage) error { return s.checkCompleteQuota(ctx, bucket, &u, partDir, objDir, m) }
+	err = s.trackWrite(bucketDir, usageScope{ObjDir: objDir, Key: key, PartDir: partDir}, checkQuota, func() error {
+		if m.VersionID, err = s.prepareVersion(ctx, bucket, bucketDir, objDir, key); err != nil {
+			return err
 		}
-		if strings.HasPrefix(f.Name(), "part.") {
-			parts = append(parts, filepath.Join(partDir, f.Name()))
+		// move each committed part to objDir as part.N (preserve original name)
+		for _, p := range m.Parts {
+			if err := os.Rename(filepath.Join(partDir, p.FileName()), filepath.Join(objDir, p.FileName())); err != nil {
+				return err
+			}
 		}
-	}
-	sort.Strings(parts)
-	// move each part to objDir as part.N (preserve original name)
-	for _, p := range parts {
-		if err := os.Rename(p, filepath.Join(objDir, filepath.Base(p))); err != nil {
+		if err := s.publish(objDir, m, meta); err != nil {
 			return err
 		}
+		// remove multipart dir for uploadID, including parts that were not committed
+		return os.RemoveAll(partDir)
+	})
+	if err != nil {
+		return info, err
 	}
-	// write metadata
-	if err := s.writeMeta(objDir, meta); err != nil {
-		return err
+	return m.info(key), nil
+}
+
+// selectParts validates the parts a client wants to commit against those
+// uploaded to partDir, encrypted as enc, and returns the manifest of the
+// resulting object. A nil list selects every uploaded part in numeric order.
+func selectParts(partDir string, parts []CompletedPart, enc *Encryption, c *objectCipher) (Manifest, error) {
+	var m Manifest
+	uploaded, err := uploadedParts(partDir, enc)
+	if err != nil {
+		return m, err
+	}
+	if parts == nil {
+		for _, p := range uploaded {
+			parts = append(parts, CompletedPart{PartNumber: p.Number})
+		}
+	}
+	if len(parts) == 0 {
+		return m, fmt.Errorf("%w: no parts to complete", ErrInvalidPart)
+	}
+	byNumber := make(map[int]PartInfo, len(uploaded))
+	for _, p := range uploaded {
+		byNumber[p.Number] = p
 	}
-	// remove multipart dir for uploadID
-	return os.RemoveAll(partDir)
+	prev := 0
+	for _, cp := range parts {
+		if cp.PartNumber <= prev {
+			return m, fmt.Errorf("%w: part numbers must be listed in ascending order", ErrInvalidPart)
+		}
+		prev = cp.PartNumber
+		up, ok := byNumber[cp.PartNumber]
+		if !ok {
+			return m, fmt.Errorf("%w: part %d was not uploaded", ErrInvalidPart, cp.PartNumber)
+		}
+		up, err := uploadedPartInfo(partDir, up, enc, c)
+		if err != nil {
+			return m, err
+		}
+		if cp.ETag != "" && strings.Trim(cp.ETag, `"`) != up.ETag {
+			return m, fmt.Errorf("%w: etag mismatch for part %d", ErrInvalidPart, cp.PartNumber)
+		}
+		m.Parts = append(m.Parts, up)
+		m.Size += up.Size
+	}
+	return m, nil
+}
+
+// uploadedPartInfo completes p with the checksums recorded by UploadPart,
+// recomputing them from the part data, decrypted with c, when the record is
+// missing or stale.
+func uploadedPartInfo(partDir string, p PartInfo, enc *Encryption, c *objectCipher) (PartInfo, error) {
+	var rec PartInfo
+	if b, err := os.ReadFile(filepath.Join(partDir, p.FileName()+".json")); err == nil {
+		if json.Unmarshal(b, &rec) == nil && rec.Number == p.Number && rec.Size == p.Size && rec.ETag != "" {
+			return rec, nil
+		}
+	}
+	if enc != nil && c == nil {
+		return p, fmt.Errorf("%w: part %d has no checksum record", ErrCustomerKeyRequired, p.Number)
+	}
+	f, err := openPartFile(partDir, p, c, 0)
+	if err != nil {
+		return p, err
+	}
+	defer f.Close()
+	sums := newChecksumWriter()
+	if _, err := io.Copy(sums, f); err != nil {
+		return p, err
+	}
+	sum := sums.Sum()
+	p.ETag, p.SHA256 = sum.MD5, sum.SHA256
+	return p, nil
 }
 
 func (s *LocalStorage) AbortMultipart(ctx context.Context, bucket, key, uploadID string) error {
-	dir, err := s.ensureBucketDir(bucket)
+	partDir, _, err := s.openUpload(bucket, key, uploadID)
+	if err != nil {
+		return err
+	}
+	bucketDir, err := s.bucketPath(bucket)
 	if err != nil {
 		return err
 	}
-	partDir := filepath.Join(dir, ".multipart", uploadID)
-	return os.RemoveAll(partDir)
+	return s.trackUsage(bucketDir, usageScope{PartDir: partDir}, func() error {
+		return os.RemoveAll(partDir)
+	})
 }
 
 // Bucket metadata stored as .bucket.meta in bucket root
 func (s *LocalStorage) PutBucketMetadata(ctx context.Context, bucket string, meta BucketMetadata) error {
-	dir, err := s.ensureBucketDir(bucket)
+	dir, err := s.existingBucketDir(bucket)
 	if err != nil {
 		return err
 	}
@@ -288,18 +653,21 @@ func (s *LocalStorage) PutBucketMetadata(ctx context.Context, bucket string, met
 	if err != nil {
 		return err
 	}
-	tmp := filepath.Join(dir, ".bucket.meta.tmp")
-	if err := os.WriteFile(tmp, b, 0o644); err != nil {
-		return err
-	}
-	return os.Rename(tmp, filepath.Join(dir, ".bucket.meta"))
+	return writeFileAtomic(filepath.Join(dir, ".bucket.meta"), b)
 }
 
 func (s *LocalStorage) GetBucketMetadata(ctx context.Context, bucket string) (BucketMetadata, error) {
 	var bm BucketMetadata
-	dir := filepath.Join(s.Root, bucket)
+	dir, err := s.existingBucketDir(bucket)
+	if err != nil {
+		return bm, err
+	}
 	data, err := os.ReadFile(filepath.Join(dir, ".bucket.meta"))
 	if err != nil {
+		// a bucket without .bucket.meta uses the defaults (no limits)
+		if errors.Is(err, fs.ErrNotExist) {
+			return bm, nil
+		}
 		return bm, err
 	}
 	if err := json.Unmarshal(data, &bm); err != nil {
@@ -308,39 +676,18 @@ func (s *LocalStorage) GetBucketMetadata(ctx context.Context, bucket string) (Bu
 	return bm, nil
 }
 
-// Stats: iterate bucket and summarize objects and bytes
+// Stats summarizes the bucket from its usage counters.
 func (s *LocalStorage) Stats(ctx context.Context, bucket string) (Stats, error) {
-	base := filepath.Join(s.Root, bucket)
 	var st Stats
-	if _, err := os.Stat(base); os.IsNotExist(err) {
-		return st, nil
-	}
-	err := filepath.Walk(base, func(p string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if info.IsDir() {
-			return nil
-		}
-		// ignore internal dot files
-		if strings.HasPrefix(info.Name(), ".") {
-			return nil
-		}
-		// count only part.* files as storage usage
-		if strings.HasPrefix(info.Name(), "part.") {
-			st.UsedBytes += info.Size()
-		}
-		return nil
-	})
-	if err != nil {
-		return st, err
-	}
-	// count objects by listing directories that contain part files
-	objs, err := s.List(ctx, bucket, "")
+	u, err := s.Usage(ctx, bucket)
 	if err != nil {
 		return st, err
 	}
-	st.ObjectCount = int64(len(objs))
+	st.ObjectCount = u.Objects
+	st.PartCount = u.Parts
+	st.VersionBytes = u.VersionBytes
+	st.MultipartBytes = u.MultipartBytes
+	st.UsedBytes = u.used()
 	// capacity from bucket meta if available
 	if bm, err := s.GetBucketMetadata(ctx, bucket); err == nil {
 		st.CapacityBytes = bm.CapacityBytes
@@ -348,92 +695,126 @@ func (s *LocalStorage) Stats(ctx context.Context, bucket string) (Stats, error)
 	return st, nil
 }
 
-// Reconstruct writes a single file at outPath with a small binary header containing selected metadata keys (JSON), length-prefixed.
+// Reconstruct writes the object to a new file at outPath, see ReconstructTo.
+// It never replaces an existing file (or follows a symbolic link there): it
+// fails with fs.ErrExist instead.
 func (s *LocalStorage) Reconstruct(ctx context.Context, bucket, key, outPath string, includeKeys []string) error {
-	objDir := filepath.Join(s.Root, bucket, key)
-	// Read metadata
-	meta, err := s.GetMetadata(ctx, bucket, key)
+	if err := os.MkdirAll(filepath.Dir(outPath), 0o755); err != nil {
+		return err
+	}
+	of, err := os.OpenFile(outPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	err = s.ReconstructTo(ctx, bucket, key, of, includeKeys)
+	if cerr := of.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(outPath)
+	}
+	return err
+}
+
+// ReconstructTo writes the object to w as a reconstructed file (see
+// ContainerVersion for the format) whose header carries the key, ETag and
+// the metadata keys listed in includeKeys, plus "filename" when set; "*"
+// selects every key. The object is looked up before anything is written,
+// so a failure to find it leaves w untouched.
+func (s *LocalStorage) ReconstructTo(ctx context.Context, bucket, key string, w io.Writer, includeKeys []string) error {
+	objDir, m, err := s.manifest(bucket, key)
 	if err != nil {
 		return err
 	}
-	header := make(map[string]string)
+	c, err := s.objectCipher(ctx, m.Encryption)
+	if err != nil {
+		return err
+	}
+	meta, err := s.readMeta(objDir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	h := ContainerHeader{Key: key, ETag: m.ETag, LastModified: m.LastModified, Metadata: Metadata{}}
 	for _, k := range includeKeys {
-		if v, ok := meta[k]; ok {
-			header[k] = v
+		if k == "*" {
+			maps.Copy(h.Metadata, meta)
+		} else if v, ok := meta[k]; ok {
+			h.Metadata[k] = v
 		}
 	}
 	// Force include filename if present in meta
 	if name, ok := meta["filename"]; ok {
-		header["filename"] = name
+		h.Metadata["filename"] = name
 	}
-	hbin, err := json.Marshal(header)
+	rc, err := openRange(objDir, m, 0, -1, c)
 	if err != nil {
 		return err
 	}
-	// open out file
-	if err := os.MkdirAll(filepath.Dir(outPath), 0o755); err != nil {
-		return err
-	}
-	of, err := os.Create(outPath)
+	defer rc.Close()
+	return writeContainer(w, h, m.Size, rc)
+}
+
+func (s *LocalStorage) Delete(ctx context.Context, bucket, key string) error {
+	path, err := s.objectPath(bucket, key)
 	if err != nil {
 		return err
 	}
-	defer of.Close()
-	// write length-prefixed header: 8 bytes big-endian length
-	var lnBuf [8]byte
-	ln := uint64(len(hbin))
-	for i := 0; i < 8; i++ {
-		lnBuf[7-i] = byte(ln >> (uint(i) * 8))
-	}
-	if _, err := of.Write(lnBuf[:]); err != nil {
+	bucketDir, err := s.existingBucketDir(bucket)
+	if err != nil {
 		return err
 	}
-	if _, err := of.Write(hbin); err != nil {
+	versioned, err := s.versioningEnabled(ctx, bucket)
+	if err != nil {
 		return err
 	}
-	// append parts
-	files, err := os.ReadDir(objDir)
-	if err != nil {
+	_, err = readManifest(path)
+	exists := err == nil
+	if !exists && !errors.Is(err, fs.ErrNotExist) {
 		return err
 	}
-	var parts []string
-	for _, f := range files {
-		if f.IsDir() {
-			continue
-		}
-		if strings.HasPrefix(f.Name(), "part.") {
-			parts = append(parts, filepath.Join(objDir, f.Name()))
-		}
+	if !exists && strings.HasSuffix(key, "/") {
+		_, err := os.Stat(filepath.Join(path, ".dir"))
+		exists = err == nil
 	}
-	sort.Strings(parts)
-	for _, p := range parts {
-		in, err := os.Open(p)
+	if versioned && !strings.HasSuffix(key, "/") {
+		ids, err := archivedVersions(bucketDir, key)
 		if err != nil {
 			return err
 		}
-		if _, err := io.Copy(of, in); err != nil {
-			in.Close()
-			return err
+		if !exists && len(ids) == 0 {
+			return s.keyNotFound(bucket, key)
 		}
-		in.Close()
+		// keep the current version and record the delete with a marker
+		return s.trackUsage(bucketDir, usageScope{ObjDir: path, Key: key}, func() error {
+			if err := archiveCurrent(bucketDir, path, key, true); err != nil {
+				return err
+			}
+			if exists {
+				if err := removeObjectFiles(path); err != nil {
+					return err
+				}
+			}
+			_, err := writeDeleteMarker(bucketDir, key)
+			return err
+		})
 	}
-	return nil
-}
-
-func (s *LocalStorage) Delete(ctx context.Context, bucket, key string) error {
-	path := filepath.Join(s.Root, bucket, key)
-	return os.RemoveAll(path)
+	if !exists {
+		return s.keyNotFound(bucket, key)
+	}
+	// only the object's own files go; objects nested below its key stay
+	return s.trackUsage(bucketDir, usageScope{ObjDir: path, Key: key}, func() error {
+		return removeObjectFiles(path)
+	})
 }
 
 func (s *LocalStorage) List(ctx context.Context, bucket, prefix string) ([]string, error) {
-	base := filepath.Join(s.Root, bucket)
+	base, err := s.existingBucketDir(bucket)
+	if err != nil {
+		return nil, err
+	}
 	// Collect object directories (each object is a directory containing parts and data.meta)
 	set := map[string]struct{}{}
-	// if base does not exist, return empty list
-	if _, err := os.Stat(base); os.IsNotExist(err) {
-		return nil, nil
-	}
-	err := filepath.Walk(base, func(p string, info os.FileInfo, err error) error {
+	err = filepath.Walk(base, func(p string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -3,11 +3,20 @@ package storage
 import (
 	"bytes"
 	"context"
-	"encoding/json"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestLocalStorage_PutGetListDelete(t *testing.T) {
@@ -16,6 +25,7 @@ func TestLocalStorage_PutGetListDelete(t *testing.T) {
 	ctx := context.Background()
 
 	bucket := "testbucket"
+	createBuckets(t, s, bucket)
 	key := "path/to/object.txt"
 	data := []byte("hello world")
 
@@ -71,6 +81,7 @@ func TestLocalStorage_MultipartStatsReconstruct(t *testing.T) {
 	s := &LocalStorage{Root: dir}
 	ctx := context.Background()
 	bucket := "mbucket"
+	createBuckets(t, s, bucket)
 	key := "folder/file.bin"
 
 	// Start multipart
@@ -79,14 +90,14 @@ func TestLocalStorage_MultipartStatsReconstruct(t *testing.T) {
 		t.Fatalf("StartMultipart: %v", err)
 	}
 	// upload 2 parts
-	if err := s.UploadPart(ctx, bucket, key, uploadID, 1, bytes.NewReader([]byte("AAAA"))); err != nil {
+	if _, err := s.UploadPart(ctx, bucket, key, uploadID, 1, bytes.NewReader([]byte("AAAA"))); err != nil {
 		t.Fatalf("UploadPart1: %v", err)
 	}
-	if err := s.UploadPart(ctx, bucket, key, uploadID, 2, bytes.NewReader([]byte("BBBB"))); err != nil {
+	if _, err := s.UploadPart(ctx, bucket, key, uploadID, 2, bytes.NewReader([]byte("BBBB"))); err != nil {
 		t.Fatalf("UploadPart2: %v", err)
 	}
 	meta := Metadata{"filename": "file.bin", "tag": "x"}
-	if err := s.CompleteMultipart(ctx, bucket, key, uploadID, meta); err != nil {
+	if _, err := s.CompleteMultipart(ctx, bucket, key, uploadID, nil, meta); err != nil {
 		t.Fatalf("CompleteMultipart: %v", err)
 	}
 
@@ -112,24 +123,1725 @@ func TestLocalStorage_MultipartStatsReconstruct(t *testing.T) {
 	if err != nil {
 		t.Fatalf("open out: %v", err)
 	}
-	var lnBuf [8]byte
-	if _, err := io.ReadFull(f, lnBuf[:]); err != nil {
-		t.Fatalf("read header len: %v", err)
+	rc, err := OpenReconstructed(f)
+	if err != nil {
+		t.Fatalf("OpenReconstructed: %v", err)
+	}
+	if rc.Version != ContainerVersion || rc.Size != 8 || rc.Header.Key != key || rc.Header.Metadata["filename"] != "file.bin" {
+		t.Fatalf("unexpected header: %+v", rc)
+	}
+	if payload, err := io.ReadAll(rc); err != nil || string(payload) != "AAAABBBB" {
+		t.Fatalf("payload %q: %v", payload, err)
+	}
+	f.Close()
+
+	// ReconstructTo streams the same bytes
+	var buf bytes.Buffer
+	if err := s.ReconstructTo(ctx, bucket, key, &buf, []string{"filename"}); err != nil {
+		t.Fatalf("ReconstructTo: %v", err)
+	}
+	want, err := os.ReadFile(out)
+	if err != nil || !bytes.Equal(buf.Bytes(), want) || !bytes.Contains(want, []byte("AAAABBBB")) {
+		t.Fatalf("ReconstructTo wrote %q, Reconstruct %q (%v)", buf.Bytes(), want, err)
+	}
+	if err := s.Reconstruct(ctx, bucket, "missing", out, nil); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("Reconstruct over an existing file: %v", err)
+	}
+	if got, err := os.ReadFile(out); err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("existing file changed: %q %v", got, err)
+	}
+	buf.Reset()
+	if err := s.ReconstructTo(ctx, bucket, "missing", &buf, nil); !errors.Is(err, ErrNoSuchKey) || buf.Len() != 0 {
+		t.Fatalf("ReconstructTo missing key: %v, wrote %d bytes", err, buf.Len())
+	}
+}
+
+func TestLocalStorage_RejectsInvalidNames(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	s := &LocalStorage{Root: root}
+	ctx := context.Background()
+
+	// a file outside the root that traversal attempts must never touch
+	victim := filepath.Join(dir, "victim")
+	if err := os.WriteFile(victim, []byte("keep"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct{ bucket, key string }{
+		{"..", "victim"},
+		{"bucket", "../../victim"},
+		{"bucket", "a/../../../victim"},
+		{"bucket", "/etc/passwd"},
+		{"bucket", "a//b"},
+		{"bucket", ".multipart/x"},
+		{"bucket", ".hidden/a"},
+		{"bucket", ".foo"},
+		{"bucket", "a/_stats"},
+		{"bucket", "obj/part.1"},
+		{"Bucket", "key"},
+		{"_stats", "key"},
+		{"192.168.0.1", "key"},
+	}
+	for _, c := range cases {
+		if err := s.Put(ctx, c.bucket, c.key, bytes.NewReader([]byte("x"))); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Put(%q, %q): expected ErrInvalidKey, got %v", c.bucket, c.key, err)
+		}
+		if err := s.Delete(ctx, c.bucket, c.key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Delete(%q, %q): expected ErrInvalidKey, got %v", c.bucket, c.key, err)
+		}
+	}
+	if err := s.AbortMultipart(ctx, "bucket", "key", "../../victim"); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("AbortMultipart: expected ErrInvalidKey, got %v", err)
+	}
+	if _, err := os.Stat(victim); err != nil {
+		t.Fatalf("victim file was touched: %v", err)
+	}
+	if _, err := os.Stat(root); !os.IsNotExist(err) {
+		t.Fatalf("expected nothing created under root, stat err: %v", err)
+	}
+
+	// only the first segment is kept for internal files
+	s = &LocalStorage{Root: t.TempDir()}
+	createBuckets(t, s, "bucket")
+	if err := s.Put(ctx, "bucket", "home/.profile", strings.NewReader("x")); err != nil {
+		t.Fatalf("Put of a nested dot segment: %v", err)
+	}
+	if keys, err := s.List(ctx, "bucket", ""); err != nil || len(keys) != 1 || keys[0] != "home/.profile" {
+		t.Fatalf("List: %v %v", keys, err)
+	}
+}
+
+func TestLocalStorage_TypedErrors(t *testing.T) {
+	s := &LocalStorage{Root: t.TempDir()}
+	ctx := context.Background()
+	createBuckets(t, s, "bucket")
+
+	if _, err := s.Get(ctx, "missing", "key"); !errors.Is(err, ErrNoSuchBucket) {
+		t.Fatalf("Get on missing bucket: expected ErrNoSuchBucket, got %v", err)
+	}
+	if err := s.Put(ctx, "bucket", "key", bytes.NewReader([]byte("x"))); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, err := s.Get(ctx, "bucket", "other"); !errors.Is(err, ErrNoSuchKey) {
+		t.Fatalf("Get on missing key: expected ErrNoSuchKey, got %v", err)
+	}
+	if _, err := s.GetMetadata(ctx, "bucket", "other"); !errors.Is(err, ErrNoSuchKey) {
+		t.Fatalf("GetMetadata on missing key: expected ErrNoSuchKey, got %v", err)
+	}
+	if err := s.Delete(ctx, "bucket", "other"); !errors.Is(err, ErrNoSuchKey) {
+		t.Fatalf("Delete on missing key: expected ErrNoSuchKey, got %v", err)
+	}
+	if _, err := s.UploadPart(ctx, "bucket", "key", "upload-nope", 1, bytes.NewReader(nil)); !errors.Is(err, ErrNoSuchUpload) {
+		t.Fatalf("UploadPart on unknown upload: expected ErrNoSuchUpload, got %v", err)
+	}
+	id, err := s.StartMultipart(ctx, "bucket", "key")
+	if err != nil {
+		t.Fatalf("StartMultipart: %v", err)
+	}
+	if _, err := s.UploadPart(ctx, "bucket", "key", id, 0, bytes.NewReader(nil)); !errors.Is(err, ErrInvalidPart) {
+		t.Fatalf("UploadPart with part 0: expected ErrInvalidPart, got %v", err)
+	}
+	if _, err := s.CompleteMultipart(ctx, "bucket", "key", id, nil, nil); !errors.Is(err, ErrInvalidPart) {
+		t.Fatalf("CompleteMultipart without parts: expected ErrInvalidPart, got %v", err)
+	}
+	if err := s.AbortMultipart(ctx, "bucket", "key", id); err != nil {
+		t.Fatalf("AbortMultipart: %v", err)
+	}
+	if err := s.AbortMultipart(ctx, "bucket", "key", id); !errors.Is(err, ErrNoSuchUpload) {
+		t.Fatalf("second AbortMultipart: expected ErrNoSuchUpload, got %v", err)
+	}
+	// error messages must not leak filesystem paths
+	_, err = s.Get(ctx, "bucket", "other")
+	if strings.Contains(err.Error(), s.Root) {
+		t.Fatalf("error leaks storage root: %v", err)
+	}
+}
+
+// failingReader yields some data and then fails, simulating a client that
+// disconnects mid-upload.
+type failingReader struct{ sent bool }
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if f.sent {
+		return 0, errors.New("connection reset")
+	}
+	f.sent = true
+	return copy(p, "partial"), nil
+}
+
+func TestLocalStorage_AtomicOverwrite(t *testing.T) {
+	s := &LocalStorage{Root: t.TempDir()}
+	ctx := context.Background()
+	bucket, key := "bucket", "obj"
+	createBuckets(t, s, bucket)
+
+	// multipart version with three parts
+	id, err := s.StartMultipart(ctx, bucket, key)
+	if err != nil {
+		t.Fatalf("StartMultipart: %v", err)
+	}
+	for i, p := range []string{"one-", "two-", "three"} {
+		if _, err := s.UploadPart(ctx, bucket, key, id, i+1, bytes.NewReader([]byte(p))); err != nil {
+			t.Fatalf("UploadPart %d: %v", i+1, err)
+		}
+	}
+	if _, err := s.CompleteMultipart(ctx, bucket, key, id, nil, Metadata{"v": "1"}); err != nil {
+		t.Fatalf("CompleteMultipart: %v", err)
+	}
+
+	// an interrupted overwrite must leave the old object untouched
+	if _, err := s.PutWithMetadata(ctx, bucket, key, &failingReader{}, Metadata{"v": "2"}); err == nil {
+		t.Fatal("expected error from interrupted upload")
+	}
+	readAll := func() string {
+		t.Helper()
+		rc, err := s.Get(ctx, bucket, key)
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		defer rc.Close()
+		b, err := io.ReadAll(rc)
+		if err != nil {
+			t.Fatalf("ReadAll: %v", err)
+		}
+		return string(b)
+	}
+	if got := readAll(); got != "one-two-three" {
+		t.Fatalf("after interrupted overwrite got %q", got)
+	}
+	if m, _ := s.GetMetadata(ctx, bucket, key); m["v"] != "1" {
+		t.Fatalf("metadata changed by interrupted overwrite: %v", m)
+	}
+
+	// a single-part overwrite must not be concatenated with the old parts
+	if _, err := s.PutWithMetadata(ctx, bucket, key, bytes.NewReader([]byte("new")), Metadata{"v": "3"}); err != nil {
+		t.Fatalf("PutWithMetadata: %v", err)
+	}
+	if got := readAll(); got != "new" {
+		t.Fatalf("after overwrite got %q, want %q", got, "new")
+	}
+	staging, _ := os.ReadDir(filepath.Join(s.Root, bucket, stagingDirName))
+	if len(staging) != 0 {
+		t.Fatalf("staging directory not cleaned up: %d entries", len(staging))
+	}
+}
+
+func TestLocalStorage_MultipartManyPartsOrder(t *testing.T) {
+	s := &LocalStorage{Root: t.TempDir()}
+	ctx := context.Background()
+	bucket, key := "bucket", "big.bin"
+	createBuckets(t, s, bucket)
+
+	id, err := s.StartMultipart(ctx, bucket, key)
+	if err != nil {
+		t.Fatalf("StartMultipart: %v", err)
+	}
+	// upload 12 parts out of order so part.10 would sort before part.2 lexically
+	var want bytes.Buffer
+	var parts []CompletedPart
+	for n := 1; n <= 12; n++ {
+		parts = append(parts, CompletedPart{PartNumber: n})
+		fmt.Fprintf(&want, "<%02d>", n)
+	}
+	for n := 12; n >= 1; n-- {
+		if _, err := s.UploadPart(ctx, bucket, key, id, n, strings.NewReader(fmt.Sprintf("<%02d>", n))); err != nil {
+			t.Fatalf("UploadPart %d: %v", n, err)
+		}
+	}
+	// a part that is uploaded but not listed must not be committed
+	if _, err := s.UploadPart(ctx, bucket, key, id, 13, strings.NewReader("<junk>")); err != nil {
+		t.Fatalf("UploadPart 13: %v", err)
+	}
+	if _, err := s.CompleteMultipart(ctx, bucket, key, id, []CompletedPart{{PartNumber: 2}, {PartNumber: 1}}, nil); !errors.Is(err, ErrInvalidPart) {
+		t.Fatalf("unordered parts: expected ErrInvalidPart, got %v", err)
+	}
+	if _, err := s.CompleteMultipart(ctx, bucket, key, id, []CompletedPart{{PartNumber: 1}, {PartNumber: 14}}, nil); !errors.Is(err, ErrInvalidPart) {
+		t.Fatalf("missing part: expected ErrInvalidPart, got %v", err)
+	}
+	if _, err := s.CompleteMultipart(ctx, bucket, key, id, []CompletedPart{{PartNumber: 1, ETag: "bogus"}}, nil); !errors.Is(err, ErrInvalidPart) {
+		t.Fatalf("bad etag: expected ErrInvalidPart, got %v", err)
+	}
+	if _, err := s.CompleteMultipart(ctx, bucket, key, id, parts, nil); err != nil {
+		t.Fatalf("CompleteMultipart: %v", err)
+	}
+	rc, err := s.Get(ctx, bucket, key)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	got, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(got) != want.String() {
+		t.Fatalf("parts reassembled out of order:\n got %s\nwant %s", got, want.String())
+	}
+}
+
+func TestLocalStorage_ChecksumsAndETags(t *testing.T) {
+	s := &LocalStorage{Root: t.TempDir()}
+	ctx := context.Background()
+	bucket := "bucket"
+	createBuckets(t, s, bucket)
+	data := []byte("hello world")
+	sum := md5.Sum(data)
+	sha := sha256.Sum256(data)
+
+	info, err := s.PutWithMetadata(ctx, bucket, "obj", bytes.NewReader(data), nil)
+	if err != nil {
+		t.Fatalf("PutWithMetadata: %v", err)
+	}
+	if info.ETag != hex.EncodeToString(sum[:]) || info.Checksums.SHA256 != hex.EncodeToString(sha[:]) {
+		t.Fatalf("unexpected checksums: %+v", info)
+	}
+	if info.Size != int64(len(data)) || info.Checksums.CRC32C == "" {
+		t.Fatalf("unexpected object info: %+v", info)
+	}
+
+	// a mismatching digest rejects the upload and keeps the previous object
+	bad := NewVerifyingReader(bytes.NewReader([]byte("tampered")), Checksums{MD5: info.ETag})
+	if _, err := s.PutWithMetadata(ctx, bucket, "obj", bad, nil); !errors.Is(err, ErrBadDigest) {
+		t.Fatalf("expected ErrBadDigest, got %v", err)
+	}
+	good := NewVerifyingReader(bytes.NewReader(data), Checksums{MD5: info.ETag, SHA256: info.Checksums.SHA256})
+	if _, err := s.PutWithMetadata(ctx, bucket, "obj", good, nil); err != nil {
+		t.Fatalf("PutWithMetadata with matching digests: %v", err)
+	}
+
+	// multipart ETag is md5(concat(part md5s))-N
+	id, err := s.StartMultipart(ctx, bucket, "mp")
+	if err != nil {
+		t.Fatalf("StartMultipart: %v", err)
+	}
+	var concat []byte
+	var parts []CompletedPart
+	for n, p := range []string{"AAAA", "BBBB"} {
+		pi, err := s.UploadPart(ctx, bucket, "mp", id, n+1, strings.NewReader(p))
+		if err != nil {
+			t.Fatalf("UploadPart: %v", err)
+		}
+		ps := md5.Sum([]byte(p))
+		if pi.ETag != hex.EncodeToString(ps[:]) {
+			t.Fatalf("part %d etag %q", n+1, pi.ETag)
+		}
+		concat = append(concat, ps[:]...)
+		parts = append(parts, CompletedPart{PartNumber: n + 1, ETag: `"` + pi.ETag + `"`})
+	}
+	mi, err := s.CompleteMultipart(ctx, bucket, "mp", id, parts, nil)
+	if err != nil {
+		t.Fatalf("CompleteMultipart: %v", err)
+	}
+	want := md5.Sum(concat)
+	if mi.ETag != hex.EncodeToString(want[:])+"-2" {
+		t.Fatalf("multipart etag %q", mi.ETag)
+	}
+}
+
+func TestLocalStorage_GetRangeAcrossParts(t *testing.T) {
+	s := &LocalStorage{Root: t.TempDir()}
+	ctx := context.Background()
+	bucket, key := "bucket", "ranged"
+	createBuckets(t, s, bucket)
+
+	id, err := s.StartMultipart(ctx, bucket, key)
+	if err != nil {
+		t.Fatalf("StartMultipart: %v", err)
+	}
+	for n, p := range []string{"0123", "4567", "89"} {
+		if _, err := s.UploadPart(ctx, bucket, key, id, n+1, strings.NewReader(p)); err != nil {
+			t.Fatalf("UploadPart: %v", err)
+		}
+	}
+	if _, err := s.CompleteMultipart(ctx, bucket, key, id, nil, nil); err != nil {
+		t.Fatalf("CompleteMultipart: %v", err)
+	}
+	info, err := s.Stat(ctx, bucket, key)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if info.Size != 10 || info.LastModified.IsZero() {
+		t.Fatalf("unexpected info: %+v", info)
+	}
+
+	cases := []struct {
+		off, n int64
+		want   string
+	}{
+		{0, -1, "0123456789"},
+		{3, 2, "34"},
+		{4, 4, "4567"},
+		{5, 100, "56789"},
+		{9, 1, "9"},
+		{10, -1, ""},
+	}
+	for _, c := range cases {
+		rc, err := s.GetRange(ctx, bucket, key, c.off, c.n)
+		if err != nil {
+			t.Fatalf("GetRange(%d, %d): %v", c.off, c.n, err)
+		}
+		got, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil || string(got) != c.want {
+			t.Fatalf("GetRange(%d, %d) = %q, %v; want %q", c.off, c.n, got, err, c.want)
+		}
+	}
+	if _, err := s.GetRange(ctx, bucket, key, 11, 1); !errors.Is(err, ErrInvalidRange) {
+		t.Fatalf("expected ErrInvalidRange, got %v", err)
+	}
+}
+
+func TestLocalStorage_Versioning(t *testing.T) {
+	s := &LocalStorage{Root: t.TempDir()}
+	ctx := context.Background()
+	bucket, key := "versioned", "doc.txt"
+	createBuckets(t, s, bucket)
+
+	read := func(rc io.ReadCloser, err error) string {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		defer rc.Close()
+		b, _ := io.ReadAll(rc)
+		return string(b)
+	}
+
+	// written before versioning is enabled -> null version
+	if err := s.Put(ctx, bucket, key, strings.NewReader("v0")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := s.PutBucketMetadata(ctx, bucket, BucketMetadata{Versioning: true}); err != nil {
+		t.Fatalf("PutBucketMetadata: %v", err)
+	}
+	// a nested key must survive deletes of its parent key
+	if err := s.Put(ctx, bucket, key+"/child", strings.NewReader("child")); err != nil {
+		t.Fatalf("Put child: %v", err)
+	}
+	v1, err := s.PutWithMetadata(ctx, bucket, key, strings.NewReader("v1"), nil)
+	if err != nil {
+		t.Fatalf("PutWithMetadata v1: %v", err)
+	}
+	v2, err := s.PutWithMetadata(ctx, bucket, key, strings.NewReader("v2"), nil)
+	if err != nil {
+		t.Fatalf("PutWithMetadata v2: %v", err)
+	}
+	if v1.VersionID == "" || v2.VersionID == "" || v1.VersionID == v2.VersionID {
+		t.Fatalf("expected distinct version IDs, got %q and %q", v1.VersionID, v2.VersionID)
+	}
+	if got := read(s.Get(ctx, bucket, key)); got != "v2" {
+		t.Fatalf("Get = %q, want v2", got)
+	}
+	for vid, want := range map[string]string{NullVersionID: "v0", v1.VersionID: "v1", v2.VersionID: "v2"} {
+		rc, _, err := s.GetVersion(ctx, bucket, key, vid)
+		if got := read(rc, err); got != want {
+			t.Fatalf("GetVersion(%s) = %q, want %q", vid, got, want)
+		}
+		if got := read(s.GetVersionRange(ctx, bucket, key, vid, 1, 1)); got != want[1:] {
+			t.Fatalf("GetVersionRange(%s) = %q, want %q", vid, got, want[1:])
+		}
+	}
+
+	// delete adds a marker and keeps the versions
+	if err := s.Delete(ctx, bucket, key); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := s.Get(ctx, bucket, key); !errors.Is(err, ErrNoSuchKey) {
+		t.Fatalf("Get after delete: expected ErrNoSuchKey, got %v", err)
+	}
+	if got := read(s.Get(ctx, bucket, key+"/child")); got != "child" {
+		t.Fatalf("nested object damaged by delete: %q", got)
+	}
+	versions, err := s.ListVersions(ctx, bucket, key)
+	if err != nil {
+		t.Fatalf("ListVersions: %v", err)
+	}
+	var own []VersionInfo
+	for _, v := range versions {
+		if v.Key == key {
+			own = append(own, v)
+		}
+	}
+	if len(own) != 4 || !own[0].DeleteMarker || !own[0].IsLatest || own[1].VersionID != v2.VersionID || own[3].VersionID != NullVersionID {
+		t.Fatalf("unexpected versions: %+v", own)
+	}
+
+	// removing the delete marker restores the newest version
+	if err := s.DeleteVersion(ctx, bucket, key, own[0].VersionID); err != nil {
+		t.Fatalf("DeleteVersion marker: %v", err)
+	}
+	if got := read(s.Get(ctx, bucket, key)); got != "v2" {
+		t.Fatalf("Get after removing marker = %q, want v2", got)
+	}
+	// permanently deleting the current version promotes the previous one
+	if err := s.DeleteVersion(ctx, bucket, key, v2.VersionID); err != nil {
+		t.Fatalf("DeleteVersion v2: %v", err)
+	}
+	if got := read(s.Get(ctx, bucket, key)); got != "v1" {
+		t.Fatalf("Get after deleting v2 = %q, want v1", got)
+	}
+	if err := s.DeleteVersion(ctx, bucket, key, v2.VersionID); !errors.Is(err, ErrNoSuchVersion) {
+		t.Fatalf("expected ErrNoSuchVersion, got %v", err)
+	}
+}
+
+func TestLocalStorage_NullVersionOrder(t *testing.T) {
+	s := &LocalStorage{Root: t.TempDir()}
+	ctx := context.Background()
+	bucket, key := "versioned", "doc.txt"
+	createBuckets(t, s, bucket)
+	put := func(body string) ObjectInfo {
+		t.Helper()
+		info, err := s.PutWithMetadata(ctx, bucket, key, strings.NewReader(body), nil)
+		if err != nil {
+			t.Fatalf("PutWithMetadata %s: %v", body, err)
+		}
+		return info
+	}
+	versioning := func(on bool) {
+		t.Helper()
+		if err := s.PutBucketMetadata(ctx, bucket, BucketMetadata{Versioning: on}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// v1 is archived, then a null version is written while versioning is
+	// suspended and archived when it is resumed: it is newer than v1
+	versioning(true)
+	v1 := put("one")
+	put("two")
+	versioning(false)
+	put("null")
+	versioning(true)
+	v3 := put("three")
+
+	versions, err := s.ListVersions(ctx, bucket, key)
+	if err != nil {
+		t.Fatalf("ListVersions: %v", err)
+	}
+	var ids []string
+	for _, v := range versions {
+		ids = append(ids, v.VersionID)
+	}
+	if want := []string{v3.VersionID, NullVersionID, v1.VersionID}; strings.Join(ids, ",") != strings.Join(want, ",") {
+		t.Fatalf("ListVersions order = %v, want %v", ids, want)
+	}
+	// removing the current version brings back the newest archived one
+	if err := s.DeleteVersion(ctx, bucket, key, v3.VersionID); err != nil {
+		t.Fatalf("DeleteVersion: %v", err)
+	}
+	rc, err := s.Get(ctx, bucket, key)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	got, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(got) != "null" {
+		t.Fatalf("promoted version holds %q, want the null version", got)
+	}
+}
+
+// unsizedReader hides the length of the wrapped reader, like a chunked HTTP body.
+type unsizedReader struct{ r io.Reader }
+
+func (u unsizedReader) Read(p []byte) (int, error) { return u.r.Read(p) }
+
+func TestLocalStorage_Quota(t *testing.T) {
+	s := &LocalStorage{Root: t.TempDir()}
+	ctx := context.Background()
+	bucket := "quota"
+	createBuckets(t, s, bucket)
+
+	if _, err := s.PutWithMetadata(ctx, bucket, "a", strings.NewReader("12345"), nil); err != nil {
+		t.Fatalf("PutWithMetadata: %v", err)
+	}
+	if err := s.PutBucketMetadata(ctx, bucket, BucketMetadata{CapacityBytes: 10}); err != nil {
+		t.Fatalf("PutBucketMetadata: %v", err)
+	}
+	// known size rejected up front
+	if _, err := s.PutWithMetadata(ctx, bucket, "b", strings.NewReader("123456"), nil); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("sized write: expected ErrQuotaExceeded, got %v", err)
+	}
+	// unknown size rejected while streaming
+	if _, err := s.PutWithMetadata(ctx, bucket, "b", unsizedReader{strings.NewReader("123456")}, nil); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("streamed write: expected ErrQuotaExceeded, got %v", err)
+	}
+	if _, err := s.Stat(ctx, bucket, "b"); !errors.Is(err, ErrNoSuchKey) {
+		t.Fatalf("rejected write was stored: %v", err)
+	}
+	// overwriting releases the old object
+	if _, err := s.PutWithMetadata(ctx, bucket, "a", strings.NewReader("1234567890"), nil); err != nil {
+		t.Fatalf("overwrite within quota: %v", err)
+	}
+	id, err := s.StartMultipart(ctx, bucket, "mp")
+	if err != nil {
+		t.Fatalf("StartMultipart: %v", err)
+	}
+	if _, err := s.UploadPart(ctx, bucket, "mp", id, 1, strings.NewReader("x")); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("UploadPart: expected ErrQuotaExceeded, got %v", err)
+	}
+	st, err := s.Stats(ctx, bucket)
+	if err != nil {
+		t.Fatalf("Stats: %v", err)
+	}
+	if st.UsedBytes != 10 {
+		t.Fatalf("expected 10 used bytes, got %d", st.UsedBytes)
+	}
+}
+
+// TestLocalStorage_QuotaConcurrentWrites checks that writes racing for the
+// last bytes of a bucket's capacity cannot exceed it together.
+func TestLocalStorage_QuotaConcurrentWrites(t *testing.T) {
+	s := &LocalStorage{Root: t.TempDir()}
+	ctx := context.Background()
+	bucket := "crowded"
+	createBuckets(t, s, bucket)
+	if err := s.PutBucketMetadata(ctx, bucket, BucketMetadata{CapacityBytes: 100}); err != nil {
+		t.Fatalf("PutBucketMetadata: %v", err)
+	}
+	if err := s.Put(ctx, bucket, "src", strings.NewReader("0123456789")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		stored int
+	)
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var err error
+			key := fmt.Sprintf("obj-%02d", i)
+			switch i % 3 {
+			case 0:
+				_, err = s.PutWithMetadata(ctx, bucket, key, strings.NewReader("0123456789"), nil)
+			case 1:
+				_, err = s.Copy(ctx, bucket, "src", bucket, key, CopyOptions{})
+			default:
+				var id string
+				if id, err = s.StartMultipart(ctx, bucket, key); err == nil {
+					if _, err = s.UploadPart(ctx, bucket, key, id, 1, strings.NewReader("01234")); err == nil {
+						if _, err = s.UploadPart(ctx, bucket, key, id, 2, strings.NewReader("56789")); err == nil {
+							_, err = s.CompleteMultipart(ctx, bucket, key, id, nil, nil)
+						}
+					}
+					if err != nil {
+						s.AbortMultipart(ctx, bucket, key, id)
+					}
+				}
+			}
+			if err != nil && !errors.Is(err, ErrQuotaExceeded) {
+				t.Errorf("write %s: %v", key, err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				stored++
+			}
+		}()
+	}
+	wg.Wait()
+	st, err := s.Stats(ctx, bucket)
+	if err != nil {
+		t.Fatalf("Stats: %v", err)
+	}
+	if st.UsedBytes > 100 || stored > 9 {
+		t.Fatalf("capacity exceeded: %d objects stored, %d bytes used", stored, st.UsedBytes)
+	}
+	if u, err := s.Recount(ctx, bucket); err != nil || u.used() != st.UsedBytes {
+		t.Fatalf("counters drifted: %+v %v, stats say %d", u, err, st.UsedBytes)
+	}
+}
+
+func TestLocalStorage_Lifecycle(t *testing.T) {
+	s := &LocalStorage{Root: t.TempDir()}
+	ctx := context.Background()
+	bucket := "lifecycle"
+	createBuckets(t, s, bucket)
+
+	for _, k := range []string{"logs/a", "logs/b", "keep/c"} {
+		if _, err := s.PutWithMetadata(ctx, bucket, k, strings.NewReader(k), nil); err != nil {
+			t.Fatalf("PutWithMetadata %s: %v", k, err)
+		}
+	}
+	// the lifecycle worker has no customer-provided key, yet expires objects
+	// encrypted with one
+	keys, err := NewKeyring(bytes.Repeat([]byte{1}, KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Keys = keys
+	withKey := WithCustomerKey(ctx, bytes.Repeat([]byte{2}, KeySize))
+	if _, err := s.PutWithMetadata(withKey, bucket, "logs/private", strings.NewReader("sealed"), nil); err != nil {
+		t.Fatalf("PutWithMetadata with a customer key: %v", err)
+	}
+	if _, err := s.StartMultipart(ctx, bucket, "big"); err != nil {
+		t.Fatalf("StartMultipart: %v", err)
+	}
+	if err := s.PutLifecycle(ctx, bucket, LifecycleConfig{Rules: []LifecycleRule{{ID: "bad"}}}); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("rule without action: expected ErrInvalidConfig, got %v", err)
+	}
+	if err := s.PutLifecycle(ctx, bucket, LifecycleConfig{Rules: []LifecycleRule{{ID: "retention", ExpirationDays: 1}}}); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("rule with the reserved retention id: expected ErrInvalidConfig, got %v", err)
+	}
+	cfg := LifecycleConfig{Rules: []LifecycleRule{
+		{ID: "logs", Prefix: "logs/", ExpirationDays: 7},
+		{ID: "uploads", AbortIncompleteMultipartDays: 1},
+	}}
+	if err := s.PutLifecycle(ctx, bucket, cfg); err != nil {
+		t.Fatalf("PutLifecycle: %v", err)
+	}
+	got, err := s.GetLifecycle(ctx, bucket)
+	if err != nil || len(got.Rules) != 2 {
+		t.Fatalf("GetLifecycle: %+v %v", got, err)
+	}
+
+	// nothing is old enough yet
+	report, err := s.ApplyLifecycle(ctx, bucket, false)
+	if err != nil || len(report.Actions) != 0 {
+		t.Fatalf("fresh bucket: %+v %v", report, err)
+	}
+
+	later := time.Now().Add(8 * 24 * time.Hour)
+	report, err = s.applyLifecycle(ctx, bucket, later, true)
+	if err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if len(report.Actions) != 4 {
+		t.Fatalf("dry run: expected 4 actions, got %+v", report.Actions)
+	}
+	if keys, _ := s.List(ctx, bucket, "logs/"); len(keys) != 3 {
+		t.Fatalf("dry run deleted objects: %v", keys)
+	}
+
+	if _, err := s.applyLifecycle(ctx, bucket, later, false); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	left, err := s.List(ctx, bucket, "")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(left) != 1 || left[0] != "keep/c" {
+		t.Fatalf("expected only keep/c to survive, got %v", left)
+	}
+	entries, _ := os.ReadDir(filepath.Join(s.Root, bucket, ".multipart"))
+	if len(entries) != 0 {
+		t.Fatalf("expected incomplete upload to be aborted, found %d", len(entries))
+	}
+
+	// RetentionDays acts as an implicit rule; noncurrent versions expire on their own schedule
+	if err := s.PutBucketMetadata(ctx, bucket, BucketMetadata{RetentionDays: 30, Versioning: true}); err != nil {
+		t.Fatalf("PutBucketMetadata: %v", err)
+	}
+	if err := s.PutLifecycle(ctx, bucket, LifecycleConfig{Rules: []LifecycleRule{{ID: "old", NoncurrentVersionExpirationDays: 1}}}); err != nil {
+		t.Fatalf("PutLifecycle: %v", err)
+	}
+	if _, err := s.PutWithMetadata(ctx, bucket, "keep/c", strings.NewReader("v2"), nil); err != nil {
+		t.Fatalf("overwrite: %v", err)
+	}
+	report, err = s.applyLifecycle(ctx, bucket, time.Now().Add(2*24*time.Hour), false)
+	if err != nil || len(report.Actions) != 1 || report.Actions[0].Action != ActionExpireVersion {
+		t.Fatalf("noncurrent expiration: %+v %v", report, err)
+	}
+	versions, err := s.ListVersions(ctx, bucket, "keep/")
+	if err != nil || len(versions) != 1 {
+		t.Fatalf("expected one version left, got %+v %v", versions, err)
+	}
+	// the expired version becomes noncurrent, so the "old" rule removes it too
+	report, err = s.applyLifecycle(ctx, bucket, time.Now().Add(31*24*time.Hour), false)
+	if err != nil || len(report.Actions) != 2 || report.Actions[0].Rule != "retention" {
+		t.Fatalf("retention: %+v %v", report, err)
+	}
+	if _, err := s.Stat(ctx, bucket, "keep/c"); !errors.Is(err, ErrNoSuchKey) {
+		t.Fatalf("expected keep/c to be expired, got %v", err)
+	}
+}
+
+func TestLocalStorage_BucketPolicy(t *testing.T) {
+	s := &LocalStorage{Root: t.TempDir()}
+	ctx := context.Background()
+	bucket := "assets"
+	createBuckets(t, s, bucket)
+
+	for _, st := range []PolicyStatement{
+		{Effect: "maybe", Principals: []string{"*"}, Actions: []string{ActionGetObject}},
+		{Effect: EffectAllow, Actions: []string{ActionGetObject}},
+		{Effect: EffectAllow, Principals: []string{"*"}, Actions: []string{"storage:Fly"}},
+		{Effect: EffectAllow, Principals: []string{"*"}, Actions: []string{ActionGetObject}, Condition: &PolicyCondition{SourceIP: []string{"10.0.0.0/33"}}},
+	} {
+		if err := s.PutBucketPolicy(ctx, bucket, BucketPolicy{Statements: []PolicyStatement{st}}); !errors.Is(err, ErrInvalidConfig) {
+			t.Fatalf("PutBucketPolicy(%+v): expected ErrInvalidConfig, got %v", st, err)
+		}
+	}
+	p := BucketPolicy{PublicRead: true, Statements: []PolicyStatement{
+		{Effect: EffectDeny, Principals: []string{"bob"}, Actions: []string{"storage:*"}, Condition: &PolicyCondition{NotSourceIP: []string{"10.0.0.1"}}},
+	}}
+	if err := s.PutBucketPolicy(ctx, bucket, p); err != nil {
+		t.Fatalf("PutBucketPolicy: %v", err)
+	}
+	got, err := s.GetBucketPolicy(ctx, bucket)
+	if err != nil || !got.PublicRead || len(got.Statements) != 1 {
+		t.Fatalf("GetBucketPolicy: %+v %v", got, err)
+	}
+	// the policy file is not an object
+	if keys, err := s.List(ctx, bucket, ""); err != nil || len(keys) != 0 {
+		t.Fatalf("List: %v %v", keys, err)
+	}
+	if err := s.DeleteBucketPolicy(ctx, bucket); err != nil {
+		t.Fatalf("DeleteBucketPolicy: %v", err)
+	}
+	if got, err := s.GetBucketPolicy(ctx, bucket); err != nil || got.PublicRead {
+		t.Fatalf("GetBucketPolicy after delete: %+v %v", got, err)
+	}
+	if _, err := s.GetBucketPolicy(ctx, "missing"); !errors.Is(err, ErrNoSuchBucket) {
+		t.Fatalf("GetBucketPolicy of a missing bucket: %v", err)
+	}
+}
+
+func TestLocalStorage_Encryption(t *testing.T) {
+	root := t.TempDir()
+	k1, k2 := bytes.Repeat([]byte{1}, KeySize), bytes.Repeat([]byte{2}, KeySize)
+	keys, err := NewKeyring(k1)
+	if err != nil {
+		t.Fatalf("NewKeyring: %v", err)
+	}
+	s := &LocalStorage{Root: root, Keys: keys}
+	ctx := context.Background()
+	bucket := "vault"
+	createBuckets(t, s, bucket)
+
+	data := make([]byte, 3*frameSize+123)
+	for i := range data {
+		data[i] = byte(i * 7 / 5)
+	}
+	info, err := s.PutWithMetadata(ctx, bucket, "big", bytes.NewReader(data), Metadata{"note": "classified"})
+	if err != nil {
+		t.Fatalf("PutWithMetadata: %v", err)
+	}
+	if info.Size != int64(len(data)) || info.Encryption != EncryptionAES256 || info.Checksums.MD5 != fmt.Sprintf("%x", md5.Sum(data)) {
+		t.Fatalf("put info: %+v", info)
+	}
+	raw, err := os.ReadFile(filepath.Join(root, bucket, "big", "part.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(raw)) != encryptedSize(int64(len(data))) || bytes.Contains(raw, data[frameSize:frameSize+64]) {
+		t.Fatalf("part file of %d bytes is not encrypted", len(raw))
+	}
+	if rawMeta, _ := os.ReadFile(filepath.Join(root, bucket, "big", "data.meta")); bytes.Contains(rawMeta, []byte("classified")) {
+		t.Fatalf("data.meta in clear: %s", rawMeta)
+	}
+	if meta, err := s.GetMetadata(ctx, bucket, "big"); err != nil || meta["note"] != "classified" {
+		t.Fatalf("GetMetadata: %v %v", meta, err)
+	}
+	read := func(s *LocalStorage, ctx context.Context, key string, off, n int64) ([]byte, error) {
+		rc, err := s.GetRange(ctx, bucket, key, off, n)
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return io.ReadAll(rc)
+	}
+	for _, r := range [][2]int64{{0, -1}, {1, 10}, {frameSize - 3, 6}, {2*frameSize + 1, frameSize}, {int64(len(data)) - 5, -1}} {
+		got, err := read(s, ctx, "big", r[0], r[1])
+		want := data[r[0]:]
+		if r[1] >= 0 {
+			want = want[:r[1]]
+		}
+		if err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("GetRange(%d, %d): %d bytes, %v", r[0], r[1], len(got), err)
+		}
+	}
+
+	// multipart parts are encrypted with the data key of the upload
+	id, err := s.StartMultipart(ctx, bucket, "multi")
+	if err != nil {
+		t.Fatalf("StartMultipart: %v", err)
+	}
+	p1, p2 := []byte("first part"), data[:frameSize+5]
+	for n, p := range map[int][]byte{2: p2, 1: p1} {
+		if _, err := s.UploadPart(ctx, bucket, "multi", id, n, bytes.NewReader(p)); err != nil {
+			t.Fatalf("UploadPart %d: %v", n, err)
+		}
+	}
+	if parts, err := s.ListParts(ctx, bucket, "multi", id); err != nil || len(parts) != 2 || parts[1].Size != int64(len(p2)) {
+		t.Fatalf("ListParts: %+v %v", parts, err)
+	}
+	if _, err := s.CompleteMultipart(ctx, bucket, "multi", id, nil, nil); err != nil {
+		t.Fatalf("CompleteMultipart: %v", err)
+	}
+	if got, err := read(s, ctx, "multi", 5, -1); err != nil || !bytes.Equal(got, append(append([]byte{}, p1[5:]...), p2...)) {
+		t.Fatalf("read multipart: %d bytes, %v", len(got), err)
+	}
+
+	// customer-provided keys
+	ck, wrong := bytes.Repeat([]byte{3}, KeySize), bytes.Repeat([]byte{4}, KeySize)
+	withKey := WithCustomerKey(ctx, ck)
+	info, err = s.PutWithMetadata(withKey, bucket, "private", strings.NewReader("for my eyes only"), nil)
+	if err != nil || info.CustomerKeyMD5 != CustomerKeyMD5(ck) {
+		t.Fatalf("PutWithMetadata with a customer key: %+v %v", info, err)
+	}
+	if _, err := read(s, ctx, "private", 0, -1); !errors.Is(err, ErrCustomerKeyRequired) {
+		t.Fatalf("read without the customer key: %v", err)
+	}
+	if _, err := s.Stat(WithCustomerKey(ctx, wrong), bucket, "private"); !errors.Is(err, ErrWrongCustomerKey) {
+		t.Fatalf("Stat with the wrong key: %v", err)
+	}
+	if got, err := read(s, withKey, "private", 4, 2); err != nil || string(got) != "my" {
+		t.Fatalf("read with the customer key: %q %v", got, err)
+	}
+	if _, err := s.Copy(ctx, bucket, "private", bucket, "shared", CopyOptions{}); !errors.Is(err, ErrCustomerKeyRequired) {
+		t.Fatalf("Copy without the source key: %v", err)
+	}
+	info, err = s.Copy(WithCopySourceCustomerKey(ctx, ck), bucket, "private", bucket, "shared", CopyOptions{})
+	if err != nil || info.CustomerKeyMD5 != "" || info.Encryption != EncryptionAES256 {
+		t.Fatalf("Copy to master key encryption: %+v %v", info, err)
+	}
+	if got, err := read(s, ctx, "shared", 0, -1); err != nil || string(got) != "for my eyes only" {
+		t.Fatalf("read copy: %q %v", got, err)
+	}
+	if report, err := s.Fsck(ctx, FsckOptions{VerifyChecksums: true}); err != nil || len(report.Issues) != 0 {
+		t.Fatalf("Fsck: %+v %v", report.Issues, err)
+	}
+
+	// rotation rewraps everything under the new key, after which the old
+	// key is no longer needed
+	keys, _ = NewKeyring(k2, k1)
+	rotated := &LocalStorage{Root: root, Keys: keys}
+	// not while a server holds the root
+	unlock, err := s.LockRoot()
+	if err != nil {
+		t.Fatalf("LockRoot: %v", err)
+	}
+	if report, err := rotated.RotateKeys(ctx); !errors.Is(err, ErrRootLocked) || report.Rewrapped != 0 {
+		t.Fatalf("RotateKeys on a locked root: %+v %v", report, err)
 	}
-	var ln uint64
-	for i := 0; i < 8; i++ {
-		ln = (ln << 8) | uint64(lnBuf[i])
+	if err := unlock(); err != nil {
+		t.Fatal(err)
 	}
-	h := make([]byte, ln)
-	if _, err := io.ReadFull(f, h); err != nil {
-		t.Fatalf("read header: %v", err)
+	report, err := rotated.RotateKeys(ctx)
+	if err != nil || report.Rewrapped != 3 || report.Resealed != 4 || report.CustomerKeys != 1 || len(report.Retired) != 1 || report.Retired[0] != KeyID(k1) {
+		t.Fatalf("RotateKeys: %+v %v", report, err)
 	}
-	var hdr map[string]string
-	if err := json.Unmarshal(h, &hdr); err != nil {
-		t.Fatalf("unmarshal header: %v", err)
+	keys, _ = NewKeyring(k2)
+	s = &LocalStorage{Root: root, Keys: keys}
+	if got, err := read(s, ctx, "big", 0, -1); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read after rotation: %d bytes, %v", len(got), err)
 	}
-	if hdr["filename"] != "file.bin" {
-		t.Fatalf("unexpected header filename: %v", hdr)
+	if meta, err := s.GetMetadata(ctx, bucket, "big"); err != nil || meta["note"] != "classified" {
+		t.Fatalf("GetMetadata after rotation: %v %v", meta, err)
+	}
+	keys, _ = NewKeyring(k1)
+	if _, err := read(&LocalStorage{Root: root, Keys: keys}, ctx, "big", 0, -1); !errors.Is(err, ErrKeyUnavailable) {
+		t.Fatalf("read with the retired key: %v", err)
+	}
+
+	// tampering with the data is detected
+	raw, _ = os.ReadFile(filepath.Join(root, bucket, "big", "part.1"))
+	raw[len(raw)-100] ^= 1
+	if err := os.WriteFile(filepath.Join(root, bucket, "big", "part.1"), raw, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := read(s, ctx, "big", 0, -1); err == nil {
+		t.Fatal("read of a tampered part succeeded")
+	}
+	if _, err := read(s, ctx, "big", 0, 10); err != nil {
+		t.Fatalf("frames before the tampered one: %v", err)
+	}
+}
+
+func TestLocalStorage_UsageCounters(t *testing.T) {
+	s := &LocalStorage{Root: t.TempDir()}
+	ctx := context.Background()
+	bucket := "usage"
+	createBuckets(t, s, bucket)
+
+	put := func(key, data string) {
+		t.Helper()
+		if _, err := s.PutWithMetadata(ctx, bucket, key, strings.NewReader(data), nil); err != nil {
+			t.Fatalf("PutWithMetadata %s: %v", key, err)
+		}
+	}
+	put("a", "12345")
+	put("dir/b", "123")
+	put("a", "1234567") // overwrite
+	id, err := s.StartMultipart(ctx, bucket, "mp")
+	if err != nil {
+		t.Fatalf("StartMultipart: %v", err)
+	}
+	for i, p := range []string{"xx", "yyy", "z"} {
+		if _, err := s.UploadPart(ctx, bucket, "mp", id, i+1, strings.NewReader(p)); err != nil {
+			t.Fatalf("UploadPart: %v", err)
+		}
+	}
+	u, err := s.Usage(ctx, bucket)
+	if err != nil {
+		t.Fatalf("Usage: %v", err)
+	}
+	if want := (Usage{Objects: 2, Bytes: 10, Parts: 2, MultipartBytes: 6}); u != want {
+		t.Fatalf("usage after puts: got %+v want %+v", u, want)
+	}
+	if _, err := s.CompleteMultipart(ctx, bucket, "mp", id, []CompletedPart{{PartNumber: 1}, {PartNumber: 2}}, nil); err != nil {
+		t.Fatalf("CompleteMultipart: %v", err)
+	}
+	if err := s.Delete(ctx, bucket, "dir/b"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := s.PutBucketMetadata(ctx, bucket, BucketMetadata{Versioning: true}); err != nil {
+		t.Fatalf("PutBucketMetadata: %v", err)
+	}
+	put("a", "12")
+	if err := s.Delete(ctx, bucket, "mp"); err != nil {
+		t.Fatalf("Delete versioned: %v", err)
+	}
+	id2, _ := s.StartMultipart(ctx, bucket, "gone")
+	s.UploadPart(ctx, bucket, "gone", id2, 1, strings.NewReader("abcd"))
+	if err := s.AbortMultipart(ctx, bucket, "gone", id2); err != nil {
+		t.Fatalf("AbortMultipart: %v", err)
+	}
+
+	u, err = s.Usage(ctx, bucket)
+	if err != nil {
+		t.Fatalf("Usage: %v", err)
+	}
+	if want := (Usage{Objects: 1, Bytes: 2, Parts: 1, VersionBytes: 12}); u != want {
+		t.Fatalf("usage: got %+v want %+v", u, want)
+	}
+	recounted, err := s.Recount(ctx, bucket)
+	if err != nil || recounted != u {
+		t.Fatalf("Recount: got %+v %v, want %+v", recounted, err, u)
+	}
+	st, err := s.Stats(ctx, bucket)
+	if err != nil {
+		t.Fatalf("Stats: %v", err)
+	}
+	if st.ObjectCount != 1 || st.UsedBytes != 14 || st.VersionBytes != 12 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+
+	// drifted counters are repaired by Recount
+	if err := os.WriteFile(filepath.Join(s.Root, bucket, usageFileName), []byte(`{"objects":42}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if recounted, err = s.Recount(ctx, bucket); err != nil || recounted != u {
+		t.Fatalf("Recount after drift: got %+v %v, want %+v", recounted, err, u)
+	}
+}
+
+func TestLocalStorage_ListObjects(t *testing.T) {
+	s := &LocalStorage{Root: t.TempDir()}
+	ctx := context.Background()
+	bucket := "listing"
+	createBuckets(t, s, bucket)
+
+	keys := []string{"a", "a-b", "a/x", "a/y/z", "b/1", "b/2", "c"}
+	for _, k := range keys {
+		if _, err := s.PutWithMetadata(ctx, bucket, k, strings.NewReader(k), nil); err != nil {
+			t.Fatalf("PutWithMetadata %s: %v", k, err)
+		}
+	}
+	names := func(objs []ObjectInfo) []string {
+		var out []string
+		for _, o := range objs {
+			out = append(out, o.Key)
+		}
+		return out
+	}
+
+	// full listing is in lexicographic order ("a-b" sorts before "a/x")
+	res, err := s.ListObjects(ctx, bucket, ListOptions{})
+	if err != nil {
+		t.Fatalf("ListObjects: %v", err)
+	}
+	if got := names(res.Objects); fmt.Sprint(got) != fmt.Sprint(keys) || res.IsTruncated {
+		t.Fatalf("full listing: got %v truncated=%v", got, res.IsTruncated)
+	}
+	if res.Objects[0].Size != 1 || res.Objects[0].ETag == "" || res.Objects[0].LastModified.IsZero() {
+		t.Fatalf("missing object details: %+v", res.Objects[0])
+	}
+
+	// delimiter groups folders into common prefixes
+	res, err = s.ListObjects(ctx, bucket, ListOptions{Delimiter: "/"})
+	if err != nil {
+		t.Fatalf("ListObjects delimiter: %v", err)
+	}
+	if got := names(res.Objects); fmt.Sprint(got) != "[a a-b c]" {
+		t.Fatalf("delimiter objects: %v", got)
+	}
+	if fmt.Sprint(res.CommonPrefixes) != "[a/ b/]" {
+		t.Fatalf("delimiter prefixes: %v", res.CommonPrefixes)
+	}
+	res, err = s.ListObjects(ctx, bucket, ListOptions{Prefix: "a/", Delimiter: "/"})
+	if err != nil || fmt.Sprint(names(res.Objects)) != "[a/x]" || fmt.Sprint(res.CommonPrefixes) != "[a/y/]" {
+		t.Fatalf("folder listing: %+v %v", res, err)
+	}
+
+	// paging with continuation tokens visits every entry exactly once
+	var seen []string
+	opts := ListOptions{Delimiter: "/", MaxKeys: 2}
+	for page := 0; ; page++ {
+		if page > 5 {
+			t.Fatal("pagination does not terminate")
+		}
+		res, err := s.ListObjects(ctx, bucket, opts)
+		if err != nil {
+			t.Fatalf("ListObjects page %d: %v", page, err)
+		}
+		seen = append(seen, names(res.Objects)...)
+		seen = append(seen, res.CommonPrefixes...)
+		if !res.IsTruncated {
+			break
+		}
+		opts.ContinuationToken = res.NextContinuationToken
+	}
+	sort.Strings(seen)
+	if fmt.Sprint(seen) != "[a a-b a/ b/ c]" {
+		t.Fatalf("paged listing: %v", seen)
+	}
+
+	res, err = s.ListObjects(ctx, bucket, ListOptions{StartAfter: "a/x"})
+	if err != nil || fmt.Sprint(names(res.Objects)) != "[a/y/z b/1 b/2 c]" {
+		t.Fatalf("start-after: %+v %v", names(res.Objects), err)
+	}
+	if _, err := s.ListObjects(ctx, bucket, ListOptions{ContinuationToken: "!!"}); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("bad token: expected ErrInvalidArgument, got %v", err)
+	}
+	if _, err := s.ListObjects(ctx, "missing", ListOptions{}); !errors.Is(err, ErrNoSuchBucket) {
+		t.Fatalf("missing bucket: expected ErrNoSuchBucket, got %v", err)
+	}
+}
+
+func TestLocalStorage_MultipartUploadRecords(t *testing.T) {
+	s := &LocalStorage{Root: t.TempDir()}
+	ctx := context.Background()
+	bucket := "uploads"
+	createBuckets(t, s, bucket)
+
+	if _, err := s.StartMultipart(ctx, bucket, ""); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("keyless upload: expected ErrInvalidKey, got %v", err)
+	}
+	up, err := s.CreateMultipartUpload(ctx, bucket, "videos/a.mp4", Metadata{MetaContentType: "video/mp4"}, "alice")
+	if err != nil {
+		t.Fatalf("CreateMultipartUpload: %v", err)
+	}
+	other, err := s.StartMultipart(ctx, bucket, "docs/b.txt")
+	if err != nil {
+		t.Fatalf("StartMultipart: %v", err)
+	}
+	if _, err := s.UploadPart(ctx, bucket, "videos/a.mp4", up.UploadID, 2, strings.NewReader("world")); err != nil {
+		t.Fatalf("UploadPart: %v", err)
+	}
+	if _, err := s.UploadPart(ctx, bucket, "videos/a.mp4", up.UploadID, 1, strings.NewReader("hello ")); err != nil {
+		t.Fatalf("UploadPart: %v", err)
+	}
+	if _, err := s.UploadPart(ctx, bucket, "docs/b.txt", up.UploadID, 3, strings.NewReader("x")); !errors.Is(err, ErrNoSuchUpload) {
+		t.Fatalf("part for another key: expected ErrNoSuchUpload, got %v", err)
+	}
+
+	uploads, err := s.ListMultipartUploads(ctx, bucket, "")
+	if err != nil || len(uploads) != 2 || uploads[0].UploadID != other || uploads[1].Initiator != "alice" {
+		t.Fatalf("ListMultipartUploads: %+v %v", uploads, err)
+	}
+	uploads, err = s.ListMultipartUploads(ctx, bucket, "videos/")
+	if err != nil || len(uploads) != 1 || uploads[0].Key != "videos/a.mp4" || uploads[0].Initiated.IsZero() {
+		t.Fatalf("ListMultipartUploads prefix: %+v %v", uploads, err)
+	}
+	parts, err := s.ListParts(ctx, bucket, "videos/a.mp4", up.UploadID)
+	if err != nil || len(parts) != 2 || parts[0].Number != 1 || parts[1].Size != 5 || parts[0].ETag == "" {
+		t.Fatalf("ListParts: %+v %v", parts, err)
+	}
+	if _, err := s.ListParts(ctx, bucket, "docs/b.txt", up.UploadID); !errors.Is(err, ErrNoSuchUpload) {
+		t.Fatalf("ListParts other key: expected ErrNoSuchUpload, got %v", err)
+	}
+
+	if _, err := s.CompleteMultipart(ctx, bucket, "docs/b.txt", up.UploadID, nil, nil); !errors.Is(err, ErrNoSuchUpload) {
+		t.Fatalf("complete onto another key: expected ErrNoSuchUpload, got %v", err)
+	}
+	if err := s.AbortMultipart(ctx, bucket, "videos/a.mp4", other); !errors.Is(err, ErrNoSuchUpload) {
+		t.Fatalf("abort other upload: expected ErrNoSuchUpload, got %v", err)
+	}
+	if _, err := s.CompleteMultipart(ctx, bucket, "videos/a.mp4", up.UploadID, nil, nil); err != nil {
+		t.Fatalf("CompleteMultipart: %v", err)
+	}
+	// metadata given at creation is applied when completing without any
+	info, err := s.Stat(ctx, bucket, "videos/a.mp4")
+	if err != nil || info.ContentType != "video/mp4" || info.Size != 11 {
+		t.Fatalf("Stat: %+v %v", info, err)
+	}
+	if uploads, _ := s.ListMultipartUploads(ctx, bucket, ""); len(uploads) != 1 {
+		t.Fatalf("completed upload still listed: %+v", uploads)
+	}
+
+	// an upload started before records existed is bound to no key, and
+	// only garbage collection can remove it
+	legacy, err := s.StartMultipart(ctx, bucket, "old.bin")
+	if err != nil {
+		t.Fatalf("StartMultipart: %v", err)
+	}
+	if _, err := s.UploadPart(ctx, bucket, "old.bin", legacy, 1, strings.NewReader("old")); err != nil {
+		t.Fatalf("UploadPart: %v", err)
+	}
+	if err := os.Remove(filepath.Join(s.Root, bucket, ".multipart", legacy, uploadRecordName)); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"old.bin", "docs/b.txt"} {
+		if _, err := s.ListParts(ctx, bucket, key, legacy); !errors.Is(err, ErrNoSuchUpload) {
+			t.Fatalf("ListParts of a legacy upload on %s: expected ErrNoSuchUpload, got %v", key, err)
+		}
+		if _, err := s.UploadPart(ctx, bucket, key, legacy, 2, strings.NewReader("x")); !errors.Is(err, ErrNoSuchUpload) {
+			t.Fatalf("UploadPart to a legacy upload on %s: expected ErrNoSuchUpload, got %v", key, err)
+		}
+		if _, err := s.CompleteMultipart(ctx, bucket, key, legacy, nil, nil); !errors.Is(err, ErrNoSuchUpload) {
+			t.Fatalf("complete a legacy upload onto %s: expected ErrNoSuchUpload, got %v", key, err)
+		}
+		if err := s.AbortMultipart(ctx, bucket, key, legacy); !errors.Is(err, ErrNoSuchUpload) {
+			t.Fatalf("abort a legacy upload on %s: expected ErrNoSuchUpload, got %v", key, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(s.Root, bucket, ".multipart", legacy, uploadRecordName)); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("legacy upload got a record: %v", err)
+	}
+	if _, err := s.collectGarbage(ctx, time.Now().Add(48*time.Hour), GCOptions{MaxAge: 24 * time.Hour}); err != nil {
+		t.Fatalf("collectGarbage: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(s.Root, bucket, ".multipart", legacy)); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("legacy upload not collected: %v", err)
+	}
+	if u, err := s.Usage(ctx, bucket); err != nil || u.MultipartBytes != 0 {
+		t.Fatalf("usage after collecting the legacy upload: %+v %v", u, err)
+	}
+	if staging, _ := os.ReadDir(filepath.Join(s.Root, bucket, stagingDirName)); len(staging) != 0 {
+		t.Fatalf("uploads left in the staging area: %v", staging)
+	}
+}
+
+func TestLocalStorage_CopyRename(t *testing.T) {
+	s := &LocalStorage{Root: t.TempDir()}
+	ctx := context.Background()
+	createBuckets(t, s, "src", "dst")
+
+	src, err := s.PutWithMetadata(ctx, "src", "in/a.txt", strings.NewReader("hello"), Metadata{MetaContentType: "text/plain", "owner": "a"})
+	if err != nil {
+		t.Fatalf("PutWithMetadata: %v", err)
+	}
+	info, err := s.Copy(ctx, "src", "in/a.txt", "dst", "out/a.txt", CopyOptions{})
+	if err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	if info.ETag != src.ETag || info.Size != 5 || info.ContentType != "text/plain" {
+		t.Fatalf("unexpected copy info %+v", info)
+	}
+	// parts are shared with the source, not rewritten
+	a, _ := os.Stat(filepath.Join(s.Root, "src", "in/a.txt", "part.1"))
+	b, _ := os.Stat(filepath.Join(s.Root, "dst", "out/a.txt", "part.1"))
+	if !os.SameFile(a, b) {
+		t.Fatalf("expected copy to hard-link the source part")
+	}
+	meta, err := s.GetMetadata(ctx, "dst", "out/a.txt")
+	if err != nil || meta["owner"] != "a" {
+		t.Fatalf("metadata not copied: %v %v", meta, err)
+	}
+	// overwriting the source leaves the copy intact
+	if _, err := s.PutWithMetadata(ctx, "src", "in/a.txt", strings.NewReader("changed"), nil); err != nil {
+		t.Fatalf("overwrite source: %v", err)
+	}
+	rc, err := s.Get(ctx, "dst", "out/a.txt")
+	if err != nil {
+		t.Fatalf("Get copy: %v", err)
+	}
+	got, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(got) != "hello" {
+		t.Fatalf("copy changed with its source: %q", got)
+	}
+
+	if _, err := s.Copy(ctx, "src", "in/a.txt", "src", "in/b.txt", CopyOptions{MetadataDirective: MetadataReplace, Metadata: Metadata{"owner": "b"}}); err != nil {
+		t.Fatalf("Copy replace: %v", err)
+	}
+	if meta, _ := s.GetMetadata(ctx, "src", "in/b.txt"); meta["owner"] != "b" || meta[MetaContentType] != "" {
+		t.Fatalf("metadata not replaced: %v", meta)
+	}
+	if _, err := s.Copy(ctx, "src", "in/a.txt", "src", "x", CopyOptions{MetadataDirective: "MERGE"}); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("bad directive: expected ErrInvalidArgument, got %v", err)
+	}
+	if _, err := s.Copy(ctx, "src", "missing", "dst", "x", CopyOptions{}); !errors.Is(err, ErrNoSuchKey) {
+		t.Fatalf("missing source: expected ErrNoSuchKey, got %v", err)
+	}
+
+	// copy a previous version
+	if err := s.PutBucketMetadata(ctx, "src", BucketMetadata{Versioning: true}); err != nil {
+		t.Fatalf("PutBucketMetadata: %v", err)
+	}
+	if _, err := s.PutWithMetadata(ctx, "src", "in/a.txt", strings.NewReader("v3"), nil); err != nil {
+		t.Fatalf("PutWithMetadata: %v", err)
+	}
+	if _, err := s.Copy(ctx, "src", "in/a.txt", "dst", "old.txt", CopyOptions{SourceVersionID: NullVersionID}); err != nil {
+		t.Fatalf("Copy version: %v", err)
+	}
+	if info, _ := s.Stat(ctx, "dst", "old.txt"); info.Size != int64(len("changed")) {
+		t.Fatalf("copied wrong version: %+v", info)
+	}
+
+	if _, err := s.Rename(ctx, "dst", "out/a.txt", "moved/a.txt"); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if _, err := s.Stat(ctx, "dst", "out/a.txt"); !errors.Is(err, ErrNoSuchKey) {
+		t.Fatalf("renamed source still present: %v", err)
+	}
+	if info, err := s.Stat(ctx, "dst", "moved/a.txt"); err != nil || info.ETag != src.ETag {
+		t.Fatalf("renamed object: %+v %v", info, err)
+	}
+	if u, _ := s.Usage(ctx, "dst"); u.Objects != 2 || u.Bytes != int64(len("hello")+len("changed")) {
+		t.Fatalf("usage after copy/rename: %+v", u)
+	}
+}
+
+func TestLocalStorage_Buckets(t *testing.T) {
+	s := &LocalStorage{Root: t.TempDir()}
+	ctx := context.Background()
+
+	// writes and probes never create buckets implicitly
+	if _, err := s.PutWithMetadata(ctx, "photos", "a.jpg", strings.NewReader("x"), nil); !errors.Is(err, ErrNoSuchBucket) {
+		t.Fatalf("write to missing bucket: expected ErrNoSuchBucket, got %v", err)
+	}
+	if err := s.AbortMultipart(ctx, "photos", "a.jpg", "upload-1"); !errors.Is(err, ErrNoSuchBucket) {
+		t.Fatalf("abort in missing bucket: expected ErrNoSuchBucket, got %v", err)
+	}
+	if _, err := s.HeadBucket(ctx, "photos"); !errors.Is(err, ErrNoSuchBucket) {
+		t.Fatalf("HeadBucket: expected ErrNoSuchBucket, got %v", err)
+	}
+
+	createBuckets(t, s, "photos", "docs")
+	if err := s.CreateBucket(ctx, "photos"); !errors.Is(err, ErrBucketExists) {
+		t.Fatalf("CreateBucket twice: expected ErrBucketExists, got %v", err)
+	}
+	if err := s.CreateBucket(ctx, "Bad_Name"); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("CreateBucket invalid: expected ErrInvalidKey, got %v", err)
+	}
+	info, err := s.HeadBucket(ctx, "photos")
+	if err != nil || info.Name != "photos" || info.CreationDate.IsZero() {
+		t.Fatalf("HeadBucket: %+v %v", info, err)
+	}
+	buckets, err := s.ListBuckets(ctx)
+	if err != nil || len(buckets) != 2 || buckets[0].Name != "docs" || buckets[1].Name != "photos" {
+		t.Fatalf("ListBuckets: %+v %v", buckets, err)
+	}
+
+	if _, err := s.PutWithMetadata(ctx, "photos", "a.jpg", strings.NewReader("x"), nil); err != nil {
+		t.Fatalf("PutWithMetadata: %v", err)
+	}
+	id, err := s.StartMultipart(ctx, "docs", "big")
+	if err != nil {
+		t.Fatalf("StartMultipart: %v", err)
+	}
+	for _, b := range []string{"photos", "docs"} {
+		if err := s.DeleteBucket(ctx, b, false); !errors.Is(err, ErrBucketNotEmpty) {
+			t.Fatalf("DeleteBucket %s: expected ErrBucketNotEmpty, got %v", b, err)
+		}
+	}
+	if err := s.DeleteBucket(ctx, "photos", true); err != nil {
+		t.Fatalf("DeleteBucket force: %v", err)
+	}
+	if _, err := s.Get(ctx, "photos", "a.jpg"); !errors.Is(err, ErrNoSuchBucket) {
+		t.Fatalf("Get after delete: expected ErrNoSuchBucket, got %v", err)
+	}
+	if err := s.AbortMultipart(ctx, "docs", "big", id); err != nil {
+		t.Fatalf("AbortMultipart: %v", err)
+	}
+	if err := s.DeleteBucket(ctx, "docs", false); err != nil {
+		t.Fatalf("DeleteBucket empty: %v", err)
+	}
+	if buckets, _ := s.ListBuckets(ctx); len(buckets) != 0 {
+		t.Fatalf("buckets left: %+v", buckets)
+	}
+	if entries, _ := os.ReadDir(s.Root); len(entries) != 0 {
+		t.Fatalf("leftovers under root: %v", entries)
+	}
+	// the name can be reused
+	createBuckets(t, s, "photos")
+}
+
+func TestLocalStorage_GarbageCollector(t *testing.T) {
+	s := &LocalStorage{Root: t.TempDir()}
+	ctx := context.Background()
+	bucket := "scratch"
+	createBuckets(t, s, bucket)
+
+	up, err := s.StartMultipart(ctx, bucket, "big.bin")
+	if err != nil {
+		t.Fatalf("StartMultipart: %v", err)
+	}
+	if _, err := s.UploadPart(ctx, bucket, "big.bin", up, 1, strings.NewReader("abandoned")); err != nil {
+		t.Fatalf("UploadPart: %v", err)
+	}
+	if err := s.Put(ctx, bucket, "kept.txt", strings.NewReader("kept")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	// leftovers of interrupted writes
+	bucketDir := filepath.Join(s.Root, bucket)
+	leftovers := []string{
+		filepath.Join(bucketDir, "kept.txt", "data.meta.tmp"),
+		filepath.Join(bucketDir, ".bucket.meta.tmp"),
+		filepath.Join(bucketDir, stagingDirName, "put-123"),
+		filepath.Join(s.Root, deletedDirPrefix+"1", "old", "kept.txt", "part.1"),
+	}
+	for _, p := range leftovers {
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte("leftover"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// nothing is old enough yet
+	opts := GCOptions{MaxAge: 24 * time.Hour}
+	report, err := s.collectGarbage(ctx, time.Now(), opts)
+	if err != nil || len(report.AbortedUploads) != 0 || len(report.RemovedPaths) != 0 {
+		t.Fatalf("early gc: %+v %v", report, err)
+	}
+
+	later := time.Now().Add(25 * time.Hour)
+	opts.DryRun = true
+	report, err = s.collectGarbage(ctx, later, opts)
+	if err != nil || len(report.AbortedUploads) != 1 || len(report.RemovedPaths) != 4 {
+		t.Fatalf("dry-run gc: %+v %v", report, err)
+	}
+	if uploads, _ := s.ListMultipartUploads(ctx, bucket, ""); len(uploads) != 1 {
+		t.Fatalf("dry run aborted the upload")
+	}
+	dryReclaimed := report.ReclaimedBytes
+
+	opts.DryRun = false
+	report, err = s.collectGarbage(ctx, later, opts)
+	if err != nil || len(report.AbortedUploads) != 1 || report.AbortedUploads[0].UploadID != up {
+		t.Fatalf("gc: %+v %v", report, err)
+	}
+	if len(report.RemovedPaths) != 4 || report.ReclaimedBytes != dryReclaimed || report.ReclaimedBytes < int64(len("abandoned")+4*len("leftover")) {
+		t.Fatalf("gc removed %v (%d bytes, dry run %d)", report.RemovedPaths, report.ReclaimedBytes, dryReclaimed)
+	}
+	for _, p := range leftovers {
+		if _, err := os.Stat(p); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("%s not removed: %v", p, err)
+		}
+	}
+	if uploads, _ := s.ListMultipartUploads(ctx, bucket, ""); len(uploads) != 0 {
+		t.Fatalf("upload not aborted: %+v", uploads)
+	}
+	if u, err := s.Usage(ctx, bucket); err != nil || u.MultipartBytes != 0 || u.Objects != 1 {
+		t.Fatalf("usage after gc: %+v %v", u, err)
+	}
+	rc, err := s.Get(ctx, bucket, "kept.txt")
+	if err != nil {
+		t.Fatalf("Get after gc: %v", err)
+	}
+	got, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(got) != "kept" {
+		t.Fatalf("object damaged by gc: %q", got)
+	}
+
+	// a second pass finds nothing
+	report, err = s.collectGarbage(ctx, later, opts)
+	if err != nil || len(report.AbortedUploads) != 0 || len(report.RemovedPaths) != 0 {
+		t.Fatalf("second gc: %+v %v", report, err)
+	}
+}
+
+func TestLocalStorage_Fsck(t *testing.T) {
+	s := &LocalStorage{Root: t.TempDir()}
+	ctx := context.Background()
+	bucket := "checked"
+	createBuckets(t, s, bucket)
+	if err := s.PutBucketMetadata(ctx, bucket, BucketMetadata{Versioning: true}); err != nil {
+		t.Fatalf("PutBucketMetadata: %v", err)
+	}
+	for _, key := range []string{"ok.txt", "dir/rot.txt", "dir/lost.txt", "extra.txt", "meta.txt", "empty.txt"} {
+		if err := s.Put(ctx, bucket, key, strings.NewReader("content of "+key)); err != nil {
+			t.Fatalf("Put %s: %v", key, err)
+		}
+	}
+	// metadata written before any data is a valid object
+	if err := s.PutMetadata(ctx, bucket, "meta-only", Metadata{"note": "no data yet"}); err != nil {
+		t.Fatalf("PutMetadata: %v", err)
+	}
+	// an archived version whose manifest is damaged
+	if err := s.Put(ctx, bucket, "ok.txt", strings.NewReader("second version")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	versions, err := s.ListVersions(ctx, bucket, "ok.txt")
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("ListVersions: %+v %v", versions, err)
+	}
+	bucketDir := filepath.Join(s.Root, bucket)
+	oldVersion, _ := versionPath(bucketDir, "ok.txt", versions[1].VersionID)
+
+	damage := map[string]string{
+		filepath.Join(bucketDir, "dir", "rot.txt", "part.1"): "content of dir/rot.tx!", // same size, bit rot
+		filepath.Join(bucketDir, "extra.txt", "part.7"):      "stray",
+		filepath.Join(bucketDir, "meta.txt", "data.meta"):    "{not json",
+		filepath.Join(bucketDir, "empty.txt", "part.1"):      "",
+		filepath.Join(oldVersion, manifestFileName):          "[]",
+	}
+	for p, data := range damage {
+		os.MkdirAll(filepath.Dir(p), 0o755)
+		if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Remove(filepath.Join(bucketDir, "dir", "lost.txt", "part.1")); err != nil {
+		t.Fatal(err)
+	}
+
+	kinds := func(r FsckReport) map[string]string {
+		got := map[string]string{}
+		for _, is := range r.Issues {
+			got[is.Key+"@"+is.VersionID] = is.Kind
+		}
+		return got
+	}
+	want := map[string]string{
+		"dir/lost.txt@":                   IssueMissingPart,
+		"extra.txt@":                      IssueExtraPart,
+		"meta.txt@":                       IssueCorruptMeta,
+		"empty.txt@":                      IssueZeroLengthPart,
+		"ok.txt@" + versions[1].VersionID: IssueCorruptManifest,
+	}
+
+	// without checksums the bit rot goes unnoticed
+	report, err := s.Fsck(ctx, FsckOptions{})
+	if err != nil {
+		t.Fatalf("Fsck: %v", err)
+	}
+	if got := kinds(report); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("issues:\n got %v\nwant %v", got, want)
+	}
+	want["dir/rot.txt@"] = IssueChecksumMismatch
+	report, err = s.Fsck(ctx, FsckOptions{VerifyChecksums: true})
+	if err != nil {
+		t.Fatalf("Fsck: %v", err)
+	}
+	if got := kinds(report); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("issues:\n got %v\nwant %v", got, want)
+	}
+	if report.Unrepaired() != len(report.Issues) || report.Buckets != 1 {
+		t.Fatalf("report: %+v", report)
+	}
+
+	report, err = s.Fsck(ctx, FsckOptions{VerifyChecksums: true, Repair: true})
+	if err != nil {
+		t.Fatalf("Fsck repair: %v", err)
+	}
+	if report.Unrepaired() != 0 {
+		t.Fatalf("unrepaired issues: %+v", report.Issues)
+	}
+	for _, is := range report.Issues {
+		wantRepair := RepairQuarantined
+		if is.Kind == IssueExtraPart {
+			wantRepair = RepairRemoved
+		}
+		if is.Repair != wantRepair {
+			t.Fatalf("%s %s: repair %q, want %q", is.Key, is.Kind, is.Repair, wantRepair)
+		}
+		if is.Repair == RepairQuarantined {
+			if _, err := os.Stat(filepath.Join(s.Root, is.QuarantinePath, "issues.json")); err != nil {
+				t.Fatalf("%s: quarantine: %v", is.Key, err)
+			}
+		}
+	}
+	keys, err := s.List(ctx, bucket, "")
+	sort.Strings(keys)
+	if err != nil || fmt.Sprint(keys) != "[extra.txt meta-only meta.txt ok.txt]" {
+		t.Fatalf("keys after repair: %v %v", keys, err)
+	}
+	if meta, err := s.GetMetadata(ctx, bucket, "meta.txt"); err != nil || len(meta) != 0 {
+		t.Fatalf("metadata after repair: %v %v", meta, err)
+	}
+	if meta, err := s.GetMetadata(ctx, bucket, "meta-only"); err != nil || meta["note"] != "no data yet" {
+		t.Fatalf("metadata-only object after repair: %v %v", meta, err)
+	}
+	if versions, _ := s.ListVersions(ctx, bucket, "ok.txt"); len(versions) != 1 {
+		t.Fatalf("damaged version still listed: %+v", versions)
+	}
+	if u, err := s.Usage(ctx, bucket); err != nil || u.Objects != 3 || u.VersionBytes != 0 {
+		t.Fatalf("usage after repair: %+v %v", u, err)
+	}
+	report, err = s.Fsck(ctx, FsckOptions{VerifyChecksums: true})
+	if err != nil || len(report.Issues) != 0 || report.Objects != 4 {
+		t.Fatalf("after repair: %+v %v", report, err)
+	}
+}
+
+// TestLocalStorage_FsckRepairWhileWriting runs repairing scrubs while
+// objects are overwritten: nothing is damaged, so nothing may be repaired.
+func TestLocalStorage_FsckRepairWhileWriting(t *testing.T) {
+	s := &LocalStorage{Root: t.TempDir()}
+	ctx := context.Background()
+	bucket := "busy"
+	createBuckets(t, s, bucket)
+
+	done := make(chan struct{})
+	var (
+		wg     sync.WaitGroup
+		issues []FsckIssue
+		errs   []error
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			report, err := s.Fsck(ctx, FsckOptions{VerifyChecksums: true, Repair: true})
+			if err != nil {
+				errs = append(errs, err)
+			}
+			issues = append(issues, report.Issues...)
+		}
+	}()
+	var single, multi string
+	for i := 0; i < 40; i++ {
+		single = strings.Repeat(fmt.Sprint(i), 1+i*97)
+		if err := s.Put(ctx, bucket, "single.txt", strings.NewReader(single)); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		id, err := s.StartMultipart(ctx, bucket, "multi.bin")
+		if err != nil {
+			t.Fatalf("StartMultipart: %v", err)
+		}
+		multi = ""
+		for n := 1; n <= 1+i%4; n++ {
+			part := strings.Repeat(fmt.Sprint(n), i+n)
+			if _, err := s.UploadPart(ctx, bucket, "multi.bin", id, n, strings.NewReader(part)); err != nil {
+				t.Fatalf("UploadPart: %v", err)
+			}
+			multi += part
+		}
+		if _, err := s.CompleteMultipart(ctx, bucket, "multi.bin", id, nil, nil); err != nil {
+			t.Fatalf("CompleteMultipart: %v", err)
+		}
+	}
+	close(done)
+	wg.Wait()
+	if len(issues) != 0 || len(errs) != 0 {
+		t.Fatalf("scrub of healthy objects: %+v %v", issues, errs)
+	}
+	for key, want := range map[string]string{"single.txt": single, "multi.bin": multi} {
+		rc, err := s.Get(ctx, bucket, key)
+		if err != nil {
+			t.Fatalf("Get %s: %v", key, err)
+		}
+		got, _ := io.ReadAll(rc)
+		rc.Close()
+		if string(got) != want {
+			t.Fatalf("Get %s: %d bytes, want %d", key, len(got), len(want))
+		}
+	}
+	if _, err := os.Stat(filepath.Join(s.Root, bucket, quarantineDirName)); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("quarantine directory created: %v", err)
+	}
+}
+
+// TestLocalStorage_PutMetadataLocked checks that metadata is written under
+// the lock writes publish under, like the object data.
+func TestLocalStorage_PutMetadataLocked(t *testing.T) {
+	s := &LocalStorage{Root: t.TempDir()}
+	ctx := context.Background()
+	bucket := "meta"
+	createBuckets(t, s, bucket)
+	if err := s.Put(ctx, bucket, "doc", strings.NewReader("data")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	s.usageMu.Lock()
+	done := make(chan error, 1)
+	go func() { done <- s.PutMetadata(ctx, bucket, "doc", Metadata{"note": "updated"}) }()
+	select {
+	case err := <-done:
+		s.usageMu.Unlock()
+		t.Fatalf("PutMetadata returned while a write held the lock: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	s.usageMu.Unlock()
+	if err := <-done; err != nil {
+		t.Fatalf("PutMetadata: %v", err)
+	}
+	if meta, err := s.GetMetadata(ctx, bucket, "doc"); err != nil || meta["note"] != "updated" {
+		t.Fatalf("GetMetadata: %v %v", meta, err)
+	}
+	if u, err := s.Usage(ctx, bucket); err != nil || u.Objects != 1 || u.Bytes != 4 {
+		t.Fatalf("usage: %+v %v", u, err)
+	}
+}
+
+func TestLocalStorage_ReconstructContainer(t *testing.T) {
+	s := &LocalStorage{Root: t.TempDir()}
+	ctx := context.Background()
+	createBuckets(t, s, "src", "dst")
+	meta := Metadata{"filename": "report.pdf", MetaContentType: "application/pdf", "owner": "alice"}
+	if _, err := s.PutWithMetadata(ctx, "src", "docs/report.pdf", strings.NewReader("%PDF-1.7 ..."), meta); err != nil {
+		t.Fatalf("PutWithMetadata: %v", err)
+	}
+	var file bytes.Buffer
+	if err := s.ReconstructTo(ctx, "src", "docs/report.pdf", &file, []string{"*"}); err != nil {
+		t.Fatalf("ReconstructTo: %v", err)
+	}
+
+	// round trip under the recorded key, with every metadata key
+	info, err := s.Import(ctx, "dst", "", bytes.NewReader(file.Bytes()))
+	if err != nil || info.Key != "docs/report.pdf" || info.Size != 12 {
+		t.Fatalf("Import: %+v %v", info, err)
+	}
+	got, err := s.GetMetadata(ctx, "dst", "docs/report.pdf")
+	if err != nil || fmt.Sprint(got) != fmt.Sprint(meta) {
+		t.Fatalf("imported metadata %v, want %v (%v)", got, meta, err)
+	}
+	if info, err := s.Import(ctx, "dst", "renamed.pdf", bytes.NewReader(file.Bytes())); err != nil || info.Key != "renamed.pdf" {
+		t.Fatalf("Import renamed: %+v %v", info, err)
+	}
+
+	// corrupted and truncated files are rejected and publish nothing
+	corrupt := bytes.Clone(file.Bytes())
+	corrupt[len(corrupt)-sha256.Size-1] ^= 1
+	if _, err := s.Import(ctx, "dst", "corrupt.pdf", bytes.NewReader(corrupt)); !errors.Is(err, ErrBadDigest) {
+		t.Fatalf("corrupt payload: expected ErrBadDigest, got %v", err)
+	}
+	truncated := file.Bytes()[:file.Len()-sha256.Size-3]
+	if _, err := s.Import(ctx, "dst", "truncated.pdf", bytes.NewReader(truncated)); !errors.Is(err, ErrInvalidContainer) {
+		t.Fatalf("truncated payload: expected ErrInvalidContainer, got %v", err)
+	}
+	if _, err := s.Import(ctx, "dst", "garbage.pdf", strings.NewReader("not a container at all")); !errors.Is(err, ErrInvalidContainer) {
+		t.Fatalf("garbage: expected ErrInvalidContainer, got %v", err)
+	}
+	for _, key := range []string{"corrupt.pdf", "truncated.pdf", "garbage.pdf"} {
+		if _, err := s.Stat(ctx, "dst", key); !errors.Is(err, ErrNoSuchKey) {
+			t.Fatalf("%s was published: %v", key, err)
+		}
+	}
+
+	// files written before the container format are read as version 0
+	legacy := []byte{0, 0, 0, 0, 0, 0, 0, 23}
+	legacy = append(legacy, `{"filename":"old.bin"}`+" "...)
+	legacy = append(legacy, "old payload"...)
+	rc, err := OpenReconstructed(bytes.NewReader(legacy))
+	if err != nil || rc.Version != 0 || rc.Size != -1 || rc.Header.Metadata["filename"] != "old.bin" {
+		t.Fatalf("legacy header: %+v %v", rc, err)
+	}
+	if payload, err := io.ReadAll(rc); err != nil || string(payload) != "old payload" {
+		t.Fatalf("legacy payload %q: %v", payload, err)
+	}
+	if _, err := s.Import(ctx, "dst", "", bytes.NewReader(legacy)); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("legacy import without key: expected ErrInvalidArgument, got %v", err)
+	}
+}
+
+// createBuckets creates the buckets a test writes to.
+func createBuckets(t *testing.T, s *LocalStorage, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		if err := s.CreateBucket(context.Background(), name); err != nil {
+			t.Fatalf("CreateBucket %s: %v", name, err)
+		}
 	}
-	f.Close()
 }
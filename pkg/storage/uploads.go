@@ -0,0 +1,249 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// uploadRecordName is the file in an upload directory that binds the upload
+// to its key.
+const uploadRecordName = "upload.json"
+
+// uploadKeyName is the file in the upload directory of an encrypted upload
+// holding its Encryption, kept out of the record that ListMultipartUploads
+// returns.
+const uploadKeyName = "upload.key"
+
+// MultipartUpload describes an in-progress multipart upload.
+type MultipartUpload struct {
+	UploadID  string    `json:"upload_id"`
+	Bucket    string    `json:"bucket"`
+	Key       string    `json:"key"`
+	Initiator string    `json:"initiator,omitempty"`
+	Initiated time.Time `json:"initiated"`
+	// Metadata is applied to the object when CompleteMultipart is called
+	// without metadata of its own.
+	Metadata Metadata `json:"metadata,omitempty"`
+}
+
+// StartMultipart starts an upload for key with no metadata.
+func (s *LocalStorage) StartMultipart(ctx context.Context, bucket, key string) (string, error) {
+	up, err := s.CreateMultipartUpload(ctx, bucket, key, nil, "")
+	return up.UploadID, err
+}
+
+// CreateMultipartUpload starts an upload bound to key. Parts can only be
+// uploaded to, and the upload completed or aborted on, that same key.
+func (s *LocalStorage) CreateMultipartUpload(ctx context.Context, bucket, key string, meta Metadata, initiator string) (MultipartUpload, error) {
+	up := MultipartUpload{Bucket: bucket, Key: key, Initiator: initiator, Metadata: meta}
+	if _, err := ParseObjectKey(key); err != nil {
+		return up, err
+	}
+	if strings.HasSuffix(key, "/") {
+		return up, invalid(key, "cannot upload a directory key in parts")
+	}
+	dir, err := s.existingBucketDir(bucket)
+	if err != nil {
+		return up, err
+	}
+	// the upload is assembled in the staging area and renamed into place,
+	// so no upload is ever visible without its record
+	stagingDir := filepath.Join(dir, stagingDirName)
+	multipartDir := filepath.Join(dir, ".multipart")
+	for _, d := range []string{stagingDir, multipartDir} {
+		if err := os.MkdirAll(d, 0o755); err != nil {
+			return up, err
+		}
+	}
+	up.Initiated = time.Now().UTC()
+	for {
+		d, err := os.MkdirTemp(stagingDir, "upload-")
+		if err != nil {
+			return up, err
+		}
+		up.UploadID = filepath.Base(d)
+		err = s.writeUpload(ctx, d, up)
+		if err == nil {
+			err = os.Rename(d, filepath.Join(multipartDir, up.UploadID))
+		}
+		if err == nil {
+			return up, syncDir(multipartDir)
+		}
+		os.RemoveAll(d)
+		if !errors.Is(err, fs.ErrExist) { // else the ID is taken: pick another
+			return up, err
+		}
+	}
+}
+
+// writeUpload writes the record of up, and the data key its parts are
+// encrypted with, to the new upload directory d.
+func (s *LocalStorage) writeUpload(ctx context.Context, d string, up MultipartUpload) error {
+	// every part is encrypted with the data key chosen now
+	enc, _, err := s.newEncryption(ctx)
+	if err == nil && enc != nil {
+		var b []byte
+		if b, err = json.Marshal(enc); err == nil {
+			err = writeFileAtomic(filepath.Join(d, uploadKeyName), b)
+		}
+	}
+	if err == nil {
+		var b []byte
+		if b, err = json.Marshal(up); err == nil {
+			err = writeFileAtomic(filepath.Join(d, uploadRecordName), b)
+		}
+	}
+	return err
+}
+
+// openUpload returns the directory and record of an upload, failing with
+// ErrNoSuchUpload when it does not exist or belongs to another key. Uploads
+// started before records existed are bound to no key, so they can only be
+// listed and expired by CollectGarbage.
+func (s *LocalStorage) openUpload(bucket, key, uploadID string) (string, MultipartUpload, error) {
+	dir, err := s.existingUploadDir(bucket, uploadID)
+	if err != nil {
+		return "", MultipartUpload{}, err
+	}
+	up, err := readUploadRecord(dir)
+	if err != nil {
+		return "", up, err
+	}
+	up.Bucket = bucket
+	if up.Key == "" || up.Key != key {
+		return "", up, fmt.Errorf("%w: %s is not an upload of %s/%s", ErrNoSuchUpload, uploadID, bucket, key)
+	}
+	return dir, up, nil
+}
+
+// readUploadRecord reads the record of the upload in dir. For uploads
+// without a record it returns an unbound record dated from the directory.
+func readUploadRecord(dir string) (MultipartUpload, error) {
+	up := MultipartUpload{UploadID: filepath.Base(dir)}
+	data, err := os.ReadFile(filepath.Join(dir, uploadRecordName))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			return up, err
+		}
+		fi, err := os.Stat(dir)
+		if err != nil {
+			return up, err
+		}
+		up.Initiated = fi.ModTime().UTC()
+		return up, nil
+	}
+	if err := json.Unmarshal(data, &up); err != nil {
+		return up, fmt.Errorf("corrupt upload record: %w", err)
+	}
+	return up, nil
+}
+
+// readUploadEncryption returns the encryption of the parts of the upload in
+// dir, nil when they are stored in clear.
+func readUploadEncryption(dir string) (*Encryption, error) {
+	data, err := os.ReadFile(filepath.Join(dir, uploadKeyName))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var enc Encryption
+	if err := json.Unmarshal(data, &enc); err != nil {
+		return nil, fmt.Errorf("corrupt upload key: %w", err)
+	}
+	return &enc, nil
+}
+
+// uploadedParts lists the parts uploaded to dir with the size of their
+// data, which for encrypted parts is smaller than the file.
+func uploadedParts(dir string, enc *Encryption) ([]PartInfo, error) {
+	parts, err := scanParts(dir)
+	if err != nil || enc == nil {
+		return parts, err
+	}
+	for i, p := range parts {
+		size, ok := plainSize(p.Size)
+		if !ok {
+			return nil, fmt.Errorf("%w: part %d is truncated", ErrInvalidPart, p.Number)
+		}
+		parts[i].Size = size
+	}
+	return parts, nil
+}
+
+// ListMultipartUploads lists the in-progress uploads whose key starts with
+// prefix, sorted by key and then by initiation time.
+func (s *LocalStorage) ListMultipartUploads(ctx context.Context, bucket, prefix string) ([]MultipartUpload, error) {
+	bucketDir, err := s.existingBucketDir(bucket)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(filepath.Join(bucketDir, ".multipart"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	uploads := []MultipartUpload{}
+	for _, e := range entries {
+		if !e.IsDir() || !strings.HasPrefix(e.Name(), "upload-") {
+			continue
+		}
+		up, err := readUploadRecord(filepath.Join(bucketDir, ".multipart", e.Name()))
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) { // completed or aborted meanwhile
+				continue
+			}
+			return nil, err
+		}
+		if !strings.HasPrefix(up.Key, prefix) {
+			continue
+		}
+		up.Bucket = bucket
+		uploads = append(uploads, up)
+	}
+	sort.Slice(uploads, func(i, j int) bool {
+		if uploads[i].Key != uploads[j].Key {
+			return uploads[i].Key < uploads[j].Key
+		}
+		return uploads[i].Initiated.Before(uploads[j].Initiated)
+	})
+	return uploads, nil
+}
+
+// ListParts lists the parts uploaded so far, in part number order.
+func (s *LocalStorage) ListParts(ctx context.Context, bucket, key, uploadID string) ([]PartInfo, error) {
+	dir, _, err := s.openUpload(bucket, key, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := readUploadEncryption(dir)
+	if err != nil {
+		return nil, err
+	}
+	parts, err := uploadedParts(dir, enc)
+	if err != nil {
+		return nil, err
+	}
+	for i, p := range parts {
+		// checksums come from the sidecar written by UploadPart; they are
+		// left empty rather than recomputed when it is missing
+		var rec PartInfo
+		if b, err := os.ReadFile(filepath.Join(dir, p.FileName()+".json")); err == nil {
+			if json.Unmarshal(b, &rec) == nil && rec.Number == p.Number && rec.Size == p.Size {
+				parts[i] = rec
+			}
+		}
+	}
+	if parts == nil {
+		parts = []PartInfo{}
+	}
+	return parts, nil
+}
@@ -0,0 +1,239 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// usageFileName holds a bucket's usage counters next to .bucket.meta.
+const usageFileName = ".bucket.usage"
+
+// Usage holds the counters a bucket maintains on every write and delete, so
+// Stats and quota checks never walk the bucket. After a crash they can be
+// rebuilt from the objects on disk with Recount.
+type Usage struct {
+	// Objects, Bytes and Parts describe the current version of every object.
+	Objects int64 `json:"objects"`
+	Bytes   int64 `json:"bytes"`
+	Parts   int64 `json:"parts"`
+	// VersionBytes is held by archived versions of a versioned bucket.
+	VersionBytes int64 `json:"version_bytes"`
+	// MultipartBytes is held by parts of uploads that are still in progress.
+	MultipartBytes int64 `json:"multipart_bytes"`
+}
+
+// used returns the bytes counted against the bucket's capacity.
+func (u Usage) used() int64 { return u.Bytes + u.VersionBytes + u.MultipartBytes }
+
+func (u Usage) add(v Usage, sign int64) Usage {
+	u.Objects += sign * v.Objects
+	u.Bytes += sign * v.Bytes
+	u.Parts += sign * v.Parts
+	u.VersionBytes += sign * v.VersionBytes
+	u.MultipartBytes += sign * v.MultipartBytes
+	return u
+}
+
+// usageScope names what a mutation may change: the current object and
+// archived versions of Key, and the parts of the upload in PartDir.
+type usageScope struct {
+	ObjDir  string
+	Key     string
+	PartDir string
+}
+
+// measure returns the usage attributable to scope as it is now on disk.
+func (sc usageScope) measure(bucketDir string) (Usage, error) {
+	var u Usage
+	if sc.ObjDir != "" {
+		m, err := readManifest(sc.ObjDir)
+		switch {
+		case err == nil:
+			u.Objects, u.Bytes, u.Parts = 1, m.Size, int64(len(m.Parts))
+		case !errors.Is(err, fs.ErrNotExist):
+			return u, err
+		}
+		vb, err := versionsUsage(bucketDir, sc.Key)
+		if err != nil {
+			return u, err
+		}
+		u.VersionBytes = vb
+	}
+	if sc.PartDir != "" {
+		parts, err := scanParts(sc.PartDir)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return u, err
+		}
+		for _, p := range parts {
+			u.MultipartBytes += p.Size
+		}
+	}
+	return u, nil
+}
+
+// versionsUsage returns the bytes held by the archived versions of key.
+func versionsUsage(bucketDir, key string) (int64, error) {
+	ids, err := archivedVersions(bucketDir, key)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	for _, id := range ids {
+		dir, _ := versionPath(bucketDir, key, id)
+		if m, err := readManifest(dir); err == nil {
+			n += m.Size
+		}
+	}
+	return n, nil
+}
+
+// trackUsage runs fn, which mutates the objects, versions or upload in
+// scope, and adds the resulting change to the bucket's counters. Mutations
+// are serialised so that the counters stay consistent with the data.
+func (s *LocalStorage) trackUsage(bucketDir string, scope usageScope, fn func() error) error {
+	return s.trackWrite(bucketDir, scope, nil, fn)
+}
+
+// trackWrite is trackUsage for writes that must fit in the bucket's
+// capacity: check is given the bucket's usage before fn runs, and fn only
+// runs when check succeeds, both within the same critical section.
+func (s *LocalStorage) trackWrite(bucketDir string, scope usageScope, check func(Usage) error, fn func() error) error {
+	s.usageMu.Lock()
+	defer s.usageMu.Unlock()
+	total, err := s.loadUsage(bucketDir)
+	if err != nil {
+		return err
+	}
+	if check != nil {
+		if err := check(total); err != nil {
+			return err
+		}
+	}
+	before, err := scope.measure(bucketDir)
+	if err != nil {
+		return err
+	}
+	ferr := fn()
+	// count whatever fn managed to do, even when it failed half-way
+	after, err := scope.measure(bucketDir)
+	if err == nil {
+		total = total.add(after, 1).add(before, -1)
+		err = writeUsage(bucketDir, total)
+	}
+	if ferr != nil {
+		return ferr
+	}
+	return err
+}
+
+// loadUsage reads the bucket's counters, computing them the first time a
+// bucket is seen (e.g. one created before counters existed).
+func (s *LocalStorage) loadUsage(bucketDir string) (Usage, error) {
+	var u Usage
+	data, err := os.ReadFile(filepath.Join(bucketDir, usageFileName))
+	if err == nil {
+		if err := json.Unmarshal(data, &u); err != nil {
+			return u, fmt.Errorf("corrupt usage counters: %w", err)
+		}
+		return u, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return u, err
+	}
+	if u, err = s.countUsage(bucketDir); err != nil {
+		return u, err
+	}
+	return u, writeUsage(bucketDir, u)
+}
+
+func writeUsage(bucketDir string, u Usage) error {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(bucketDir, usageFileName), b)
+}
+
+// Usage returns the bucket's usage counters.
+func (s *LocalStorage) Usage(ctx context.Context, bucket string) (Usage, error) {
+	bucketDir, err := s.existingBucketDir(bucket)
+	if err != nil {
+		return Usage{}, err
+	}
+	s.usageMu.Lock()
+	defer s.usageMu.Unlock()
+	return s.loadUsage(bucketDir)
+}
+
+// Recount rebuilds the bucket's usage counters from the objects, versions
+// and uploads on disk, replacing counters that drifted after a crash.
+func (s *LocalStorage) Recount(ctx context.Context, bucket string) (Usage, error) {
+	bucketDir, err := s.existingBucketDir(bucket)
+	if err != nil {
+		return Usage{}, err
+	}
+	s.usageMu.Lock()
+	defer s.usageMu.Unlock()
+	u, err := s.countUsage(bucketDir)
+	if err != nil {
+		return u, err
+	}
+	return u, writeUsage(bucketDir, u)
+}
+
+// countUsage measures a whole bucket by walking it.
+func (s *LocalStorage) countUsage(bucketDir string) (Usage, error) {
+	var u Usage
+	bucket := filepath.Base(bucketDir)
+	keys, err := s.List(context.Background(), bucket, "")
+	if err != nil {
+		return u, err
+	}
+	for _, key := range keys {
+		m, err := readManifest(filepath.Join(bucketDir, key))
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return u, err
+		}
+		u.Objects++
+		u.Bytes += m.Size
+		u.Parts += int64(len(m.Parts))
+	}
+	entries, err := os.ReadDir(filepath.Join(bucketDir, versionsDirName))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return u, err
+	}
+	for _, e := range entries {
+		key, err := os.ReadFile(filepath.Join(bucketDir, versionsDirName, e.Name(), "key"))
+		if err != nil {
+			continue
+		}
+		n, err := versionsUsage(bucketDir, string(key))
+		if err != nil {
+			return u, err
+		}
+		u.VersionBytes += n
+	}
+	uploads, err := os.ReadDir(filepath.Join(bucketDir, ".multipart"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return u, err
+	}
+	for _, e := range uploads {
+		if !e.IsDir() {
+			continue
+		}
+		sub, err := usageScope{PartDir: filepath.Join(bucketDir, ".multipart", e.Name())}.measure(bucketDir)
+		if err != nil {
+			return u, err
+		}
+		u.MultipartBytes += sub.MultipartBytes
+	}
+	return u, nil
+}
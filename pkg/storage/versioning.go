@@ -0,0 +1,473 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Versioned buckets keep every overwritten or deleted object under
+//
+//	{bucket}/.versions/{sha256(key)}/key          original key
+//	{bucket}/.versions/{sha256(key)}/{versionID}/ parts, data.manifest, data.meta
+//
+// The current version stays in the regular object directory, so reads of
+// the latest version are unaffected. Keys are hashed because they may be
+// longer than a file name and may contain slashes. A delete marker is an
+// archived version whose manifest has DeleteMarker set.
+const versionsDirName = ".versions"
+
+// NullVersionID identifies versions written while versioning was disabled.
+const NullVersionID = "null"
+
+// VersionInfo describes one version of an object, or a delete marker.
+type VersionInfo struct {
+	Key          string    `json:"key"`
+	VersionID    string    `json:"version_id"`
+	IsLatest     bool      `json:"is_latest"`
+	DeleteMarker bool      `json:"delete_marker,omitempty"`
+	Size         int64     `json:"size"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// newVersionID returns a unique version ID that sorts chronologically.
+func newVersionID() string {
+	var b [4]byte
+	rand.Read(b[:])
+	return fmt.Sprintf("%016x%s", time.Now().UnixNano(), hex.EncodeToString(b[:]))
+}
+
+func versionIDOf(m Manifest) string {
+	if m.VersionID == "" {
+		return NullVersionID
+	}
+	return m.VersionID
+}
+
+// versioningEnabled reports whether the bucket keeps object versions.
+func (s *LocalStorage) versioningEnabled(ctx context.Context, bucket string) (bool, error) {
+	bm, err := s.GetBucketMetadata(ctx, bucket)
+	if err != nil {
+		return false, err
+	}
+	return bm.Versioning, nil
+}
+
+// keyVersionsDir returns the archive directory holding old versions of key.
+func keyVersionsDir(bucketDir, key string) string {
+	h := sha256.Sum256([]byte(key))
+	return filepath.Join(bucketDir, versionsDirName, hex.EncodeToString(h[:]))
+}
+
+// versionPath validates versionID and returns its archive directory.
+func versionPath(bucketDir, key, versionID string) (string, error) {
+	if versionID == "" || strings.ContainsAny(versionID, "/\\\x00") || strings.HasPrefix(versionID, ".") || versionID == "key" {
+		return "", invalid(versionID, "malformed version id")
+	}
+	return filepath.Join(keyVersionsDir(bucketDir, key), versionID), nil
+}
+
+// archiveCurrent preserves the current version of the object in objDir in
+// the version archive. Part files are hard-linked (or copied when links are
+// not supported) so the current object stays readable; with move set they are
+// renamed instead, leaving objDir without an object. It does nothing when no
+// current version exists.
+func archiveCurrent(bucketDir, objDir, key string, move bool) error {
+	m, err := readManifest(objDir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	dst, err := versionPath(bucketDir, key, versionIDOf(m))
+	if err != nil {
+		return err
+	}
+	// a null version is replaced by the next null version, as in S3
+	if err := os.RemoveAll(dst); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dst, 0o755); err != nil {
+		return err
+	}
+	if err := writeVersionsKey(filepath.Dir(dst), key); err != nil {
+		return err
+	}
+	files := append([]string{"data.meta"}, sortedPartNames(m)...)
+	for _, name := range files {
+		src := filepath.Join(objDir, name)
+		var err error
+		if move {
+			err = os.Rename(src, filepath.Join(dst, name))
+		} else {
+			err = linkOrCopy(src, filepath.Join(dst, name))
+		}
+		if err != nil && !(name == "data.meta" && errors.Is(err, fs.ErrNotExist)) {
+			return err
+		}
+	}
+	if err := writeManifest(dst, m); err != nil {
+		return err
+	}
+	if move {
+		if err := os.Remove(filepath.Join(objDir, manifestFileName)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return syncDir(filepath.Dir(dst))
+}
+
+func sortedPartNames(m Manifest) []string {
+	names := make([]string, 0, len(m.Parts))
+	for _, p := range m.Parts {
+		names = append(names, p.FileName())
+	}
+	return names
+}
+
+// writeVersionsKey records the original key in its archive directory so
+// ListVersions can map hashed directories back to keys.
+func writeVersionsKey(dir, key string) error {
+	path := filepath.Join(dir, "key")
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	return writeFileAtomic(path, []byte(key))
+}
+
+// linkOrCopy hard-links src to dst, falling back to a copy.
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	} else if errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	staged, _, _, err := stageFile(filepath.Dir(dst), ".copy-*", in)
+	if err != nil {
+		return err
+	}
+	return os.Rename(staged, dst)
+}
+
+// writeDeleteMarker archives a delete marker as the newest version of key.
+func writeDeleteMarker(bucketDir, key string) (string, error) {
+	vid := newVersionID()
+	dst, err := versionPath(bucketDir, key, vid)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dst, 0o755); err != nil {
+		return "", err
+	}
+	if err := writeVersionsKey(filepath.Dir(dst), key); err != nil {
+		return "", err
+	}
+	m := Manifest{VersionID: vid, DeleteMarker: true, LastModified: time.Now().UTC()}
+	if err := writeManifest(dst, m); err != nil {
+		return "", err
+	}
+	return vid, nil
+}
+
+// removeObjectFiles deletes the files of the object stored in objDir while
+// leaving objects nested below it (keys with objDir's key as a prefix)
+// untouched. The directory itself is removed once empty.
+func removeObjectFiles(objDir string) error {
+	entries, err := os.ReadDir(objDir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		if err := os.Remove(filepath.Join(objDir, e.Name())); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	// fails harmlessly when nested objects remain
+	os.Remove(objDir)
+	return nil
+}
+
+// archivedVersions returns the archived version IDs of key, newest first by
+// modification time; generated IDs, which sort chronologically, break ties.
+func archivedVersions(bucketDir, key string) ([]string, error) {
+	entries, err := os.ReadDir(keyVersionsDir(bucketDir, key))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var ids []string
+	modified := map[string]time.Time{}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		ids = append(ids, e.Name())
+		// a null version can be newer than generated IDs: it is written
+		// while versioning is suspended and archived once it is resumed
+		if m, err := readManifest(filepath.Join(keyVersionsDir(bucketDir, key), e.Name())); err == nil {
+			modified[e.Name()] = m.LastModified
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if ti, tj := modified[ids[i]], modified[ids[j]]; !ti.Equal(tj) {
+			return ti.After(tj)
+		}
+		if ids[i] == NullVersionID || ids[j] == NullVersionID {
+			return ids[j] == NullVersionID && ids[i] != NullVersionID
+		}
+		return ids[i] > ids[j]
+	})
+	return ids, nil
+}
+
+// promoteLatest makes the newest archived version current again after the
+// current version was permanently deleted. If the newest version is a delete
+// marker the object stays deleted. Empty archive directories are removed.
+func promoteLatest(bucketDir, objDir, key string) error {
+	if _, err := readManifest(objDir); err == nil {
+		return nil
+	}
+	ids, err := archivedVersions(bucketDir, key)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		os.RemoveAll(keyVersionsDir(bucketDir, key))
+		return nil
+	}
+	src, _ := versionPath(bucketDir, key, ids[0])
+	m, err := readManifest(src)
+	if err != nil {
+		return err
+	}
+	if m.DeleteMarker {
+		return nil
+	}
+	if err := os.MkdirAll(objDir, 0o755); err != nil {
+		return err
+	}
+	// the manifest goes last so the version is only visible once complete
+	files := append(append([]string{"data.meta"}, sortedPartNames(m)...), manifestFileName)
+	for _, name := range files {
+		if err := os.Rename(filepath.Join(src, name), filepath.Join(objDir, name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.RemoveAll(src); err != nil {
+		return err
+	}
+	return syncDir(objDir)
+}
+
+// GetVersion returns the content and description of a specific version.
+func (s *LocalStorage) GetVersion(ctx context.Context, bucket, key, versionID string) (io.ReadCloser, ObjectInfo, error) {
+	info := ObjectInfo{Key: key, VersionID: versionID}
+	dir, m, err := s.versionManifest(bucket, key, versionID)
+	if err != nil {
+		return nil, info, err
+	}
+	c, err := s.objectCipher(ctx, m.Encryption)
+	if err != nil {
+		return nil, info, err
+	}
+	rc, err := openRange(dir, m, 0, -1, c)
+	if err != nil {
+		return nil, info, err
+	}
+	info = m.info(key)
+	info.VersionID = versionIDOf(m)
+	if meta, err := s.readMeta(dir); err == nil {
+		info.ContentType = meta[MetaContentType]
+	}
+	return rc, info, nil
+}
+
+// GetVersionRange returns length bytes of a specific version starting at
+// offset, like GetRange.
+func (s *LocalStorage) GetVersionRange(ctx context.Context, bucket, key, versionID string, offset, length int64) (io.ReadCloser, error) {
+	dir, m, err := s.versionManifest(bucket, key, versionID)
+	if err != nil {
+		return nil, err
+	}
+	c, err := s.objectCipher(ctx, m.Encryption)
+	if err != nil {
+		return nil, err
+	}
+	return openRange(dir, m, offset, length, c)
+}
+
+// GetVersionMetadata reads the metadata of a specific version.
+func (s *LocalStorage) GetVersionMetadata(ctx context.Context, bucket, key, versionID string) (Metadata, error) {
+	dir, _, err := s.versionManifest(bucket, key, versionID)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := s.readMeta(dir)
+	if errors.Is(err, fs.ErrNotExist) { // archived without metadata
+		return Metadata{}, nil
+	}
+	return meta, err
+}
+
+// versionManifest finds a version, current or archived, and loads its
+// manifest. Delete markers fail with ErrNoSuchKey.
+func (s *LocalStorage) versionManifest(bucket, key, versionID string) (string, Manifest, error) {
+	objDir, err := s.objectPath(bucket, key)
+	if err != nil {
+		return "", Manifest{}, err
+	}
+	bucketDir, err := s.existingBucketDir(bucket)
+	if err != nil {
+		return "", Manifest{}, err
+	}
+	dir := objDir
+	m, err := readManifest(objDir)
+	if err != nil || versionIDOf(m) != versionID {
+		if dir, err = versionPath(bucketDir, key, versionID); err != nil {
+			return "", Manifest{}, err
+		}
+		if m, err = readManifest(dir); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return "", Manifest{}, fmt.Errorf("%w: %s/%s version %s", ErrNoSuchVersion, bucket, key, versionID)
+			}
+			return "", Manifest{}, err
+		}
+	}
+	if m.DeleteMarker {
+		return "", Manifest{}, fmt.Errorf("%w: %s/%s version %s is a delete marker", ErrNoSuchKey, bucket, key, versionID)
+	}
+	return dir, m, nil
+}
+
+// ListVersions lists every version and delete marker of the keys matching
+// prefix, sorted by key and then newest first.
+func (s *LocalStorage) ListVersions(ctx context.Context, bucket, prefix string) ([]VersionInfo, error) {
+	bucketDir, err := s.existingBucketDir(bucket)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := s.List(ctx, bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+	current := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		current[k] = true
+	}
+	// keys that only exist in the archive (deleted objects)
+	entries, err := os.ReadDir(filepath.Join(bucketDir, versionsDirName))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	for _, e := range entries {
+		b, err := os.ReadFile(filepath.Join(bucketDir, versionsDirName, e.Name(), "key"))
+		if err != nil {
+			continue
+		}
+		if k := string(b); strings.HasPrefix(k, prefix) {
+			if _, ok := current[k]; !ok {
+				current[k] = false
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+
+	var out []VersionInfo
+	for _, key := range keys {
+		latest := true
+		if current[key] {
+			objDir := filepath.Join(bucketDir, key)
+			if m, err := readManifest(objDir); err == nil {
+				out = append(out, m.versionInfo(key, true))
+				latest = false
+			}
+		}
+		ids, err := archivedVersions(bucketDir, key)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			dir, _ := versionPath(bucketDir, key, id)
+			m, err := readManifest(dir)
+			if err != nil {
+				continue
+			}
+			out = append(out, m.versionInfo(key, latest))
+			latest = false
+		}
+	}
+	return out, nil
+}
+
+func (m Manifest) versionInfo(key string, latest bool) VersionInfo {
+	return VersionInfo{
+		Key:          key,
+		VersionID:    versionIDOf(m),
+		IsLatest:     latest,
+		DeleteMarker: m.DeleteMarker,
+		Size:         m.Size,
+		ETag:         m.ETag,
+		LastModified: m.LastModified,
+	}
+}
+
+// DeleteVersion permanently removes one version or delete marker. Removing
+// the current version makes the next newest version current again.
+func (s *LocalStorage) DeleteVersion(ctx context.Context, bucket, key, versionID string) error {
+	objDir, err := s.objectPath(bucket, key)
+	if err != nil {
+		return err
+	}
+	bucketDir, err := s.existingBucketDir(bucket)
+	if err != nil {
+		return err
+	}
+	scope := usageScope{ObjDir: objDir, Key: key}
+	if m, err := readManifest(objDir); err == nil && versionIDOf(m) == versionID {
+		return s.trackUsage(bucketDir, scope, func() error {
+			if err := removeObjectFiles(objDir); err != nil {
+				return err
+			}
+			return promoteLatest(bucketDir, objDir, key)
+		})
+	}
+	dir, err := versionPath(bucketDir, key, versionID)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(dir); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("%w: %s/%s version %s", ErrNoSuchVersion, bucket, key, versionID)
+		}
+		return err
+	}
+	return s.trackUsage(bucketDir, scope, func() error {
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+		return promoteLatest(bucketDir, objDir, key)
+	})
+}